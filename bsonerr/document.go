@@ -42,3 +42,49 @@ var ElementNotFound = errors.New("element not found")
 
 // OutOfBounds indicates that an index provided to access something was invalid.
 var OutOfBounds = errors.New("out of bounds")
+
+// NonNumeric indicates that an arithmetic operation was attempted on a value
+// that is not a number.
+var NonNumeric = errors.New("value is not numeric")
+
+// NumericOverflow indicates that the result of an arithmetic operation cannot
+// be represented by the type of its operands.
+var NumericOverflow = errors.New("numeric overflow")
+
+// InvalidExtendedJSON indicates that input could not be parsed as MongoDB
+// Extended JSON, as when a type wrapper like $numberLong or $binary is
+// malformed.
+var InvalidExtendedJSON = errors.New("invalid extended JSON")
+
+// DocumentTooLarge indicates that a document is larger than the maximum size
+// allowed by a decoder or encoder.
+var DocumentTooLarge = errors.New("document exceeds maximum size")
+
+// MaxDepthExceeded indicates that documents and arrays are nested more
+// deeply than the configured limit.
+var MaxDepthExceeded = errors.New("document exceeds maximum nesting depth")
+
+// DuplicateKey indicates that a key appears more than once in a document.
+var DuplicateKey = errors.New("duplicate document key")
+
+// TooManyElements indicates that a document contains more elements, in
+// total across its embedded documents and arrays, than the configured
+// limit.
+var TooManyElements = errors.New("document exceeds maximum element count")
+
+// InvalidUTF8 indicates that a key or string in a document is not valid
+// UTF-8.
+var InvalidUTF8 = errors.New("invalid UTF-8")
+
+// InvalidSortSpec indicates that a sort specification document is
+// empty, or has a key that is not a valid path or a direction that is
+// not 1 or -1.
+var InvalidSortSpec = errors.New("invalid sort specification")
+
+// TypeMismatch indicates that a value cannot be converted to the
+// requested Go type without losing information.
+var TypeMismatch = errors.New("type mismatch")
+
+// InvalidPatch indicates that a patch operation is malformed or cannot
+// be applied to a document.
+var InvalidPatch = errors.New("invalid patch")
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	birchPath = "github.com/tychoish/birch"
+	typesPath = "github.com/tychoish/birch/types"
+)
+
+type typeKind int
+
+const (
+	scalarKind typeKind = iota
+	documentKind
+	pointerKind
+	sliceKind
+	mapKind
+)
+
+// fieldType is the generator's model of the type of a field.
+type fieldType struct {
+	kind typeKind
+	// expr is the type as written in the source package.
+	expr string
+	// named is set for scalars whose type is a named type defined
+	// in the package, and base is the type it is defined as.
+	named string
+	base  string
+	// pkgs are the packages referenced by expr (and base), by the
+	// name used in the source package.
+	pkgs   map[string]string
+	scalar *scalarType
+	elem   *fieldType
+}
+
+// scalarType describes the constructors and accessors used for types
+// that map directly to a single BSON value.
+type scalarType struct {
+	// ctor is the name of the EC and VC constructor method.
+	ctor string
+	// arg is the type that the constructor accepts, when values
+	// must be converted.
+	arg string
+	// accessor is the name of the Value method used for decoding,
+	// which returns the value and a boolean.
+	accessor string
+	// convert is true when the value returned by the accessor must
+	// be converted to the type of the field.
+	convert bool
+	// skip is the number of leading values that the accessor
+	// returns before the value.
+	skip int
+	// nilable types decode null values as nil.
+	nilable bool
+	// pointer types encode nil values as null.
+	pointer bool
+	// overflow formats the condition under which the value, as
+	// returned by the accessor, does not fit in the type, which the
+	// reflection decoder reports as an error.
+	overflow func(r *renderer, expr string) string
+	// empty formats the omitempty condition for the value, given
+	// the expression and its type.
+	empty         func(expr, typ string) string
+	emptyUsesType bool
+}
+
+func notZero(expr, _ string) string       { return expr + " != 0" }
+func notEmpty(expr, _ string) string      { return "len(" + expr + ") != 0" }
+func notNil(expr, _ string) string        { return expr + " != nil" }
+func notZeroMethod(expr, _ string) string { return "!" + expr + ".IsZero()" }
+func notZeroValue(expr, typ string) string {
+	return expr + " != (" + typ + "{})"
+}
+
+func overflowsInt32(_ *renderer, expr string) string {
+	return "int(int32(" + expr + ")) != " + expr
+}
+
+func overflowsFloat32(r *renderer, expr string) string {
+	r.use("math", "math")
+	return "math.Abs(" + expr + ") > math.MaxFloat32 && !math.IsInf(" + expr + ", 0)"
+}
+
+// scalars are keyed by the package path qualified name of the type.
+var scalars = map[string]*scalarType{
+	"bool":                        {ctor: "Boolean", accessor: "BooleanOK", empty: func(e, _ string) string { return e }},
+	"string":                      {ctor: "String", accessor: "StringValueOK", empty: func(e, _ string) string { return e + ` != ""` }},
+	"int":                         {ctor: "Int", accessor: "IntOK", empty: notZero},
+	"int32":                       {ctor: "Int32", accessor: "IntOK", convert: true, overflow: overflowsInt32, empty: notZero},
+	"int64":                       {ctor: "Int64", accessor: "IntOK", convert: true, empty: notZero},
+	"float32":                     {ctor: "Double", arg: "float64", accessor: "DoubleOK", convert: true, overflow: overflowsFloat32, empty: notZero},
+	"float64":                     {ctor: "Double", accessor: "DoubleOK", empty: notZero},
+	"[]byte":                      {ctor: "Binary", accessor: "BinaryOK", skip: 1, nilable: true, empty: notEmpty},
+	"time.Time":                   {ctor: "Time", accessor: "TimeOK", empty: notZeroMethod},
+	"time.Duration":               {ctor: "Duration", accessor: "IntOK", convert: true, empty: notZero},
+	typesPath + ".ObjectID":       {ctor: "ObjectID", accessor: "ObjectIDOK", empty: notZeroMethod},
+	typesPath + ".Decimal128":     {ctor: "Decimal128", accessor: "Decimal128OK", empty: notZeroValue, emptyUsesType: true},
+	"*" + birchPath + ".Document": {ctor: "SubDocument", accessor: "MutableDocumentOK", nilable: true, pointer: true, empty: notNil},
+	"*" + birchPath + ".Array":    {ctor: "Array", accessor: "MutableArrayOK", nilable: true, pointer: true, empty: notNil},
+}
+
+// valueCtor returns the name of the VC constructor for a scalar,
+// which differs from the EC constructor for documents.
+func (s *scalarType) valueCtor() string {
+	if s.ctor == "SubDocument" {
+		return "Document"
+	}
+	return s.ctor
+}
+
+// field is a single (possibly promoted) field of a struct.
+type field struct {
+	// name is the Go selector for the field, relative to the
+	// receiver, including any inline structs.
+	name      string
+	key       string
+	omitEmpty bool
+	typ       *fieldType
+}
+
+type sourceFile struct {
+	imports map[string]string
+}
+
+type typeDecl struct {
+	spec *ast.TypeSpec
+	file *sourceFile
+}
+
+type generator struct {
+	fset  *token.FileSet
+	pkg   string
+	decls map[string]*typeDecl
+}
+
+// Generate parses the package in dir and returns the source of a
+// file, named output, containing MarshalDocument and
+// UnmarshalDocument methods for the named struct types.
+func Generate(dir string, typeNames []string, output string) ([]byte, error) {
+	g := &generator{
+		fset:  token.NewFileSet(),
+		decls: map[string]*typeDecl{},
+	}
+
+	if err := g.parse(dir, output); err != nil {
+		return nil, err
+	}
+
+	structs := make([]*structType, 0, len(typeNames))
+	for _, name := range typeNames {
+		name = strings.TrimSpace(name)
+		st, err := g.structType(name)
+		if err != nil {
+			return nil, err
+		}
+		structs = append(structs, st)
+	}
+
+	return g.render(structs)
+}
+
+func (g *generator) parse(dir, output string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") || name == output {
+			continue
+		}
+
+		file, err := parser.ParseFile(g.fset, filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return err
+		}
+
+		if g.pkg == "" {
+			g.pkg = file.Name.Name
+		} else if g.pkg != file.Name.Name {
+			return fmt.Errorf("found packages %s and %s in %s", g.pkg, file.Name.Name, dir)
+		}
+
+		src := &sourceFile{imports: map[string]string{}}
+		for _, imp := range file.Imports {
+			path, err := strconv.Unquote(imp.Path.Value)
+			if err != nil {
+				return err
+			}
+			local := path[strings.LastIndex(path, "/")+1:]
+			if imp.Name != nil {
+				local = imp.Name.Name
+			}
+			src.imports[local] = path
+		}
+
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				g.decls[ts.Name.Name] = &typeDecl{spec: ts, file: src}
+			}
+		}
+	}
+
+	if g.pkg == "" {
+		return fmt.Errorf("no go files in %s", dir)
+	}
+
+	return nil
+}
+
+func (g *generator) errorf(pos token.Pos, format string, args ...any) error {
+	return fmt.Errorf("%s: %s", g.fset.Position(pos), fmt.Sprintf(format, args...))
+}
+
+type structType struct {
+	name   string
+	fields []*field
+}
+
+func (g *generator) structType(name string) (*structType, error) {
+	decl, ok := g.decls[name]
+	if !ok {
+		return nil, fmt.Errorf("type %s is not defined in package %s", name, g.pkg)
+	}
+
+	if decl.spec.TypeParams != nil {
+		return nil, g.errorf(decl.spec.Pos(), "generic type %s is not supported", name)
+	}
+
+	st, ok := decl.spec.Type.(*ast.StructType)
+	if !ok {
+		return nil, g.errorf(decl.spec.Pos(), "type %s is not a struct", name)
+	}
+
+	out := &structType{name: name}
+	seen := map[string]bool{}
+	if err := g.addFields(out, seen, st, decl.file, ""); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (g *generator) addFields(out *structType, seen map[string]bool, st *ast.StructType, file *sourceFile, prefix string) error {
+	for _, astField := range st.Fields.List {
+		var tag reflect.StructTag
+		if astField.Tag != nil {
+			raw, err := strconv.Unquote(astField.Tag.Value)
+			if err != nil {
+				return g.errorf(astField.Tag.Pos(), "invalid struct tag")
+			}
+			tag = reflect.StructTag(raw)
+		}
+
+		names := make([]string, 0, len(astField.Names))
+		for _, ident := range astField.Names {
+			names = append(names, ident.Name)
+		}
+		embedded := len(names) == 0
+		if embedded {
+			names = append(names, embeddedName(astField.Type))
+		}
+
+		for _, name := range names {
+			key, omitEmpty, inline, ok := parseTag(name, tag, embedded)
+			if !ok {
+				continue
+			}
+
+			if inline {
+				ident, isIdent := astField.Type.(*ast.Ident)
+				if !isIdent {
+					return g.errorf(astField.Pos(), "inline field %s must be a struct defined in package %s", name, g.pkg)
+				}
+				decl, isLocal := g.decls[ident.Name]
+				if !isLocal {
+					return g.errorf(astField.Pos(), "inline field %s must be a struct defined in package %s", name, g.pkg)
+				}
+				inner, isStruct := decl.spec.Type.(*ast.StructType)
+				if !isStruct {
+					return g.errorf(astField.Pos(), "inline field %s must be a struct", name)
+				}
+				if err := g.addFields(out, seen, inner, decl.file, prefix+name+"."); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if seen[key] {
+				return g.errorf(astField.Pos(), "duplicated key %q in struct %s", key, out.name)
+			}
+			seen[key] = true
+
+			ft, err := g.fieldType(astField.Type, file)
+			if err != nil {
+				return err
+			}
+
+			out.fields = append(out.fields, &field{
+				name:      prefix + name,
+				key:       key,
+				omitEmpty: omitEmpty,
+				typ:       ft,
+			})
+		}
+	}
+
+	return nil
+}
+
+// parseTag mirrors the struct tag handling of the reflection-based
+// encoder and decoder.
+func parseTag(name string, tag reflect.StructTag, embedded bool) (key string, omitEmpty, inline, ok bool) {
+	raw, hasTag := tag.Lookup("bson")
+	if raw == "-" {
+		return "", false, false, false
+	}
+
+	key, opts, _ := strings.Cut(raw, ",")
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		switch opt {
+		case "omitempty":
+			omitEmpty = true
+		case "inline":
+			inline = true
+		}
+	}
+
+	if !token.IsExported(name) && !(embedded && inline) {
+		return "", false, false, false
+	}
+
+	if !hasTag || key == "" {
+		key = strings.ToLower(name)
+	}
+
+	return key, omitEmpty, inline, true
+}
+
+func embeddedName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return embeddedName(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	case *ast.Ident:
+		return t.Name
+	default:
+		return ""
+	}
+}
+
+func (g *generator) fieldType(expr ast.Expr, file *sourceFile) (*fieldType, error) {
+	ft := &fieldType{expr: types.ExprString(expr), pkgs: map[string]string{}}
+
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if scalar, ok := scalars[t.Name]; ok {
+			ft.scalar = scalar
+			return ft, nil
+		}
+
+		decl, ok := g.decls[t.Name]
+		if !ok {
+			return nil, g.errorf(t.Pos(), "unsupported type %s", t.Name)
+		}
+
+		if decl.spec.Assign.IsValid() {
+			alias, err := g.fieldType(decl.spec.Type, decl.file)
+			if err != nil {
+				return nil, err
+			}
+			alias.expr = ft.expr
+			return alias, nil
+		}
+
+		if _, isStruct := decl.spec.Type.(*ast.StructType); isStruct {
+			ft.kind = documentKind
+			return ft, nil
+		}
+
+		underlying, err := g.fieldType(decl.spec.Type, decl.file)
+		if err != nil {
+			return nil, err
+		}
+		if underlying.kind != scalarKind || underlying.named != "" {
+			return nil, g.errorf(t.Pos(), "unsupported type %s", t.Name)
+		}
+
+		ft.scalar = underlying.scalar
+		ft.named = t.Name
+		ft.base = underlying.expr
+		ft.pkgs = underlying.pkgs
+		return ft, nil
+	case *ast.SelectorExpr:
+		pkg, ok := t.X.(*ast.Ident)
+		if !ok {
+			return nil, g.errorf(t.Pos(), "unsupported type %s", ft.expr)
+		}
+		path, ok := file.imports[pkg.Name]
+		if !ok {
+			return nil, g.errorf(t.Pos(), "unknown package %s", pkg.Name)
+		}
+		ft.pkgs[pkg.Name] = path
+
+		if scalar, ok := scalars[path+"."+t.Sel.Name]; ok {
+			ft.scalar = scalar
+			return ft, nil
+		}
+
+		ft.kind = documentKind
+		return ft, nil
+	case *ast.StarExpr:
+		if sel, ok := t.X.(*ast.SelectorExpr); ok {
+			if pkg, ok := sel.X.(*ast.Ident); ok {
+				path := file.imports[pkg.Name]
+				if scalar, ok := scalars["*"+path+"."+sel.Sel.Name]; ok {
+					ft.scalar = scalar
+					ft.pkgs[pkg.Name] = path
+					return ft, nil
+				}
+			}
+		}
+
+		elem, err := g.fieldType(t.X, file)
+		if err != nil {
+			return nil, err
+		}
+		if elem.kind == pointerKind || (elem.kind == scalarKind && elem.scalar.nilable) {
+			return nil, g.errorf(t.Pos(), "unsupported type %s", ft.expr)
+		}
+
+		ft.kind = pointerKind
+		ft.elem = elem
+		ft.pkgs = elem.pkgs
+		return ft, nil
+	case *ast.ArrayType:
+		if t.Len != nil {
+			return nil, g.errorf(t.Pos(), "unsupported array type %s", ft.expr)
+		}
+		if ident, ok := t.Elt.(*ast.Ident); ok && ident.Name == "byte" {
+			ft.scalar = scalars["[]byte"]
+			return ft, nil
+		}
+
+		elem, err := g.fieldType(t.Elt, file)
+		if err != nil {
+			return nil, err
+		}
+
+		ft.kind = sliceKind
+		ft.elem = elem
+		ft.pkgs = elem.pkgs
+		return ft, nil
+	case *ast.MapType:
+		if key, ok := t.Key.(*ast.Ident); !ok || key.Name != "string" {
+			return nil, g.errorf(t.Pos(), "unsupported map type %s, keys must be strings", ft.expr)
+		}
+
+		elem, err := g.fieldType(t.Value, file)
+		if err != nil {
+			return nil, err
+		}
+
+		ft.kind = mapKind
+		ft.elem = elem
+		ft.pkgs = elem.pkgs
+		return ft, nil
+	default:
+		return nil, g.errorf(expr.Pos(), "unsupported type %s", ft.expr)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func TestGenerate(t *testing.T) {
+	t.Run("Golden", func(t *testing.T) {
+		// the generated code in the example package is the golden
+		// file, and its own tests cover the generated methods.
+		dir := filepath.Join("internal", "example")
+		golden := filepath.Join(dir, "example_birch.go")
+
+		out, err := Generate(dir, []string{"Event", "Base", "Counters", "Sample"}, filepath.Base(golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if *update {
+			if err := os.WriteFile(golden, out, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(out, expected) {
+			t.Errorf("generated code does not match %s; run go test -update to regenerate it", golden)
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		for _, tc := range []struct {
+			name  string
+			src   string
+			types string
+			err   string
+		}{
+			{
+				name:  "Undefined",
+				src:   "type T struct{}",
+				types: "Missing",
+				err:   "type Missing is not defined",
+			},
+			{
+				name:  "NotStruct",
+				src:   "type T int",
+				types: "T",
+				err:   "type T is not a struct",
+			},
+			{
+				name:  "Channel",
+				src:   "type T struct { C chan int }",
+				types: "T",
+				err:   "unsupported type chan int",
+			},
+			{
+				name:  "MapKey",
+				src:   "type T struct { M map[int]string }",
+				types: "T",
+				err:   "keys must be strings",
+			},
+			{
+				name:  "FixedArray",
+				src:   "type T struct { A [4]int }",
+				types: "T",
+				err:   "unsupported array type [4]int",
+			},
+			{
+				name:  "DuplicateKey",
+				src:   "type T struct { A int `bson:\"a\"`; B int `bson:\"a\"` }",
+				types: "T",
+				err:   `duplicated key "a"`,
+			},
+			{
+				name:  "InlineNonStruct",
+				src:   "type N int\ntype T struct { N `bson:\",inline\"` }",
+				types: "T",
+				err:   "inline field N must be a struct",
+			},
+			{
+				name:  "Generic",
+				src:   "type T[V any] struct { V V }",
+				types: "T",
+				err:   "generic type T is not supported",
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				dir := t.TempDir()
+				if err := os.WriteFile(filepath.Join(dir, "src.go"), []byte("package src\n\n"+tc.src+"\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+
+				_, err := Generate(dir, strings.Split(tc.types, ","), "src_birch.go")
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error containing %q, got %v", tc.err, err)
+				}
+			})
+		}
+	})
+}
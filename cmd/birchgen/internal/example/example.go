@@ -0,0 +1,57 @@
+// Package example holds types used to exercise birchgen. The
+// generated file, example_birch.go, is also the golden file for the
+// generator's tests.
+package example
+
+import (
+	"time"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/types"
+)
+
+//go:generate go run github.com/tychoish/birch/cmd/birchgen -type Event,Base,Counters,Sample
+
+// State is a named type with a scalar underlying type.
+type State int64
+
+// Base is inlined into other types.
+type Base struct {
+	ID      types.ObjectID `bson:"_id"`
+	Created time.Time      `bson:"created"`
+}
+
+// Counters is a nested document.
+type Counters struct {
+	Number int64 `bson:"n"`
+	Errors int32 `bson:"errors,omitempty"`
+}
+
+// Event has a field of each of the kinds supported by the generator.
+type Event struct {
+	Base     `bson:",inline"`
+	Name     string `bson:"name"`
+	Untagged int
+	Skipped  string             `bson:"-"`
+	State    State              `bson:"state"`
+	Ratio    float64            `bson:"ratio,omitempty"`
+	Scale    float32            `bson:"scale"`
+	Enabled  bool               `bson:"enabled"`
+	Elapsed  time.Duration      `bson:"elapsed"`
+	Amount   types.Decimal128   `bson:"amount"`
+	Payload  []byte             `bson:"payload"`
+	Counters Counters           `bson:"counters"`
+	Previous *Counters          `bson:"previous"`
+	Limit    *int64             `bson:"limit,omitempty"`
+	Tags     []string           `bson:"tags"`
+	History  []Counters         `bson:"history"`
+	Labels   map[string]string  `bson:"labels,omitempty"`
+	Series   map[string][]int64 `bson:"series"`
+	Extra    *birch.Document    `bson:"extra"`
+}
+
+// Sample is a type with a nested slice of pointers.
+type Sample struct {
+	Points []*Counters `bson:"points"`
+	Marks  []time.Time `bson:"marks"`
+}
@@ -0,0 +1,453 @@
+// Code generated by birchgen. DO NOT EDIT.
+
+package example
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// MarshalDocument implements the birch.DocumentMarshaler interface.
+func (e *Event) MarshalDocument() (*birch.Document, error) {
+	doc := birch.DC.Make(19)
+	doc.Append(birch.EC.ObjectID("_id", e.Base.ID))
+	doc.Append(birch.EC.Time("created", e.Base.Created))
+	doc.Append(birch.EC.String("name", e.Name))
+	doc.Append(birch.EC.Int("untagged", e.Untagged))
+	doc.Append(birch.EC.Int64("state", int64(e.State)))
+	if e.Ratio != 0 {
+		doc.Append(birch.EC.Double("ratio", e.Ratio))
+	}
+	doc.Append(birch.EC.Double("scale", float64(e.Scale)))
+	doc.Append(birch.EC.Boolean("enabled", e.Enabled))
+	doc.Append(birch.EC.Duration("elapsed", e.Elapsed))
+	doc.Append(birch.EC.Decimal128("amount", e.Amount))
+	doc.Append(birch.EC.Binary("payload", e.Payload))
+	sub1, err := e.Counters.MarshalDocument()
+	if err != nil {
+		return nil, fmt.Errorf("counters: %w", err)
+	}
+	doc.Append(birch.EC.SubDocument("counters", sub1))
+	if e.Previous == nil {
+		doc.Append(birch.EC.Null("previous"))
+	} else {
+		sub2, err := e.Previous.MarshalDocument()
+		if err != nil {
+			return nil, fmt.Errorf("previous: %w", err)
+		}
+		doc.Append(birch.EC.SubDocument("previous", sub2))
+	}
+	if e.Limit != nil {
+		doc.Append(birch.EC.Int64("limit", *e.Limit))
+	}
+	arr3 := birch.MakeArray(len(e.Tags))
+	for idx4 := range e.Tags {
+		arr3.Append(birch.VC.String(e.Tags[idx4]))
+	}
+	doc.Append(birch.EC.Array("tags", arr3))
+	arr5 := birch.MakeArray(len(e.History))
+	for idx6 := range e.History {
+		sub7, err := e.History[idx6].MarshalDocument()
+		if err != nil {
+			return nil, fmt.Errorf("history.%d: %w", idx6, err)
+		}
+		arr5.Append(birch.VC.Document(sub7))
+	}
+	doc.Append(birch.EC.Array("history", arr5))
+	if len(e.Labels) != 0 {
+		sub8 := birch.DC.Make(len(e.Labels))
+		for _, key9 := range slices.Sorted(maps.Keys(e.Labels)) {
+			val10 := e.Labels[key9]
+			sub8.Append(birch.EC.String(key9, val10))
+		}
+		doc.Append(birch.EC.SubDocument("labels", sub8))
+	}
+	sub11 := birch.DC.Make(len(e.Series))
+	for _, key12 := range slices.Sorted(maps.Keys(e.Series)) {
+		val13 := e.Series[key12]
+		arr14 := birch.MakeArray(len(val13))
+		for idx15 := range val13 {
+			arr14.Append(birch.VC.Int64(val13[idx15]))
+		}
+		sub11.Append(birch.EC.Array(key12, arr14))
+	}
+	doc.Append(birch.EC.SubDocument("series", sub11))
+	if e.Extra == nil {
+		doc.Append(birch.EC.Null("extra"))
+	} else {
+		doc.Append(birch.EC.SubDocument("extra", e.Extra))
+	}
+	return doc, nil
+}
+
+// UnmarshalDocument implements the birch.DocumentUnmarshaler interface.
+func (e *Event) UnmarshalDocument(in *birch.Document) error {
+	for elem := range in.Iterator() {
+		switch elem.Key() {
+		case "_id":
+			v1, ok := elem.Value().ObjectIDOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into types.ObjectID at \"_id\"", elem.Value().Type())
+			}
+			e.Base.ID = v1
+		case "created":
+			v2, ok := elem.Value().TimeOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into time.Time at \"created\"", elem.Value().Type())
+			}
+			e.Base.Created = v2
+		case "name":
+			v3, ok := elem.Value().StringValueOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into string at \"name\"", elem.Value().Type())
+			}
+			e.Name = v3
+		case "untagged":
+			v4, ok := elem.Value().IntOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into int at \"untagged\"", elem.Value().Type())
+			}
+			e.Untagged = v4
+		case "state":
+			v5, ok := elem.Value().IntOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into State at \"state\"", elem.Value().Type())
+			}
+			e.State = State(v5)
+		case "ratio":
+			v6, ok := elem.Value().DoubleOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into float64 at \"ratio\"", elem.Value().Type())
+			}
+			e.Ratio = v6
+		case "scale":
+			v7, ok := elem.Value().DoubleOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into float32 at \"scale\"", elem.Value().Type())
+			}
+			if math.Abs(v7) > math.MaxFloat32 && !math.IsInf(v7, 0) {
+				return fmt.Errorf("cannot decode %s into float32 at \"scale\": value overflows target type", elem.Value().Type())
+			}
+			e.Scale = float32(v7)
+		case "enabled":
+			v8, ok := elem.Value().BooleanOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into bool at \"enabled\"", elem.Value().Type())
+			}
+			e.Enabled = v8
+		case "elapsed":
+			v9, ok := elem.Value().IntOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into time.Duration at \"elapsed\"", elem.Value().Type())
+			}
+			e.Elapsed = time.Duration(v9)
+		case "amount":
+			v10, ok := elem.Value().Decimal128OK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into types.Decimal128 at \"amount\"", elem.Value().Type())
+			}
+			e.Amount = v10
+		case "payload":
+			if elem.Value().Type() == bsontype.Null {
+				e.Payload = nil
+			} else {
+				_, v11, ok := elem.Value().BinaryOK()
+				if !ok {
+					return fmt.Errorf("cannot decode %s into []byte at \"payload\"", elem.Value().Type())
+				}
+				e.Payload = v11
+			}
+		case "counters":
+			doc12, ok := elem.Value().MutableDocumentOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into Counters at \"counters\"", elem.Value().Type())
+			}
+			if err := e.Counters.UnmarshalDocument(doc12); err != nil {
+				return fmt.Errorf("counters: %w", err)
+			}
+		case "previous":
+			if elem.Value().Type() == bsontype.Null {
+				e.Previous = nil
+			} else {
+				if e.Previous == nil {
+					e.Previous = new(Counters)
+				}
+				doc13, ok := elem.Value().MutableDocumentOK()
+				if !ok {
+					return fmt.Errorf("cannot decode %s into Counters at \"previous\"", elem.Value().Type())
+				}
+				if err := e.Previous.UnmarshalDocument(doc13); err != nil {
+					return fmt.Errorf("previous: %w", err)
+				}
+			}
+		case "limit":
+			if elem.Value().Type() == bsontype.Null {
+				e.Limit = nil
+			} else {
+				if e.Limit == nil {
+					e.Limit = new(int64)
+				}
+				v14, ok := elem.Value().IntOK()
+				if !ok {
+					return fmt.Errorf("cannot decode %s into int64 at \"limit\"", elem.Value().Type())
+				}
+				*e.Limit = int64(v14)
+			}
+		case "tags":
+			if elem.Value().Type() == bsontype.Null {
+				e.Tags = nil
+			} else {
+				arr15, ok := elem.Value().MutableArrayOK()
+				if !ok {
+					return fmt.Errorf("cannot decode %s into []string at \"tags\"", elem.Value().Type())
+				}
+				e.Tags = make([]string, arr15.Len())
+				idx16 := 0
+				for item17 := range arr15.Iterator() {
+					v18, ok := item17.StringValueOK()
+					if !ok {
+						return fmt.Errorf("cannot decode %s into string at \"tags.%d\"", item17.Type(), idx16)
+					}
+					e.Tags[idx16] = v18
+					idx16++
+				}
+			}
+		case "history":
+			if elem.Value().Type() == bsontype.Null {
+				e.History = nil
+			} else {
+				arr19, ok := elem.Value().MutableArrayOK()
+				if !ok {
+					return fmt.Errorf("cannot decode %s into []Counters at \"history\"", elem.Value().Type())
+				}
+				e.History = make([]Counters, arr19.Len())
+				idx20 := 0
+				for item21 := range arr19.Iterator() {
+					doc22, ok := item21.MutableDocumentOK()
+					if !ok {
+						return fmt.Errorf("cannot decode %s into Counters at \"history.%d\"", item21.Type(), idx20)
+					}
+					if err := e.History[idx20].UnmarshalDocument(doc22); err != nil {
+						return fmt.Errorf("history.%d: %w", idx20, err)
+					}
+					idx20++
+				}
+			}
+		case "labels":
+			if elem.Value().Type() == bsontype.Null {
+				e.Labels = nil
+			} else {
+				doc23, ok := elem.Value().MutableDocumentOK()
+				if !ok {
+					return fmt.Errorf("cannot decode %s into map[string]string at \"labels\"", elem.Value().Type())
+				}
+				e.Labels = make(map[string]string, doc23.Len())
+				for elem24 := range doc23.Iterator() {
+					var item25 string
+					v26, ok := elem24.Value().StringValueOK()
+					if !ok {
+						return fmt.Errorf("cannot decode %s into string at \"labels.%s\"", elem24.Value().Type(), elem24.Key())
+					}
+					item25 = v26
+					e.Labels[elem24.Key()] = item25
+				}
+			}
+		case "series":
+			if elem.Value().Type() == bsontype.Null {
+				e.Series = nil
+			} else {
+				doc27, ok := elem.Value().MutableDocumentOK()
+				if !ok {
+					return fmt.Errorf("cannot decode %s into map[string][]int64 at \"series\"", elem.Value().Type())
+				}
+				e.Series = make(map[string][]int64, doc27.Len())
+				for elem28 := range doc27.Iterator() {
+					var item29 []int64
+					if elem28.Value().Type() == bsontype.Null {
+						item29 = nil
+					} else {
+						arr30, ok := elem28.Value().MutableArrayOK()
+						if !ok {
+							return fmt.Errorf("cannot decode %s into []int64 at \"series.%s\"", elem28.Value().Type(), elem28.Key())
+						}
+						item29 = make([]int64, arr30.Len())
+						idx31 := 0
+						for item32 := range arr30.Iterator() {
+							v33, ok := item32.IntOK()
+							if !ok {
+								return fmt.Errorf("cannot decode %s into int64 at \"series.%s.%d\"", item32.Type(), elem28.Key(), idx31)
+							}
+							item29[idx31] = int64(v33)
+							idx31++
+						}
+					}
+					e.Series[elem28.Key()] = item29
+				}
+			}
+		case "extra":
+			if elem.Value().Type() == bsontype.Null {
+				e.Extra = nil
+			} else {
+				v34, ok := elem.Value().MutableDocumentOK()
+				if !ok {
+					return fmt.Errorf("cannot decode %s into *birch.Document at \"extra\"", elem.Value().Type())
+				}
+				e.Extra = v34
+			}
+		}
+	}
+
+	return nil
+}
+
+// MarshalDocument implements the birch.DocumentMarshaler interface.
+func (b *Base) MarshalDocument() (*birch.Document, error) {
+	doc := birch.DC.Make(2)
+	doc.Append(birch.EC.ObjectID("_id", b.ID))
+	doc.Append(birch.EC.Time("created", b.Created))
+	return doc, nil
+}
+
+// UnmarshalDocument implements the birch.DocumentUnmarshaler interface.
+func (b *Base) UnmarshalDocument(in *birch.Document) error {
+	for elem := range in.Iterator() {
+		switch elem.Key() {
+		case "_id":
+			v1, ok := elem.Value().ObjectIDOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into types.ObjectID at \"_id\"", elem.Value().Type())
+			}
+			b.ID = v1
+		case "created":
+			v2, ok := elem.Value().TimeOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into time.Time at \"created\"", elem.Value().Type())
+			}
+			b.Created = v2
+		}
+	}
+
+	return nil
+}
+
+// MarshalDocument implements the birch.DocumentMarshaler interface.
+func (c *Counters) MarshalDocument() (*birch.Document, error) {
+	doc := birch.DC.Make(2)
+	doc.Append(birch.EC.Int64("n", c.Number))
+	if c.Errors != 0 {
+		doc.Append(birch.EC.Int32("errors", c.Errors))
+	}
+	return doc, nil
+}
+
+// UnmarshalDocument implements the birch.DocumentUnmarshaler interface.
+func (c *Counters) UnmarshalDocument(in *birch.Document) error {
+	for elem := range in.Iterator() {
+		switch elem.Key() {
+		case "n":
+			v1, ok := elem.Value().IntOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into int64 at \"n\"", elem.Value().Type())
+			}
+			c.Number = int64(v1)
+		case "errors":
+			v2, ok := elem.Value().IntOK()
+			if !ok {
+				return fmt.Errorf("cannot decode %s into int32 at \"errors\"", elem.Value().Type())
+			}
+			if int(int32(v2)) != v2 {
+				return fmt.Errorf("cannot decode %s into int32 at \"errors\": value overflows target type", elem.Value().Type())
+			}
+			c.Errors = int32(v2)
+		}
+	}
+
+	return nil
+}
+
+// MarshalDocument implements the birch.DocumentMarshaler interface.
+func (s *Sample) MarshalDocument() (*birch.Document, error) {
+	doc := birch.DC.Make(2)
+	arr1 := birch.MakeArray(len(s.Points))
+	for idx2 := range s.Points {
+		if s.Points[idx2] == nil {
+			arr1.Append(birch.VC.Null())
+		} else {
+			sub3, err := s.Points[idx2].MarshalDocument()
+			if err != nil {
+				return nil, fmt.Errorf("points.%d: %w", idx2, err)
+			}
+			arr1.Append(birch.VC.Document(sub3))
+		}
+	}
+	doc.Append(birch.EC.Array("points", arr1))
+	arr4 := birch.MakeArray(len(s.Marks))
+	for idx5 := range s.Marks {
+		arr4.Append(birch.VC.Time(s.Marks[idx5]))
+	}
+	doc.Append(birch.EC.Array("marks", arr4))
+	return doc, nil
+}
+
+// UnmarshalDocument implements the birch.DocumentUnmarshaler interface.
+func (s *Sample) UnmarshalDocument(in *birch.Document) error {
+	for elem := range in.Iterator() {
+		switch elem.Key() {
+		case "points":
+			if elem.Value().Type() == bsontype.Null {
+				s.Points = nil
+			} else {
+				arr1, ok := elem.Value().MutableArrayOK()
+				if !ok {
+					return fmt.Errorf("cannot decode %s into []*Counters at \"points\"", elem.Value().Type())
+				}
+				s.Points = make([]*Counters, arr1.Len())
+				idx2 := 0
+				for item3 := range arr1.Iterator() {
+					if item3.Type() == bsontype.Null {
+						s.Points[idx2] = nil
+					} else {
+						if s.Points[idx2] == nil {
+							s.Points[idx2] = new(Counters)
+						}
+						doc4, ok := item3.MutableDocumentOK()
+						if !ok {
+							return fmt.Errorf("cannot decode %s into Counters at \"points.%d\"", item3.Type(), idx2)
+						}
+						if err := s.Points[idx2].UnmarshalDocument(doc4); err != nil {
+							return fmt.Errorf("points.%d: %w", idx2, err)
+						}
+					}
+					idx2++
+				}
+			}
+		case "marks":
+			if elem.Value().Type() == bsontype.Null {
+				s.Marks = nil
+			} else {
+				arr5, ok := elem.Value().MutableArrayOK()
+				if !ok {
+					return fmt.Errorf("cannot decode %s into []time.Time at \"marks\"", elem.Value().Type())
+				}
+				s.Marks = make([]time.Time, arr5.Len())
+				idx6 := 0
+				for item7 := range arr5.Iterator() {
+					v8, ok := item7.TimeOK()
+					if !ok {
+						return fmt.Errorf("cannot decode %s into time.Time at \"marks.%d\"", item7.Type(), idx6)
+					}
+					s.Marks[idx6] = v8
+					idx6++
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package example
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/types"
+)
+
+func makeEvent(t *testing.T) *Event {
+	t.Helper()
+
+	amount, err := types.ParseDecimal128("42.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := int64(100)
+
+	return &Event{
+		Base:     Base{ID: types.NewObjectID(), Created: time.Unix(1700000000, 0).UTC()},
+		Name:     "event",
+		Untagged: 7,
+		State:    State(3),
+		Scale:    1.5,
+		Enabled:  true,
+		Elapsed:  time.Minute,
+		Amount:   amount,
+		Payload:  []byte("payload"),
+		Counters: Counters{Number: 10, Errors: 2},
+		Previous: &Counters{Number: 5},
+		Limit:    &limit,
+		Tags:     []string{"a", "b"},
+		History:  []Counters{{Number: 1}, {Number: 2, Errors: 1}},
+		Labels:   map[string]string{"z": "last", "a": "first"},
+		Series:   map[string][]int64{"one": {1}, "two": {1, 2}},
+		Extra:    birch.DC.Elements(birch.EC.String("hello", "world")),
+	}
+}
+
+func TestGeneratedMethods(t *testing.T) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		in := makeEvent(t)
+
+		doc, err := in.MarshalDocument()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := &Event{}
+		if err := doc.Unmarshal(out); err != nil {
+			t.Fatal(err)
+		}
+
+		if out.ID != in.ID || !out.Created.Equal(in.Created) || out.Name != in.Name || out.Untagged != in.Untagged {
+			t.Errorf("scalar mismatch: %+v", out)
+		}
+		if out.State != in.State || out.Scale != in.Scale || !out.Enabled || out.Elapsed != in.Elapsed {
+			t.Errorf("converted scalar mismatch: %+v", out)
+		}
+		if out.Amount.String() != "42.5" || string(out.Payload) != "payload" {
+			t.Errorf("special type mismatch: %s %q", out.Amount, out.Payload)
+		}
+		if out.Counters != in.Counters || *out.Previous != *in.Previous || *out.Limit != *in.Limit {
+			t.Errorf("nested mismatch: %+v %+v %v", out.Counters, out.Previous, out.Limit)
+		}
+		if len(out.History) != 2 || out.History[1] != in.History[1] || strings.Join(out.Tags, ",") != "a,b" {
+			t.Errorf("slice mismatch: %+v %v", out.History, out.Tags)
+		}
+		if out.Labels["a"] != "first" || len(out.Series["two"]) != 2 || out.Series["two"][1] != 2 {
+			t.Errorf("map mismatch: %v %v", out.Labels, out.Series)
+		}
+		if out.Extra.Lookup("hello").StringValue() != "world" {
+			t.Errorf("document mismatch: %s", out.Extra)
+		}
+	})
+	t.Run("MatchesReflection", func(t *testing.T) {
+		for name, in := range map[string]*Event{
+			"Populated": makeEvent(t),
+			"Empty":     {},
+		} {
+			t.Run(name, func(t *testing.T) {
+				generated, err := in.MarshalDocument()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// passing the value, rather than the pointer,
+				// causes DC.Interface to use reflection.
+				reflected, err := birch.DCE.Interface(*in)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				a, err := generated.MarshalBSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := reflected.MarshalBSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(a, b) {
+					t.Errorf("documents differ:\n%s\n%s", generated, reflected)
+				}
+			})
+		}
+	})
+	t.Run("OmitEmpty", func(t *testing.T) {
+		doc, err := (&Event{}).MarshalDocument()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"ratio", "limit", "labels"} {
+			if doc.Lookup(key) != nil {
+				t.Errorf("%s should be omitted", key)
+			}
+		}
+		if doc.Lookup("previous") == nil || doc.Lookup("counters") == nil {
+			t.Error("fields without omitempty should be present")
+		}
+	})
+	t.Run("Null", func(t *testing.T) {
+		out := makeEvent(t)
+		doc := birch.DC.Elements(
+			birch.EC.Null("previous"),
+			birch.EC.Null("tags"),
+			birch.EC.Null("series"),
+			birch.EC.Null("extra"),
+		)
+		if err := out.UnmarshalDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+		if out.Previous != nil || out.Tags != nil || out.Series != nil || out.Extra != nil {
+			t.Errorf("null should reset fields: %+v", out)
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		for _, tc := range []struct {
+			name string
+			doc  *birch.Document
+			msg  string
+		}{
+			{
+				name: "TopLevel",
+				doc:  birch.DC.Elements(birch.EC.Boolean("name", true)),
+				msg:  `cannot decode boolean into string at "name"`,
+			},
+			{
+				name: "Nested",
+				doc:  birch.DC.Elements(birch.EC.SubDocumentFromElements("counters", birch.EC.String("n", "ten"))),
+				msg:  `counters: cannot decode string into int64 at "n"`,
+			},
+			{
+				name: "ArrayIndex",
+				doc: birch.DC.Elements(birch.EC.ArrayFromElements("history",
+					birch.VC.DocumentFromElements(birch.EC.Int64("n", 1)),
+					birch.VC.String("two"),
+				)),
+				msg: `cannot decode string into Counters at "history.1"`,
+			},
+			{
+				name: "MapKey",
+				doc: birch.DC.Elements(birch.EC.SubDocumentFromElements("series",
+					birch.EC.ArrayFromElements("one", birch.VC.Double(1.5)),
+				)),
+				msg: `cannot decode double into int64 at "series.one.0"`,
+			},
+			{
+				name: "Int32Overflow",
+				doc:  birch.DC.Elements(birch.EC.SubDocumentFromElements("counters", birch.EC.Int64("errors", 1<<40))),
+				msg:  `counters: cannot decode 64-bit integer into int32 at "errors": value overflows target type`,
+			},
+			{
+				name: "Float32Overflow",
+				doc:  birch.DC.Elements(birch.EC.Double("scale", 1e300)),
+				msg:  `cannot decode double into float32 at "scale": value overflows target type`,
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				err := (&Event{}).UnmarshalDocument(tc.doc)
+				if err == nil || err.Error() != tc.msg {
+					t.Errorf("expected %q, got %v", tc.msg, err)
+				}
+			})
+		}
+	})
+	t.Run("MatchesReflection", func(t *testing.T) {
+		// reflectCounters has the same fields as Counters, without
+		// the generated methods, so it decodes with reflection.
+		type reflectCounters Counters
+
+		for _, count := range []int64{1 << 31, -1<<31 - 1, 1 << 40} {
+			doc := birch.DC.Elements(birch.EC.Int64("n", 1), birch.EC.Int64("errors", count))
+			var generated Counters
+			var reflected reflectCounters
+			if err := generated.UnmarshalDocument(doc); err == nil || !strings.HasSuffix(err.Error(), "value overflows target type") {
+				t.Errorf("%d: unexpected error %v", count, err)
+			}
+			if err := doc.Unmarshal(&reflected); err == nil || !strings.HasSuffix(err.Error(), "value overflows target type") {
+				t.Errorf("%d: unexpected error %v", count, err)
+			}
+		}
+		for _, count := range []int64{1<<31 - 1, -1 << 31} {
+			doc := birch.DC.Elements(birch.EC.Int64("n", 1), birch.EC.Int64("errors", count))
+			var generated Counters
+			var reflected reflectCounters
+			if err := generated.UnmarshalDocument(doc); err != nil || int64(generated.Errors) != count {
+				t.Errorf("%d: unexpected result %d, %v", count, generated.Errors, err)
+			}
+			if err := doc.Unmarshal(&reflected); err != nil || reflected != reflectCounters(generated) {
+				t.Errorf("%d: unexpected result %+v, %v", count, reflected, err)
+			}
+		}
+	})
+}
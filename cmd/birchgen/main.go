@@ -0,0 +1,71 @@
+// Command birchgen generates reflection-free MarshalDocument and
+// UnmarshalDocument methods for struct types, using the birch
+// constructors and the typed Value accessors. It is intended to be
+// run by go generate:
+//
+//	//go:generate go run github.com/tychoish/birch/cmd/birchgen -type Performance,Counters
+//
+// Fields are named and handled using the same bson struct tags as
+// the reflection-based encoder: `bson:"name,omitempty,inline"`, where
+// "-" skips the field, and untagged fields use the lower-cased field
+// name. Inline fields must be structs defined in the same package.
+//
+// Supported field types are bool, string, int, int32, int64, float32,
+// float64, time.Time, time.Duration, types.ObjectID,
+// types.Decimal128, []byte, *birch.Document, *birch.Array, named
+// types defined in the package whose underlying type is one of those,
+// other named types (which must implement MarshalDocument and
+// UnmarshalDocument), as well as pointers to, slices of, and maps
+// with string keys of all of the above.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	var (
+		typeNames string
+		output    string
+		dir       string
+	)
+
+	flag.StringVar(&typeNames, "type", "", "comma separated list of struct types to generate methods for")
+	flag.StringVar(&output, "output", "", "output file name; defaults to <file>_birch.go for the file containing go:generate")
+	flag.StringVar(&dir, "dir", ".", "directory of the package containing the types")
+	flag.Parse()
+
+	if err := run(dir, output, typeNames); err != nil {
+		fmt.Fprintln(os.Stderr, "birchgen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir, output, typeNames string) error {
+	if typeNames == "" {
+		return fmt.Errorf("must specify at least one type with -type")
+	}
+
+	if output == "" {
+		base := "birch"
+		if gofile := os.Getenv("GOFILE"); gofile != "" {
+			base = strings.TrimSuffix(gofile, ".go")
+		}
+		output = base + "_birch.go"
+	}
+
+	if !filepath.IsAbs(output) {
+		output = filepath.Join(dir, output)
+	}
+
+	src, err := Generate(dir, strings.Split(typeNames, ","), filepath.Base(output))
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(output, src, 0o644)
+}
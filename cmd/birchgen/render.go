@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// renderer accumulates the body of the generated file and the imports
+// it requires.
+type renderer struct {
+	buf     bytes.Buffer
+	imports map[string]string
+	next    int
+}
+
+// sink describes where an encoded value goes: either appended to a
+// document (with a key) or appended to an array.
+type sink struct {
+	target string
+	// key is a go expression for the key, and is empty for arrays.
+	key string
+}
+
+// path is the location of a value, as a format string and the names
+// of the variables that hold the array indexes and map keys.
+type path struct {
+	format string
+	args   []string
+}
+
+func keyPath(key string) path { return path{format: strings.ReplaceAll(key, "%", "%%")} }
+
+func (p path) child(verb, arg string) path {
+	return path{format: p.format + "." + verb, args: append(slices.Clip(p.args), arg)}
+}
+
+func (g *generator) render(structs []*structType) ([]byte, error) {
+	r := &renderer{imports: map[string]string{"birch": birchPath}}
+
+	for _, st := range structs {
+		r.marshal(st)
+		r.unmarshal(st)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by birchgen. DO NOT EDIT.\n\npackage %s\n\n", g.pkg)
+
+	// standard library imports are grouped before all others
+	var std, other []string
+	for name, path := range r.imports {
+		spec := strconv.Quote(path)
+		if path[strings.LastIndex(path, "/")+1:] != name {
+			spec = name + " " + spec
+		}
+		if strings.Contains(strings.Split(path, "/")[0], ".") {
+			other = append(other, spec)
+		} else {
+			std = append(std, spec)
+		}
+	}
+	slices.Sort(std)
+	slices.Sort(other)
+	fmt.Fprintf(&out, "import (\n%s\n\n%s\n)\n", strings.Join(std, "\n"), strings.Join(other, "\n"))
+
+	out.Write(r.buf.Bytes())
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %w", err)
+	}
+
+	return src, nil
+}
+
+func (r *renderer) printf(format string, args ...any) { fmt.Fprintf(&r.buf, format, args...) }
+
+func (r *renderer) name(prefix string) string {
+	r.next++
+	return prefix + strconv.Itoa(r.next)
+}
+
+func (r *renderer) use(name, path string) { r.imports[name] = path }
+
+// typeExpr returns the source expression for a type, and records the
+// imports that it needs.
+func (r *renderer) typeExpr(ft *fieldType) string {
+	for name, path := range ft.pkgs {
+		r.use(name, path)
+	}
+	return ft.expr
+}
+
+func receiverName(typeName string) string {
+	return string(unicode.ToLower([]rune(typeName)[0]))
+}
+
+func (r *renderer) marshal(st *structType) {
+	recv := receiverName(st.name)
+	r.next = 0
+
+	r.printf("\n// MarshalDocument implements the birch.DocumentMarshaler interface.\n")
+	r.printf("func (%s *%s) MarshalDocument() (*birch.Document, error) {\n", recv, st.name)
+	r.printf("doc := birch.DC.Make(%d)\n", len(st.fields))
+
+	for _, f := range st.fields {
+		expr := recv + "." + f.name
+		out := sink{target: "doc", key: strconv.Quote(f.key)}
+
+		cond := ""
+		if f.omitEmpty {
+			cond = r.emptyCondition(expr, f.typ)
+		}
+		if cond == "" {
+			r.encode(out, expr, f.typ, keyPath(f.key))
+			continue
+		}
+
+		r.printf("if %s {\n", cond)
+		switch {
+		case f.typ.kind == pointerKind && f.typ.elem.kind != documentKind:
+			// the nil check is the omitempty condition
+			r.encode(out, "*"+expr, f.typ.elem, keyPath(f.key))
+		case f.typ.kind == pointerKind:
+			r.encode(out, expr, f.typ.elem, keyPath(f.key))
+		case f.typ.kind == scalarKind && f.typ.scalar.pointer:
+			r.put(out, f.typ.scalar.ctor, expr)
+		default:
+			r.encode(out, expr, f.typ, keyPath(f.key))
+		}
+		r.printf("}\n")
+	}
+
+	r.printf("return doc, nil\n}\n")
+}
+
+// emptyCondition returns the condition under which a field tagged
+// omitempty is encoded; struct values are never omitted.
+func (r *renderer) emptyCondition(expr string, ft *fieldType) string {
+	switch ft.kind {
+	case scalarKind:
+		if ft.scalar.empty == nil {
+			return ""
+		}
+		if ft.scalar.emptyUsesType {
+			return ft.scalar.empty(expr, r.typeExpr(ft))
+		}
+		return ft.scalar.empty(expr, ft.expr)
+	case pointerKind:
+		return notNil(expr, "")
+	case sliceKind, mapKind:
+		return notEmpty(expr, "")
+	default:
+		return ""
+	}
+}
+
+func (r *renderer) put(s sink, ctor string, args ...string) {
+	if s.key == "" {
+		if ctor == "SubDocument" {
+			ctor = "Document"
+		}
+		r.printf("%s.Append(birch.VC.%s(%s))\n", s.target, ctor, strings.Join(args, ", "))
+		return
+	}
+
+	r.printf("%s.Append(birch.EC.%s(%s))\n", s.target, ctor, strings.Join(append([]string{s.key}, args...), ", "))
+}
+
+// wrapError returns an expression that annotates err with the path.
+func (r *renderer) wrapError(p path) string {
+	r.use("fmt", "fmt")
+	args := append([]string{strconv.Quote(p.format + ": %w")}, p.args...)
+	return "fmt.Errorf(" + strings.Join(append(args, "err"), ", ") + ")"
+}
+
+func (r *renderer) encode(s sink, expr string, ft *fieldType, p path) {
+	switch ft.kind {
+	case scalarKind:
+		if ft.scalar.pointer {
+			r.printf("if %s == nil {\n", expr)
+			r.put(s, "Null")
+			r.printf("} else {\n")
+			r.put(s, ft.scalar.ctor, expr)
+			r.printf("}\n")
+			return
+		}
+
+		arg := expr
+		switch {
+		case ft.scalar.arg != "":
+			arg = ft.scalar.arg + "(" + expr + ")"
+		case ft.named != "":
+			for name, path := range ft.pkgs {
+				r.use(name, path)
+			}
+			arg = ft.base + "(" + expr + ")"
+		}
+		r.put(s, ft.scalar.ctor, arg)
+	case documentKind:
+		sub := r.name("sub")
+		r.printf("%s, err := %s.MarshalDocument()\n", sub, expr)
+		r.printf("if err != nil {\nreturn nil, %s\n}\n", r.wrapError(p))
+		r.put(s, "SubDocument", sub)
+	case pointerKind:
+		r.printf("if %s == nil {\n", expr)
+		r.put(s, "Null")
+		r.printf("} else {\n")
+		if ft.elem.kind == documentKind {
+			r.encode(s, expr, ft.elem, p)
+		} else {
+			r.encode(s, "*"+expr, ft.elem, p)
+		}
+		r.printf("}\n")
+	case sliceKind:
+		arr, idx := r.name("arr"), r.name("idx")
+		r.printf("%s := birch.MakeArray(len(%s))\n", arr, expr)
+		r.printf("for %s := range %s {\n", idx, expr)
+		r.encode(sink{target: arr}, expr+"["+idx+"]", ft.elem, p.child("%d", idx))
+		r.printf("}\n")
+		r.put(s, "Array", arr)
+	case mapKind:
+		r.use("maps", "maps")
+		r.use("slices", "slices")
+		sub, key, val := r.name("sub"), r.name("key"), r.name("val")
+		r.printf("%s := birch.DC.Make(len(%s))\n", sub, expr)
+		r.printf("for _, %s := range slices.Sorted(maps.Keys(%s)) {\n", key, expr)
+		r.printf("%s := %s[%s]\n", val, expr, key)
+		r.encode(sink{target: sub, key: key}, val, ft.elem, p.child("%s", key))
+		r.printf("}\n")
+		r.put(s, "SubDocument", sub)
+	}
+}
+
+func (r *renderer) unmarshal(st *structType) {
+	recv := receiverName(st.name)
+	r.next = 0
+
+	r.printf("\n// UnmarshalDocument implements the birch.DocumentUnmarshaler interface.\n")
+	r.printf("func (%s *%s) UnmarshalDocument(in *birch.Document) error {\n", recv, st.name)
+
+	if len(st.fields) > 0 {
+		r.printf("for elem := range in.Iterator() {\n")
+		r.printf("switch elem.Key() {\n")
+		for _, f := range st.fields {
+			r.printf("case %s:\n", strconv.Quote(f.key))
+			r.decode(recv+"."+f.name, "elem.Value()", f.typ, keyPath(f.key))
+		}
+		r.printf("}\n}\n\n")
+	}
+
+	r.printf("return nil\n}\n")
+}
+
+// typeError returns an expression for the error produced when the
+// value has the wrong type.
+func (r *renderer) typeError(val string, ft *fieldType, p path) string {
+	r.use("fmt", "fmt")
+	args := append([]string{
+		strconv.Quote("cannot decode %s into " + ft.expr + " at \"" + p.format + "\""),
+		val + ".Type()",
+	}, p.args...)
+	return "fmt.Errorf(" + strings.Join(args, ", ") + ")"
+}
+
+// overflowError returns an expression for the error produced when the
+// value does not fit in the type.
+func (r *renderer) overflowError(val string, ft *fieldType, p path) string {
+	r.use("fmt", "fmt")
+	args := append([]string{
+		strconv.Quote("cannot decode %s into " + ft.expr + " at \"" + p.format + "\": value overflows target type"),
+		val + ".Type()",
+	}, p.args...)
+	return "fmt.Errorf(" + strings.Join(args, ", ") + ")"
+}
+
+// ifNull opens a conditional block that sets the target to nil when
+// the value is null, and returns the function that closes it.
+func (r *renderer) ifNull(target, val string) func() {
+	r.use("bsontype", birchPath+"/bsontype")
+	r.printf("if %s.Type() == bsontype.Null {\n%s = nil\n} else {\n", val, target)
+	return func() { r.printf("}\n") }
+}
+
+func (r *renderer) decode(target, val string, ft *fieldType, p path) {
+	switch ft.kind {
+	case scalarKind:
+		if ft.scalar.nilable {
+			defer r.ifNull(target, val)()
+		}
+
+		out := r.name("v")
+		r.printf("%s%s, ok := %s.%s()\n", strings.Repeat("_, ", ft.scalar.skip), out, val, ft.scalar.accessor)
+		r.printf("if !ok {\nreturn %s\n}\n", r.typeError(val, ft, p))
+		if ft.scalar.overflow != nil {
+			r.printf("if %s {\nreturn %s\n}\n", ft.scalar.overflow(r, out), r.overflowError(val, ft, p))
+		}
+
+		switch {
+		case ft.named != "":
+			out = ft.named + "(" + out + ")"
+		case ft.scalar.convert:
+			out = r.typeExpr(ft) + "(" + out + ")"
+		}
+		r.printf("%s = %s\n", target, out)
+	case documentKind:
+		doc := r.name("doc")
+		r.printf("%s, ok := %s.MutableDocumentOK()\n", doc, val)
+		r.printf("if !ok {\nreturn %s\n}\n", r.typeError(val, ft, p))
+		r.printf("if err := %s.UnmarshalDocument(%s); err != nil {\nreturn %s\n}\n", target, doc, r.wrapError(p))
+	case pointerKind:
+		defer r.ifNull(target, val)()
+
+		r.printf("if %s == nil {\n%s = new(%s)\n}\n", target, target, r.typeExpr(ft.elem))
+		if ft.elem.kind == documentKind {
+			r.decode(target, val, ft.elem, p)
+		} else {
+			r.decode("*"+target, val, ft.elem, p)
+		}
+	case sliceKind:
+		defer r.ifNull(target, val)()
+
+		arr, idx, item := r.name("arr"), r.name("idx"), r.name("item")
+		r.printf("%s, ok := %s.MutableArrayOK()\n", arr, val)
+		r.printf("if !ok {\nreturn %s\n}\n", r.typeError(val, ft, p))
+		r.printf("%s = make(%s, %s.Len())\n", target, r.typeExpr(ft), arr)
+		r.printf("%s := 0\n", idx)
+		r.printf("for %s := range %s.Iterator() {\n", item, arr)
+		r.decode(target+"["+idx+"]", item, ft.elem, p.child("%d", idx))
+		r.printf("%s++\n}\n", idx)
+	case mapKind:
+		defer r.ifNull(target, val)()
+
+		doc, elem, item := r.name("doc"), r.name("elem"), r.name("item")
+		r.printf("%s, ok := %s.MutableDocumentOK()\n", doc, val)
+		r.printf("if !ok {\nreturn %s\n}\n", r.typeError(val, ft, p))
+		r.printf("%s = make(%s, %s.Len())\n", target, r.typeExpr(ft), doc)
+		r.printf("for %s := range %s.Iterator() {\n", elem, doc)
+		r.printf("var %s %s\n", item, r.typeExpr(ft.elem))
+		r.decode(item, elem+".Value()", ft.elem, p.child("%s", elem+".Key()"))
+		r.printf("%s[%s.Key()] = %s\n}\n", target, elem, item)
+	}
+}
@@ -7,11 +7,10 @@
 package birch
 
 import (
-	"fmt"
 	"math"
+	"reflect"
 	"time"
 
-	"github.com/tychoish/birch/bsontype"
 	"github.com/tychoish/birch/elements"
 	"github.com/tychoish/birch/jsonx"
 	"github.com/tychoish/birch/types"
@@ -37,10 +36,29 @@ type ValueConstructorError struct{}
 // For common types, type casting is used, for all slices and all
 // other complex types, this relies on the Marshaler interface.
 //
+// Values of other types, including structs, are converted using
+// reflection, respecting the same `bson:"name,omitempty,inline"` tags
+// as Document.Unmarshal.
+//
 // If the value cannot be converted to bson, a null Element is constructed with the
 // key. This method will never return a nil *Element. If an error turning the
 // value into an Element is desired, use the InterfaceErr method.
+//
+// Types registered with DefaultRegistry are converted with their
+// registered encoders.
 func (ElementConstructor) Interface(key string, value any) *Element {
+	return DefaultRegistry.element(key, value)
+}
+
+// interfaceElement converts the types registered with the registry
+// and the types that do not require reflection directly, and falls
+// back to reflection for all other types. The element is nil if the
+// value could not be converted.
+func (r *Registry) interfaceElement(key string, value any) (*Element, error) {
+	if elem, ok, err := r.encodeRegistered(key, value); ok {
+		return elem, err
+	}
+
 	var (
 		elem *Element
 		err  error
@@ -99,13 +117,13 @@ func (ElementConstructor) Interface(key string, value any) *Element {
 	case types.Timestamp:
 		elem = EC.Timestamp(key, t.T, t.I)
 	case map[string]any:
-		elem = EC.SubDocument(key, DC.MapInterface(t))
+		elem = EC.SubDocument(key, r.mapDocument(t))
 	case map[any]any:
-		elem = EC.SubDocument(key, DC.Interface(t))
+		elem = EC.SubDocument(key, r.mapInterfaceDocument(t))
 	case map[string]string:
 		elem = EC.SubDocument(key, DC.MapString(t))
 	case []any:
-		elem = EC.SliceInterface(key, t)
+		elem = r.sliceElement(key, t)
 	case []string:
 		elem = EC.SliceString(key, t)
 	case []int64:
@@ -147,53 +165,19 @@ func (ElementConstructor) Interface(key string, value any) *Element {
 		elem, err = ECE.DocumentMarshaler(key, t)
 	case Marshaler:
 		elem, err = ECE.Marshaler(key, t)
-	default:
-		elem = EC.Null(key)
-	}
-
-	if err != nil || elem == nil {
+	case nil:
 		elem = EC.Null(key)
+	default:
+		elem, err = r.reflectElement(key, reflect.ValueOf(value))
 	}
 
-	return elem
+	return elem, err
 }
 
 // InterfaceErr does what Interface does, but returns an error when it cannot
 // properly convert a value into an *Element. See Interface for details.
 func (ElementConstructorError) Interface(key string, value any) (*Element, error) {
-	switch t := value.(type) {
-	case uint:
-		switch {
-		case t < math.MaxInt32:
-			return EC.Int32(key, int32(t)), nil
-		case uint64(t) > math.MaxInt64:
-			return nil, fmt.Errorf("BSON only has signed integer types and %d overflows an int64", t)
-		default:
-			return EC.Int64(key, int64(t)), nil
-		}
-	case uint64:
-		switch {
-		case t < math.MaxInt32:
-			return EC.Int32(key, int32(t)), nil
-		case t > math.MaxInt64:
-			return nil, fmt.Errorf("BSON only has signed integer types and %d overflows an int64", t)
-		default:
-			return EC.Int64(key, int64(t)), nil
-		}
-	case DocumentMarshaler:
-		return ECE.DocumentMarshaler(key, t)
-	case Marshaler:
-		return ECE.Marshaler(key, t)
-	default:
-		if t == nil {
-			return EC.Null(key), nil
-		}
-		elem := EC.Interface(key, t)
-		if elem.Value().Type() == bsontype.Null {
-			return nil, fmt.Errorf("Cannot create element for type %T, try using bsoncodec.ConstructElementErr", value)
-		}
-		return elem, nil
-	}
+	return DefaultRegistry.Element(key, value)
 }
 
 // Double creates a double element with the given key and value.
@@ -8,7 +8,6 @@ package birch
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"iter"
 
@@ -101,6 +100,7 @@ func (d *Document) Set(elem *Element) *Document {
 	for idx, e := range d.elems {
 		if elem.Key() == e.Key() {
 			d.elems[idx] = elem
+			d.cacheValid = false
 			return d
 		}
 	}
@@ -119,10 +119,10 @@ func (d *Document) Delete(key string) *Element {
 		if d.elems[idx].Key() == key {
 			elem := d.elems[idx]
 			d.elems = append(d.elems[:idx], d.elems[idx+1:]...)
+			d.cacheValid = false
 			return elem
 		}
 	}
-	d.cacheValid = false
 	return nil
 }
 
@@ -145,7 +145,8 @@ func (d *Document) ElementAtOK(index uint) (*Element, bool) {
 func (d *Document) Iterator() iter.Seq[*Element] { return irt.Slice(d.elems) }
 
 // Extend merges a second document into the document. It may produce a
-// document with duplicate keys.
+// document with duplicate keys; use Merge to combine documents
+// without duplicating keys.
 func (d *Document) Extend(d2 *Document) *Document { d.Append(d2.elems...); return d }
 
 // Reset clears a document so it can be reused. This method clears references
@@ -270,13 +271,7 @@ func (d *Document) writeByteSlice(start uint, size uint32, b []byte) (int64, err
 
 // MarshalBSON implements the Marshaler interface.
 func (d *Document) MarshalBSON() ([]byte, error) {
-	size, err := d.Validate()
-	if err != nil {
-		return nil, err
-	}
-
-	b := make([]byte, size)
-	_, err = d.writeByteSlice(0, size, b)
+	b, err := d.AppendBSON(nil)
 	if err != nil {
 		return nil, err
 	}
@@ -356,36 +351,17 @@ func (d *Document) String() string {
 // reasonably well for simple map types and will not always round
 // trip. While unmarshal will overwrite values in an existing input
 // structure, it will not delete other values, and will avoid writing
-// fields in the document which cannot be easily converted. While this
-// method does not work with arbitrary types that do not implement
-// DocumentUnmarshaler, it does not use reflection.
+// fields in the document which cannot be easily converted.
+//
+// When the input type does not implement DocumentUnmarshaler or
+// Unmarshaler and is not one of the supported map types, Unmarshal
+// falls back to reflection, and populates pointers to structs and
+// maps with string keys. Struct fields are matched to keys using
+// `bson:"name,omitempty,inline"` tags, or the lower-cased field name
+// when there is no tag. Type mismatches are reported as *DecodeError
+// values that name the path of the offending value. Decoders
+// registered with DefaultRegistry are used for the types they were
+// registered for.
 func (d *Document) Unmarshal(into any) error {
-	switch out := into.(type) {
-	case DocumentUnmarshaler:
-		return out.UnmarshalDocument(d)
-	case Unmarshaler:
-		raw, err := d.MarshalBSON()
-		if err != nil {
-			return err
-		}
-		return out.UnmarshalBSON(raw)
-	case map[string]string:
-		for _, elem := range d.elems {
-			if val, ok := elem.value.StringValueOK(); ok {
-				out[elem.Key()] = val
-			}
-		}
-	case map[string]any:
-		for _, elem := range d.elems {
-			out[elem.Key()] = elem.value.Interface()
-		}
-	case map[any]any:
-		for _, elem := range d.elems {
-			out[elem.Key()] = elem.value.Interface()
-		}
-	default:
-		// TODO consider falling back to reflection
-		return fmt.Errorf("cannot unmarshal into %T", into)
-	}
-	return nil
+	return DefaultRegistry.Unmarshal(d, into)
 }
@@ -486,7 +486,12 @@ func TestDocument(t *testing.T) {
 			if 42 != doc.Elements()[0].Value().Int32() {
 				t.Fatalf("values are not equal %v and %v", 42, doc.Elements()[0].Value().Int32())
 			}
-			if "forty-two" != sdoc.Elements()[0].Value().StringValue() {
+			// numbers sort before strings in the BSON
+			// comparison order.
+			if 42 != sdoc.Elements()[0].Value().Int32() {
+				t.Error("values should be equal")
+			}
+			if "forty-two" != sdoc.Elements()[1].Value().StringValue() {
 				t.Error("values should be equal")
 			}
 		})
@@ -0,0 +1,347 @@
+// Package encrypt provides field-level encryption of the values in
+// BSON documents with AES-GCM.
+//
+// Encrypted values are binary values with the encrypted subtype (6),
+// which record the type of the original value and the ID of the key
+// that encrypted it, so that documents with encrypted fields remain
+// valid BSON, and decrypting them restores the exact original values.
+// Values are encrypted with a random nonce by default; deterministic
+// encryption derives the nonce from the key and the value, so that
+// equal values have equal ciphertexts and can be matched for
+// equality, at the cost of revealing which values are equal.
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// BinarySubtype is the subtype of binary values that hold encrypted
+// values.
+const BinarySubtype byte = 0x06
+
+// the first byte of an encrypted value identifies the mode, using the
+// same values as the payloads of MongoDB's client-side field level
+// encryption.
+const (
+	deterministicMode byte = 0x01
+	randomMode        byte = 0x02
+)
+
+const maxKeyIDLength = 255
+
+// ErrUnknownKey indicates that a key provider does not have a key with
+// the requested ID.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// ErrInvalidKeyID indicates that a key ID is empty or longer than 255
+// bytes.
+var ErrInvalidKeyID = errors.New("invalid encryption key id")
+
+// ErrInvalidCiphertext indicates that an encrypted value is malformed,
+// or could not be authenticated with its key.
+var ErrInvalidCiphertext = errors.New("invalid encrypted value")
+
+// ErrOverlappingPaths indicates that a path to encrypt is within
+// another path to encrypt.
+var ErrOverlappingPaths = errors.New("overlapping encryption paths")
+
+// KeyProvider supplies the keys that encrypt and decrypt values.
+// Implementations must be safe for concurrent use when the
+// Encrypter is used concurrently.
+type KeyProvider interface {
+	// Key returns the AES key, of 16, 24 or 32 bytes, with the
+	// ID. Providers should return an error that wraps ErrUnknownKey
+	// for IDs that they do not have.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider for a fixed set of keys, by ID.
+type StaticKeys map[string][]byte
+
+// Key returns the key with the ID.
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// Encrypter encrypts and decrypts values with the keys from a
+// KeyProvider.
+type Encrypter struct {
+	Keys KeyProvider
+	// KeyID is the ID of the key that encrypts values. Decryption
+	// uses the key recorded in each value.
+	KeyID string
+	// Deterministic encrypts equal values with equal ciphertexts.
+	Deterministic bool
+	// Rand is the source of nonces for random encryption, which is
+	// crypto/rand.Reader when nil.
+	Rand io.Reader
+}
+
+// Metadata describes an encrypted value.
+type Metadata struct {
+	KeyID         string
+	Type          bsontype.Type
+	Deterministic bool
+}
+
+// IsEncrypted reports whether the value is a binary value with the
+// encrypted subtype.
+func IsEncrypted(v *birch.Value) bool {
+	if v == nil || v.Type() != bsontype.Binary {
+		return false
+	}
+	subtype, _ := v.Binary()
+	return subtype == BinarySubtype
+}
+
+// ReadMetadata returns the metadata of the encrypted value without
+// decrypting it.
+func ReadMetadata(v *birch.Value) (Metadata, error) {
+	meta, _, _, err := parse(v)
+	return meta, err
+}
+
+// Encrypt replaces the values at the paths in the document with
+// encrypted values. Paths without a value, and values that are already
+// encrypted, are left unchanged. Either all of the values are
+// encrypted, or, if there is an error, the document is not modified.
+func (e Encrypter) Encrypt(doc *birch.Document, paths ...birch.Path) error {
+	for idx, path := range paths {
+		for _, other := range paths[idx+1:] {
+			if within(path, other) || within(other, path) {
+				return fmt.Errorf("%w: %q and %q", ErrOverlappingPaths, path.String(), other.String())
+			}
+		}
+	}
+
+	values := make([]*birch.Value, len(paths))
+	for idx, path := range paths {
+		val, err := doc.LookupPath(path)
+		if err != nil {
+			return err
+		}
+		if val == nil || IsEncrypted(val) {
+			continue
+		}
+
+		if values[idx], err = e.EncryptValue(val); err != nil {
+			return fmt.Errorf("encrypting %q: %w", path.String(), err)
+		}
+	}
+
+	for idx, path := range paths {
+		if values[idx] == nil {
+			continue
+		}
+		if err := doc.SetPath(path, values[idx]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Decrypt replaces every encrypted value in the document, including
+// values in nested documents and arrays, with its original value.
+// Either all of the values are decrypted, or, if there is an error,
+// the document is not modified.
+func (e Encrypter) Decrypt(doc *birch.Document) error {
+	var paths []birch.Path
+	var values []*birch.Value
+
+	for path, val := range doc.Walk() {
+		if !IsEncrypted(val) {
+			continue
+		}
+
+		out, err := e.DecryptValue(val)
+		if err != nil {
+			return fmt.Errorf("decrypting %q: %w", path.String(), err)
+		}
+		paths = append(paths, path)
+		values = append(values, out)
+	}
+
+	for idx, path := range paths {
+		if err := doc.SetPath(path, values[idx]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EncryptValue returns the encrypted form of the value, with the key
+// KeyID.
+func (e Encrypter) EncryptValue(v *birch.Value) (*birch.Value, error) {
+	if e.KeyID == "" || len(e.KeyID) > maxKeyIDLength {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidKeyID, e.KeyID)
+	}
+
+	plaintext, err := v.AppendBSON(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	key, aead, err := e.cipher(e.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := randomMode
+	if e.Deterministic {
+		mode = deterministicMode
+	}
+
+	// the header is authenticated, but not encrypted, so that the
+	// metadata can be read without the key and cannot be altered.
+	header := make([]byte, 0, 3+len(e.KeyID))
+	header = append(header, mode, byte(len(e.KeyID)))
+	header = append(header, e.KeyID...)
+	header = append(header, byte(v.Type()))
+
+	nonce := make([]byte, aead.NonceSize())
+	if e.Deterministic {
+		// the nonce is a MAC of the value, with a key derived from
+		// the encryption key, so that it only repeats for equal
+		// values, which have equal ciphertexts.
+		mac := hmac.New(sha256.New, derive(key, "nonce"))
+		mac.Write(header)
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := io.ReadFull(e.random(), nonce); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	data = append(data, header...)
+	data = append(data, nonce...)
+	data = aead.Seal(data, nonce, plaintext, header)
+
+	return birch.VC.BinaryWithSubtype(data, BinarySubtype), nil
+}
+
+// DecryptValue returns the original value of the encrypted value.
+func (e Encrypter) DecryptValue(v *birch.Value) (*birch.Value, error) {
+	meta, header, body, err := parse(v)
+	if err != nil {
+		return nil, err
+	}
+
+	_, aead, err := e.cipher(meta.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: too short", ErrInvalidCiphertext)
+	}
+
+	plaintext, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCiphertext, err)
+	}
+
+	return readValue(meta.Type, plaintext)
+}
+
+func (e Encrypter) cipher(id string) ([]byte, cipher.AEAD, error) {
+	if e.Keys == nil {
+		return nil, nil, fmt.Errorf("%w: %q: no key provider", ErrUnknownKey, id)
+	}
+
+	key, err := e.Keys.Key(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key %q: %w", id, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, aead, nil
+}
+
+func (e Encrypter) random() io.Reader {
+	if e.Rand == nil {
+		return rand.Reader
+	}
+	return e.Rand
+}
+
+func derive(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// parse splits an encrypted value into its metadata, its header and
+// the nonce and ciphertext that follow the header.
+func parse(v *birch.Value) (Metadata, []byte, []byte, error) {
+	if !IsEncrypted(v) {
+		return Metadata{}, nil, nil, fmt.Errorf("%w: not an encrypted binary value", ErrInvalidCiphertext)
+	}
+	_, data := v.Binary()
+
+	if len(data) < 2 || (data[0] != deterministicMode && data[0] != randomMode) {
+		return Metadata{}, nil, nil, fmt.Errorf("%w: unknown mode", ErrInvalidCiphertext)
+	}
+	size := 3 + int(data[1])
+	if data[1] == 0 || len(data) < size {
+		return Metadata{}, nil, nil, fmt.Errorf("%w: invalid key id", ErrInvalidCiphertext)
+	}
+
+	meta := Metadata{
+		KeyID:         string(data[2 : size-1]),
+		Type:          bsontype.Type(data[size-1]),
+		Deterministic: data[0] == deterministicMode,
+	}
+
+	return meta, data[:size], data[size:], nil
+}
+
+// readValue constructs a value of the type from its BSON
+// representation, by reading it as the only element of a document.
+func readValue(t bsontype.Type, data []byte) (*birch.Value, error) {
+	buf := make([]byte, 4, 4+2+len(data)+1)
+	buf = append(buf, byte(t), 0x00)
+	buf = append(buf, data...)
+	buf = append(buf, 0x00)
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)))
+
+	doc, err := birch.ReadDocument(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCiphertext, err)
+	}
+	if doc.Len() != 1 {
+		return nil, fmt.Errorf("%w: invalid value", ErrInvalidCiphertext)
+	}
+
+	return doc.ElementAt(0).Value(), nil
+}
+
+// within reports whether the path is within the parent path.
+func within(path, parent birch.Path) bool {
+	return len(path) > len(parent) && slices.Equal(path[:len(parent)], parent)
+}
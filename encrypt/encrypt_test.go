@@ -0,0 +1,236 @@
+package encrypt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/internal/birchtest"
+)
+
+func mustMarshal(t *testing.T, doc *birch.Document) []byte {
+	t.Helper()
+	data, err := doc.MarshalBSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncrypt(t *testing.T) {
+	keys := StaticKeys{
+		"primary":   bytes.Repeat([]byte{1}, 32),
+		"secondary": bytes.Repeat([]byte{2}, 16),
+		"short":     []byte("short"),
+	}
+	input := func() *birch.Document {
+		doc := birchtest.Document(t, `{"name":"Ada","token":"s3cr3t","address":{"city":"London","zip":"N1"},`+
+			`"cards":[{"number":"4111","exp":"12/30"}],"tags":["a","b"],"score":1.5}`)
+		doc.Append(birch.EC.Int64("ssn", 123456789))
+		return doc
+	}
+	paths := []birch.Path{
+		birch.ParsePath("token"),
+		birch.ParsePath("address.zip"),
+		birch.ParsePath("cards.0.number"),
+		birch.ParsePath("tags"),
+		birch.ParsePath("ssn"),
+		birch.ParsePath("missing.field"),
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		for _, deterministic := range []bool{false, true} {
+			e := Encrypter{Keys: keys, KeyID: "primary", Deterministic: deterministic}
+			doc := input()
+
+			if err := e.Encrypt(doc, paths...); err != nil {
+				t.Fatal(err)
+			}
+			for path, typ := range map[string]bsontype.Type{
+				"token":          bsontype.String,
+				"address.zip":    bsontype.String,
+				"cards.0.number": bsontype.String,
+				"tags":           bsontype.Array,
+				"ssn":            bsontype.Int64,
+			} {
+				val, err := doc.LookupPath(birch.ParsePath(path))
+				if err != nil || !IsEncrypted(val) {
+					t.Fatalf("%s: not encrypted: %v, %v", path, val, err)
+				}
+				meta, err := ReadMetadata(val)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if meta != (Metadata{KeyID: "primary", Type: typ, Deterministic: deterministic}) {
+					t.Errorf("%s: unexpected metadata %+v", path, meta)
+				}
+			}
+			if doc.Lookup("name").StringValue() != "Ada" || doc.Lookup("address").MutableDocument().Lookup("city").StringValue() != "London" {
+				t.Fatalf("unexpected document %s", doc)
+			}
+			if doc.Lookup("missing") != nil {
+				t.Fatalf("unexpected document %s", doc)
+			}
+
+			// encrypted documents remain valid BSON
+			parsed, err := birch.ReadDocument(mustMarshal(t, doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := e.Decrypt(parsed); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(mustMarshal(t, parsed), mustMarshal(t, input())) {
+				t.Errorf("got %s, expected %s", parsed, input())
+			}
+		}
+	})
+	t.Run("Idempotent", func(t *testing.T) {
+		e := Encrypter{Keys: keys, KeyID: "primary"}
+		doc := input()
+		if err := e.Encrypt(doc, paths...); err != nil {
+			t.Fatal(err)
+		}
+		encrypted := mustMarshal(t, doc)
+		if err := e.Encrypt(doc, paths...); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(mustMarshal(t, doc), encrypted) {
+			t.Error("encrypted values were encrypted again")
+		}
+	})
+	t.Run("Deterministic", func(t *testing.T) {
+		val := birch.VC.String("s3cr3t")
+		for _, test := range []struct {
+			name  string
+			a, b  Encrypter
+			equal bool
+		}{
+			{name: "Random", a: Encrypter{Keys: keys, KeyID: "primary"}, b: Encrypter{Keys: keys, KeyID: "primary"}},
+			{name: "Deterministic", a: Encrypter{Keys: keys, KeyID: "primary", Deterministic: true}, b: Encrypter{Keys: keys, KeyID: "primary", Deterministic: true}, equal: true},
+			{name: "Keys", a: Encrypter{Keys: keys, KeyID: "primary", Deterministic: true}, b: Encrypter{Keys: keys, KeyID: "secondary", Deterministic: true}},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				a, err := test.a.EncryptValue(val)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := test.b.EncryptValue(val)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if a.Equal(b) != test.equal {
+					t.Errorf("ciphertext equality is %t", a.Equal(b))
+				}
+
+				other, err := test.a.EncryptValue(birch.VC.String("other"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if other.Equal(a) {
+					t.Error("different values have equal ciphertexts")
+				}
+			})
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		e := Encrypter{Keys: keys, KeyID: "primary"}
+		encrypted, err := e.EncryptValue(birch.VC.String("s3cr3t"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, data := encrypted.Binary()
+
+		tampered := bytes.Clone(data)
+		tampered[len(tampered)-1] ^= 1
+		retyped := bytes.Clone(data)
+		retyped[2+len("primary")] = byte(bsontype.Int32)
+
+		for _, test := range []struct {
+			name string
+			e    Encrypter
+			val  *birch.Value
+			err  error
+		}{
+			{name: "UnknownKey", e: Encrypter{Keys: StaticKeys{}}, val: encrypted, err: ErrUnknownKey},
+			{name: "NoKeys", e: Encrypter{}, val: encrypted, err: ErrUnknownKey},
+			{name: "WrongKey", e: Encrypter{Keys: StaticKeys{"primary": keys["secondary"]}}, val: encrypted, err: ErrInvalidCiphertext},
+			{name: "Tampered", e: e, val: birch.VC.BinaryWithSubtype(tampered, BinarySubtype), err: ErrInvalidCiphertext},
+			{name: "Retyped", e: e, val: birch.VC.BinaryWithSubtype(retyped, BinarySubtype), err: ErrInvalidCiphertext},
+			{name: "Truncated", e: e, val: birch.VC.BinaryWithSubtype(data[:len(data)-20], BinarySubtype), err: ErrInvalidCiphertext},
+			{name: "Header", e: e, val: birch.VC.BinaryWithSubtype(data[:4], BinarySubtype), err: ErrInvalidCiphertext},
+			{name: "Mode", e: e, val: birch.VC.BinaryWithSubtype([]byte{3, 1, 'x', 2}, BinarySubtype), err: ErrInvalidCiphertext},
+			{name: "Subtype", e: e, val: birch.VC.Binary(data), err: ErrInvalidCiphertext},
+			{name: "NotBinary", e: e, val: birch.VC.String("s3cr3t"), err: ErrInvalidCiphertext},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				if _, err := test.e.DecryptValue(test.val); !errors.Is(err, test.err) {
+					t.Errorf("unexpected error %v", err)
+				}
+			})
+		}
+
+		for _, e := range []Encrypter{
+			{Keys: keys},
+			{Keys: keys, KeyID: string(bytes.Repeat([]byte{'x'}, 256))},
+		} {
+			if _, err := e.EncryptValue(birch.VC.Int32(1)); !errors.Is(err, ErrInvalidKeyID) {
+				t.Errorf("unexpected error %v", err)
+			}
+		}
+		if _, err := (Encrypter{Keys: keys, KeyID: "missing"}).EncryptValue(birch.VC.Int32(1)); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := (Encrypter{Keys: keys, KeyID: "short"}).EncryptValue(birch.VC.Int32(1)); err == nil {
+			t.Error("expected an error for an invalid key size")
+		}
+	})
+	t.Run("Atomic", func(t *testing.T) {
+		for name, test := range map[string]struct {
+			e     Encrypter
+			paths []birch.Path
+			err   error
+		}{
+			"UnknownKey":  {e: Encrypter{Keys: keys, KeyID: "missing"}, paths: paths, err: ErrUnknownKey},
+			"Overlapping": {e: Encrypter{Keys: keys, KeyID: "primary"}, paths: []birch.Path{{"token"}, {"address"}, {"address", "zip"}}, err: ErrOverlappingPaths},
+			"Path":        {e: Encrypter{Keys: keys, KeyID: "primary"}, paths: []birch.Path{{"token"}, {"name", "first"}}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				doc := input()
+				err := test.e.Encrypt(doc, test.paths...)
+				var perr *birch.PathError
+				if err == nil || (test.err != nil && !errors.Is(err, test.err)) || (test.err == nil && !errors.As(err, &perr)) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if !bytes.Equal(mustMarshal(t, doc), mustMarshal(t, input())) {
+					t.Errorf("document modified: %s", doc)
+				}
+			})
+		}
+		t.Run("Decrypt", func(t *testing.T) {
+			doc := input()
+			if err := (Encrypter{Keys: keys, KeyID: "primary"}).Encrypt(doc, birch.Path{"token"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := (Encrypter{Keys: keys, KeyID: "secondary"}).Encrypt(doc, birch.Path{"ssn"}); err != nil {
+				t.Fatal(err)
+			}
+			encrypted := mustMarshal(t, doc)
+
+			if err := (Encrypter{Keys: StaticKeys{"primary": keys["primary"]}}).Decrypt(doc); !errors.Is(err, ErrUnknownKey) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !bytes.Equal(mustMarshal(t, doc), encrypted) {
+				t.Errorf("document modified: %s", doc)
+			}
+			if err := (Encrypter{Keys: keys}).Decrypt(doc); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(mustMarshal(t, doc), mustMarshal(t, input())) {
+				t.Errorf("got %s, expected %s", doc, input())
+			}
+		})
+	})
+}
@@ -0,0 +1,31 @@
+// Package birchtest provides fixtures for the tests of the packages
+// built on birch.
+package birchtest
+
+import (
+	"testing"
+
+	"github.com/tychoish/birch"
+)
+
+// Document parses the (relaxed) JSON document, and fails the test if
+// it cannot be parsed.
+func Document(t testing.TB, in string) *birch.Document {
+	t.Helper()
+	doc := birch.DC.New()
+	if err := doc.UnmarshalJSON([]byte(in)); err != nil {
+		t.Fatalf("parsing %s: %v", in, err)
+	}
+	return doc
+}
+
+// Array parses the JSON array, and fails the test if it cannot be
+// parsed.
+func Array(t testing.TB, in string) *birch.Array {
+	t.Helper()
+	arr := birch.NewArray()
+	if err := arr.UnmarshalJSON([]byte(in)); err != nil {
+		t.Fatalf("parsing %s: %v", in, err)
+	}
+	return arr
+}
@@ -0,0 +1,61 @@
+package match
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// sameBracket reports whether two values are in the same type bracket,
+// which is a requirement for the comparison query operators.
+func sameBracket(a, b *birch.Value) bool {
+	return birch.CanonicalTypeOrder(a.Type()) == birch.CanonicalTypeOrder(b.Type())
+}
+
+// Equal reports whether the values are equal using MongoDB's
+// semantics, where numbers of different types may be equal.
+func Equal(a, b *birch.Value) bool { return sameBracket(a, b) && Compare(a, b) == 0 }
+
+// Compare orders two values using MongoDB's comparison order, first by
+// type bracket and then by value, and returns -1, 0, or 1. It is
+// birch.Compare.
+func Compare(a, b *birch.Value) int { return birch.Compare(a, b) }
+
+func intValue(v *birch.Value) (int64, bool) {
+	switch v.Type() {
+	case bsontype.Int32:
+		return int64(v.Int32()), true
+	case bsontype.Int64:
+		return v.Int64(), true
+	default:
+		return 0, false
+	}
+}
+
+func floatValue(v *birch.Value) float64 {
+	switch v.Type() {
+	case bsontype.Int32:
+		return float64(v.Int32())
+	case bsontype.Int64:
+		return float64(v.Int64())
+	case bsontype.Double:
+		return v.Double()
+	case bsontype.Decimal128:
+		f, err := strconv.ParseFloat(v.Decimal128().String(), 64)
+		if err != nil && f == 0 {
+			return math.NaN()
+		}
+		return f
+	default:
+		return math.NaN()
+	}
+}
+
+func stringValue(v *birch.Value) string {
+	if v.Type() == bsontype.Symbol {
+		return v.Symbol()
+	}
+	return v.StringValue()
+}
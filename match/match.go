@@ -0,0 +1,733 @@
+// Package match compiles MongoDB query filters, expressed as birch
+// documents, into predicates over documents.
+//
+// Filters support the comparison operators ($eq, $ne, $gt, $gte, $lt,
+// $lte, $in, $nin), the element operators ($exists, $type), $regex,
+// the logical operators ($and, $or, $nor, $not), and the array
+// operators ($elemMatch, $size, $all). Dotted paths traverse embedded
+// documents and arrays with MongoDB's semantics: numeric keys index
+// into arrays, other keys are resolved in each document in an array,
+// and operators match an array field when they match the array or any
+// of its elements.
+package match
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// ErrInvalidFilter is returned (wrapped) by Compile when a filter is
+// malformed or uses an unsupported operator.
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Matcher is a compiled filter. Matchers are immutable and safe for
+// concurrent use.
+type Matcher struct {
+	pred docPredicate
+}
+
+type (
+	docPredicate   func(*birch.Document) bool
+	fieldPredicate func([]*birch.Value) bool
+)
+
+// Compile converts a filter document into a Matcher. A nil or empty
+// filter matches all documents.
+func Compile(filter *birch.Document) (*Matcher, error) {
+	if filter == nil {
+		filter = birch.DC.New()
+	}
+
+	pred, err := compileQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Matcher{pred: pred}, nil
+}
+
+// Match reports whether the document matches the filter.
+func (m *Matcher) Match(doc *birch.Document) bool {
+	if doc == nil {
+		return false
+	}
+	return m.pred(doc)
+}
+
+// MatchReader reports whether the document in the reader matches the
+// filter, returning an error if the reader is not a valid document.
+func (m *Matcher) MatchReader(r birch.Reader) (bool, error) {
+	doc, err := birch.DCE.Reader(r)
+	if err != nil {
+		return false, err
+	}
+
+	return m.Match(doc), nil
+}
+
+// ElementMatcher is a compiled condition for individual array
+// elements, with the semantics of $elemMatch and of the $pull update
+// operator.
+type ElementMatcher struct {
+	pred func(*birch.Value) bool
+}
+
+// CompileElement converts a condition into an ElementMatcher. Documents
+// of operators (e.g. {"$gt": 1}) apply to the element itself, other
+// documents are filters for elements that are documents, and all other
+// values match equal elements.
+func CompileElement(cond *birch.Value) (*ElementMatcher, error) {
+	if cond == nil {
+		return nil, invalidf("nil condition")
+	}
+
+	pred, err := compileElement(cond)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ElementMatcher{pred: pred}, nil
+}
+
+// Match reports whether the value matches the condition.
+func (m *ElementMatcher) Match(val *birch.Value) bool { return val != nil && m.pred(val) }
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidFilter, fmt.Sprintf(format, args...))
+}
+
+func compileQuery(filter *birch.Document) (docPredicate, error) {
+	preds := make([]docPredicate, 0, filter.Len())
+
+	for elem := range filter.Iterator() {
+		key := elem.Key()
+
+		switch key {
+		case "$and", "$or", "$nor":
+			pred, err := compileLogical(key, elem.Value())
+			if err != nil {
+				return nil, err
+			}
+			preds = append(preds, pred)
+		case "$comment":
+			continue
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, invalidf("unsupported top-level operator %q", key)
+			}
+
+			pred, err := compileCondition(elem.Value())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+
+			path := birch.ParsePath(key)
+			preds = append(preds, func(doc *birch.Document) bool { return pred(resolve(doc, path)) })
+		}
+	}
+
+	return func(doc *birch.Document) bool {
+		for _, pred := range preds {
+			if !pred(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileLogical(op string, val *birch.Value) (docPredicate, error) {
+	arr, ok := val.MutableArrayOK()
+	if !ok || arr.Len() == 0 {
+		return nil, invalidf("%s must be a non-empty array", op)
+	}
+
+	preds := make([]docPredicate, 0, arr.Len())
+	for item := range arr.Iterator() {
+		doc, ok := item.MutableDocumentOK()
+		if !ok {
+			return nil, invalidf("%s must contain only documents", op)
+		}
+		pred, err := compileQuery(doc)
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+
+	switch op {
+	case "$and":
+		return func(doc *birch.Document) bool {
+			for _, pred := range preds {
+				if !pred(doc) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case "$or":
+		return func(doc *birch.Document) bool {
+			for _, pred := range preds {
+				if pred(doc) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	default:
+		return func(doc *birch.Document) bool {
+			for _, pred := range preds {
+				if pred(doc) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	}
+}
+
+// isOperatorDocument reports whether a document contains query
+// operators, rather than being a literal value for equality.
+func isOperatorDocument(doc *birch.Document) bool {
+	return doc.Len() > 0 && strings.HasPrefix(doc.ElementAt(0).Key(), "$")
+}
+
+// compileCondition compiles the value associated with a field in a
+// filter, which is either a document of operators, a regular
+// expression, or a value to compare for equality.
+func compileCondition(val *birch.Value) (fieldPredicate, error) {
+	if doc, ok := val.MutableDocumentOK(); ok && isOperatorDocument(doc) {
+		return compileOperators(doc)
+	}
+
+	if val.Type() == bsontype.Regex {
+		pattern, options := val.Regex()
+		return compileRegex(pattern, options)
+	}
+
+	return eqPredicate(val), nil
+}
+
+func compileOperators(doc *birch.Document) (fieldPredicate, error) {
+	preds := make([]fieldPredicate, 0, doc.Len())
+
+	for elem := range doc.Iterator() {
+		op, operand := elem.Key(), elem.Value()
+
+		var (
+			pred fieldPredicate
+			err  error
+		)
+
+		switch op {
+		case "$eq":
+			pred = eqPredicate(operand)
+		case "$ne":
+			pred = not(eqPredicate(operand))
+		case "$gt":
+			pred = cmpPredicate(operand, false, func(c int) bool { return c > 0 })
+		case "$gte":
+			pred = cmpPredicate(operand, true, func(c int) bool { return c >= 0 })
+		case "$lt":
+			pred = cmpPredicate(operand, false, func(c int) bool { return c < 0 })
+		case "$lte":
+			pred = cmpPredicate(operand, true, func(c int) bool { return c <= 0 })
+		case "$in":
+			pred, err = inPredicate(operand)
+		case "$nin":
+			pred, err = inPredicate(operand)
+			pred = not(pred)
+		case "$exists":
+			pred = existsPredicate(truthy(operand))
+		case "$type":
+			pred, err = typePredicate(operand)
+		case "$regex":
+			pred, err = regexOperator(operand, doc.Lookup("$options"))
+		case "$options":
+			if doc.Lookup("$regex") == nil {
+				return nil, invalidf("$options requires $regex")
+			}
+			continue
+		case "$not":
+			pred, err = notPredicate(operand)
+		case "$elemMatch":
+			pred, err = elemMatchPredicate(operand)
+		case "$size":
+			pred, err = sizePredicate(operand)
+		case "$all":
+			pred, err = allPredicate(operand)
+		default:
+			return nil, invalidf("unsupported operator %q", op)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+
+	return func(values []*birch.Value) bool {
+		for _, pred := range preds {
+			if !pred(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// anyValue reports whether the function is true for any of the values
+// or, for arrays, any of their elements.
+func anyValue(values []*birch.Value, fn func(*birch.Value) bool) bool {
+	for _, val := range values {
+		if fn(val) {
+			return true
+		}
+
+		if arr, ok := val.MutableArrayOK(); ok {
+			for item := range arr.Iterator() {
+				if fn(item) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func not(pred fieldPredicate) fieldPredicate {
+	return func(values []*birch.Value) bool { return !pred(values) }
+}
+
+func isNull(val *birch.Value) bool {
+	return val.Type() == bsontype.Null || val.Type() == bsontype.Undefined
+}
+
+func truthy(val *birch.Value) bool {
+	switch val.Type() {
+	case bsontype.Boolean:
+		return val.Boolean()
+	case bsontype.Null, bsontype.Undefined:
+		return false
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		return floatValue(val) != 0
+	default:
+		return true
+	}
+}
+
+func eqPredicate(operand *birch.Value) fieldPredicate {
+	if isNull(operand) {
+		// null matches both null values and missing fields
+		return func(values []*birch.Value) bool {
+			return len(values) == 0 || anyValue(values, isNull)
+		}
+	}
+
+	return func(values []*birch.Value) bool {
+		return anyValue(values, func(val *birch.Value) bool { return Equal(val, operand) })
+	}
+}
+
+func cmpPredicate(operand *birch.Value, inclusive bool, test func(int) bool) fieldPredicate {
+	if inclusive && isNull(operand) {
+		return eqPredicate(operand)
+	}
+
+	// MinKey and MaxKey compare with values of every type.
+	anyType := operand.Type() == bsontype.MinKey || operand.Type() == bsontype.MaxKey
+
+	return func(values []*birch.Value) bool {
+		return anyValue(values, func(val *birch.Value) bool {
+			return (anyType || sameBracket(val, operand)) && test(Compare(val, operand))
+		})
+	}
+}
+
+func inPredicate(operand *birch.Value) (fieldPredicate, error) {
+	arr, ok := operand.MutableArrayOK()
+	if !ok {
+		return nil, invalidf("$in and $nin require an array")
+	}
+
+	preds := make([]fieldPredicate, 0, arr.Len())
+	for item := range arr.Iterator() {
+		if item.Type() == bsontype.Regex {
+			pattern, options := item.Regex()
+			pred, err := compileRegex(pattern, options)
+			if err != nil {
+				return nil, err
+			}
+			preds = append(preds, pred)
+			continue
+		}
+		preds = append(preds, eqPredicate(item))
+	}
+
+	return func(values []*birch.Value) bool {
+		for _, pred := range preds {
+			if pred(values) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func existsPredicate(exists bool) fieldPredicate {
+	return func(values []*birch.Value) bool { return (len(values) > 0) == exists }
+}
+
+var typeAliases = map[string][]bsontype.Type{
+	"double":              {bsontype.Double},
+	"string":              {bsontype.String},
+	"object":              {bsontype.EmbeddedDocument},
+	"array":               {bsontype.Array},
+	"binData":             {bsontype.Binary},
+	"undefined":           {bsontype.Undefined},
+	"objectId":            {bsontype.ObjectID},
+	"bool":                {bsontype.Boolean},
+	"date":                {bsontype.DateTime},
+	"null":                {bsontype.Null},
+	"regex":               {bsontype.Regex},
+	"dbPointer":           {bsontype.DBPointer},
+	"javascript":          {bsontype.JavaScript},
+	"symbol":              {bsontype.Symbol},
+	"javascriptWithScope": {bsontype.CodeWithScope},
+	"int":                 {bsontype.Int32},
+	"timestamp":           {bsontype.Timestamp},
+	"long":                {bsontype.Int64},
+	"decimal":             {bsontype.Decimal128},
+	"minKey":              {bsontype.MinKey},
+	"maxKey":              {bsontype.MaxKey},
+	"number":              {bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128},
+}
+
+// typeNames maps each type to its alias, and is derived from the
+// aliases that name a single type.
+var typeNames = func() map[bsontype.Type]string {
+	names := make(map[bsontype.Type]string, len(typeAliases))
+	for name, types := range typeAliases {
+		if len(types) == 1 {
+			names[types[0]] = name
+		}
+	}
+	return names
+}()
+
+// TypeAlias returns the types that a $type alias, such as "int" or
+// "number", names, and false if the alias is unknown.
+func TypeAlias(alias string) ([]bsontype.Type, bool) {
+	types, ok := typeAliases[alias]
+	return slices.Clone(types), ok
+}
+
+// TypeName returns the $type alias of the type, as reported by the
+// $type aggregation operator, and false if the type has no alias.
+func TypeName(t bsontype.Type) (string, bool) {
+	name, ok := typeNames[t]
+	return name, ok
+}
+
+func typePredicate(operand *birch.Value) (fieldPredicate, error) {
+	var specs []*birch.Value
+	if arr, ok := operand.MutableArrayOK(); ok {
+		for item := range arr.Iterator() {
+			specs = append(specs, item)
+		}
+	} else {
+		specs = append(specs, operand)
+	}
+
+	types := map[bsontype.Type]bool{}
+	for _, spec := range specs {
+		if alias, ok := spec.StringValueOK(); ok {
+			matches, ok := typeAliases[alias]
+			if !ok {
+				return nil, invalidf("unknown type alias %q", alias)
+			}
+			for _, t := range matches {
+				types[t] = true
+			}
+			continue
+		}
+
+		code, ok := asInt(spec)
+		switch {
+		case !ok:
+			return nil, invalidf("$type requires a type alias or number")
+		case code == -1:
+			types[bsontype.MinKey] = true
+		case code >= 1 && code <= 19, code == 127:
+			types[bsontype.Type(code)] = true
+		default:
+			return nil, invalidf("invalid type code %d", code)
+		}
+	}
+
+	return func(values []*birch.Value) bool {
+		return anyValue(values, func(val *birch.Value) bool { return types[val.Type()] })
+	}, nil
+}
+
+func regexOperator(pattern, options *birch.Value) (fieldPredicate, error) {
+	var expr, opts string
+
+	switch pattern.Type() {
+	case bsontype.String:
+		expr = pattern.StringValue()
+	case bsontype.Regex:
+		expr, opts = pattern.Regex()
+	default:
+		return nil, invalidf("$regex requires a string or regular expression")
+	}
+
+	if options != nil {
+		var ok bool
+		if opts, ok = options.StringValueOK(); !ok {
+			return nil, invalidf("$options requires a string")
+		}
+	}
+
+	return compileRegex(expr, opts)
+}
+
+// compileRegex builds a predicate that matches string values against
+// the pattern, as well as regular expression values that are
+// identical to the pattern.
+func compileRegex(pattern, options string) (fieldPredicate, error) {
+	var flags strings.Builder
+	for _, opt := range options {
+		switch opt {
+		case 'i', 'm', 's':
+			flags.WriteRune(opt)
+		default:
+			return nil, invalidf("unsupported regular expression option %q", opt)
+		}
+	}
+
+	expr := pattern
+	if flags.Len() > 0 {
+		expr = "(?" + flags.String() + ")" + pattern
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidFilter, err)
+	}
+
+	return func(values []*birch.Value) bool {
+		return anyValue(values, func(val *birch.Value) bool {
+			switch val.Type() {
+			case bsontype.String, bsontype.Symbol:
+				return re.MatchString(stringValue(val))
+			case bsontype.Regex:
+				p, o := val.Regex()
+				return p == pattern && o == options
+			default:
+				return false
+			}
+		})
+	}, nil
+}
+
+func notPredicate(operand *birch.Value) (fieldPredicate, error) {
+	var (
+		pred fieldPredicate
+		err  error
+	)
+
+	switch operand.Type() {
+	case bsontype.Regex:
+		pattern, options := operand.Regex()
+		pred, err = compileRegex(pattern, options)
+	case bsontype.EmbeddedDocument:
+		doc := operand.MutableDocument()
+		if !isOperatorDocument(doc) {
+			return nil, invalidf("$not requires a document of operators")
+		}
+		pred, err = compileOperators(doc)
+	default:
+		return nil, invalidf("$not requires a regular expression or a document")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return not(pred), nil
+}
+
+func elemMatchPredicate(operand *birch.Value) (fieldPredicate, error) {
+	if operand.Type() != bsontype.EmbeddedDocument {
+		return nil, invalidf("$elemMatch requires a document")
+	}
+
+	match, err := compileElement(operand)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(values []*birch.Value) bool {
+		for _, val := range values {
+			arr, ok := val.MutableArrayOK()
+			if !ok {
+				continue
+			}
+			for item := range arr.Iterator() {
+				if match(item) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// compileElement compiles a condition for a single array element:
+// documents of operators apply to the element itself, other documents
+// are queries against embedded documents, and any other value is
+// compared with the element for equality.
+func compileElement(cond *birch.Value) (func(*birch.Value) bool, error) {
+	if doc, ok := cond.MutableDocumentOK(); ok && !isOperatorDocument(doc) {
+		pred, err := compileQuery(doc)
+		if err != nil {
+			return nil, err
+		}
+		return func(item *birch.Value) bool {
+			sub, ok := item.MutableDocumentOK()
+			return ok && pred(sub)
+		}, nil
+	}
+
+	pred, err := compileCondition(cond)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(item *birch.Value) bool { return pred([]*birch.Value{item}) }, nil
+}
+
+func sizePredicate(operand *birch.Value) (fieldPredicate, error) {
+	size, ok := asInt(operand)
+	if !ok || size < 0 {
+		return nil, invalidf("$size requires a non-negative integer")
+	}
+
+	return func(values []*birch.Value) bool {
+		for _, val := range values {
+			if arr, ok := val.MutableArrayOK(); ok && int64(arr.Len()) == size {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func allPredicate(operand *birch.Value) (fieldPredicate, error) {
+	arr, ok := operand.MutableArrayOK()
+	if !ok {
+		return nil, invalidf("$all requires an array")
+	}
+
+	preds := make([]fieldPredicate, 0, arr.Len())
+	for item := range arr.Iterator() {
+		if doc, ok := item.MutableDocumentOK(); ok && isOperatorDocument(doc) {
+			if doc.ElementAt(0).Key() != "$elemMatch" || doc.Len() != 1 {
+				return nil, invalidf("$all only supports $elemMatch operators")
+			}
+			pred, err := elemMatchPredicate(doc.ElementAt(0).Value())
+			if err != nil {
+				return nil, err
+			}
+			preds = append(preds, pred)
+			continue
+		}
+
+		pred, err := compileCondition(item)
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+
+	return func(values []*birch.Value) bool {
+		if len(preds) == 0 {
+			return false
+		}
+		for _, pred := range preds {
+			if !pred(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// asInt converts numeric values with integral values to an int64.
+func asInt(val *birch.Value) (int64, bool) {
+	if num, ok := intValue(val); ok {
+		return num, true
+	}
+
+	switch val.Type() {
+	case bsontype.Double, bsontype.Decimal128:
+		f := floatValue(val)
+		if f != float64(int64(f)) {
+			return 0, false
+		}
+		return int64(f), true
+	default:
+		return 0, false
+	}
+}
+
+// resolve returns the values at the path in the document. Arrays
+// along the path contribute the element at numeric keys, as well as
+// the values found in each of their embedded documents.
+func resolve(doc *birch.Document, path birch.Path) []*birch.Value {
+	return resolveDocument(doc, path, nil)
+}
+
+func resolveDocument(doc *birch.Document, path birch.Path, out []*birch.Value) []*birch.Value {
+	elem := doc.LookupElement(path[0])
+	if elem == nil {
+		return out
+	}
+
+	return resolveValue(elem.Value(), path[1:], out)
+}
+
+func resolveValue(val *birch.Value, path birch.Path, out []*birch.Value) []*birch.Value {
+	if len(path) == 0 {
+		return append(out, val)
+	}
+
+	switch val.Type() {
+	case bsontype.EmbeddedDocument:
+		return resolveDocument(val.MutableDocument(), path, out)
+	case bsontype.Array:
+		arr := val.MutableArray()
+		if idx, err := strconv.ParseUint(path[0], 10, 0); err == nil {
+			if item, err := arr.Lookup(uint(idx)); err == nil {
+				out = resolveValue(item, path[1:], out)
+			}
+		}
+		for item := range arr.Iterator() {
+			if sub, ok := item.MutableDocumentOK(); ok {
+				out = resolveDocument(sub, path, out)
+			}
+		}
+		return out
+	default:
+		return out
+	}
+}
@@ -0,0 +1,361 @@
+package match
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/internal/birchtest"
+)
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		filter  string
+		matches []string
+		misses  []string
+	}{
+		{
+			name:    "Empty",
+			filter:  `{}`,
+			matches: []string{`{}`, `{"a":1}`},
+		},
+		{
+			name:    "ImplicitEq",
+			filter:  `{"a":1}`,
+			matches: []string{`{"a":1}`, `{"a":1.0}`, `{"a":[2,1]}`},
+			misses:  []string{`{"a":2}`, `{"a":"1"}`, `{}`},
+		},
+		{
+			name:    "EqDocument",
+			filter:  `{"a":{"b":1}}`,
+			matches: []string{`{"a":{"b":1}}`, `{"a":[{"b":1}]}`},
+			misses:  []string{`{"a":{"b":1,"c":2}}`},
+		},
+		{
+			name:    "EqArray",
+			filter:  `{"a":[1,2]}`,
+			matches: []string{`{"a":[1,2]}`, `{"a":[[1,2],3]}`},
+			misses:  []string{`{"a":[2,1]}`, `{"a":1}`},
+		},
+		{
+			name:    "EqNull",
+			filter:  `{"a":null}`,
+			matches: []string{`{"a":null}`, `{}`, `{"a":[1,null]}`},
+			misses:  []string{`{"a":1}`},
+		},
+		{
+			name:    "Ne",
+			filter:  `{"a":{"$ne":1}}`,
+			matches: []string{`{"a":2}`, `{}`},
+			misses:  []string{`{"a":1}`, `{"a":[1,2]}`},
+		},
+		{
+			name:    "Gt",
+			filter:  `{"a":{"$gt":1}}`,
+			matches: []string{`{"a":2}`, `{"a":1.5}`, `{"a":[0,3]}`},
+			misses:  []string{`{"a":1}`, `{"a":"2"}`, `{}`},
+		},
+		{
+			name:    "Range",
+			filter:  `{"a":{"$gte":1,"$lt":3}}`,
+			matches: []string{`{"a":1}`, `{"a":2}`, `{"a":[0,4,2]}`},
+			misses:  []string{`{"a":3}`, `{"a":0}`},
+		},
+		{
+			name:    "RangeAcrossElements",
+			filter:  `{"a":{"$gt":1,"$lt":3}}`,
+			matches: []string{`{"a":[0,4]}`},
+		},
+		{
+			name:    "Lte",
+			filter:  `{"a":{"$lte":"b"}}`,
+			matches: []string{`{"a":"a"}`, `{"a":"b"}`},
+			misses:  []string{`{"a":"c"}`, `{"a":1}`},
+		},
+		{
+			name:    "GtMinKey",
+			filter:  `{"a":{"$gt":{"$minKey":1}}}`,
+			matches: []string{`{"a":1}`, `{"a":"x"}`, `{"a":null}`},
+			misses:  []string{`{}`},
+		},
+		{
+			name:    "In",
+			filter:  `{"a":{"$in":[1,"x",null]}}`,
+			matches: []string{`{"a":1}`, `{"a":"x"}`, `{}`, `{"a":[5,1]}`},
+			misses:  []string{`{"a":2}`},
+		},
+		{
+			name:    "InRegex",
+			filter:  `{"a":{"$in":[{"$regularExpression":{"pattern":"^ab","options":""}}]}}`,
+			matches: []string{`{"a":"abc"}`},
+			misses:  []string{`{"a":"cab"}`},
+		},
+		{
+			name:    "Nin",
+			filter:  `{"a":{"$nin":[1,2]}}`,
+			matches: []string{`{"a":3}`, `{}`},
+			misses:  []string{`{"a":1}`, `{"a":[3,2]}`},
+		},
+		{
+			name:    "Exists",
+			filter:  `{"a.b":{"$exists":true}}`,
+			matches: []string{`{"a":{"b":null}}`, `{"a":[{"c":1},{"b":1}]}`},
+			misses:  []string{`{"a":{"c":1}}`, `{"a":1}`},
+		},
+		{
+			name:    "NotExists",
+			filter:  `{"a":{"$exists":false}}`,
+			matches: []string{`{"b":1}`},
+			misses:  []string{`{"a":null}`},
+		},
+		{
+			name:    "TypeAlias",
+			filter:  `{"a":{"$type":"string"}}`,
+			matches: []string{`{"a":"x"}`, `{"a":[1,"x"]}`},
+			misses:  []string{`{"a":1}`},
+		},
+		{
+			name:    "TypeNumber",
+			filter:  `{"a":{"$type":["number","null"]}}`,
+			matches: []string{`{"a":1}`, `{"a":1.5}`, `{"a":null}`},
+			misses:  []string{`{"a":"x"}`},
+		},
+		{
+			name:    "TypeCode",
+			filter:  `{"a":{"$type":4}}`,
+			matches: []string{`{"a":[]}`},
+			misses:  []string{`{"a":{}}`},
+		},
+		{
+			name:    "Regex",
+			filter:  `{"a":{"$regex":"^AB","$options":"i"}}`,
+			matches: []string{`{"a":"abc"}`, `{"a":["x","Abc"]}`},
+			misses:  []string{`{"a":"cab"}`, `{"a":1}`},
+		},
+		{
+			name:    "RegexValue",
+			filter:  `{"a":{"$regularExpression":{"pattern":"b$","options":""}}}`,
+			matches: []string{`{"a":"ab"}`},
+			misses:  []string{`{"a":"ba"}`},
+		},
+		{
+			name:    "Not",
+			filter:  `{"a":{"$not":{"$gt":1}}}`,
+			matches: []string{`{"a":1}`, `{}`, `{"a":"x"}`},
+			misses:  []string{`{"a":2}`, `{"a":[0,2]}`},
+		},
+		{
+			name:    "NotRegex",
+			filter:  `{"a":{"$not":{"$regularExpression":{"pattern":"^a","options":""}}}}`,
+			matches: []string{`{"a":"ba"}`},
+			misses:  []string{`{"a":"ab"}`},
+		},
+		{
+			name:    "And",
+			filter:  `{"$and":[{"a":1},{"b":2}]}`,
+			matches: []string{`{"a":1,"b":2}`},
+			misses:  []string{`{"a":1}`, `{"b":2}`},
+		},
+		{
+			name:    "Or",
+			filter:  `{"$or":[{"a":1},{"b":2}]}`,
+			matches: []string{`{"a":1}`, `{"b":2}`},
+			misses:  []string{`{"a":2,"b":1}`},
+		},
+		{
+			name:    "Nor",
+			filter:  `{"$nor":[{"a":1},{"b":2}]}`,
+			matches: []string{`{"a":2,"b":1}`, `{}`},
+			misses:  []string{`{"a":1}`, `{"b":2}`},
+		},
+		{
+			name:    "ElemMatchQuery",
+			filter:  `{"a":{"$elemMatch":{"b":1,"c":{"$gt":1}}}}`,
+			matches: []string{`{"a":[{"b":1,"c":2}]}`},
+			misses:  []string{`{"a":[{"b":1,"c":1},{"b":2,"c":2}]}`, `{"a":{"b":1,"c":2}}`},
+		},
+		{
+			name:    "ElemMatchOperators",
+			filter:  `{"a":{"$elemMatch":{"$gt":1,"$lt":3}}}`,
+			matches: []string{`{"a":[0,2]}`},
+			misses:  []string{`{"a":[0,4]}`, `{"a":2}`},
+		},
+		{
+			name:    "Size",
+			filter:  `{"a":{"$size":2}}`,
+			matches: []string{`{"a":[1,2]}`},
+			misses:  []string{`{"a":[1]}`, `{"a":2}`, `{}`},
+		},
+		{
+			name:    "All",
+			filter:  `{"a":{"$all":[1,2]}}`,
+			matches: []string{`{"a":[2,3,1]}`},
+			misses:  []string{`{"a":[1,3]}`, `{"a":1}`},
+		},
+		{
+			name:   "AllEmpty",
+			filter: `{"a":{"$all":[]}}`,
+			misses: []string{`{"a":[]}`, `{"a":[1]}`},
+		},
+		{
+			name:    "AllElemMatch",
+			filter:  `{"a":{"$all":[{"$elemMatch":{"b":1}},{"$elemMatch":{"b":2}}]}}`,
+			matches: []string{`{"a":[{"b":2},{"b":1}]}`},
+			misses:  []string{`{"a":[{"b":1}]}`},
+		},
+		{
+			name:    "DottedArrayTraversal",
+			filter:  `{"a.b.c":1}`,
+			matches: []string{`{"a":[{"b":{"c":1}}]}`, `{"a":[{"b":[{"c":2},{"c":1}]}]}`, `{"a":{"b":{"c":[1]}}}`},
+			misses:  []string{`{"a":[{"b":{"c":2}}]}`},
+		},
+		{
+			name:    "ArrayIndex",
+			filter:  `{"a.1":2}`,
+			matches: []string{`{"a":[1,2]}`, `{"a":{"1":2}}`},
+			misses:  []string{`{"a":[2,1]}`},
+		},
+		{
+			name:    "ArrayIndexDocument",
+			filter:  `{"a.0.b":1}`,
+			matches: []string{`{"a":[{"b":1}]}`},
+			misses:  []string{`{"a":[{"b":2},{"b":1}]}`},
+		},
+		{
+			name:    "Comment",
+			filter:  `{"$comment":"ignored","a":1}`,
+			matches: []string{`{"a":1}`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := Compile(birchtest.Document(t, tc.filter))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, in := range tc.matches {
+				if !m.Match(birchtest.Document(t, in)) {
+					t.Errorf("%s should match %s", tc.filter, in)
+				}
+			}
+			for _, in := range tc.misses {
+				if m.Match(birchtest.Document(t, in)) {
+					t.Errorf("%s should not match %s", tc.filter, in)
+				}
+			}
+		})
+	}
+	t.Run("Reader", func(t *testing.T) {
+		m, err := Compile(birchtest.Document(t, `{"a.b":{"$in":[1,2]}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := birchtest.Document(t, `{"a":{"b":2}}`).MarshalBSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := m.MatchReader(birch.Reader(data)); err != nil || !ok {
+			t.Errorf("unexpected result %t, %v", ok, err)
+		}
+		if _, err := m.MatchReader(birch.Reader(data[:4])); err == nil {
+			t.Error("expected error for invalid reader")
+		}
+	})
+	t.Run("Element", func(t *testing.T) {
+		for _, tc := range []struct {
+			cond    string
+			matches []*birch.Value
+			misses  []*birch.Value
+		}{
+			{
+				cond:    `{"c":2}`,
+				matches: []*birch.Value{birch.VC.Int32(2), birch.VC.Double(2)},
+				misses:  []*birch.Value{birch.VC.Int32(3), birch.VC.String("2")},
+			},
+			{
+				cond:    `{"c":{"$gt":1,"$lt":3}}`,
+				matches: []*birch.Value{birch.VC.Int32(2)},
+				misses:  []*birch.Value{birch.VC.Int32(3), nil},
+			},
+			{
+				cond:    `{"c":{"a":1}}`,
+				matches: []*birch.Value{birch.VC.DocumentFromElements(birch.EC.Int32("a", 1), birch.EC.Int32("b", 2))},
+				misses:  []*birch.Value{birch.VC.DocumentFromElements(birch.EC.Int32("b", 2)), birch.VC.Int32(1)},
+			},
+		} {
+			m, err := CompileElement(birchtest.Document(t, tc.cond).Lookup("c"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, val := range tc.matches {
+				if !m.Match(val) {
+					t.Errorf("%s should match %v", tc.cond, val.Interface())
+				}
+			}
+			for _, val := range tc.misses {
+				if m.Match(val) {
+					t.Errorf("%s should not match %v", tc.cond, val)
+				}
+			}
+		}
+		if _, err := CompileElement(nil); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("Nil", func(t *testing.T) {
+		m, err := Compile(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.Match(birch.DC.New()) || m.Match(nil) {
+			t.Error("unexpected result for nil filter or document")
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		for _, filter := range []string{
+			`{"$where":"true"}`,
+			`{"$and":[]}`,
+			`{"$or":[1]}`,
+			`{"a":{"$unknown":1}}`,
+			`{"a":{"$in":1}}`,
+			`{"a":{"$type":"unknown"}}`,
+			`{"a":{"$type":42}}`,
+			`{"a":{"$regex":"("}}`,
+			`{"a":{"$regex":"a","$options":"x"}}`,
+			`{"a":{"$options":"i"}}`,
+			`{"a":{"$not":1}}`,
+			`{"a":{"$not":{"b":1}}}`,
+			`{"a":{"$elemMatch":1}}`,
+			`{"a":{"$size":-1}}`,
+			`{"a":{"$size":1.5}}`,
+			`{"a":{"$all":[{"$gt":1}]}}`,
+			`{"$or":[{"a":{"$bad":1}}]}`,
+		} {
+			if _, err := Compile(birchtest.Document(t, filter)); !errors.Is(err, ErrInvalidFilter) {
+				t.Errorf("%s: expected invalid filter error, got %v", filter, err)
+			}
+		}
+	})
+	t.Run("TypeAlias", func(t *testing.T) {
+		for alias, types := range typeAliases {
+			got, ok := TypeAlias(alias)
+			if !ok || len(got) != len(types) {
+				t.Errorf("%s: expected %v, got %v", alias, types, got)
+			}
+			if len(types) != 1 {
+				continue
+			}
+			if name, ok := TypeName(types[0]); !ok || name != alias {
+				t.Errorf("%s: expected the name of %s to be the alias, got %q", alias, types[0], name)
+			}
+		}
+		if _, ok := TypeAlias("unknown"); ok {
+			t.Error("expected unknown alias to be missing")
+		}
+		if name, ok := TypeName(bsontype.Type(0)); ok {
+			t.Errorf("expected invalid type to have no name, got %q", name)
+		}
+	})
+}
@@ -0,0 +1,717 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/match"
+)
+
+// expression is a compiled aggregation expression. Expressions return
+// a nil value when they evaluate to a missing field.
+type expression func(*birch.Document) (*birch.Value, error)
+
+// compileExpression compiles an aggregation expression: strings that
+// begin with "$" are field paths, "$$ROOT" and "$$CURRENT" are the
+// input document, documents with a single "$"-prefixed key are
+// operators, other documents and arrays are evaluated element-wise,
+// and all other values are literals.
+func compileExpression(val *birch.Value) (expression, error) {
+	switch val.Type() {
+	case bsontype.String:
+		str := val.StringValue()
+		switch {
+		case str == "$$ROOT" || str == "$$CURRENT":
+			return func(doc *birch.Document) (*birch.Value, error) { return birch.VC.Document(doc), nil }, nil
+		case strings.HasPrefix(str, "$$"):
+			return nil, invalidf("unsupported variable %q", str)
+		case strings.HasPrefix(str, "$"):
+			path, err := parseFieldPath(str[1:])
+			if err != nil {
+				return nil, err
+			}
+			return func(doc *birch.Document) (*birch.Value, error) { return resolveField(doc, path), nil }, nil
+		}
+	case bsontype.EmbeddedDocument:
+		doc := val.MutableDocument()
+		if doc.Len() > 0 && strings.HasPrefix(doc.ElementAt(0).Key(), "$") {
+			if doc.Len() != 1 {
+				return nil, invalidf("an expression operator must be the only field in its document")
+			}
+			return compileOperator(doc.ElementAt(0).Key(), doc.ElementAt(0).Value())
+		}
+		return compileObject(doc)
+	case bsontype.Array:
+		exprs, err := compileList(val)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc *birch.Document) (*birch.Value, error) {
+			values, err := evaluateAll(doc, exprs)
+			if err != nil {
+				return nil, err
+			}
+			for idx := range values {
+				if values[idx] == nil {
+					values[idx] = birch.VC.Null()
+				}
+			}
+			return birch.VC.ArrayFromValues(values...), nil
+		}, nil
+	}
+
+	return literal(val), nil
+}
+
+func literal(val *birch.Value) expression {
+	return func(*birch.Document) (*birch.Value, error) { return val, nil }
+}
+
+func compileObject(spec *birch.Document) (expression, error) {
+	type field struct {
+		key  string
+		expr expression
+	}
+
+	fields := make([]field, 0, spec.Len())
+	for elem := range spec.Iterator() {
+		if strings.HasPrefix(elem.Key(), "$") || strings.Contains(elem.Key(), ".") {
+			return nil, invalidf("invalid field name %q in an object expression", elem.Key())
+		}
+		expr, err := compileExpression(elem.Value())
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field{key: elem.Key(), expr: expr})
+	}
+
+	return func(doc *birch.Document) (*birch.Value, error) {
+		out := birch.DC.Make(len(fields))
+		for _, f := range fields {
+			val, err := f.expr(doc)
+			if err != nil {
+				return nil, err
+			}
+			if val != nil {
+				out.Append(birch.EC.Value(f.key, val))
+			}
+		}
+		return birch.VC.Document(out), nil
+	}, nil
+}
+
+// compileList compiles the elements of an array of expressions.
+func compileList(val *birch.Value) ([]expression, error) {
+	arr := val.MutableArray()
+	exprs := make([]expression, 0, arr.Len())
+	for item := range arr.Iterator() {
+		expr, err := compileExpression(item)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	return exprs, nil
+}
+
+// compileArgs compiles the arguments of an operator, which are either
+// an array of expressions or a single expression, and checks the
+// number of arguments. A negative max means there is no limit.
+func compileArgs(op string, val *birch.Value, minArgs, maxArgs int) ([]expression, error) {
+	var (
+		exprs []expression
+		err   error
+	)
+
+	if val.Type() == bsontype.Array {
+		exprs, err = compileList(val)
+	} else {
+		var expr expression
+		expr, err = compileExpression(val)
+		exprs = []expression{expr}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(exprs) < minArgs || (maxArgs >= 0 && len(exprs) > maxArgs) {
+		if minArgs == maxArgs {
+			return nil, invalidf("%s requires %d arguments", op, minArgs)
+		}
+		return nil, invalidf("%s requires at least %d arguments", op, minArgs)
+	}
+
+	return exprs, nil
+}
+
+func evaluateAll(doc *birch.Document, exprs []expression) ([]*birch.Value, error) {
+	values := make([]*birch.Value, len(exprs))
+	for idx, expr := range exprs {
+		val, err := expr(doc)
+		if err != nil {
+			return nil, err
+		}
+		values[idx] = val
+	}
+	return values, nil
+}
+
+type operatorFunc func(op string, args []*birch.Value) (*birch.Value, error)
+
+// operators maps expression operators that evaluate all of their
+// arguments to their implementation and their argument counts.
+var operators = map[string]struct {
+	minArgs, maxArgs int
+	fn               operatorFunc
+}{
+	"$add":         {1, -1, addOperator},
+	"$subtract":    {2, 2, subtractOperator},
+	"$multiply":    {1, -1, multiplyOperator},
+	"$divide":      {2, 2, divideOperator},
+	"$mod":         {2, 2, modOperator},
+	"$abs":         {1, 1, absOperator},
+	"$eq":          {2, 2, comparisonOperator(func(c int) bool { return c == 0 })},
+	"$ne":          {2, 2, comparisonOperator(func(c int) bool { return c != 0 })},
+	"$gt":          {2, 2, comparisonOperator(func(c int) bool { return c > 0 })},
+	"$gte":         {2, 2, comparisonOperator(func(c int) bool { return c >= 0 })},
+	"$lt":          {2, 2, comparisonOperator(func(c int) bool { return c < 0 })},
+	"$lte":         {2, 2, comparisonOperator(func(c int) bool { return c <= 0 })},
+	"$cmp":         {2, 2, cmpOperator},
+	"$not":         {1, 1, notOperator},
+	"$concat":      {0, -1, concatOperator},
+	"$toLower":     {1, 1, caseOperator(strings.ToLower)},
+	"$toUpper":     {1, 1, caseOperator(strings.ToUpper)},
+	"$size":        {1, 1, sizeOperator},
+	"$arrayElemAt": {2, 2, arrayElemAtOperator},
+	"$in":          {2, 2, inOperator},
+	"$type":        {1, 1, typeOperator},
+}
+
+func compileOperator(op string, operand *birch.Value) (expression, error) {
+	switch op {
+	case "$literal":
+		return literal(operand), nil
+	case "$and", "$or":
+		return compileLogical(op, operand)
+	case "$cond":
+		return compileCond(operand)
+	case "$ifNull":
+		return compileIfNull(operand)
+	}
+
+	impl, ok := operators[op]
+	if !ok {
+		return nil, invalidf("unsupported expression operator %q", op)
+	}
+
+	exprs, err := compileArgs(op, operand, impl.minArgs, impl.maxArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(doc *birch.Document) (*birch.Value, error) {
+		args, err := evaluateAll(doc, exprs)
+		if err != nil {
+			return nil, err
+		}
+		return impl.fn(op, args)
+	}, nil
+}
+
+func compileLogical(op string, operand *birch.Value) (expression, error) {
+	exprs, err := compileArgs(op, operand, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// $and stops at the first false value, and $or at the first true
+	// value.
+	stop := op == "$or"
+
+	return func(doc *birch.Document) (*birch.Value, error) {
+		for _, expr := range exprs {
+			val, err := expr(doc)
+			if err != nil {
+				return nil, err
+			}
+			if truthy(val) == stop {
+				return birch.VC.Boolean(stop), nil
+			}
+		}
+		return birch.VC.Boolean(!stop), nil
+	}, nil
+}
+
+func compileCond(operand *birch.Value) (expression, error) {
+	var branches []expression
+
+	if spec, ok := operand.MutableDocumentOK(); ok {
+		for _, key := range []string{"if", "then", "else"} {
+			val := spec.Lookup(key)
+			if val == nil {
+				return nil, invalidf("$cond requires %q", key)
+			}
+			expr, err := compileExpression(val)
+			if err != nil {
+				return nil, err
+			}
+			branches = append(branches, expr)
+		}
+		if spec.Len() != 3 {
+			return nil, invalidf("$cond only supports if, then, and else")
+		}
+	} else {
+		var err error
+		if branches, err = compileArgs("$cond", operand, 3, 3); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(doc *birch.Document) (*birch.Value, error) {
+		cond, err := branches[0](doc)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return branches[1](doc)
+		}
+		return branches[2](doc)
+	}, nil
+}
+
+func compileIfNull(operand *birch.Value) (expression, error) {
+	exprs, err := compileArgs("$ifNull", operand, 2, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(doc *birch.Document) (*birch.Value, error) {
+		for _, expr := range exprs[:len(exprs)-1] {
+			val, err := expr(doc)
+			if err != nil {
+				return nil, err
+			}
+			if !isNullish(val) {
+				return val, nil
+			}
+		}
+		return exprs[len(exprs)-1](doc)
+	}, nil
+}
+
+// resolveField returns the value of a field path in a document. When
+// the path traverses an array, the result is an array of the values
+// found in each of its elements, as in MongoDB.
+func resolveField(doc *birch.Document, path birch.Path) *birch.Value {
+	elem := doc.LookupElement(path[0])
+	if elem == nil {
+		return nil
+	}
+
+	return resolveValue(elem.Value(), path[1:])
+}
+
+func resolveValue(val *birch.Value, path birch.Path) *birch.Value {
+	if len(path) == 0 {
+		return val
+	}
+
+	switch val.Type() {
+	case bsontype.EmbeddedDocument:
+		return resolveField(val.MutableDocument(), path)
+	case bsontype.Array:
+		var out []*birch.Value
+		for item := range val.MutableArray().Iterator() {
+			if item.Type() != bsontype.EmbeddedDocument && item.Type() != bsontype.Array {
+				continue
+			}
+			if res := resolveValue(item, path); res != nil {
+				out = append(out, res)
+			}
+		}
+		return birch.VC.ArrayFromValues(out...)
+	default:
+		return nil
+	}
+}
+
+func parseFieldPath(str string) (birch.Path, error) {
+	path := birch.ParsePath(str)
+	if len(path) == 0 {
+		return nil, invalidf("empty field path")
+	}
+	for _, key := range path {
+		if key == "" || strings.HasPrefix(key, "$") {
+			return nil, invalidf("invalid field path %q", str)
+		}
+	}
+	return path, nil
+}
+
+func isNullish(val *birch.Value) bool {
+	return val == nil || val.Type() == bsontype.Null || val.Type() == bsontype.Undefined
+}
+
+// truthy reports whether a value is true in a boolean context: false,
+// null, missing values, and zero are false, and everything else is true.
+func truthy(val *birch.Value) bool {
+	if isNullish(val) {
+		return false
+	}
+
+	switch val.Type() {
+	case bsontype.Boolean:
+		return val.Boolean()
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		f, _ := toFloat(val)
+		return f != 0
+	default:
+		return true
+	}
+}
+
+func isNumber(val *birch.Value) bool {
+	switch val.Type() {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double:
+		return true
+	default:
+		return false
+	}
+}
+
+func toFloat(val *birch.Value) (float64, bool) {
+	switch val.Type() {
+	case bsontype.Int32:
+		return float64(val.Int32()), true
+	case bsontype.Int64:
+		return float64(val.Int64()), true
+	case bsontype.Double:
+		return val.Double(), true
+	default:
+		return 0, false
+	}
+}
+
+func toInt(val *birch.Value) (int64, bool) {
+	switch val.Type() {
+	case bsontype.Int32:
+		return int64(val.Int32()), true
+	case bsontype.Int64:
+		return val.Int64(), true
+	case bsontype.Double:
+		f := val.Double()
+		if f != math.Trunc(f) || math.Abs(f) > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(f), true
+	default:
+		return 0, false
+	}
+}
+
+func typeErrorf(op string, val *birch.Value, expected string) error {
+	return fmt.Errorf("%w: %s requires %s, not %s", ErrTypeMismatch, op, expected, val.Type())
+}
+
+// number holds an intermediate result of an arithmetic operation,
+// which is an int32, int64, or double value.
+type number struct {
+	typ bsontype.Type
+	i   int64
+	f   float64
+}
+
+func newNumber(val *birch.Value) number {
+	switch val.Type() {
+	case bsontype.Int32:
+		return number{typ: bsontype.Int32, i: int64(val.Int32())}
+	case bsontype.Int64:
+		return number{typ: bsontype.Int64, i: val.Int64()}
+	default:
+		return number{typ: bsontype.Double, f: val.Double()}
+	}
+}
+
+func (n number) float() float64 {
+	if n.typ == bsontype.Double {
+		return n.f
+	}
+	return float64(n.i)
+}
+
+// combine applies an operation to two numbers with the type of the
+// widest operand, promoting int32 results that overflow to int64, and
+// int64 results that overflow to double.
+func (n number) combine(o number, ints func(a, b int64) (int64, bool), floats func(a, b float64) float64) number {
+	if n.typ == bsontype.Double || o.typ == bsontype.Double {
+		return number{typ: bsontype.Double, f: floats(n.float(), o.float())}
+	}
+
+	res, ok := ints(n.i, o.i)
+	switch {
+	case !ok:
+		return number{typ: bsontype.Double, f: floats(n.float(), o.float())}
+	case n.typ == bsontype.Int32 && o.typ == bsontype.Int32 && res >= math.MinInt32 && res <= math.MaxInt32:
+		return number{typ: bsontype.Int32, i: res}
+	default:
+		return number{typ: bsontype.Int64, i: res}
+	}
+}
+
+func (n number) value() *birch.Value {
+	switch n.typ {
+	case bsontype.Int32:
+		return birch.VC.Int32(int32(n.i))
+	case bsontype.Int64:
+		return birch.VC.Int64(n.i)
+	default:
+		return birch.VC.Double(n.f)
+	}
+}
+
+func addInts(a, b int64) (int64, bool) {
+	sum := a + b
+	return sum, (b >= 0) == (sum >= a)
+}
+
+func multiplyInts(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	product := a * b
+	return product, product/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64)
+}
+
+func addOperator(op string, args []*birch.Value) (*birch.Value, error) {
+	sum := number{typ: bsontype.Int32}
+	var date *int64
+
+	for _, arg := range args {
+		switch {
+		case isNullish(arg):
+			return birch.VC.Null(), nil
+		case arg.Type() == bsontype.DateTime:
+			if date != nil {
+				return nil, fmt.Errorf("%w: %s only supports one date", ErrTypeMismatch, op)
+			}
+			ms := arg.DateTime()
+			date = &ms
+		case isNumber(arg):
+			sum = sum.combine(newNumber(arg), addInts, func(a, b float64) float64 { return a + b })
+		default:
+			return nil, typeErrorf(op, arg, "numbers or dates")
+		}
+	}
+
+	if date != nil {
+		return birch.VC.DateTime(*date + int64(math.Round(sum.float()))), nil
+	}
+
+	return sum.value(), nil
+}
+
+func subtractOperator(op string, args []*birch.Value) (*birch.Value, error) {
+	a, b := args[0], args[1]
+
+	switch {
+	case isNullish(a) || isNullish(b):
+		return birch.VC.Null(), nil
+	case a.Type() == bsontype.DateTime && b.Type() == bsontype.DateTime:
+		return birch.VC.Int64(a.DateTime() - b.DateTime()), nil
+	case a.Type() == bsontype.DateTime && isNumber(b):
+		return birch.VC.DateTime(a.DateTime() - int64(math.Round(newNumber(b).float()))), nil
+	case isNumber(a) && isNumber(b):
+		neg := newNumber(b).combine(number{typ: bsontype.Int32, i: -1}, multiplyInts, func(a, b float64) float64 { return a * b })
+		return newNumber(a).combine(neg, addInts, func(a, b float64) float64 { return a + b }).value(), nil
+	case !isNumber(a) && a.Type() != bsontype.DateTime:
+		return nil, typeErrorf(op, a, "numbers or dates")
+	default:
+		return nil, typeErrorf(op, b, "numbers")
+	}
+}
+
+func multiplyOperator(op string, args []*birch.Value) (*birch.Value, error) {
+	product := number{typ: bsontype.Int32, i: 1}
+
+	for _, arg := range args {
+		switch {
+		case isNullish(arg):
+			return birch.VC.Null(), nil
+		case isNumber(arg):
+			product = product.combine(newNumber(arg), multiplyInts, func(a, b float64) float64 { return a * b })
+		default:
+			return nil, typeErrorf(op, arg, "numbers")
+		}
+	}
+
+	return product.value(), nil
+}
+
+func divideOperator(op string, args []*birch.Value) (*birch.Value, error) {
+	a, b, err := numericPair(op, args)
+	if a == nil || err != nil {
+		return b, err
+	}
+
+	divisor, _ := toFloat(b)
+	if divisor == 0 {
+		return nil, fmt.Errorf("%w: %s by zero", ErrInvalidValue, op)
+	}
+
+	dividend, _ := toFloat(a)
+	return birch.VC.Double(dividend / divisor), nil
+}
+
+func modOperator(op string, args []*birch.Value) (*birch.Value, error) {
+	a, b, err := numericPair(op, args)
+	if a == nil || err != nil {
+		return b, err
+	}
+
+	x, y := newNumber(a), newNumber(b)
+	if y.float() == 0 {
+		return nil, fmt.Errorf("%w: %s by zero", ErrInvalidValue, op)
+	}
+
+	return x.combine(y, func(a, b int64) (int64, bool) {
+		if b == -1 {
+			return 0, true
+		}
+		return a % b, true
+	}, math.Mod).value(), nil
+}
+
+// numericPair checks that both arguments are numbers. When either is
+// null, it returns a nil first value and a null second value.
+func numericPair(op string, args []*birch.Value) (*birch.Value, *birch.Value, error) {
+	if isNullish(args[0]) || isNullish(args[1]) {
+		return nil, birch.VC.Null(), nil
+	}
+	for _, arg := range args {
+		if !isNumber(arg) {
+			return nil, nil, typeErrorf(op, arg, "numbers")
+		}
+	}
+	return args[0], args[1], nil
+}
+
+func absOperator(op string, args []*birch.Value) (*birch.Value, error) {
+	switch arg := args[0]; {
+	case isNullish(arg):
+		return birch.VC.Null(), nil
+	case !isNumber(arg):
+		return nil, typeErrorf(op, arg, "a number")
+	case arg.Type() == bsontype.Double:
+		return birch.VC.Double(math.Abs(arg.Double())), nil
+	default:
+		n := newNumber(arg)
+		if n.i >= 0 {
+			return arg, nil
+		}
+		return n.combine(number{typ: bsontype.Int32, i: -1}, multiplyInts, func(a, b float64) float64 { return a * b }).value(), nil
+	}
+}
+
+// orNull returns a null value for missing arguments, which
+// compare as null in expressions.
+func orNull(val *birch.Value) *birch.Value {
+	if val == nil {
+		return birch.VC.Null()
+	}
+	return val
+}
+
+func comparisonOperator(test func(int) bool) operatorFunc {
+	return func(_ string, args []*birch.Value) (*birch.Value, error) {
+		return birch.VC.Boolean(test(match.Compare(orNull(args[0]), orNull(args[1])))), nil
+	}
+}
+
+func cmpOperator(_ string, args []*birch.Value) (*birch.Value, error) {
+	return birch.VC.Int32(int32(match.Compare(orNull(args[0]), orNull(args[1])))), nil
+}
+
+func notOperator(_ string, args []*birch.Value) (*birch.Value, error) {
+	return birch.VC.Boolean(!truthy(args[0])), nil
+}
+
+func concatOperator(op string, args []*birch.Value) (*birch.Value, error) {
+	var out strings.Builder
+	for _, arg := range args {
+		if isNullish(arg) {
+			return birch.VC.Null(), nil
+		}
+		str, ok := arg.StringValueOK()
+		if !ok {
+			return nil, typeErrorf(op, arg, "strings")
+		}
+		out.WriteString(str)
+	}
+	return birch.VC.String(out.String()), nil
+}
+
+func caseOperator(fn func(string) string) operatorFunc {
+	return func(op string, args []*birch.Value) (*birch.Value, error) {
+		if isNullish(args[0]) {
+			return birch.VC.String(""), nil
+		}
+		str, ok := args[0].StringValueOK()
+		if !ok {
+			return nil, typeErrorf(op, args[0], "a string")
+		}
+		return birch.VC.String(fn(str)), nil
+	}
+}
+
+func sizeOperator(op string, args []*birch.Value) (*birch.Value, error) {
+	if args[0] == nil || args[0].Type() != bsontype.Array {
+		return nil, typeErrorf(op, orNull(args[0]), "an array")
+	}
+	return birch.VC.Int32(int32(args[0].MutableArray().Len())), nil
+}
+
+func arrayElemAtOperator(op string, args []*birch.Value) (*birch.Value, error) {
+	if isNullish(args[0]) || isNullish(args[1]) {
+		return birch.VC.Null(), nil
+	}
+	if args[0].Type() != bsontype.Array {
+		return nil, typeErrorf(op, args[0], "an array")
+	}
+	idx, ok := toInt(args[1])
+	if !ok {
+		return nil, typeErrorf(op, args[1], "an integral index")
+	}
+
+	arr := args[0].MutableArray()
+	if idx < 0 {
+		idx += int64(arr.Len())
+	}
+	if idx < 0 || idx >= int64(arr.Len()) {
+		return nil, nil
+	}
+
+	return arr.Lookup(uint(idx))
+}
+
+func inOperator(op string, args []*birch.Value) (*birch.Value, error) {
+	if args[1] == nil || args[1].Type() != bsontype.Array {
+		return nil, typeErrorf(op, orNull(args[1]), "an array")
+	}
+	needle := orNull(args[0])
+	found := slices.ContainsFunc(slices.Collect(args[1].MutableArray().Iterator()), func(item *birch.Value) bool {
+		return match.Equal(item, needle)
+	})
+	return birch.VC.Boolean(found), nil
+}
+
+func typeOperator(_ string, args []*birch.Value) (*birch.Value, error) {
+	if args[0] == nil {
+		return birch.VC.String("missing"), nil
+	}
+	name, _ := match.TypeName(args[0].Type())
+	return birch.VC.String(name), nil
+}
@@ -0,0 +1,237 @@
+package pipeline
+
+import (
+	"iter"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/match"
+	"github.com/tychoish/fun/erc"
+)
+
+// accumulator collects the values of an expression for the documents
+// in a group.
+type accumulator interface {
+	add(*birch.Value)
+	result() *birch.Value
+}
+
+var accumulators = map[string]func() accumulator{
+	"$sum":   func() accumulator { return &sumAccumulator{sum: number{typ: bsontype.Int32}} },
+	"$avg":   func() accumulator { return &avgAccumulator{} },
+	"$min":   func() accumulator { return &extremeAccumulator{replace: func(c int) bool { return c < 0 }} },
+	"$max":   func() accumulator { return &extremeAccumulator{replace: func(c int) bool { return c > 0 }} },
+	"$push":  func() accumulator { return &pushAccumulator{} },
+	"$first": func() accumulator { return &firstAccumulator{} },
+	"$last":  func() accumulator { return &lastAccumulator{} },
+}
+
+// sumAccumulator adds numeric values, ignoring all other values.
+type sumAccumulator struct{ sum number }
+
+func (a *sumAccumulator) add(val *birch.Value) {
+	if val != nil && isNumber(val) {
+		a.sum = a.sum.combine(newNumber(val), addInts, func(x, y float64) float64 { return x + y })
+	}
+}
+
+func (a *sumAccumulator) result() *birch.Value { return a.sum.value() }
+
+// avgAccumulator averages numeric values, ignoring all other values,
+// and is null when there are no numeric values.
+type avgAccumulator struct {
+	sum   float64
+	count int
+}
+
+func (a *avgAccumulator) add(val *birch.Value) {
+	if f, ok := toFloat(orNull(val)); ok {
+		a.sum += f
+		a.count++
+	}
+}
+
+func (a *avgAccumulator) result() *birch.Value {
+	if a.count == 0 {
+		return birch.VC.Null()
+	}
+	return birch.VC.Double(a.sum / float64(a.count))
+}
+
+// extremeAccumulator holds the minimum or maximum value, ignoring null
+// and missing values.
+type extremeAccumulator struct {
+	value   *birch.Value
+	replace func(int) bool
+}
+
+func (a *extremeAccumulator) add(val *birch.Value) {
+	if !isNullish(val) && (a.value == nil || a.replace(match.Compare(val, a.value))) {
+		a.value = val
+	}
+}
+
+func (a *extremeAccumulator) result() *birch.Value { return orNull(a.value) }
+
+// pushAccumulator collects all values, ignoring missing values.
+type pushAccumulator struct{ values []*birch.Value }
+
+func (a *pushAccumulator) add(val *birch.Value) {
+	if val != nil {
+		a.values = append(a.values, val)
+	}
+}
+
+func (a *pushAccumulator) result() *birch.Value { return birch.VC.ArrayFromValues(a.values...) }
+
+type firstAccumulator struct {
+	value *birch.Value
+	seen  bool
+}
+
+func (a *firstAccumulator) add(val *birch.Value) {
+	if !a.seen {
+		a.value, a.seen = orNull(val), true
+	}
+}
+
+func (a *firstAccumulator) result() *birch.Value { return orNull(a.value) }
+
+type lastAccumulator struct{ value *birch.Value }
+
+func (a *lastAccumulator) add(val *birch.Value) { a.value = orNull(val) }
+func (a *lastAccumulator) result() *birch.Value { return orNull(a.value) }
+
+func compileGroup(operand *birch.Value) (stage, error) {
+	spec, ok := operand.MutableDocumentOK()
+	if !ok {
+		return nil, invalidf("$group requires a document")
+	}
+
+	idVal := spec.Lookup("_id")
+	if idVal == nil {
+		return nil, invalidf("$group requires an _id")
+	}
+	id, err := compileExpression(idVal)
+	if err != nil {
+		return nil, err
+	}
+
+	type field struct {
+		key  string
+		expr expression
+		acc  func() accumulator
+	}
+
+	var fields []field
+	for elem := range spec.Iterator() {
+		key := elem.Key()
+		if key == "_id" {
+			continue
+		}
+		if strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+			return nil, invalidf("invalid $group field name %q", key)
+		}
+
+		def, ok := elem.Value().MutableDocumentOK()
+		if !ok || def.Len() != 1 {
+			return nil, invalidf("$group field %q must be a document with one accumulator", key)
+		}
+
+		name := def.ElementAt(0).Key()
+		acc, ok := accumulators[name]
+		if !ok {
+			return nil, invalidf("unsupported accumulator %q", name)
+		}
+
+		expr, err := compileExpression(def.ElementAt(0).Value())
+		if err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, field{key: key, expr: expr, acc: acc})
+	}
+
+	type group struct {
+		id   *birch.Value
+		accs []accumulator
+	}
+
+	return func(seq iter.Seq[*birch.Document], catcher *erc.Collector) iter.Seq[*birch.Document] {
+		return func(yield func(*birch.Document) bool) {
+			var groups []*group
+			index := map[string]*group{}
+
+			for doc := range seq {
+				key, err := id(doc)
+				if !catcher.PushOk(err) {
+					return
+				}
+				key = orNull(key)
+
+				hash, err := groupKey(key)
+				if !catcher.PushOk(err) {
+					return
+				}
+
+				g, ok := index[hash]
+				if !ok {
+					g = &group{id: key, accs: make([]accumulator, len(fields))}
+					for idx, f := range fields {
+						g.accs[idx] = f.acc()
+					}
+					index[hash] = g
+					groups = append(groups, g)
+				}
+
+				for idx, f := range fields {
+					val, err := f.expr(doc)
+					if !catcher.PushOk(err) {
+						return
+					}
+					g.accs[idx].add(val)
+				}
+			}
+
+			for _, g := range groups {
+				out := birch.DC.Make(len(fields) + 1).Append(birch.EC.Value("_id", g.id))
+				for idx, f := range fields {
+					out.Append(birch.EC.Value(f.key, g.accs[idx].result()))
+				}
+				if !yield(out) {
+					return
+				}
+			}
+		}
+	}, nil
+}
+
+// groupKey returns a string that identifies a group. Numbers with the
+// same value are in the same group regardless of their type, and other
+// values are identified by their BSON representation.
+func groupKey(val *birch.Value) (string, error) {
+	if isNumber(val) {
+		if n, ok := toInt(val); ok {
+			return "i" + strconv.FormatInt(n, 10), nil
+		}
+		f, _ := toFloat(val)
+		if math.IsNaN(f) {
+			return "nan", nil
+		}
+		return "f" + strconv.FormatFloat(f, 'g', -1, 64), nil
+	}
+
+	if val.Type() == bsontype.Undefined {
+		val = birch.VC.Null()
+	}
+
+	data, err := birch.EC.Value("", val).MarshalBSON()
+	if err != nil {
+		return "", err
+	}
+
+	return "v" + string(data), nil
+}
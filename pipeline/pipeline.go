@@ -0,0 +1,175 @@
+// Package pipeline applies a subset of MongoDB's aggregation pipeline
+// to sequences of birch documents.
+//
+// The supported stages are $match, $project, $addFields (and its alias
+// $set), $unwind, $group, $sort, $skip, $limit, and $count. Stages that
+// compute values use aggregation expressions: field paths (e.g. "$a.b"),
+// the $$ROOT variable, literals, object and array expressions, and the
+// operators $literal, $add, $subtract, $multiply, $divide, $mod, $abs,
+// $eq, $ne, $gt, $gte, $lt, $lte, $cmp, $and, $or, $not, $cond, $ifNull,
+// $concat, $toLower, $toUpper, $size, $arrayElemAt, $in, and $type.
+//
+// Stages other than $group, $sort, and $count process documents as they
+// are produced, without buffering the input. Stages never modify their
+// input documents.
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/fun/erc"
+)
+
+var (
+	// ErrInvalidPipeline is returned (wrapped) by Compile when a
+	// pipeline is malformed or uses an unsupported stage or operator.
+	ErrInvalidPipeline = errors.New("invalid pipeline")
+
+	// ErrTypeMismatch is returned (wrapped) by Iterator.Close when an
+	// expression operator is applied to a value of the wrong type.
+	ErrTypeMismatch = errors.New("type mismatch")
+
+	// ErrInvalidValue is returned (wrapped) by Iterator.Close when an
+	// expression cannot be evaluated for a value, as when dividing by
+	// zero.
+	ErrInvalidValue = errors.New("invalid value")
+)
+
+// stage transforms a sequence of documents, reporting errors to the
+// collector and ending the sequence early when an error occurs.
+type stage func(iter.Seq[*birch.Document], *erc.Collector) iter.Seq[*birch.Document]
+
+// Pipeline is a compiled aggregation pipeline. Pipelines are immutable
+// and safe for concurrent use.
+type Pipeline struct {
+	stages []stage
+}
+
+// Iterator holds the output of a pipeline. Errors that occur while
+// processing documents end the iteration, and are returned by Close.
+type Iterator struct {
+	iterator iter.Seq[*birch.Document]
+	catcher  erc.Collector
+}
+
+// Iterator returns the documents produced by the pipeline.
+func (it *Iterator) Iterator() iter.Seq[*birch.Document] { return it.iterator }
+
+// Close returns any error encountered during iteration.
+func (it *Iterator) Close() error { return it.catcher.Resolve() }
+
+// Compile converts an array of stage documents into a Pipeline.
+func Compile(stages *birch.Array) (*Pipeline, error) {
+	out := &Pipeline{}
+	if stages == nil {
+		return out, nil
+	}
+
+	for idx := 0; idx < stages.Len(); idx++ {
+		val, err := stages.Lookup(uint(idx))
+		if err != nil {
+			return nil, err
+		}
+
+		spec, ok := val.MutableDocumentOK()
+		if !ok || spec.Len() != 1 {
+			return nil, invalidf("stage %d must be a document with exactly one field", idx)
+		}
+
+		name, operand := spec.ElementAt(0).Key(), spec.ElementAt(0).Value()
+		compile, ok := stageCompilers[name]
+		if !ok {
+			return nil, invalidf("unsupported stage %q", name)
+		}
+
+		st, err := compile(operand)
+		if err != nil {
+			return nil, fmt.Errorf("stage %d (%s): %w", idx, name, err)
+		}
+		out.stages = append(out.stages, st)
+	}
+
+	return out, nil
+}
+
+// Run applies the pipeline to the sequence of documents. The pipeline
+// does not consume the input until the output is iterated.
+func (p *Pipeline) Run(seq iter.Seq[*birch.Document]) *Iterator {
+	out := &Iterator{}
+	for _, st := range p.stages {
+		seq = st(seq, &out.catcher)
+	}
+	out.iterator = seq
+	return out
+}
+
+// Aggregate compiles a pipeline and applies it to a sequence of
+// documents, collecting the results.
+func Aggregate(stages *birch.Array, seq iter.Seq[*birch.Document]) ([]*birch.Document, error) {
+	p, err := Compile(stages)
+	if err != nil {
+		return nil, err
+	}
+
+	results := p.Run(seq)
+
+	var out []*birch.Document
+	for doc := range results.Iterator() {
+		out = append(out, doc)
+	}
+
+	if err := results.Close(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPipeline, fmt.Sprintf(format, args...))
+}
+
+var stageCompilers = map[string]func(*birch.Value) (stage, error){
+	"$match":     compileMatch,
+	"$project":   compileProject,
+	"$addFields": compileAddFields,
+	"$set":       compileAddFields,
+	"$unwind":    compileUnwind,
+	"$group":     compileGroup,
+	"$sort":      compileSort,
+	"$skip":      compileSkip,
+	"$limit":     compileLimit,
+	"$count":     compileCount,
+}
+
+// mapStage builds a stage that transforms each document independently,
+// dropping documents when the function returns nil.
+func mapStage(fn func(*birch.Document) (*birch.Document, error)) stage {
+	return func(seq iter.Seq[*birch.Document], catcher *erc.Collector) iter.Seq[*birch.Document] {
+		return func(yield func(*birch.Document) bool) {
+			for doc := range seq {
+				out, err := fn(doc)
+				if err != nil {
+					catcher.Push(err)
+					return
+				}
+				if out != nil && !yield(out) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// clone returns a deep copy of a document, so that stages can modify
+// documents without changing their input.
+func clone(doc *birch.Document) (*birch.Document, error) {
+	data, err := doc.MarshalBSON()
+	if err != nil {
+		return nil, err
+	}
+	return birch.ReadDocument(data)
+}
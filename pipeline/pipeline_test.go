@@ -0,0 +1,265 @@
+package pipeline
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/internal/birchtest"
+)
+
+func mustDocuments(t *testing.T, in string) []*birch.Document {
+	t.Helper()
+	var out []*birch.Document
+	for val := range birchtest.Array(t, in).Iterator() {
+		out = append(out, val.MutableDocument())
+	}
+	return out
+}
+
+func requireDocuments(t *testing.T, docs []*birch.Document, expected string) {
+	t.Helper()
+	values := make([]*birch.Value, 0, len(docs))
+	for _, doc := range docs {
+		values = append(values, birch.VC.Document(doc))
+	}
+	out, err := birch.NewArray(values...).MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != expected {
+		t.Errorf("expected %s, got %s", expected, out)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	const sales = `[
+		{"_id":1,"item":"a","qty":2,"price":10,"tags":["x","y"]},
+		{"_id":2,"item":"b","qty":1,"price":20,"tags":[]},
+		{"_id":3,"item":"a","qty":5,"price":10},
+		{"_id":4,"item":"c","qty":3,"price":1.5,"tags":["z"]}
+	]`
+
+	for _, tc := range []struct {
+		name     string
+		pipeline string
+		expected string
+	}{
+		{
+			name:     "Empty",
+			pipeline: `[]`,
+			expected: `[{"_id":1,"item":"a","qty":2,"price":10,"tags":["x","y"]},{"_id":2,"item":"b","qty":1,"price":20,"tags":[]},{"_id":3,"item":"a","qty":5,"price":10},{"_id":4,"item":"c","qty":3,"price":1.500000,"tags":["z"]}]`,
+		},
+		{
+			name:     "Match",
+			pipeline: `[{"$match":{"qty":{"$gte":3}}},{"$project":{"item":1}}]`,
+			expected: `[{"_id":3,"item":"a"},{"_id":4,"item":"c"}]`,
+		},
+		{
+			name:     "ProjectInclusion",
+			pipeline: `[{"$limit":1},{"$project":{"_id":0,"item":1,"total":{"$multiply":["$qty","$price"]}}}]`,
+			expected: `[{"item":"a","total":20}]`,
+		},
+		{
+			name:     "ProjectExclusion",
+			pipeline: `[{"$limit":1},{"$project":{"tags":0,"price":0}}]`,
+			expected: `[{"_id":1,"item":"a","qty":2}]`,
+		},
+		{
+			name:     "AddFields",
+			pipeline: `[{"$skip":3},{"$addFields":{"total":{"$multiply":["$qty","$price"]},"meta.item":{"$toUpper":"$item"}}}]`,
+			expected: `[{"_id":4,"item":"c","qty":3,"price":1.500000,"tags":["z"],"total":4.500000,"meta":{"item":"C"}}]`,
+		},
+		{
+			name:     "Unwind",
+			pipeline: `[{"$unwind":"$tags"},{"$project":{"tags":1}}]`,
+			expected: `[{"_id":1,"tags":"x"},{"_id":1,"tags":"y"},{"_id":4,"tags":"z"}]`,
+		},
+		{
+			name:     "UnwindPreserve",
+			pipeline: `[{"$unwind":{"path":"$tags","includeArrayIndex":"idx","preserveNullAndEmptyArrays":true}},{"$project":{"tags":1,"idx":1}}]`,
+			expected: `[{"_id":1,"tags":"x","idx":0},{"_id":1,"tags":"y","idx":1},{"_id":2,"tags":[],"idx":null},{"_id":3,"idx":null},{"_id":4,"tags":"z","idx":0}]`,
+		},
+		{
+			name:     "Group",
+			pipeline: `[{"$group":{"_id":"$item","qty":{"$sum":"$qty"},"count":{"$sum":1},"avg":{"$avg":"$qty"},"ids":{"$push":"$_id"},"min":{"$min":"$qty"},"max":{"$max":"$qty"},"first":{"$first":"$_id"},"last":{"$last":"$_id"}}}]`,
+			expected: `[{"_id":"a","qty":7,"count":2,"avg":3.500000,"ids":[1,3],"min":2,"max":5,"first":1,"last":3},{"_id":"b","qty":1,"count":1,"avg":1.000000,"ids":[2],"min":1,"max":1,"first":2,"last":2},{"_id":"c","qty":3,"count":1,"avg":3.000000,"ids":[4],"min":3,"max":3,"first":4,"last":4}]`,
+		},
+		{
+			name:     "GroupAll",
+			pipeline: `[{"$group":{"_id":null,"revenue":{"$sum":{"$multiply":["$qty","$price"]}}}}]`,
+			expected: `[{"_id":null,"revenue":94.500000}]`,
+		},
+		{
+			name:     "GroupNumericKeys",
+			pipeline: `[{"$group":{"_id":{"$divide":["$price",10]},"n":{"$sum":1}}},{"$sort":{"_id":1}}]`,
+			expected: `[{"_id":0.150000,"n":1},{"_id":1.000000,"n":2},{"_id":2.000000,"n":1}]`,
+		},
+		{
+			name:     "Sort",
+			pipeline: `[{"$sort":{"price":-1,"qty":1}},{"$project":{"_id":1}}]`,
+			expected: `[{"_id":2},{"_id":1},{"_id":3},{"_id":4}]`,
+		},
+		{
+			name:     "SkipLimit",
+			pipeline: `[{"$skip":1},{"$limit":2},{"$project":{"_id":1}}]`,
+			expected: `[{"_id":2},{"_id":3}]`,
+		},
+		{
+			name:     "Count",
+			pipeline: `[{"$match":{"item":"a"}},{"$count":"n"}]`,
+			expected: `[{"n":2}]`,
+		},
+		{
+			name:     "CountNone",
+			pipeline: `[{"$match":{"item":"q"}},{"$count":"n"}]`,
+			expected: `[]`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			input := mustDocuments(t, sales)
+			docs, err := Aggregate(birchtest.Array(t, tc.pipeline), slices.Values(input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			requireDocuments(t, docs, tc.expected)
+			requireDocuments(t, input, `[{"_id":1,"item":"a","qty":2,"price":10,"tags":["x","y"]},{"_id":2,"item":"b","qty":1,"price":20,"tags":[]},{"_id":3,"item":"a","qty":5,"price":10},{"_id":4,"item":"c","qty":3,"price":1.500000,"tags":["z"]}]`)
+		})
+	}
+	t.Run("Project", func(t *testing.T) {
+		const input = `[{"_id":1,"a":{"b":1,"c":2},"d":[{"b":3,"c":4},5]}]`
+		for _, tc := range []struct {
+			spec     string
+			expected string
+		}{
+			{spec: `{"a.b":1}`, expected: `[{"_id":1,"a":{"b":1}}]`},
+			{spec: `{"a":{"c":1},"_id":0}`, expected: `[{"a":{"c":2}}]`},
+			{spec: `{"d.b":1}`, expected: `[{"_id":1,"d":[{"b":3}]}]`},
+			{spec: `{"d.c":0,"a.b":0}`, expected: `[{"_id":1,"a":{"c":2},"d":[{"b":3},5]}]`},
+			{spec: `{"_id":0}`, expected: `[{"a":{"b":1,"c":2},"d":[{"b":3,"c":4},5]}]`},
+			{spec: `{"_id":1}`, expected: `[{"_id":1}]`},
+			{spec: `{"x.y":"$a.c"}`, expected: `[{"_id":1,"x":{"y":2}}]`},
+			{spec: `{"bs":"$d.b","lit":{"$literal":"$a"},"obj":{"n":"$_id"}}`, expected: `[{"_id":1,"bs":[3],"lit":"$a","obj":{"n":1}}]`},
+		} {
+			docs, err := Aggregate(birchtest.Array(t, `[{"$project":`+tc.spec+`}]`), slices.Values(mustDocuments(t, input)))
+			if err != nil {
+				t.Fatalf("%s: %v", tc.spec, err)
+			}
+			requireDocuments(t, docs, tc.expected)
+		}
+	})
+	t.Run("Expressions", func(t *testing.T) {
+		const input = `[{"a":6,"b":4,"s":"Hello","arr":[1,2,3],"n":null,"d":{"$date":"1970-01-01T00:00:10Z"}}]`
+		for _, tc := range []struct {
+			expr     string
+			expected string
+		}{
+			{expr: `{"$add":["$a","$b",1]}`, expected: `11`},
+			{expr: `{"$add":["$a",1.5]}`, expected: `7.500000`},
+			{expr: `{"$add":["$a","$n"]}`, expected: `null`},
+			{expr: `{"$add":[2147483647,1]}`, expected: `2147483648`},
+			{expr: `{"$subtract":["$a","$b"]}`, expected: `2`},
+			{expr: `{"$subtract":["$d",5000]}`, expected: `{"$date":"1970-01-01T00:00:05Z"}`},
+			{expr: `{"$multiply":["$a","$b"]}`, expected: `24`},
+			{expr: `{"$divide":["$a","$b"]}`, expected: `1.500000`},
+			{expr: `{"$mod":["$a","$b"]}`, expected: `2`},
+			{expr: `{"$abs":-3}`, expected: `3`},
+			{expr: `{"$gt":["$a","$b"]}`, expected: `true`},
+			{expr: `{"$eq":["$a",6.0]}`, expected: `true`},
+			{expr: `{"$lt":["$missing",1]}`, expected: `true`},
+			{expr: `{"$cmp":["$b","$a"]}`, expected: `-1`},
+			{expr: `{"$and":["$a",{"$gt":["$b",5]}]}`, expected: `false`},
+			{expr: `{"$or":["$n","$a"]}`, expected: `true`},
+			{expr: `{"$not":"$n"}`, expected: `true`},
+			{expr: `{"$cond":{"if":{"$gte":["$a",5]},"then":"big","else":"small"}}`, expected: `"big"`},
+			{expr: `{"$cond":["$n","yes","no"]}`, expected: `"no"`},
+			{expr: `{"$ifNull":["$n","$missing","$s"]}`, expected: `"Hello"`},
+			{expr: `{"$concat":["$s"," ","world"]}`, expected: `"Hello world"`},
+			{expr: `{"$concat":["$s","$n"]}`, expected: `null`},
+			{expr: `{"$toLower":"$s"}`, expected: `"hello"`},
+			{expr: `{"$size":"$arr"}`, expected: `3`},
+			{expr: `{"$arrayElemAt":["$arr",-1]}`, expected: `3`},
+			{expr: `{"$in":[2,"$arr"]}`, expected: `true`},
+			{expr: `{"$type":"$missing"}`, expected: `"missing"`},
+			{expr: `{"$type":"$arr"}`, expected: `"array"`},
+			{expr: `["$a","$missing"]`, expected: `[6,null]`},
+		} {
+			docs, err := Aggregate(birchtest.Array(t, `[{"$project":{"_id":0,"v":`+tc.expr+`}}]`), slices.Values(mustDocuments(t, input)))
+			if err != nil {
+				t.Fatalf("%s: %v", tc.expr, err)
+			}
+			requireDocuments(t, docs, `[{"v":`+tc.expected+`}]`)
+		}
+	})
+	t.Run("Streaming", func(t *testing.T) {
+		p, err := Compile(birchtest.Array(t, `[{"$match":{"n":{"$gt":1}}},{"$limit":2}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		consumed := 0
+		input := func(yield func(*birch.Document) bool) {
+			for idx := 0; idx < 100; idx++ {
+				consumed++
+				if !yield(birch.DC.Elements(birch.EC.Int("n", idx))) {
+					return
+				}
+			}
+		}
+
+		results := p.Run(input)
+		docs := slices.Collect(results.Iterator())
+		if err := results.Close(); err != nil {
+			t.Fatal(err)
+		}
+		requireDocuments(t, docs, `[{"n":2},{"n":3}]`)
+		if consumed != 4 {
+			t.Errorf("consumed %d documents", consumed)
+		}
+	})
+	t.Run("CompileErrors", func(t *testing.T) {
+		for _, pipeline := range []string{
+			`[1]`,
+			`[{"$match":{},"$limit":1}]`,
+			`[{"$out":"coll"}]`,
+			`[{"$match":{"a":{"$bad":1}}}]`,
+			`[{"$project":{}}]`,
+			`[{"$project":{"a":1,"b":0}}]`,
+			`[{"$project":{"a":1,"a.b":1}}]`,
+			`[{"$project":{"a":{"$unknown":1}}}]`,
+			`[{"$project":{"a":{"$add":1,"$multiply":2}}}]`,
+			`[{"$project":{"a":{"$subtract":[1]}}}]`,
+			`[{"$project":{"a":"$$NOW"}}]`,
+			`[{"$addFields":{"$a":1}}]`,
+			`[{"$unwind":"tags"}]`,
+			`[{"$unwind":{"path":"$tags","other":true}}]`,
+			`[{"$group":{"total":{"$sum":1}}}]`,
+			`[{"$group":{"_id":null,"total":{"$median":1}}}]`,
+			`[{"$group":{"_id":null,"total":1}}]`,
+			`[{"$sort":{"a":2}}]`,
+			`[{"$skip":-1}]`,
+			`[{"$limit":0}]`,
+			`[{"$count":"$n"}]`,
+		} {
+			if _, err := Compile(birchtest.Array(t, pipeline)); !errors.Is(err, ErrInvalidPipeline) {
+				t.Errorf("%s: expected invalid pipeline error, got %v", pipeline, err)
+			}
+		}
+	})
+	t.Run("RuntimeErrors", func(t *testing.T) {
+		for _, tc := range []struct {
+			pipeline string
+			err      error
+		}{
+			{pipeline: `[{"$project":{"v":{"$add":["$s",1]}}}]`, err: ErrTypeMismatch},
+			{pipeline: `[{"$project":{"v":{"$divide":[1,"$z"]}}}]`, err: ErrInvalidValue},
+			{pipeline: `[{"$group":{"_id":{"$size":"$s"}}}]`, err: ErrTypeMismatch},
+		} {
+			_, err := Aggregate(birchtest.Array(t, tc.pipeline), slices.Values(mustDocuments(t, `[{"s":"x","z":0}]`)))
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: expected %v, got %v", tc.pipeline, tc.err, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package pipeline
+
+import (
+	"strings"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// projectNode is one level of a $project specification. Each entry is
+// either a field to include or exclude, a computed field, or a nested
+// specification for an embedded document.
+type projectNode struct {
+	entries []*projectEntry
+}
+
+type projectEntry struct {
+	key     string
+	include bool
+	expr    expression
+	child   *projectNode
+}
+
+func (n *projectNode) find(key string) *projectEntry {
+	for _, entry := range n.entries {
+		if entry.key == key {
+			return entry
+		}
+	}
+	return nil
+}
+
+// add inserts an entry for the path, creating nested nodes as needed.
+func (n *projectNode) add(path birch.Path, entry *projectEntry) error {
+	for idx, key := range path[:len(path)-1] {
+		existing := n.find(key)
+		switch {
+		case existing == nil:
+			existing = &projectEntry{key: key, child: &projectNode{}}
+			n.entries = append(n.entries, existing)
+		case existing.child == nil:
+			return invalidf("path collision at %q", path[:idx+1].String())
+		}
+		n = existing.child
+	}
+
+	entry.key = path[len(path)-1]
+	if n.find(entry.key) != nil {
+		return invalidf("path collision at %q", path.String())
+	}
+	n.entries = append(n.entries, entry)
+
+	return nil
+}
+
+// projection holds a compiled $project specification, which either
+// includes (and computes) fields, or excludes fields.
+type projection struct {
+	root    *projectNode
+	exclude bool
+}
+
+func compileProject(operand *birch.Value) (stage, error) {
+	spec, ok := operand.MutableDocumentOK()
+	if !ok || spec.Len() == 0 {
+		return nil, invalidf("$project requires a non-empty document")
+	}
+
+	p := &projection{root: &projectNode{}}
+
+	var includes, excludes bool
+	if err := p.compile(spec, nil, &includes, &excludes); err != nil {
+		return nil, err
+	}
+	if includes && excludes {
+		return nil, invalidf("$project cannot mix inclusion and exclusion")
+	}
+
+	id := p.root.find("_id")
+	switch {
+	case includes:
+		if id == nil {
+			p.root.entries = append([]*projectEntry{{key: "_id", include: true}}, p.root.entries...)
+		}
+	case id != nil && id.expr == nil && id.child == nil:
+		// {_id: 0} alone is an exclusion, and {_id: 1} alone only
+		// includes _id.
+		p.exclude = !id.include
+	default:
+		p.exclude = true
+	}
+
+	return mapStage(func(doc *birch.Document) (*birch.Document, error) {
+		if p.exclude {
+			return excludeFields(p.root, doc), nil
+		}
+		return includeFields(p.root, doc, doc)
+	}), nil
+}
+
+func (p *projection) compile(spec *birch.Document, prefix birch.Path, includes, excludes *bool) error {
+	for elem := range spec.Iterator() {
+		sub, err := parseFieldPath(elem.Key())
+		if err != nil {
+			return err
+		}
+		path := append(append(birch.Path{}, prefix...), sub...)
+		val := elem.Value()
+
+		switch val.Type() {
+		case bsontype.Boolean, bsontype.Int32, bsontype.Int64, bsontype.Double:
+			include := truthy(val)
+			if path.String() != "_id" {
+				if include {
+					*includes = true
+				} else {
+					*excludes = true
+				}
+			}
+			if err := p.root.add(path, &projectEntry{include: include}); err != nil {
+				return err
+			}
+			continue
+		case bsontype.EmbeddedDocument:
+			nested := val.MutableDocument()
+			if nested.Len() == 0 {
+				return invalidf("an empty specification for %q is not allowed", path.String())
+			}
+			if !strings.HasPrefix(nested.ElementAt(0).Key(), "$") {
+				if err := p.compile(nested, path, includes, excludes); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		expr, err := compileExpression(val)
+		if err != nil {
+			return err
+		}
+		*includes = true
+		if err := p.root.add(path, &projectEntry{expr: expr}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// includeFields builds a document that contains the fields of the
+// input that are included by the node, followed by computed fields,
+// which are evaluated against the root document.
+func includeFields(node *projectNode, in, root *birch.Document) (*birch.Document, error) {
+	out := birch.DC.Make(len(node.entries))
+	done := make(map[string]bool, len(node.entries))
+
+	if in != nil {
+		for elem := range in.Iterator() {
+			entry := node.find(elem.Key())
+			if entry == nil || entry.expr != nil {
+				continue
+			}
+			done[entry.key] = true
+
+			switch {
+			case entry.child != nil:
+				val, err := includeValue(entry.child, elem.Value(), root)
+				if err != nil {
+					return nil, err
+				}
+				if val != nil {
+					out.Append(birch.EC.Value(entry.key, val))
+				}
+			case entry.include:
+				out.Append(elem.Copy())
+			}
+		}
+	}
+
+	for _, entry := range node.entries {
+		if done[entry.key] {
+			continue
+		}
+
+		switch {
+		case entry.expr != nil:
+			val, err := entry.expr(root)
+			if err != nil {
+				return nil, err
+			}
+			if val != nil {
+				out.Set(birch.EC.Value(entry.key, val))
+			}
+		case entry.child != nil && entry.child.computes():
+			sub, err := includeFields(entry.child, nil, root)
+			if err != nil {
+				return nil, err
+			}
+			out.Append(birch.EC.SubDocument(entry.key, sub))
+		}
+	}
+
+	return out, nil
+}
+
+func includeValue(node *projectNode, val *birch.Value, root *birch.Document) (*birch.Value, error) {
+	switch val.Type() {
+	case bsontype.EmbeddedDocument:
+		sub, err := includeFields(node, val.MutableDocument(), root)
+		if err != nil {
+			return nil, err
+		}
+		return birch.VC.Document(sub), nil
+	case bsontype.Array:
+		var values []*birch.Value
+		for item := range val.MutableArray().Iterator() {
+			out, err := includeValue(node, item, root)
+			if err != nil {
+				return nil, err
+			}
+			if out != nil {
+				values = append(values, out)
+			}
+		}
+		return birch.VC.ArrayFromValues(values...), nil
+	default:
+		return nil, nil
+	}
+}
+
+// computes reports whether the node, or any of its children, has
+// computed fields.
+func (n *projectNode) computes() bool {
+	for _, entry := range n.entries {
+		if entry.expr != nil || (entry.child != nil && entry.child.computes()) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeFields builds a document that contains all of the fields of
+// the input that are not excluded by the node.
+func excludeFields(node *projectNode, in *birch.Document) *birch.Document {
+	out := birch.DC.Make(in.Len())
+
+	for elem := range in.Iterator() {
+		entry := node.find(elem.Key())
+		switch {
+		case entry == nil:
+			out.Append(elem.Copy())
+		case entry.child != nil:
+			out.Append(birch.EC.Value(entry.key, excludeValue(entry.child, elem.Value())))
+		case entry.include:
+			out.Append(elem.Copy())
+		}
+	}
+
+	return out
+}
+
+func excludeValue(node *projectNode, val *birch.Value) *birch.Value {
+	switch val.Type() {
+	case bsontype.EmbeddedDocument:
+		return birch.VC.Document(excludeFields(node, val.MutableDocument()))
+	case bsontype.Array:
+		var values []*birch.Value
+		for item := range val.MutableArray().Iterator() {
+			values = append(values, excludeValue(node, item))
+		}
+		return birch.VC.ArrayFromValues(values...)
+	default:
+		return val
+	}
+}
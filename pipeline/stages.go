@@ -0,0 +1,303 @@
+package pipeline
+
+import (
+	"fmt"
+	"iter"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/match"
+	"github.com/tychoish/fun/erc"
+)
+
+func compileMatch(operand *birch.Value) (stage, error) {
+	filter, ok := operand.MutableDocumentOK()
+	if !ok {
+		return nil, invalidf("$match requires a document")
+	}
+
+	m, err := match.Compile(filter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPipeline, err)
+	}
+
+	return mapStage(func(doc *birch.Document) (*birch.Document, error) {
+		if m.Match(doc) {
+			return doc, nil
+		}
+		return nil, nil
+	}), nil
+}
+
+func compileAddFields(operand *birch.Value) (stage, error) {
+	spec, ok := operand.MutableDocumentOK()
+	if !ok {
+		return nil, invalidf("$addFields requires a document")
+	}
+
+	type field struct {
+		path birch.Path
+		expr expression
+	}
+
+	fields := make([]field, 0, spec.Len())
+	for elem := range spec.Iterator() {
+		path, err := parseFieldPath(elem.Key())
+		if err != nil {
+			return nil, err
+		}
+		expr, err := compileExpression(elem.Value())
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field{path: path, expr: expr})
+	}
+
+	return mapStage(func(doc *birch.Document) (*birch.Document, error) {
+		// expressions are evaluated against the input document, so
+		// fields cannot see the values of fields added by the same
+		// stage.
+		values := make([]*birch.Value, len(fields))
+		for idx, f := range fields {
+			val, err := f.expr(doc)
+			if err != nil {
+				return nil, err
+			}
+			values[idx] = val
+		}
+
+		out, err := clone(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		for idx, f := range fields {
+			if values[idx] == nil {
+				continue
+			}
+			if err := out.SetPath(f.path, values[idx]); err != nil {
+				return nil, err
+			}
+		}
+
+		return out, nil
+	}), nil
+}
+
+func compileUnwind(operand *birch.Value) (stage, error) {
+	var (
+		fieldPath, indexField string
+		preserve              bool
+	)
+
+	switch operand.Type() {
+	case bsontype.String:
+		fieldPath = operand.StringValue()
+	case bsontype.EmbeddedDocument:
+		for elem := range operand.MutableDocument().Iterator() {
+			var ok bool
+			switch elem.Key() {
+			case "path":
+				fieldPath, ok = elem.Value().StringValueOK()
+			case "includeArrayIndex":
+				indexField, ok = elem.Value().StringValueOK()
+			case "preserveNullAndEmptyArrays":
+				preserve, ok = elem.Value().BooleanOK()
+			default:
+				return nil, invalidf("unsupported $unwind option %q", elem.Key())
+			}
+			if !ok {
+				return nil, invalidf("invalid value for $unwind option %q", elem.Key())
+			}
+		}
+	default:
+		return nil, invalidf("$unwind requires a field path or a document")
+	}
+
+	if !strings.HasPrefix(fieldPath, "$") {
+		return nil, invalidf("$unwind path must be a field path beginning with '$'")
+	}
+	path, err := parseFieldPath(fieldPath[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	var indexPath birch.Path
+	if indexField != "" {
+		if indexPath, err = parseFieldPath(indexField); err != nil {
+			return nil, err
+		}
+	}
+
+	emit := func(doc *birch.Document, item *birch.Value, index *birch.Value) (*birch.Document, error) {
+		out, err := clone(doc)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			if err := out.SetPath(path, item); err != nil {
+				return nil, err
+			}
+		}
+		if indexPath != nil {
+			if err := out.SetPath(indexPath, index); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+
+	return func(seq iter.Seq[*birch.Document], catcher *erc.Collector) iter.Seq[*birch.Document] {
+		return func(yield func(*birch.Document) bool) {
+			for doc := range seq {
+				var items []*birch.Value
+				val := lookup(doc, path)
+
+				switch {
+				case val != nil && val.Type() == bsontype.Array:
+					items = slices.Collect(val.MutableArray().Iterator())
+				case !isNullish(val):
+					// non-array values are treated as an array with a
+					// single element.
+					out, err := emit(doc, val, birch.VC.Null())
+					if !catcher.PushOk(err) || !yield(out) {
+						return
+					}
+					continue
+				}
+
+				if len(items) == 0 {
+					if !preserve {
+						continue
+					}
+					out, err := emit(doc, nil, birch.VC.Null())
+					if !catcher.PushOk(err) || !yield(out) {
+						return
+					}
+					continue
+				}
+
+				for idx, item := range items {
+					out, err := emit(doc, item, birch.VC.Int64(int64(idx)))
+					if !catcher.PushOk(err) || !yield(out) {
+						return
+					}
+				}
+			}
+		}
+	}, nil
+}
+
+// lookup returns the value at a path through embedded documents, or
+// nil if there is no value.
+func lookup(doc *birch.Document, path birch.Path) *birch.Value {
+	elem, err := doc.Search(path...)
+	if err != nil {
+		return nil
+	}
+	return elem.Value()
+}
+
+func compileSort(operand *birch.Value) (stage, error) {
+	spec, ok := operand.MutableDocumentOK()
+	if !ok || spec.Len() == 0 {
+		return nil, invalidf("$sort requires a non-empty document")
+	}
+
+	for elem := range spec.Iterator() {
+		if _, err := parseFieldPath(elem.Key()); err != nil {
+			return nil, err
+		}
+	}
+
+	compare, err := birch.CompareBy(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: $sort: %w", ErrInvalidPipeline, err)
+	}
+
+	return func(seq iter.Seq[*birch.Document], _ *erc.Collector) iter.Seq[*birch.Document] {
+		return func(yield func(*birch.Document) bool) {
+			docs := slices.Collect(seq)
+			slices.SortStableFunc(docs, compare)
+			for _, doc := range docs {
+				if !yield(doc) {
+					return
+				}
+			}
+		}
+	}, nil
+}
+
+func compileSkip(operand *birch.Value) (stage, error) {
+	n, ok := toInt(operand)
+	if !ok || n < 0 {
+		return nil, invalidf("$skip requires a non-negative integer")
+	}
+
+	return func(seq iter.Seq[*birch.Document], _ *erc.Collector) iter.Seq[*birch.Document] {
+		return func(yield func(*birch.Document) bool) {
+			count := int64(0)
+			for doc := range seq {
+				if count < n {
+					count++
+					continue
+				}
+				if !yield(doc) {
+					return
+				}
+			}
+		}
+	}, nil
+}
+
+func compileLimit(operand *birch.Value) (stage, error) {
+	n, ok := toInt(operand)
+	if !ok || n <= 0 {
+		return nil, invalidf("$limit requires a positive integer")
+	}
+
+	return func(seq iter.Seq[*birch.Document], _ *erc.Collector) iter.Seq[*birch.Document] {
+		return func(yield func(*birch.Document) bool) {
+			count := int64(0)
+			for doc := range seq {
+				if !yield(doc) {
+					return
+				}
+				if count++; count >= n {
+					return
+				}
+			}
+		}
+	}, nil
+}
+
+func compileCount(operand *birch.Value) (stage, error) {
+	name, ok := operand.StringValueOK()
+	if !ok || name == "" || strings.HasPrefix(name, "$") || strings.Contains(name, ".") {
+		return nil, invalidf("$count requires a non-empty field name without '$' or '.'")
+	}
+
+	return func(seq iter.Seq[*birch.Document], _ *erc.Collector) iter.Seq[*birch.Document] {
+		return func(yield func(*birch.Document) bool) {
+			count := int64(0)
+			for range seq {
+				count++
+			}
+			if count == 0 {
+				return
+			}
+			yield(birch.DC.Elements(birch.EC.Value(name, intValue(count))))
+		}
+	}, nil
+}
+
+// intValue returns the smallest integer value that holds n.
+func intValue(n int64) *birch.Value {
+	if n >= math.MinInt32 && n <= math.MaxInt32 {
+		return birch.VC.Int32(int32(n))
+	}
+	return birch.VC.Int64(n)
+}
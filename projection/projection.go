@@ -0,0 +1,513 @@
+// Package projection applies MongoDB find projections to birch
+// documents, returning partial documents.
+//
+// Projections either include fields, in which case _id is included
+// unless it is explicitly excluded, or exclude fields; the two modes
+// cannot be mixed, except for _id. Keys may be dotted paths, or
+// nested projection documents, which apply to embedded documents and
+// to the documents in arrays. The $slice operator returns part of an
+// array, and the $elemMatch operator returns the first element of an
+// array that matches a condition, with the semantics of the match
+// package.
+//
+// Projections are applied to the encoded form of a document, so
+// ApplyReader produces a new Reader without constructing a Document.
+// The projection package is separate from the birch package because
+// $elemMatch depends on the match package.
+package projection
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/match"
+)
+
+// ErrInvalidProjection is returned (wrapped) by Compile when a
+// projection is malformed or uses an unsupported operator.
+var ErrInvalidProjection = errors.New("invalid projection")
+
+// Projection is a compiled projection. Projections are immutable and
+// safe for concurrent use.
+type Projection struct {
+	root    *node
+	exclude bool
+}
+
+// node is one level of a projection: the fields of a document, or of
+// the documents in an array.
+type node struct {
+	fields []*field
+}
+
+// field is the projection of a single key: a field to include or
+// exclude, a nested projection, or an operator.
+type field struct {
+	key       string
+	include   bool
+	child     *node
+	slice     *slice
+	elemMatch *match.ElementMatcher
+}
+
+type slice struct {
+	skip  int
+	limit int
+	// fromEnd is set when skip counts from the end of the array.
+	fromEnd bool
+}
+
+func (n *node) find(key string) *field {
+	for _, f := range n.fields {
+		if f.key == key {
+			return f
+		}
+	}
+	return nil
+}
+
+// add inserts a field for the path, creating nested nodes as needed.
+func (n *node) add(path birch.Path, f *field) error {
+	for idx, key := range path[:len(path)-1] {
+		existing := n.find(key)
+		switch {
+		case existing == nil:
+			existing = &field{key: key, child: &node{}}
+			n.fields = append(n.fields, existing)
+		case existing.child == nil:
+			return invalidf("path collision at %q", path[:idx+1].String())
+		}
+		n = existing.child
+	}
+
+	f.key = path[len(path)-1]
+	if n.find(f.key) != nil {
+		return invalidf("path collision at %q", path.String())
+	}
+	n.fields = append(n.fields, f)
+
+	return nil
+}
+
+// Project applies the projection specification to the document.
+func Project(doc, spec *birch.Document) (*birch.Document, error) {
+	p, err := Compile(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Apply(doc)
+}
+
+// ProjectReader applies the projection specification to the document
+// in the reader, and returns the result as a new Reader.
+func ProjectReader(r birch.Reader, spec *birch.Document) (birch.Reader, error) {
+	p, err := Compile(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.ApplyReader(r)
+}
+
+// Compile converts a projection specification into a Projection. A
+// nil or empty specification returns documents unchanged.
+func Compile(spec *birch.Document) (*Projection, error) {
+	p := &Projection{root: &node{}, exclude: true}
+	if spec == nil {
+		return p, nil
+	}
+
+	var includes, excludes bool
+	if err := p.compile(spec, nil, &includes, &excludes); err != nil {
+		return nil, err
+	}
+	if includes && excludes {
+		return nil, invalidf("cannot mix inclusion and exclusion")
+	}
+
+	id := p.root.find("_id")
+	switch {
+	case includes:
+		p.exclude = false
+		if id == nil {
+			p.root.fields = append([]*field{{key: "_id", include: true}}, p.root.fields...)
+		}
+	case id != nil && id.child == nil && id.slice == nil && id.include:
+		// {_id: 1} alone only includes _id.
+		p.exclude = false
+	}
+
+	return p, nil
+}
+
+func (p *Projection) compile(spec *birch.Document, prefix birch.Path, includes, excludes *bool) error {
+	for elem := range spec.Iterator() {
+		sub, err := parseFieldPath(elem.Key())
+		if err != nil {
+			return err
+		}
+		path := append(append(birch.Path{}, prefix...), sub...)
+		val := elem.Value()
+
+		switch val.Type() {
+		case bsontype.Boolean, bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+			include := truthy(val)
+			if path.String() != "_id" {
+				if include {
+					*includes = true
+				} else {
+					*excludes = true
+				}
+			}
+			if err := p.root.add(path, &field{include: include}); err != nil {
+				return err
+			}
+		case bsontype.EmbeddedDocument:
+			doc := val.MutableDocument()
+			if !isOperatorDocument(doc) {
+				if doc.Len() == 0 {
+					return invalidf("empty projection for %q", path.String())
+				}
+				if err := p.compile(doc, path, includes, excludes); err != nil {
+					return err
+				}
+				continue
+			}
+
+			f, err := compileOperator(path, doc)
+			if err != nil {
+				return err
+			}
+			if f.elemMatch != nil {
+				*includes = true
+			}
+			if err := p.root.add(path, f); err != nil {
+				return err
+			}
+		default:
+			return invalidf("unsupported value %s for %q", val.Type(), path.String())
+		}
+	}
+
+	return nil
+}
+
+func compileOperator(path birch.Path, doc *birch.Document) (*field, error) {
+	if doc.Len() != 1 {
+		return nil, invalidf("projection for %q must have exactly one operator", path.String())
+	}
+
+	elem := doc.ElementAt(0)
+	switch elem.Key() {
+	case "$slice":
+		s, err := compileSlice(path, elem.Value())
+		if err != nil {
+			return nil, err
+		}
+		return &field{slice: s}, nil
+	case "$elemMatch":
+		if len(path) != 1 {
+			return nil, invalidf("$elemMatch is not supported on dotted path %q", path.String())
+		}
+		if elem.Value().Type() != bsontype.EmbeddedDocument {
+			return nil, invalidf("$elemMatch for %q requires a document", path.String())
+		}
+		m, err := match.CompileElement(elem.Value())
+		if err != nil {
+			return nil, fmt.Errorf("%w: $elemMatch for %q: %w", ErrInvalidProjection, path.String(), err)
+		}
+		return &field{elemMatch: m}, nil
+	default:
+		return nil, invalidf("unsupported operator %q for %q", elem.Key(), path.String())
+	}
+}
+
+func compileSlice(path birch.Path, val *birch.Value) (*slice, error) {
+	if n, ok := asInt(val); ok {
+		if n < 0 {
+			return &slice{skip: -n, limit: -n, fromEnd: true}, nil
+		}
+		return &slice{limit: n}, nil
+	}
+
+	arr, ok := val.MutableArrayOK()
+	if !ok || arr.Len() != 2 {
+		return nil, invalidf("$slice for %q requires a number or an array of two numbers", path.String())
+	}
+
+	first, _ := arr.Lookup(0)
+	second, _ := arr.Lookup(1)
+	skip, ok := asInt(first)
+	limit, ok2 := asInt(second)
+	if !ok || !ok2 {
+		return nil, invalidf("$slice for %q requires integer values", path.String())
+	}
+	if limit <= 0 {
+		return nil, invalidf("$slice limit for %q must be positive", path.String())
+	}
+
+	if skip < 0 {
+		return &slice{skip: -skip, limit: limit, fromEnd: true}, nil
+	}
+	return &slice{skip: skip, limit: limit}, nil
+}
+
+// bounds returns the range of indexes in an array of the given length
+// that the slice selects.
+func (s *slice) bounds(length int) (int, int) {
+	start := s.skip
+	if s.fromEnd {
+		start = max(length-s.skip, 0)
+	}
+	start = min(start, length)
+
+	return start, min(start+s.limit, length)
+}
+
+// Apply returns a new document with the projection applied to the
+// document, which is not modified.
+func (p *Projection) Apply(doc *birch.Document) (*birch.Document, error) {
+	if doc == nil {
+		return nil, bsonerr.NilDocument
+	}
+
+	data, err := doc.MarshalBSON()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := p.ApplyReader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return birch.ReadDocument(out)
+}
+
+// ApplyReader returns a new Reader with the projection applied to the
+// document in the reader, copying the encoded values that it includes
+// without constructing documents.
+func (p *Projection) ApplyReader(r birch.Reader) (birch.Reader, error) {
+	if _, err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	w := birch.NewDocumentWriter(nil, birch.DocumentWriterOptions{})
+	if err := w.Begin(); err != nil {
+		return nil, err
+	}
+	if err := p.document(w, p.root, r); err != nil {
+		return nil, err
+	}
+	if err := w.End(); err != nil {
+		return nil, err
+	}
+
+	return w.Bytes(), nil
+}
+
+// document writes the fields of the document that the node selects.
+// Values selected with $elemMatch, which is only valid at the top
+// level, follow all other fields.
+func (p *Projection) document(w *birch.DocumentWriter, n *node, r birch.Reader) error {
+	var matched []*birch.Element
+
+	for elem, err := range r.Iterator() {
+		if err != nil {
+			return err
+		}
+
+		f := n.find(elem.Key())
+		switch {
+		case f == nil:
+			if p.exclude {
+				err = w.WriteElement(elem)
+			}
+		case f.elemMatch != nil:
+			matched = append(matched, elem)
+		case f.slice != nil:
+			err = p.slice(w, f.slice, elem)
+		case f.child != nil:
+			err = p.nested(w, f.child, elem.Key(), elem.Value())
+		case f.include:
+			err = w.WriteElement(elem)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, elem := range matched {
+		if err := p.elemMatch(w, n.find(elem.Key()).elemMatch, elem); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nested applies the projection for the nested node to the value,
+// which is included as is when it is not a document or an array, in
+// exclusion mode, or omitted, in inclusion mode.
+func (p *Projection) nested(w *birch.DocumentWriter, n *node, key string, val *birch.Value) error {
+	switch val.Type() {
+	case bsontype.EmbeddedDocument:
+		if err := w.BeginDocument(key); err != nil {
+			return err
+		}
+		if err := p.document(w, n, val.ReaderDocument()); err != nil {
+			return err
+		}
+		return w.End()
+	case bsontype.Array:
+		if err := w.BeginArray(key); err != nil {
+			return err
+		}
+		for elem, err := range val.ReaderArray().Iterator() {
+			if err != nil {
+				return err
+			}
+			if elem.Value().Type() != bsontype.EmbeddedDocument && elem.Value().Type() != bsontype.Array {
+				if p.exclude {
+					err = w.WriteElement(elem)
+				}
+			} else {
+				err = p.nested(w, n, elem.Key(), elem.Value())
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return w.End()
+	default:
+		if p.exclude {
+			return w.WriteValue(key, val)
+		}
+		return nil
+	}
+}
+
+func (p *Projection) slice(w *birch.DocumentWriter, s *slice, elem *birch.Element) error {
+	arr, ok := elem.Value().ReaderArrayOK()
+	if !ok {
+		return w.WriteElement(elem)
+	}
+
+	length := 0
+	for _, err := range arr.Iterator() {
+		if err != nil {
+			return err
+		}
+		length++
+	}
+	start, end := s.bounds(length)
+
+	if err := w.BeginArray(elem.Key()); err != nil {
+		return err
+	}
+
+	idx := 0
+	for value, err := range arr.Iterator() {
+		if err != nil {
+			return err
+		}
+		if idx >= start && idx < end {
+			if err := w.WriteElement(value); err != nil {
+				return err
+			}
+		}
+		idx++
+	}
+
+	return w.End()
+}
+
+// elemMatch writes an array of the first value in the array that
+// matches, and omits the field when there is no match.
+func (p *Projection) elemMatch(w *birch.DocumentWriter, m *match.ElementMatcher, elem *birch.Element) error {
+	arr, ok := elem.Value().ReaderArrayOK()
+	if !ok {
+		return nil
+	}
+
+	for value, err := range arr.Iterator() {
+		if err != nil {
+			return err
+		}
+		if !m.Match(value.Value()) {
+			continue
+		}
+
+		if err := w.BeginArray(elem.Key()); err != nil {
+			return err
+		}
+		if err := w.WriteElement(value); err != nil {
+			return err
+		}
+		return w.End()
+	}
+
+	return nil
+}
+
+func parseFieldPath(key string) (birch.Path, error) {
+	if key == "" {
+		return nil, invalidf("empty field path")
+	}
+
+	path := birch.ParsePath(key)
+	for _, part := range path {
+		if part == "" {
+			return nil, invalidf("invalid field path %q", key)
+		}
+		if strings.HasPrefix(part, "$") {
+			return nil, invalidf("unsupported field path %q", key)
+		}
+	}
+
+	return path, nil
+}
+
+func isOperatorDocument(doc *birch.Document) bool {
+	for elem := range doc.Iterator() {
+		if strings.HasPrefix(elem.Key(), "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func truthy(val *birch.Value) bool {
+	switch val.Type() {
+	case bsontype.Boolean:
+		return val.Boolean()
+	default:
+		return birch.Compare(val, birch.VC.Int32(0)) != 0
+	}
+}
+
+func asInt(val *birch.Value) (int, bool) {
+	switch val.Type() {
+	case bsontype.Int32:
+		return int(val.Int32()), true
+	case bsontype.Int64:
+		return int(val.Int64()), true
+	case bsontype.Double:
+		f := val.Double()
+		if f != float64(int(f)) {
+			return 0, false
+		}
+		return int(f), true
+	default:
+		return 0, false
+	}
+}
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidProjection, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,191 @@
+package projection
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/internal/birchtest"
+)
+
+func TestProject(t *testing.T) {
+	const input = `{"_id":1,"name":"widget","size":{"h":10,"w":20,"unit":"cm"},` +
+		`"tags":["a","b","c","d"],` +
+		`"parts":[{"id":1,"qty":5},{"id":2,"qty":2},3],` +
+		`"matrix":[[{"x":1,"y":2}],{"x":3}]}`
+
+	for _, tc := range []struct {
+		name     string
+		spec     string
+		expected string
+	}{
+		{
+			name:     "Empty",
+			spec:     `{}`,
+			expected: input,
+		},
+		{
+			name:     "Inclusion",
+			spec:     `{"name":1,"tags":true}`,
+			expected: `{"_id":1,"name":"widget","tags":["a","b","c","d"]}`,
+		},
+		{
+			name:     "InclusionDocumentOrder",
+			spec:     `{"tags":1,"name":1}`,
+			expected: `{"_id":1,"name":"widget","tags":["a","b","c","d"]}`,
+		},
+		{
+			name:     "InclusionWithoutID",
+			spec:     `{"_id":0,"name":1}`,
+			expected: `{"name":"widget"}`,
+		},
+		{
+			name:     "OnlyID",
+			spec:     `{"_id":1}`,
+			expected: `{"_id":1}`,
+		},
+		{
+			name:     "ExcludeID",
+			spec:     `{"_id":0}`,
+			expected: `{"name":"widget","size":{"h":10,"w":20,"unit":"cm"},"tags":["a","b","c","d"],"parts":[{"id":1,"qty":5},{"id":2,"qty":2},3],"matrix":[[{"x":1,"y":2}],{"x":3}]}`,
+		},
+		{
+			name:     "Exclusion",
+			spec:     `{"size":0,"parts":0,"matrix":0}`,
+			expected: `{"_id":1,"name":"widget","tags":["a","b","c","d"]}`,
+		},
+		{
+			name:     "NestedInclusion",
+			spec:     `{"size.h":1,"parts.qty":1,"matrix.x":1}`,
+			expected: `{"_id":1,"size":{"h":10},"parts":[{"qty":5},{"qty":2}],"matrix":[[{"x":1}],{"x":3}]}`,
+		},
+		{
+			name:     "NestedDocumentSpec",
+			spec:     `{"_id":0,"size":{"h":1,"w":1}}`,
+			expected: `{"size":{"h":10,"w":20}}`,
+		},
+		{
+			name:     "NestedExclusion",
+			spec:     `{"size.unit":0,"parts.id":0,"tags":0,"matrix":0}`,
+			expected: `{"_id":1,"name":"widget","size":{"h":10,"w":20},"parts":[{"qty":5},{"qty":2},3]}`,
+		},
+		{
+			name:     "NestedPathThroughScalar",
+			spec:     `{"name.first":1}`,
+			expected: `{"_id":1}`,
+		},
+		{
+			name:     "NestedExclusionThroughScalar",
+			spec:     `{"_id":0,"name.first":0,"size":0,"tags":0,"parts":0,"matrix":0}`,
+			expected: `{"name":"widget"}`,
+		},
+		{
+			name:     "Slice",
+			spec:     `{"tags":{"$slice":2},"size":0,"parts":0,"matrix":0}`,
+			expected: `{"_id":1,"name":"widget","tags":["a","b"]}`,
+		},
+		{
+			name:     "SliceAlone",
+			spec:     `{"tags":{"$slice":-1},"_id":0,"size":0,"parts":0,"matrix":0}`,
+			expected: `{"name":"widget","tags":["d"]}`,
+		},
+		{
+			name:     "SliceSkipLimit",
+			spec:     `{"name":1,"tags":{"$slice":[1,2]}}`,
+			expected: `{"_id":1,"name":"widget","tags":["b","c"]}`,
+		},
+		{
+			name:     "SliceNegativeSkip",
+			spec:     `{"tags":{"$slice":[-3,2]},"_id":0,"name":1}`,
+			expected: `{"name":"widget","tags":["b","c"]}`,
+		},
+		{
+			name:     "SliceOutOfRange",
+			spec:     `{"_id":0,"name":1,"tags":{"$slice":[10,2]}}`,
+			expected: `{"name":"widget","tags":[]}`,
+		},
+		{
+			name:     "SliceNonArray",
+			spec:     `{"_id":0,"name":{"$slice":1},"size":0,"tags":0,"parts":0,"matrix":0}`,
+			expected: `{"name":"widget"}`,
+		},
+		{
+			name:     "ElemMatch",
+			spec:     `{"parts":{"$elemMatch":{"qty":{"$lt":3}}}}`,
+			expected: `{"_id":1,"parts":[{"id":2,"qty":2}]}`,
+		},
+		{
+			name:     "ElemMatchFollowsFields",
+			spec:     `{"_id":0,"parts":{"$elemMatch":{"id":1}},"name":1}`,
+			expected: `{"name":"widget","parts":[{"id":1,"qty":5}]}`,
+		},
+		{
+			name:     "ElemMatchNoMatch",
+			spec:     `{"parts":{"$elemMatch":{"id":5}}}`,
+			expected: `{"_id":1}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := birchtest.Document(t, input)
+			spec := birchtest.Document(t, tc.spec)
+			expected := birchtest.Document(t, tc.expected)
+
+			out, err := Project(doc, spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != expected.String() {
+				t.Errorf("got %s, expected %s", out, expected)
+			}
+
+			data, err := doc.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader, err := ProjectReader(data, spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, _ := expected.MarshalBSON(); !bytes.Equal(reader, want) {
+				t.Errorf("reader: got %s, expected %s", reader, expected)
+			}
+			if doc.String() != birchtest.Document(t, input).String() {
+				t.Errorf("document modified: %s", doc)
+			}
+		})
+	}
+	t.Run("Invalid", func(t *testing.T) {
+		for _, spec := range []string{
+			`{"a":1,"b":0}`,
+			`{"a":1,"a.b":1}`,
+			`{"a.b":1,"a":1}`,
+			`{"a":"yes"}`,
+			`{"a":{}}`,
+			`{"a":{"$unknown":1}}`,
+			`{"a":{"$slice":1,"$elemMatch":{}}}`,
+			`{"a":{"$slice":"x"}}`,
+			`{"a":{"$slice":[1]}}`,
+			`{"a":{"$slice":[1,0]}}`,
+			`{"a":{"$elemMatch":1}}`,
+			`{"a.b":{"$elemMatch":{"c":1}}}`,
+			`{"a":{"$elemMatch":{"c":{"$unknown":1}}}}`,
+			`{"a":0,"b":{"$elemMatch":{"c":1}}}`,
+			`{"a..b":1}`,
+			`{"a.$":1}`,
+		} {
+			if _, err := Compile(birchtest.Document(t, spec)); !errors.Is(err, ErrInvalidProjection) {
+				t.Errorf("%s: unexpected error %v", spec, err)
+			}
+		}
+	})
+	t.Run("InvalidReader", func(t *testing.T) {
+		p, err := Compile(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.ApplyReader(birch.Reader{5, 0, 0, 0, 1}); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
@@ -265,6 +265,11 @@ func (r Reader) readElements(f func(e *Element) error) (uint32, error) {
 		}
 
 		if r[pos] == '\x00' {
+			if pos != end-1 {
+				// the terminator must be the last byte of
+				// the document.
+				return pos, bsonerr.InvalidReadOnlyDocument
+			}
 			break
 		}
 
@@ -0,0 +1,193 @@
+package birch
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/tychoish/birch/types"
+	"github.com/tychoish/fun/adt"
+)
+
+// this file contains the struct tag parsing and the cached per-type
+// field plans shared by the reflection-based encoder and decoder.
+
+var (
+	timeType          = reflect.TypeFor[time.Time]()
+	objectIDType      = reflect.TypeFor[types.ObjectID]()
+	decimalType       = reflect.TypeFor[types.Decimal128]()
+	timestampType     = reflect.TypeFor[types.Timestamp]()
+	regexType         = reflect.TypeFor[types.Regex]()
+	dbPointerType     = reflect.TypeFor[types.DBPointer]()
+	codeWithScopeType = reflect.TypeFor[types.CodeWithScope]()
+	binaryType        = reflect.TypeFor[types.Binary]()
+	documentPtrType   = reflect.TypeFor[*Document]()
+	arrayPtrType      = reflect.TypeFor[*Array]()
+	valuePtrType      = reflect.TypeFor[*Value]()
+	readerType        = reflect.TypeFor[Reader]()
+	byteSliceType     = reflect.TypeFor[[]byte]()
+)
+
+// structField describes how a single (possibly promoted) field of a
+// struct maps to a key in a document.
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// structPlan is the cached description of a struct type used by the
+// reflection encoder and decoder.
+type structPlan struct {
+	fields []structField
+	byName map[string]int
+	// inlineMap is the index of a map field tagged inline, which
+	// collects keys that do not correspond to other fields.
+	inlineMap []int
+}
+
+type structPlanEntry struct {
+	plan *structPlan
+	err  error
+}
+
+var structPlans = &adt.SyncMap[reflect.Type, structPlanEntry]{}
+
+// getStructPlan returns the (cached) field plan for the struct type.
+func getStructPlan(rt reflect.Type) (*structPlan, error) {
+	if entry, ok := structPlans.Load(rt); ok {
+		return entry.plan, entry.err
+	}
+
+	plan, err := buildStructPlan(rt)
+	structPlans.Store(rt, structPlanEntry{plan: plan, err: err})
+
+	return plan, err
+}
+
+func buildStructPlan(rt reflect.Type) (*structPlan, error) {
+	plan := &structPlan{byName: map[string]int{}}
+
+	if err := plan.addFields(rt, nil); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (p *structPlan) addFields(rt reflect.Type, parent []int) error {
+	for idx := 0; idx < rt.NumField(); idx++ {
+		field := rt.Field(idx)
+
+		tag, ok := parseStructTag(field)
+		if !ok {
+			continue
+		}
+
+		index := make([]int, len(parent), len(parent)+1)
+		copy(index, parent)
+		index = append(index, idx)
+
+		if tag.inline {
+			ft := field.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+
+			switch {
+			case ft.Kind() == reflect.Struct && field.Type.Kind() == reflect.Pointer && !field.IsExported():
+				return fmt.Errorf("inline field %s.%s cannot be an unexported pointer", rt, field.Name)
+			case ft.Kind() == reflect.Struct:
+				if err := p.addFields(ft, index); err != nil {
+					return err
+				}
+				continue
+			case field.Type.Kind() == reflect.Map && field.Type.Key().Kind() == reflect.String:
+				if p.inlineMap != nil {
+					return fmt.Errorf("multiple inline maps in struct %s", rt)
+				}
+				p.inlineMap = index
+				continue
+			default:
+				return fmt.Errorf("inline field %s.%s of type %s must be a struct or a map with string keys", rt, field.Name, field.Type)
+			}
+		}
+
+		if _, ok := p.byName[tag.name]; ok {
+			return fmt.Errorf("duplicated key %q in struct %s", tag.name, rt)
+		}
+
+		p.byName[tag.name] = len(p.fields)
+		p.fields = append(p.fields, structField{
+			name:      tag.name,
+			index:     index,
+			omitEmpty: tag.omitEmpty,
+		})
+	}
+
+	return nil
+}
+
+type structTag struct {
+	name      string
+	omitEmpty bool
+	inline    bool
+}
+
+// parseStructTag interprets the bson struct tag of a field, which has
+// the form `bson:"name,omitempty,inline"`. The second return value is
+// false for fields that should be ignored: unexported fields and
+// fields tagged with "-".
+func parseStructTag(field reflect.StructField) (structTag, bool) {
+	raw, hasTag := field.Tag.Lookup("bson")
+	if raw == "-" {
+		return structTag{}, false
+	}
+
+	var tag structTag
+
+	name, opts, _ := strings.Cut(raw, ",")
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		switch opt {
+		case "omitempty":
+			tag.omitEmpty = true
+		case "inline":
+			tag.inline = true
+		}
+	}
+
+	if !field.IsExported() && !(field.Anonymous && tag.inline) {
+		return structTag{}, false
+	}
+
+	if !hasTag || name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	tag.name = name
+
+	return tag, true
+}
+
+// fieldByIndex resolves a (possibly promoted) field, allocating nil
+// embedded pointers along the way when alloc is true. When alloc is
+// false and a nil embedded pointer is encountered, the second value
+// is false.
+func fieldByIndex(rv reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, idx := range index {
+		if i > 0 && rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				if !alloc {
+					return reflect.Value{}, false
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(idx)
+	}
+
+	return rv, true
+}
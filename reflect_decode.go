@@ -0,0 +1,404 @@
+package birch
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/types"
+)
+
+// DecodeError is returned by Document.Unmarshal when a value in the
+// document cannot be stored in the Go value at the corresponding
+// location. Path is the dotted path of the value in the document,
+// with array indexes rendered as numbers.
+type DecodeError struct {
+	Path   string
+	Type   bsontype.Type
+	Target reflect.Type
+	Err    error
+}
+
+// Error implements the error interface.
+func (e *DecodeError) Error() string {
+	msg := fmt.Sprintf("cannot decode %s into %s at %q", e.Type, e.Target, e.Path)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying cause of the error, if any.
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+var errOverflow = errors.New("value overflows target type")
+
+// unmarshalReflect is the fallback for Registry.Unmarshal when the
+// target does not implement one of the unmarshaling interfaces, and
+// populates structs (and maps with string keys) using reflection.
+func (r *Registry) unmarshalReflect(d *Document, into any) error {
+	rv := reflect.ValueOf(into)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("cannot unmarshal into %T", into)
+	}
+
+	rv = rv.Elem()
+	switch rv.Kind() {
+	case reflect.Struct, reflect.Map:
+		return r.decodeDocument("", d, rv)
+	default:
+		return fmt.Errorf("cannot unmarshal into %T", into)
+	}
+}
+
+func joinPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func (r *Registry) decodeDocument(path string, d *Document, rv reflect.Value) error {
+	switch rv.Kind() {
+	case reflect.Struct:
+		return r.decodeStruct(path, d, rv)
+	case reflect.Map:
+		return r.decodeMap(path, d, rv)
+	default:
+		return &DecodeError{Path: path, Type: bsontype.EmbeddedDocument, Target: rv.Type()}
+	}
+}
+
+func (r *Registry) decodeStruct(path string, d *Document, rv reflect.Value) error {
+	plan, err := getStructPlan(rv.Type())
+	if err != nil {
+		return &DecodeError{Path: path, Type: bsontype.EmbeddedDocument, Target: rv.Type(), Err: err}
+	}
+
+	var extra reflect.Value
+	if plan.inlineMap != nil {
+		extra, _ = fieldByIndex(rv, plan.inlineMap, true)
+	}
+
+	for _, elem := range d.elems {
+		key := elem.Key()
+		idx, ok := plan.byName[key]
+		if !ok {
+			if extra.IsValid() {
+				if err := r.decodeMapEntry(path, key, elem.value, extra); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		field, _ := fieldByIndex(rv, plan.fields[idx].index, true)
+		if err := r.decodeValue(joinPath(path, key), elem.value, field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Registry) decodeMap(path string, d *Document, rv reflect.Value) error {
+	if rv.Type().Key().Kind() != reflect.String {
+		return &DecodeError{Path: path, Type: bsontype.EmbeddedDocument, Target: rv.Type()}
+	}
+
+	for _, elem := range d.elems {
+		if err := r.decodeMapEntry(path, elem.Key(), elem.value, rv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Registry) decodeMapEntry(path, key string, val *Value, rv reflect.Value) error {
+	if rv.IsNil() {
+		rv.Set(reflect.MakeMap(rv.Type()))
+	}
+
+	item := reflect.New(rv.Type().Elem()).Elem()
+	if err := r.decodeValue(joinPath(path, key), val, item); err != nil {
+		return err
+	}
+
+	rv.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), item)
+
+	return nil
+}
+
+func (r *Registry) decodeValue(path string, val *Value, rv reflect.Value) error {
+	bt := val.Type()
+	mismatch := func() error { return &DecodeError{Path: path, Type: bt, Target: rv.Type()} }
+
+	if bt == bsontype.Null || bt == bsontype.Undefined {
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+	}
+
+	if dec, ok := r.decoder(rv.Type()); ok {
+		if err := dec(val, rv); err != nil {
+			return &DecodeError{Path: path, Type: bt, Target: rv.Type(), Err: err}
+		}
+		return nil
+	}
+
+	switch rv.Type() {
+	case documentPtrType:
+		doc, ok := val.MutableDocumentOK()
+		if !ok {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(doc.Copy()))
+		return nil
+	case arrayPtrType:
+		arr, ok := val.MutableArrayOK()
+		if !ok {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(&Array{doc: arr.doc.Copy()}))
+		return nil
+	case valuePtrType:
+		rv.Set(reflect.ValueOf(val.Copy()))
+		return nil
+	case readerType:
+		if bt != bsontype.EmbeddedDocument {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(val.ReaderDocument()))
+		return nil
+	case timeType:
+		out, ok := val.TimeOK()
+		if !ok {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(out))
+		return nil
+	case objectIDType:
+		out, ok := val.ObjectIDOK()
+		if !ok {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(out))
+		return nil
+	case decimalType:
+		out, ok := val.Decimal128OK()
+		if !ok {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(out))
+		return nil
+	case timestampType:
+		t, i, ok := val.TimestampOK()
+		if !ok {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(types.Timestamp{T: t, I: i}))
+		return nil
+	case regexType:
+		if bt != bsontype.Regex {
+			return mismatch()
+		}
+		pattern, opts := val.Regex()
+		rv.Set(reflect.ValueOf(types.Regex{Pattern: pattern, Options: opts}))
+		return nil
+	case dbPointerType:
+		db, ptr, ok := val.DBPointerOK()
+		if !ok {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(types.DBPointer{DB: db, Pointer: ptr}))
+		return nil
+	case binaryType:
+		st, data, ok := val.BinaryOK()
+		if !ok {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(types.Binary{Subtype: st, Data: data}))
+		return nil
+	}
+
+	if rv.Kind() != reflect.Pointer && rv.CanAddr() {
+		switch out := rv.Addr().Interface().(type) {
+		case DocumentUnmarshaler:
+			doc, ok := val.MutableDocumentOK()
+			if !ok {
+				return mismatch()
+			}
+			if err := out.UnmarshalDocument(doc); err != nil {
+				return &DecodeError{Path: path, Type: bt, Target: rv.Type(), Err: err}
+			}
+			return nil
+		case Unmarshaler:
+			if bt != bsontype.EmbeddedDocument {
+				return mismatch()
+			}
+			if err := out.UnmarshalBSON(val.ReaderDocument()); err != nil {
+				return &DecodeError{Path: path, Type: bt, Target: rv.Type(), Err: err}
+			}
+			return nil
+		}
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return r.decodeValue(path, val, rv.Elem())
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return mismatch()
+		}
+		if out := r.Interface(val); out != nil {
+			rv.Set(reflect.ValueOf(out))
+		} else {
+			rv.Set(reflect.Zero(rv.Type()))
+		}
+		return nil
+	case reflect.Bool:
+		out, ok := val.BooleanOK()
+		if !ok {
+			return mismatch()
+		}
+		rv.SetBool(out)
+		return nil
+	case reflect.String:
+		switch bt {
+		case bsontype.String:
+			rv.SetString(val.StringValue())
+		case bsontype.Symbol:
+			rv.SetString(val.Symbol())
+		case bsontype.JavaScript:
+			rv.SetString(val.JavaScript())
+		default:
+			return mismatch()
+		}
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		num, ok := valueAsInt64(val)
+		if !ok {
+			return mismatch()
+		}
+		if rv.OverflowInt(num) {
+			return &DecodeError{Path: path, Type: bt, Target: rv.Type(), Err: errOverflow}
+		}
+		rv.SetInt(num)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		num, ok := valueAsInt64(val)
+		if !ok {
+			return mismatch()
+		}
+		if num < 0 || rv.OverflowUint(uint64(num)) {
+			return &DecodeError{Path: path, Type: bt, Target: rv.Type(), Err: errOverflow}
+		}
+		rv.SetUint(uint64(num))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		num, ok := valueAsFloat64(val)
+		if !ok {
+			return mismatch()
+		}
+		if rv.OverflowFloat(num) {
+			return &DecodeError{Path: path, Type: bt, Target: rv.Type(), Err: errOverflow}
+		}
+		rv.SetFloat(num)
+		return nil
+	case reflect.Struct:
+		doc, ok := val.MutableDocumentOK()
+		if !ok {
+			return mismatch()
+		}
+		return r.decodeStruct(path, doc, rv)
+	case reflect.Map:
+		doc, ok := val.MutableDocumentOK()
+		if !ok {
+			return mismatch()
+		}
+		if rv.Type().Key().Kind() != reflect.String {
+			return mismatch()
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMapWithSize(rv.Type(), doc.Len()))
+		}
+		return r.decodeMap(path, doc, rv)
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 && bt == bsontype.Binary {
+			_, data := val.Binary()
+			rv.SetBytes(data)
+			return nil
+		}
+
+		arr, ok := val.MutableArrayOK()
+		if !ok {
+			return mismatch()
+		}
+
+		out := reflect.MakeSlice(rv.Type(), arr.Len(), arr.Len())
+		for idx, elem := range arr.doc.elems {
+			if err := r.decodeValue(joinPath(path, strconv.Itoa(idx)), elem.value, out.Index(idx)); err != nil {
+				return err
+			}
+		}
+		rv.Set(out)
+		return nil
+	case reflect.Array:
+		arr, ok := val.MutableArrayOK()
+		if !ok {
+			return mismatch()
+		}
+		if arr.Len() > rv.Len() {
+			return &DecodeError{Path: path, Type: bt, Target: rv.Type(), Err: fmt.Errorf("array has %d elements", arr.Len())}
+		}
+
+		rv.Set(reflect.Zero(rv.Type()))
+		for idx, elem := range arr.doc.elems {
+			if err := r.decodeValue(joinPath(path, strconv.Itoa(idx)), elem.value, rv.Index(idx)); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return mismatch()
+	}
+}
+
+// valueAsInt64 converts numeric values to an int64, when it is
+// possible to do so without losing information.
+func valueAsInt64(val *Value) (int64, bool) {
+	switch val.Type() {
+	case bsontype.Int32:
+		return int64(val.Int32()), true
+	case bsontype.Int64:
+		return val.Int64(), true
+	case bsontype.Double:
+		f := val.Double()
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(f), true
+	default:
+		return 0, false
+	}
+}
+
+// valueAsFloat64 converts numeric values to a float64.
+func valueAsFloat64(val *Value) (float64, bool) {
+	switch val.Type() {
+	case bsontype.Double:
+		return val.Double(), true
+	case bsontype.Int32:
+		return float64(val.Int32()), true
+	case bsontype.Int64:
+		return float64(val.Int64()), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,412 @@
+package birch
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+
+	"github.com/tychoish/birch/types"
+	"github.com/tychoish/fun/adt"
+)
+
+// EncodeError is returned when a value cannot be converted into BSON
+// using reflection. Path is the dotted path of the value within the
+// document being produced.
+type EncodeError struct {
+	Path string
+	Type reflect.Type
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *EncodeError) Error() string {
+	msg := fmt.Sprintf("cannot encode %s at %q", e.Type, e.Path)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying cause of the error, if any.
+func (e *EncodeError) Unwrap() error { return e.Err }
+
+var errUnsupportedType = errors.New("unsupported type")
+
+// encodeFunc converts a value of a specific type into an element. The
+// registry provides the encoders for the values that the value
+// contains.
+type encodeFunc func(r *Registry, key string, rv reflect.Value) (*Element, error)
+
+var (
+	encoders = &adt.SyncMap[reflect.Type, encodeFunc]{}
+
+	documentMarshalerType = reflect.TypeFor[DocumentMarshaler]()
+	marshalerType         = reflect.TypeFor[Marshaler]()
+)
+
+// reflectElement is the fallback used by EC.Interface for types that
+// are not handled directly.
+func (r *Registry) reflectElement(key string, rv reflect.Value) (*Element, error) {
+	if !rv.IsValid() {
+		return EC.Null(key), nil
+	}
+
+	return r.encode(key, rv)
+}
+
+// encode converts the value using the encoder registered for its type,
+// if there is one, or the encoder for its type.
+func (r *Registry) encode(key string, rv reflect.Value) (*Element, error) {
+	if enc, ok := r.encoder(rv.Type()); ok {
+		return encodeRegistered(enc, key, rv)
+	}
+
+	return encoderFor(rv.Type())(r, key, rv)
+}
+
+// reflectDocument converts structs, pointers to structs, and maps
+// with string keys into documents.
+func (r *Registry) reflectDocument(value any) (*Document, error) {
+	rv := reflect.ValueOf(value)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("value '%v' is of type '%T' which is not convertable to a document", value, value)
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		return r.encodeStruct(rv)
+	case reflect.Map:
+		return r.encodeMap(rv)
+	default:
+		return nil, fmt.Errorf("value '%v' is of type '%T' which is not convertable to a document", value, value)
+	}
+}
+
+// encoderFor returns the (cached) encoder for a type. Encoders for
+// composite types resolve the encoders of their members when they
+// run, which keeps recursive types from recursing here.
+func encoderFor(rt reflect.Type) encodeFunc {
+	if enc, ok := encoders.Load(rt); ok {
+		return enc
+	}
+
+	enc := buildEncoder(rt)
+	encoders.Store(rt, enc)
+
+	return enc
+}
+
+func buildEncoder(rt reflect.Type) encodeFunc {
+	switch rt {
+	case timeType, timestampType, documentPtrType, valuePtrType, readerType:
+		return encodeDirect
+	case objectIDType:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			return EC.ObjectID(key, rv.Interface().(types.ObjectID)), nil
+		}
+	case decimalType:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			return EC.Decimal128(key, rv.Interface().(types.Decimal128)), nil
+		}
+	case arrayPtrType:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			if rv.IsNil() {
+				return EC.Null(key), nil
+			}
+			return EC.Array(key, rv.Interface().(*Array)), nil
+		}
+	case regexType:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			rex := rv.Interface().(types.Regex)
+			return EC.Regex(key, rex.Pattern, rex.Options), nil
+		}
+	case dbPointerType:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			ptr := rv.Interface().(types.DBPointer)
+			return EC.DBPointer(key, ptr.DB, ptr.Pointer), nil
+		}
+	case binaryType:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			bin := rv.Interface().(types.Binary)
+			return EC.BinaryWithSubtype(key, bin.Data, bin.Subtype), nil
+		}
+	}
+
+	if rt.Implements(documentMarshalerType) || rt.Implements(marshalerType) {
+		return encodeMarshaler
+	}
+
+	if rt.Kind() != reflect.Pointer && (reflect.PointerTo(rt).Implements(documentMarshalerType) || reflect.PointerTo(rt).Implements(marshalerType)) {
+		fallback := buildKindEncoder(rt)
+		return func(r *Registry, key string, rv reflect.Value) (*Element, error) {
+			if rv.CanAddr() {
+				return encodeMarshaler(r, key, rv.Addr())
+			}
+			return fallback(r, key, rv)
+		}
+	}
+
+	return buildKindEncoder(rt)
+}
+
+func buildKindEncoder(rt reflect.Type) encodeFunc {
+	switch rt.Kind() {
+	case reflect.Bool:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			return EC.Boolean(key, rv.Bool()), nil
+		}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			return EC.Int32(key, int32(rv.Int())), nil
+		}
+	case reflect.Int64:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) { return EC.Int64(key, rv.Int()), nil }
+	case reflect.Int:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			return EC.Int(key, int(rv.Int())), nil
+		}
+	case reflect.Uint8, reflect.Uint16:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			return EC.Int32(key, int32(rv.Uint())), nil
+		}
+	case reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return encodeUint
+	case reflect.Float32, reflect.Float64:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			return EC.Double(key, rv.Float()), nil
+		}
+	case reflect.String:
+		return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+			return EC.String(key, rv.String()), nil
+		}
+	case reflect.Struct:
+		return func(r *Registry, key string, rv reflect.Value) (*Element, error) {
+			doc, err := r.encodeStruct(rv)
+			if err != nil {
+				return nil, prefixEncodeError(key, err)
+			}
+			return EC.SubDocument(key, doc), nil
+		}
+	case reflect.Map:
+		if rt.Key().Kind() != reflect.String {
+			return encodeUnsupported
+		}
+		return func(r *Registry, key string, rv reflect.Value) (*Element, error) {
+			doc, err := r.encodeMap(rv)
+			if err != nil {
+				return nil, prefixEncodeError(key, err)
+			}
+			return EC.SubDocument(key, doc), nil
+		}
+	case reflect.Slice:
+		if rt.Elem().Kind() == reflect.Uint8 {
+			return func(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+				return EC.Binary(key, rv.Bytes()), nil
+			}
+		}
+		return encodeSequence
+	case reflect.Array:
+		return encodeSequence
+	case reflect.Pointer:
+		return func(r *Registry, key string, rv reflect.Value) (*Element, error) {
+			if rv.IsNil() {
+				return EC.Null(key), nil
+			}
+			return r.encode(key, rv.Elem())
+		}
+	case reflect.Interface:
+		return func(r *Registry, key string, rv reflect.Value) (*Element, error) {
+			if rv.IsNil() {
+				return EC.Null(key), nil
+			}
+			// use the fast path for the dynamic type when possible
+			return r.interfaceElement(key, rv.Elem().Interface())
+		}
+	default:
+		return encodeUnsupported
+	}
+}
+
+func encodeDirect(r *Registry, key string, rv reflect.Value) (*Element, error) {
+	elem, err := r.interfaceElement(key, rv.Interface())
+	if err != nil {
+		return nil, prefixEncodeError(key, err)
+	}
+	if elem == nil {
+		return EC.Null(key), nil
+	}
+	return elem, nil
+}
+
+func encodeMarshaler(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+	if rv.Kind() == reflect.Pointer && rv.IsNil() {
+		return EC.Null(key), nil
+	}
+
+	var (
+		elem *Element
+		err  error
+	)
+
+	switch t := rv.Interface().(type) {
+	case DocumentMarshaler:
+		elem, err = ECE.DocumentMarshaler(key, t)
+	case Marshaler:
+		elem, err = ECE.Marshaler(key, t)
+	}
+
+	if err != nil {
+		return nil, &EncodeError{Path: key, Type: rv.Type(), Err: err}
+	}
+
+	return elem, nil
+}
+
+func encodeUint(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+	val := rv.Uint()
+	switch {
+	case val < math.MaxInt32:
+		return EC.Int32(key, int32(val)), nil
+	case val > math.MaxInt64:
+		return nil, &EncodeError{
+			Path: key,
+			Type: rv.Type(),
+			Err:  fmt.Errorf("BSON only has signed integer types and %d overflows an int64", val),
+		}
+	default:
+		return EC.Int64(key, int64(val)), nil
+	}
+}
+
+func encodeUnsupported(_ *Registry, key string, rv reflect.Value) (*Element, error) {
+	return nil, &EncodeError{Path: key, Type: rv.Type(), Err: errUnsupportedType}
+}
+
+func encodeSequence(r *Registry, key string, rv reflect.Value) (*Element, error) {
+	arr := MakeArray(rv.Len())
+
+	for idx := 0; idx < rv.Len(); idx++ {
+		elem, err := r.encode("", rv.Index(idx))
+		if err != nil {
+			return nil, prefixEncodeError(key, prefixEncodeError(strconv.Itoa(idx), err))
+		}
+		arr.Append(elem.value)
+	}
+
+	return EC.Array(key, arr), nil
+}
+
+func (r *Registry) encodeStruct(rv reflect.Value) (*Document, error) {
+	plan, err := getStructPlan(rv.Type())
+	if err != nil {
+		return nil, &EncodeError{Type: rv.Type(), Err: err}
+	}
+
+	doc := DC.Make(len(plan.fields))
+
+	for _, field := range plan.fields {
+		fv, ok := fieldByIndex(rv, field.index, false)
+		if !ok || (field.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+
+		elem, err := r.encode(field.name, fv)
+		if err != nil {
+			return nil, err
+		}
+		doc.Append(elem)
+	}
+
+	if plan.inlineMap == nil {
+		return doc, nil
+	}
+
+	extra, ok := fieldByIndex(rv, plan.inlineMap, false)
+	if !ok || extra.Len() == 0 {
+		return doc, nil
+	}
+
+	keys := sortedMapKeys(extra)
+	for _, key := range keys {
+		name := key.String()
+		if _, ok := plan.byName[name]; ok {
+			return nil, &EncodeError{Path: name, Type: extra.Type(), Err: errors.New("inline map key conflicts with a struct field")}
+		}
+
+		elem, err := r.encode(name, extra.MapIndex(key))
+		if err != nil {
+			return nil, err
+		}
+		doc.Append(elem)
+	}
+
+	return doc, nil
+}
+
+func (r *Registry) encodeMap(rv reflect.Value) (*Document, error) {
+	if rv.Type().Key().Kind() != reflect.String {
+		return nil, &EncodeError{Type: rv.Type(), Err: errUnsupportedType}
+	}
+
+	doc := DC.Make(rv.Len())
+
+	for _, key := range sortedMapKeys(rv) {
+		elem, err := r.encode(key.String(), rv.MapIndex(key))
+		if err != nil {
+			return nil, err
+		}
+		doc.Append(elem)
+	}
+
+	return doc, nil
+}
+
+// sortedMapKeys returns the keys of a map with string keys in
+// order, so that encoding maps produces stable documents.
+func sortedMapKeys(rv reflect.Value) []reflect.Value {
+	keys := rv.MapKeys()
+	slices.SortFunc(keys, func(a, b reflect.Value) int {
+		switch {
+		case a.String() < b.String():
+			return -1
+		case a.String() > b.String():
+			return 1
+		default:
+			return 0
+		}
+	})
+	return keys
+}
+
+func prefixEncodeError(key string, err error) error {
+	var eerr *EncodeError
+	if !errors.As(err, &eerr) {
+		return err
+	}
+
+	if eerr.Path == "" {
+		eerr.Path = key
+	} else if key != "" {
+		eerr.Path = key + "." + eerr.Path
+	}
+	return eerr
+}
+
+// isEmptyValue reports whether a value should be omitted by the
+// omitempty tag option.
+func isEmptyValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	default:
+		return rv.IsZero()
+	}
+}
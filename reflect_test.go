@@ -0,0 +1,302 @@
+package birch
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/types"
+)
+
+type reflectInner struct {
+	Name  string `bson:"name"`
+	Count int    `bson:"count,omitempty"`
+}
+
+type reflectBase struct {
+	ID types.ObjectID `bson:"_id"`
+}
+
+type reflectOuter struct {
+	reflectBase `bson:",inline"`
+	Title       string `bson:"title"`
+	Untagged    int64
+	Skipped     string            `bson:"-"`
+	Ratio       float64           `bson:"ratio"`
+	Created     time.Time         `bson:"created"`
+	Amount      types.Decimal128  `bson:"amount"`
+	Inner       reflectInner      `bson:"inner"`
+	InnerPtr    *reflectInner     `bson:"inner_ptr"`
+	Tags        []string          `bson:"tags"`
+	Items       []reflectInner    `bson:"items"`
+	Counts      map[string]int    `bson:"counts"`
+	Blob        []byte            `bson:"blob"`
+	Any         any               `bson:"any"`
+	Extra       map[string]string `bson:",inline"`
+}
+
+func TestReflectDecode(t *testing.T) {
+	oid := types.NewObjectID()
+	now := time.Unix(1700000000, 123000000)
+	dec, err := types.ParseDecimal128("1.25")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Struct", func(t *testing.T) {
+		doc := DC.Elements(
+			EC.ObjectID("_id", oid),
+			EC.String("title", "hello"),
+			EC.Int64("untagged", 42),
+			EC.String("skipped", "nope"),
+			EC.Int32("ratio", 3),
+			EC.Time("created", now),
+			EC.Decimal128("amount", dec),
+			EC.SubDocumentFromElements("inner", EC.String("name", "a"), EC.Int32("count", 2)),
+			EC.SubDocumentFromElements("inner_ptr", EC.String("name", "b")),
+			EC.SliceString("tags", []string{"x", "y"}),
+			EC.ArrayFromElements("items", VC.DocumentFromElements(EC.String("name", "c"))),
+			EC.SubDocumentFromElements("counts", EC.Int32("one", 1), EC.Int64("two", 2)),
+			EC.Binary("blob", []byte("data")),
+			EC.Boolean("any", true),
+			EC.String("leftover", "kept"),
+		)
+
+		out := &reflectOuter{}
+		if err := doc.Unmarshal(out); err != nil {
+			t.Fatal(err)
+		}
+
+		if out.ID != oid {
+			t.Error("inline object id not decoded")
+		}
+		if out.Title != "hello" || out.Untagged != 42 || out.Skipped != "" || out.Ratio != 3 {
+			t.Errorf("unexpected scalar fields: %+v", out)
+		}
+		if !out.Created.Equal(now) {
+			t.Errorf("time mismatch: %s != %s", out.Created, now)
+		}
+		if out.Amount.String() != "1.25" {
+			t.Errorf("decimal mismatch: %s", out.Amount)
+		}
+		if out.Inner.Name != "a" || out.Inner.Count != 2 {
+			t.Errorf("unexpected inner: %+v", out.Inner)
+		}
+		if out.InnerPtr == nil || out.InnerPtr.Name != "b" {
+			t.Errorf("unexpected inner pointer: %+v", out.InnerPtr)
+		}
+		if len(out.Tags) != 2 || out.Tags[1] != "y" {
+			t.Errorf("unexpected tags: %v", out.Tags)
+		}
+		if len(out.Items) != 1 || out.Items[0].Name != "c" {
+			t.Errorf("unexpected items: %v", out.Items)
+		}
+		if out.Counts["one"] != 1 || out.Counts["two"] != 2 {
+			t.Errorf("unexpected counts: %v", out.Counts)
+		}
+		if string(out.Blob) != "data" {
+			t.Errorf("unexpected blob: %q", out.Blob)
+		}
+		if out.Any != true {
+			t.Errorf("unexpected any: %v", out.Any)
+		}
+		// keys for ignored fields are collected by the inline map
+		if out.Extra["leftover"] != "kept" || out.Extra["skipped"] != "nope" || len(out.Extra) != 2 {
+			t.Errorf("unexpected inline map: %v", out.Extra)
+		}
+	})
+	t.Run("NullClearsPointer", func(t *testing.T) {
+		out := &reflectOuter{InnerPtr: &reflectInner{Name: "old"}}
+		if err := DC.Elements(EC.Null("inner_ptr")).Unmarshal(out); err != nil {
+			t.Fatal(err)
+		}
+		if out.InnerPtr != nil {
+			t.Error("null should reset pointer")
+		}
+	})
+	t.Run("Map", func(t *testing.T) {
+		out := map[string]int64{}
+		if err := DC.Elements(EC.Int32("a", 1), EC.Double("b", 2)).Unmarshal(&out); err != nil {
+			t.Fatal(err)
+		}
+		if out["a"] != 1 || out["b"] != 2 {
+			t.Errorf("unexpected map: %v", out)
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		for _, tc := range []struct {
+			name string
+			doc  *Document
+			path string
+			typ  bsontype.Type
+		}{
+			{
+				name: "TopLevel",
+				doc:  DC.Elements(EC.Int32("title", 1)),
+				path: "title",
+				typ:  bsontype.Int32,
+			},
+			{
+				name: "Nested",
+				doc:  DC.Elements(EC.SubDocumentFromElements("inner", EC.Boolean("count", true))),
+				path: "inner.count",
+				typ:  bsontype.Boolean,
+			},
+			{
+				name: "ArrayIndex",
+				doc: DC.Elements(EC.ArrayFromElements("items",
+					VC.DocumentFromElements(EC.String("name", "ok")),
+					VC.DocumentFromElements(EC.Double("name", 1)),
+				)),
+				path: "items.1.name",
+				typ:  bsontype.Double,
+			},
+			{
+				name: "FractionalInteger",
+				doc:  DC.Elements(EC.Double("untagged", 1.5)),
+				path: "untagged",
+				typ:  bsontype.Double,
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				err := tc.doc.Unmarshal(&reflectOuter{})
+				var derr *DecodeError
+				if !errors.As(err, &derr) {
+					t.Fatalf("expected decode error, got %v", err)
+				}
+				if derr.Path != tc.path || derr.Type != tc.typ {
+					t.Errorf("unexpected error details: %v", derr)
+				}
+			})
+		}
+		t.Run("Overflow", func(t *testing.T) {
+			out := &struct {
+				Small int8 `bson:"small"`
+			}{}
+			err := DC.Elements(EC.Int32("small", 1000)).Unmarshal(out)
+			if !errors.Is(err, errOverflow) {
+				t.Errorf("expected overflow, got %v", err)
+			}
+		})
+		t.Run("NonPointer", func(t *testing.T) {
+			if err := DC.New().Unmarshal(reflectOuter{}); err == nil {
+				t.Error("expected error for non-pointer")
+			}
+		})
+		t.Run("DuplicateKeys", func(t *testing.T) {
+			out := &struct {
+				A string `bson:"a"`
+				B string `bson:"a"`
+			}{}
+			if err := DC.New().Unmarshal(out); err == nil {
+				t.Error("expected error for duplicate keys")
+			}
+		})
+	})
+}
+
+func TestReflectEncode(t *testing.T) {
+	oid := types.NewObjectID()
+	now := time.Unix(1700000000, 123000000)
+	dec, err := types.ParseDecimal128("1.25")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		in := &reflectOuter{
+			reflectBase: reflectBase{ID: oid},
+			Title:       "hello",
+			Untagged:    42,
+			Skipped:     "ignored",
+			Ratio:       0.5,
+			Created:     now,
+			Amount:      dec,
+			Inner:       reflectInner{Name: "a"},
+			InnerPtr:    &reflectInner{Name: "b", Count: 3},
+			Tags:        []string{"x", "y"},
+			Items:       []reflectInner{{Name: "c"}},
+			Counts:      map[string]int{"b": 2, "a": 1},
+			Blob:        []byte("data"),
+			Any:         map[string]any{"nested": true},
+			Extra:       map[string]string{"leftover": "kept"},
+		}
+
+		doc, err := DCE.Interface(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if doc.Lookup("_id").ObjectID() != oid {
+			t.Error("inline fields should be promoted")
+		}
+		if doc.Lookup("skipped") != nil {
+			t.Error("ignored field encoded")
+		}
+		if doc.Lookup("inner").MutableDocument().Lookup("count") != nil {
+			t.Error("omitempty field encoded")
+		}
+		if doc.Lookup("untagged").Int64() != 42 {
+			t.Error("untagged field should use the lower-cased name")
+		}
+		if counts := doc.Lookup("counts").MutableDocument(); counts.ElementAt(0).Key() != "a" {
+			t.Error("map keys should be sorted")
+		}
+		if st, data := doc.Lookup("blob").Binary(); st != 0 || string(data) != "data" {
+			t.Error("byte slices should be binary")
+		}
+		if doc.Lookup("leftover").StringValue() != "kept" {
+			t.Error("inline map not encoded")
+		}
+
+		out := &reflectOuter{}
+		if err := doc.Unmarshal(out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Title != in.Title || out.InnerPtr.Count != 3 || !out.Created.Equal(now) || out.Items[0].Name != "c" || out.Amount.String() != "1.25" {
+			t.Errorf("did not round trip: %+v", out)
+		}
+	})
+	t.Run("Element", func(t *testing.T) {
+		elem := EC.Interface("key", reflectInner{Name: "a", Count: 1})
+		if elem.Value().Type() != bsontype.EmbeddedDocument {
+			t.Fatalf("unexpected type %s", elem.Value().Type())
+		}
+		if elem.Value().MutableDocument().Len() != 2 {
+			t.Error("unexpected document length")
+		}
+		if EC.Interface("key", time.Second).Value().Int64() != int64(time.Second) {
+			t.Error("durations should be int64")
+		}
+		if EC.Interface("key", (*reflectInner)(nil)).Value().Type() != bsontype.Null {
+			t.Error("nil pointers should be null")
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		in := struct {
+			Inner struct {
+				Values []any `bson:"values"`
+			} `bson:"inner"`
+		}{}
+		in.Inner.Values = []any{1, make(chan int)}
+
+		_, err := ECE.Interface("root", in)
+		var eerr *EncodeError
+		if !errors.As(err, &eerr) {
+			t.Fatalf("expected encode error, got %v", err)
+		}
+		if eerr.Path != "root.inner.values.1" {
+			t.Errorf("unexpected path %q", eerr.Path)
+		}
+		if !errors.Is(err, errUnsupportedType) {
+			t.Error("should unwrap to the cause")
+		}
+		if elem := EC.Interface("root", in); elem.Value().Type() != bsontype.Null {
+			t.Error("EC.Interface should produce null elements on error")
+		}
+		if _, err := DCE.Interface(42); err == nil {
+			t.Error("scalars are not documents")
+		}
+	})
+}
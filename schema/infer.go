@@ -0,0 +1,305 @@
+package schema
+
+import (
+	"iter"
+	"maps"
+	"slices"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/match"
+)
+
+// ArrayItems is the key that inferred paths use for the elements of an
+// array, as in the all positional operator of update paths: the
+// elements of the array at "tags" have the path "tags.$[]".
+const ArrayItems = "$[]"
+
+// maxExamples is the number of distinct example values that inference
+// retains for each path.
+const maxExamples = 3
+
+// Inference summarizes the structure of a set of documents. The zero
+// value is ready to use.
+type Inference struct {
+	count  int
+	fields map[string]*FieldSummary
+}
+
+// FieldSummary describes the values observed at a single path.
+type FieldSummary struct {
+	Path birch.Path
+	// Documents is the number of documents that have at least one
+	// value at the path.
+	Documents int
+	// Values is the number of values observed at the path, which may
+	// exceed Documents for paths within arrays.
+	Values int
+	// Types is the number of values of each type.
+	Types map[bsontype.Type]int
+	// Min and Max are the smallest and largest numeric values, or nil
+	// when no numeric values were observed.
+	Min, Max *birch.Value
+	// MinLength and MaxLength are the range of the lengths, in
+	// characters, of the string values.
+	MinLength, MaxLength int
+	// ArrayLengths is the number of arrays of each length.
+	ArrayLengths map[int]int
+	// Examples are distinct values, other than documents and arrays,
+	// in the order they were observed.
+	Examples []*birch.Value
+
+	strings int
+}
+
+// Infer summarizes the structure of the documents in the sequence.
+func Infer(docs iter.Seq[*birch.Document]) *Inference {
+	out := &Inference{}
+	for doc := range docs {
+		out.Add(doc)
+	}
+	return out
+}
+
+// Add includes the document in the summary.
+func (in *Inference) Add(doc *birch.Document) {
+	if in.fields == nil {
+		in.fields = map[string]*FieldSummary{}
+	}
+
+	in.count++
+	seen := map[*FieldSummary]bool{}
+
+	// the walk visits each value after the document or array that
+	// contains it, so the inferred path and the type of the
+	// container at each depth of the current path are on a stack.
+	var (
+		path   birch.Path
+		arrays []bool
+	)
+	for walked, val := range (birch.WalkOptions{}).Document(doc) {
+		depth := len(walked) - 1
+		key := walked[depth]
+		if depth > 0 && arrays[depth-1] {
+			key = ArrayItems
+		}
+
+		path = append(path[:depth], key)
+		arrays = append(arrays[:depth], val.Type() == bsontype.Array)
+		seen[in.value(path, val)] = true
+	}
+
+	for field := range seen {
+		field.Documents++
+	}
+}
+
+// Count returns the number of documents in the summary.
+func (in *Inference) Count() int { return in.count }
+
+// Fields returns the summaries of all paths, ordered by path, so that
+// each path precedes the paths within it.
+func (in *Inference) Fields() []*FieldSummary {
+	out := slices.Collect(maps.Values(in.fields))
+	slices.SortFunc(out, func(a, b *FieldSummary) int { return slices.Compare(a.Path, b.Path) })
+	return out
+}
+
+// Presence returns the fraction of documents that have a value at the
+// path.
+func (in *Inference) Presence(field *FieldSummary) float64 {
+	if in.count == 0 {
+		return 0
+	}
+	return float64(field.Documents) / float64(in.count)
+}
+
+// value adds the value to the summary of the path, and returns the
+// summary.
+func (in *Inference) value(path birch.Path, val *birch.Value) *FieldSummary {
+	key := fieldKey(path)
+	field, ok := in.fields[key]
+	if !ok {
+		field = &FieldSummary{Path: slices.Clone(path), Types: map[bsontype.Type]int{}}
+		in.fields[key] = field
+	}
+
+	field.Values++
+	field.Types[val.Type()]++
+
+	switch val.Type() {
+	case bsontype.EmbeddedDocument:
+		return field
+	case bsontype.Array:
+		if field.ArrayLengths == nil {
+			field.ArrayLengths = map[int]int{}
+		}
+		field.ArrayLengths[val.MutableArray().Len()]++
+		return field
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		if field.Min == nil || birch.Compare(val, field.Min) < 0 {
+			field.Min = val
+		}
+		if field.Max == nil || birch.Compare(val, field.Max) > 0 {
+			field.Max = val
+		}
+	case bsontype.String:
+		length := utf8.RuneCountInString(val.StringValue())
+		if field.strings == 0 || length < field.MinLength {
+			field.MinLength = length
+		}
+		if field.strings == 0 || length > field.MaxLength {
+			field.MaxLength = length
+		}
+		field.strings++
+	}
+
+	if len(field.Examples) < maxExamples && !slices.ContainsFunc(field.Examples, func(ex *birch.Value) bool { return match.Equal(ex, val) }) {
+		field.Examples = append(field.Examples, val)
+	}
+
+	return field
+}
+
+// fieldKey returns a distinct key for each path, which, unlike the
+// dotted form of the path, does not conflate keys that contain dots
+// with the paths of nested documents.
+func fieldKey(path birch.Path) string {
+	var key []byte
+	for _, elem := range path {
+		key = strconv.AppendQuote(key, elem)
+	}
+	return string(key)
+}
+
+// Document returns the summary as a document, with the number of
+// documents and a document for each path, in the order of Fields.
+// Types are reported with their bsonType names.
+func (in *Inference) Document() *birch.Document {
+	fields := birch.NewArray()
+	for _, field := range in.Fields() {
+		doc := birch.DC.Elements(
+			birch.EC.String("path", field.Path.String()),
+			birch.EC.Int64("documents", int64(field.Documents)),
+			birch.EC.Double("presence", in.Presence(field)),
+			birch.EC.Int64("values", int64(field.Values)),
+		)
+
+		types := birch.DC.New()
+		for _, typ := range sortedKeys(field.Types) {
+			types.Append(birch.EC.Int64(typeName(typ), int64(field.Types[typ])))
+		}
+		doc.Append(birch.EC.SubDocument("types", types))
+
+		if field.Min != nil {
+			doc.Append(birch.EC.Value("min", field.Min), birch.EC.Value("max", field.Max))
+		}
+		if field.strings > 0 {
+			doc.Append(birch.EC.Int64("minLength", int64(field.MinLength)), birch.EC.Int64("maxLength", int64(field.MaxLength)))
+		}
+		if field.ArrayLengths != nil {
+			lengths := birch.DC.New()
+			for _, length := range sortedKeys(field.ArrayLengths) {
+				lengths.Append(birch.EC.Int64(strconv.Itoa(length), int64(field.ArrayLengths[length])))
+			}
+			doc.Append(birch.EC.SubDocument("arrayLengths", lengths))
+		}
+		if len(field.Examples) > 0 {
+			doc.Append(birch.EC.Array("examples", birch.NewArray(field.Examples...)))
+		}
+
+		fields.Append(birch.VC.Document(doc))
+	}
+
+	return birch.DC.Elements(
+		birch.EC.Int64("count", int64(in.count)),
+		birch.EC.Array("fields", fields),
+	)
+}
+
+// JSONSchema returns a collection validator, with a single $jsonSchema
+// key, that every document in the summary satisfies: each path allows
+// the types observed at the path, and fields are required when they
+// are present in every document, or embedded document, that contains
+// them.
+func (in *Inference) JSONSchema() *birch.Document {
+	root := birch.DC.Elements(birch.EC.String("bsonType", "object"))
+	in.properties(root, nil, in.count)
+
+	return birch.DC.Elements(birch.EC.SubDocument("$jsonSchema", root))
+}
+
+// properties adds the properties and required keywords to the schema
+// for the fields within the documents at the path.
+func (in *Inference) properties(schema *birch.Document, path birch.Path, parents int) {
+	props := birch.DC.New()
+	required := birch.NewArray()
+
+	for _, field := range in.children(path) {
+		key := field.Path[len(field.Path)-1]
+		if key == ArrayItems {
+			continue
+		}
+
+		props.Append(birch.EC.SubDocument(key, in.fieldSchema(field)))
+		if field.Values == parents {
+			required.Append(birch.VC.String(key))
+		}
+	}
+
+	if required.Len() > 0 {
+		schema.Append(birch.EC.Array("required", required))
+	}
+	if props.Len() > 0 {
+		schema.Append(birch.EC.SubDocument("properties", props))
+	}
+}
+
+func (in *Inference) fieldSchema(field *FieldSummary) *birch.Document {
+	types := sortedKeys(field.Types)
+	schema := birch.DC.New()
+	if len(types) == 1 {
+		schema.Append(birch.EC.String("bsonType", typeName(types[0])))
+	} else {
+		names := birch.NewArray()
+		for _, typ := range types {
+			names.Append(birch.VC.String(typeName(typ)))
+		}
+		schema.Append(birch.EC.Array("bsonType", names))
+	}
+
+	if objects := field.Types[bsontype.EmbeddedDocument]; objects > 0 {
+		in.properties(schema, field.Path, objects)
+	}
+	if items, ok := in.fields[fieldKey(append(field.Path[:len(field.Path):len(field.Path)], ArrayItems))]; ok {
+		schema.Append(birch.EC.SubDocument("items", in.fieldSchema(items)))
+	}
+
+	return schema
+}
+
+// children returns the summaries of the paths directly within the
+// path, in the order of Fields.
+func (in *Inference) children(path birch.Path) []*FieldSummary {
+	var out []*FieldSummary
+	for _, field := range in.Fields() {
+		if len(field.Path) == len(path)+1 && slices.Equal(field.Path[:len(path)], path) {
+			out = append(out, field)
+		}
+	}
+	return out
+}
+
+func sortedKeys[K bsontype.Type | int, V any](m map[K]V) []K {
+	return slices.Sorted(maps.Keys(m))
+}
+
+// typeName returns the bsonType alias for the type.
+func typeName(t bsontype.Type) string {
+	if name, ok := match.TypeName(t); ok {
+		return name
+	}
+	return t.String()
+}
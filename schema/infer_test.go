@@ -0,0 +1,184 @@
+package schema
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/internal/birchtest"
+)
+
+func TestInfer(t *testing.T) {
+	inputs := []string{
+		`{"_id":1,"name":"Ada","age":36,"tags":["a","b"],"address":{"city":"London","zip":"N1"}}`,
+		`{"_id":2,"name":"Grace","age":85.5,"tags":[],"address":{"city":"NYC"}}`,
+		`{"_id":3,"name":"Linus","tags":["c",1,{"k":"v"}],"address":null}`,
+		`{"_id":4,"name":"Barbara","age":null,"tags":["a"]}`,
+	}
+	docs := make([]*birch.Document, 0, len(inputs))
+	for _, in := range inputs {
+		docs = append(docs, birchtest.Document(t, in))
+	}
+
+	inf := Infer(slices.Values(docs))
+	if inf.Count() != 4 {
+		t.Fatalf("unexpected count %d", inf.Count())
+	}
+
+	paths := []string{}
+	byPath := map[string]*FieldSummary{}
+	for _, field := range inf.Fields() {
+		paths = append(paths, field.Path.String())
+		byPath[field.Path.String()] = field
+	}
+	expected := []string{"_id", "address", "address.city", "address.zip", "age", "name", "tags", "tags.$[]", "tags.$[].k"}
+	if !slices.Equal(paths, expected) {
+		t.Fatalf("got %v, expected %v", paths, expected)
+	}
+
+	t.Run("Presence", func(t *testing.T) {
+		for path, presence := range map[string]float64{
+			"_id":         1,
+			"address":     0.75,
+			"address.zip": 0.25,
+			"tags.$[]":    0.75,
+			"tags.$[].k":  0.25,
+		} {
+			if out := inf.Presence(byPath[path]); out != presence {
+				t.Errorf("%s: got %v, expected %v", path, out, presence)
+			}
+		}
+	})
+	t.Run("Types", func(t *testing.T) {
+		age := byPath["age"]
+		if age.Values != 3 || age.Types[bsontype.Int32] != 1 || age.Types[bsontype.Double] != 1 || age.Types[bsontype.Null] != 1 {
+			t.Fatalf("unexpected types %v", age.Types)
+		}
+		items := byPath["tags.$[]"]
+		if items.Values != 6 || items.Types[bsontype.String] != 4 || items.Types[bsontype.Int32] != 1 || items.Types[bsontype.EmbeddedDocument] != 1 {
+			t.Fatalf("unexpected types %v", items.Types)
+		}
+	})
+	t.Run("Ranges", func(t *testing.T) {
+		age := byPath["age"]
+		if age.Min.Int32() != 36 || age.Max.Double() != 85.5 {
+			t.Fatalf("unexpected range %v %v", age.Min, age.Max)
+		}
+		name := byPath["name"]
+		if name.MinLength != 3 || name.MaxLength != 7 {
+			t.Fatalf("unexpected lengths %d %d", name.MinLength, name.MaxLength)
+		}
+		tags := byPath["tags"]
+		if tags.ArrayLengths[0] != 1 || tags.ArrayLengths[1] != 1 || tags.ArrayLengths[2] != 1 || tags.ArrayLengths[3] != 1 {
+			t.Fatalf("unexpected lengths %v", tags.ArrayLengths)
+		}
+	})
+	t.Run("Examples", func(t *testing.T) {
+		items := byPath["tags.$[]"]
+		if len(items.Examples) != 3 || items.Examples[0].StringValue() != "a" || items.Examples[2].StringValue() != "c" {
+			t.Fatalf("unexpected examples %v", items.Examples)
+		}
+		if len(byPath["address"].Examples) != 1 {
+			t.Fatalf("unexpected examples %v", byPath["address"].Examples)
+		}
+	})
+	t.Run("Document", func(t *testing.T) {
+		doc := inf.Document()
+		if doc.Lookup("count").Int64() != 4 {
+			t.Fatalf("unexpected document %s", doc)
+		}
+		fields := doc.Lookup("fields").MutableArray()
+		if fields.Len() != len(expected) {
+			t.Fatalf("unexpected document %s", doc)
+		}
+		age, _ := fields.Lookup(4)
+		summary := age.MutableDocument()
+		if summary.Lookup("path").StringValue() != "age" || summary.Lookup("presence").Double() != 0.75 {
+			t.Fatalf("unexpected summary %s", summary)
+		}
+		types := summary.Lookup("types").MutableDocument()
+		if types.Lookup("int").Int64() != 1 || types.Lookup("double").Int64() != 1 || types.Lookup("null").Int64() != 1 {
+			t.Fatalf("unexpected summary %s", summary)
+		}
+		tags, _ := fields.Lookup(6)
+		if tags.MutableDocument().Lookup("arrayLengths").MutableDocument().Lookup("3").Int64() != 1 {
+			t.Fatalf("unexpected summary %v", tags)
+		}
+	})
+	t.Run("JSONSchema", func(t *testing.T) {
+		validator := inf.JSONSchema()
+		root := validator.Lookup("$jsonSchema").MutableDocument()
+
+		required := []string{}
+		for val := range root.Lookup("required").MutableArray().Iterator() {
+			required = append(required, val.StringValue())
+		}
+		if !slices.Equal(required, []string{"_id", "name", "tags"}) {
+			t.Fatalf("unexpected schema %s", root)
+		}
+
+		address := root.Lookup("properties").MutableDocument().Lookup("address").MutableDocument()
+		if address.Lookup("bsonType").MutableArray().Len() != 2 {
+			t.Fatalf("unexpected schema %s", address)
+		}
+		city := address.Lookup("required").MutableArray()
+		if val, _ := city.Lookup(0); city.Len() != 1 || val.StringValue() != "city" {
+			t.Fatalf("unexpected schema %s", address)
+		}
+
+		s, err := Compile(validator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, doc := range docs {
+			if err := s.Validate(doc); err != nil {
+				t.Errorf("%s: %v", doc, err)
+			}
+		}
+		if err := s.Validate(birchtest.Document(t, `{"_id":5,"name":"x","tags":[true]}`)); err == nil {
+			t.Error("expected a violation")
+		}
+	})
+	t.Run("DottedKeys", func(t *testing.T) {
+		// a key that contains a dot is distinct from the path of a
+		// nested document.
+		inf := Infer(slices.Values([]*birch.Document{
+			birchtest.Document(t, `{"a.b":1,"a":{"b":"x"}}`),
+			birchtest.Document(t, `{"a":{"b":"y"},"c":[[1,2],[3]]}`),
+		}))
+
+		fields := inf.Fields()
+		paths := make([]birch.Path, 0, len(fields))
+		for _, field := range fields {
+			paths = append(paths, field.Path)
+		}
+		expected := []birch.Path{{"a"}, {"a", "b"}, {"a.b"}, {"c"}, {"c", ArrayItems}, {"c", ArrayItems, ArrayItems}}
+		if !slices.EqualFunc(paths, expected, slices.Equal) {
+			t.Fatalf("got %v, expected %v", paths, expected)
+		}
+		if fields[1].Values != 2 || fields[1].Types[bsontype.String] != 2 || fields[2].Values != 1 || fields[2].Types[bsontype.Int32] != 1 {
+			t.Fatalf("unexpected summaries %+v and %+v", fields[1], fields[2])
+		}
+		if fields[5].Values != 3 || fields[4].ArrayLengths[2] != 1 || fields[4].ArrayLengths[1] != 1 {
+			t.Fatalf("unexpected summaries %+v and %+v", fields[4], fields[5])
+		}
+
+		props := inf.JSONSchema().Lookup("$jsonSchema").MutableDocument().Lookup("properties").MutableDocument()
+		if props.Lookup("a.b").MutableDocument().Lookup("bsonType").StringValue() != "int" {
+			t.Fatalf("unexpected schema %s", props)
+		}
+		if props.Lookup("a").MutableDocument().Lookup("properties").MutableDocument().Lookup("b").MutableDocument().Lookup("bsonType").StringValue() != "string" {
+			t.Fatalf("unexpected schema %s", props)
+		}
+	})
+	t.Run("Empty", func(t *testing.T) {
+		var inf Inference
+		if inf.Count() != 0 || len(inf.Fields()) != 0 || inf.Document().Lookup("fields").MutableArray().Len() != 0 {
+			t.Fatal("unexpected summary")
+		}
+		if _, err := Compile(inf.JSONSchema()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
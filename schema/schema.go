@@ -0,0 +1,521 @@
+// Package schema validates birch documents against MongoDB $jsonSchema
+// documents.
+//
+// Schemas support the bsonType, required, properties,
+// additionalProperties, items, enum, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, pattern, oneOf, anyOf and allOf
+// keywords, as well as the title and description annotations. As in
+// MongoDB, bsonType accepts the type aliases of the $type query
+// operator, including "number", and keywords that do not apply to the
+// type of a value (e.g. pattern for a number) are ignored.
+//
+// Validation reports every violation in a document, with its path,
+// rather than stopping at the first.
+//
+// Infer summarizes the structure of a sequence of documents, and can
+// produce a $jsonSchema document that the documents satisfy.
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/match"
+)
+
+var (
+	// ErrInvalidSchema is returned (wrapped) by Compile when a schema
+	// is malformed or uses an unsupported keyword.
+	ErrInvalidSchema = errors.New("invalid schema")
+
+	// ErrValidation is wrapped by the *ValidationError that Validate
+	// returns when a document does not match a schema.
+	ErrValidation = errors.New("document failed validation")
+)
+
+// Violation is a single way in which a document does not match a
+// schema.
+type Violation struct {
+	// Path is the path to the value, which is empty for the document
+	// itself. Array elements use their index as the key.
+	Path birch.Path
+	// Keyword is the schema keyword that the value does not satisfy.
+	Keyword string
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%q: %s: %s", v.Path.String(), v.Keyword, v.Message)
+}
+
+// ValidationError reports all of the violations in a document.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.String())
+	}
+
+	return fmt.Sprintf("%s: %s", ErrValidation, strings.Join(msgs, "; "))
+}
+
+// Unwrap returns ErrValidation.
+func (e *ValidationError) Unwrap() error { return ErrValidation }
+
+// Schema is a compiled $jsonSchema document. Schemas are immutable
+// and safe for concurrent use.
+type Schema struct {
+	root *node
+}
+
+// node is a compiled schema, or subschema, with one field for each
+// keyword.
+type node struct {
+	types       []bsontype.Type
+	typeNames   []string
+	required    []string
+	properties  map[string]*node
+	additional  *node
+	closed      bool
+	items       *node
+	tuple       []*node
+	enum        []*birch.Value
+	minimum     *birch.Value
+	maximum     *birch.Value
+	exclusiveLo bool
+	exclusiveHi bool
+	pattern     *regexp.Regexp
+	oneOf       []*node
+	anyOf       []*node
+	allOf       []*node
+}
+
+// Compile converts a schema into a Schema. The schema may be the
+// $jsonSchema document itself, or a document with a single $jsonSchema
+// key, as in a collection validator.
+func Compile(schema *birch.Document) (*Schema, error) {
+	if schema == nil {
+		return nil, invalidf("nil schema")
+	}
+
+	if schema.Len() == 1 && schema.ElementAt(0).Key() == "$jsonSchema" {
+		doc, ok := schema.ElementAt(0).Value().MutableDocumentOK()
+		if !ok {
+			return nil, invalidf("$jsonSchema must be a document")
+		}
+		schema = doc
+	}
+
+	root, err := compileNode(schema, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Schema{root: root}, nil
+}
+
+func compileNode(doc *birch.Document, path birch.Path) (*node, error) {
+	n := &node{}
+
+	for elem := range doc.Iterator() {
+		val := elem.Value()
+
+		var err error
+		switch key := elem.Key(); key {
+		case "bsonType":
+			err = n.compileTypes(val)
+		case "required":
+			n.required, err = compileStrings(val)
+			if err == nil && len(n.required) == 0 {
+				err = errors.New("must not be empty")
+			}
+		case "properties":
+			sub, ok := val.MutableDocumentOK()
+			if !ok {
+				err = errors.New("must be a document")
+				break
+			}
+			n.properties = make(map[string]*node, sub.Len())
+			for prop := range sub.Iterator() {
+				if n.properties[prop.Key()], err = compileSchema(prop.Value(), append(path[:len(path):len(path)], prop.Key())); err != nil {
+					return nil, err
+				}
+			}
+		case "additionalProperties":
+			if allowed, ok := val.BooleanOK(); ok {
+				n.closed = !allowed
+				break
+			}
+			n.additional, err = compileSchema(val, path)
+		case "items":
+			if arr, ok := val.MutableArrayOK(); ok {
+				n.tuple, err = compileSchemas(arr, path)
+				break
+			}
+			n.items, err = compileSchema(val, path)
+		case "enum":
+			arr, ok := val.MutableArrayOK()
+			if !ok || arr.Len() == 0 {
+				err = errors.New("must be a non-empty array")
+				break
+			}
+			n.enum = slices.Collect(arr.Iterator())
+		case "minimum", "maximum":
+			if !isNumber(val) {
+				err = errors.New("must be a number")
+			} else if key == "minimum" {
+				n.minimum = val
+			} else {
+				n.maximum = val
+			}
+		case "exclusiveMinimum", "exclusiveMaximum":
+			exclusive, ok := val.BooleanOK()
+			if !ok {
+				err = errors.New("must be a boolean")
+			} else if key == "exclusiveMinimum" {
+				n.exclusiveLo = exclusive
+			} else {
+				n.exclusiveHi = exclusive
+			}
+		case "pattern":
+			expr, ok := val.StringValueOK()
+			if !ok {
+				err = errors.New("must be a string")
+				break
+			}
+			n.pattern, err = regexp.Compile(expr)
+		case "oneOf", "anyOf", "allOf":
+			arr, ok := val.MutableArrayOK()
+			if !ok || arr.Len() == 0 {
+				err = errors.New("must be a non-empty array")
+				break
+			}
+			var nodes []*node
+			if nodes, err = compileSchemas(arr, path); err != nil {
+				return nil, err
+			}
+			switch key {
+			case "oneOf":
+				n.oneOf = nodes
+			case "anyOf":
+				n.anyOf = nodes
+			default:
+				n.allOf = nodes
+			}
+		case "title", "description":
+			if _, ok := val.StringValueOK(); !ok {
+				err = errors.New("must be a string")
+			}
+		default:
+			return nil, invalidf("unsupported keyword %q at %q", key, path.String())
+		}
+
+		if err != nil {
+			if errors.Is(err, ErrInvalidSchema) {
+				return nil, err
+			}
+			return nil, invalidf("%s at %q: %v", elem.Key(), path.String(), err)
+		}
+	}
+
+	return n, nil
+}
+
+func compileSchema(val *birch.Value, path birch.Path) (*node, error) {
+	doc, ok := val.MutableDocumentOK()
+	if !ok {
+		return nil, invalidf("schema at %q must be a document", path.String())
+	}
+	return compileNode(doc, path)
+}
+
+func compileSchemas(arr *birch.Array, path birch.Path) ([]*node, error) {
+	out := make([]*node, 0, arr.Len())
+	for val := range arr.Iterator() {
+		n, err := compileSchema(val, path)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func (n *node) compileTypes(val *birch.Value) error {
+	names, err := compileStrings(val)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		types, ok := match.TypeAlias(name)
+		if !ok {
+			return fmt.Errorf("unknown type %q", name)
+		}
+		n.types = append(n.types, types...)
+	}
+	n.typeNames = names
+
+	return nil
+}
+
+// compileStrings accepts a string or an array of strings.
+func compileStrings(val *birch.Value) ([]string, error) {
+	if str, ok := val.StringValueOK(); ok {
+		return []string{str}, nil
+	}
+
+	arr, ok := val.MutableArrayOK()
+	if !ok {
+		return nil, errors.New("must be a string or an array of strings")
+	}
+
+	out := make([]string, 0, arr.Len())
+	for item := range arr.Iterator() {
+		str, ok := item.StringValueOK()
+		if !ok {
+			return nil, errors.New("must be a string or an array of strings")
+		}
+		out = append(out, str)
+	}
+
+	return out, nil
+}
+
+// Validate checks the document against the schema, and returns a
+// *ValidationError that reports every violation when it does not
+// match.
+func (s *Schema) Validate(doc *birch.Document) error {
+	if doc == nil {
+		return bsonerr.NilDocument
+	}
+
+	return s.validate(birch.VC.Document(doc), false)
+}
+
+// ValidateReader checks the document in the reader against the
+// schema, in the same manner as Validate, reading values directly
+// from the encoded document. It returns an error that is not a
+// *ValidationError if the reader is not a valid document.
+func (s *Schema) ValidateReader(r birch.Reader) error {
+	if _, err := r.Validate(); err != nil {
+		return err
+	}
+
+	return s.validate(birch.VC.DocumentFromReader(r), true)
+}
+
+func (s *Schema) validate(val *birch.Value, reader bool) error {
+	v := &validator{reader: reader}
+	v.node(nil, s.root, val)
+
+	if v.err != nil {
+		return v.err
+	}
+	if len(v.violations) > 0 {
+		return &ValidationError{Violations: v.violations}
+	}
+
+	return nil
+}
+
+// validator accumulates the violations in a document.
+type validator struct {
+	reader     bool
+	violations []Violation
+	err        error
+}
+
+func (v *validator) report(path birch.Path, keyword, format string, args ...any) {
+	v.violations = append(v.violations, Violation{Path: path, Keyword: keyword, Message: fmt.Sprintf(format, args...)})
+}
+
+// matches reports whether the value matches the schema, without
+// recording violations.
+func (v *validator) matches(path birch.Path, n *node, val *birch.Value) bool {
+	sub := &validator{reader: v.reader}
+	sub.node(path, n, val)
+	if sub.err != nil && v.err == nil {
+		v.err = sub.err
+	}
+	return len(sub.violations) == 0
+}
+
+func (v *validator) node(path birch.Path, n *node, val *birch.Value) {
+	typ := val.Type()
+
+	if len(n.types) > 0 && !slices.Contains(n.types, typ) {
+		v.report(path, "bsonType", "expected %s, got %s", strings.Join(n.typeNames, " or "), typ)
+	}
+
+	if len(n.enum) > 0 && !slices.ContainsFunc(n.enum, func(item *birch.Value) bool { return match.Equal(item, val) }) {
+		v.report(path, "enum", "value is not one of the allowed values")
+	}
+
+	if isNumber(val) {
+		if n.minimum != nil {
+			if cmp := birch.Compare(val, n.minimum); cmp < 0 || cmp == 0 && n.exclusiveLo {
+				v.report(path, "minimum", "%v is less than the minimum %v", val.Interface(), n.minimum.Interface())
+			}
+		}
+		if n.maximum != nil {
+			if cmp := birch.Compare(val, n.maximum); cmp > 0 || cmp == 0 && n.exclusiveHi {
+				v.report(path, "maximum", "%v is greater than the maximum %v", val.Interface(), n.maximum.Interface())
+			}
+		}
+	}
+
+	if n.pattern != nil {
+		if str, ok := val.StringValueOK(); ok && !n.pattern.MatchString(str) {
+			v.report(path, "pattern", "%q does not match %q", str, n.pattern.String())
+		}
+	}
+
+	switch typ {
+	case bsontype.EmbeddedDocument:
+		v.document(path, n, val)
+	case bsontype.Array:
+		v.array(path, n, val)
+	}
+
+	for _, sub := range n.allOf {
+		v.node(path, sub, val)
+	}
+
+	if len(n.anyOf) > 0 && !slices.ContainsFunc(n.anyOf, func(sub *node) bool { return v.matches(path, sub, val) }) {
+		v.report(path, "anyOf", "value does not match any schema")
+	}
+
+	if len(n.oneOf) > 0 {
+		count := 0
+		for _, sub := range n.oneOf {
+			if v.matches(path, sub, val) {
+				count++
+			}
+		}
+		if count != 1 {
+			v.report(path, "oneOf", "value matches %d schemas, expected exactly one", count)
+		}
+	}
+}
+
+func (v *validator) document(path birch.Path, n *node, val *birch.Value) {
+	if n.properties == nil && n.additional == nil && !n.closed && len(n.required) == 0 {
+		return
+	}
+
+	seen := map[string]bool{}
+	for elem, err := range v.elements(val) {
+		if err != nil {
+			v.err = err
+			return
+		}
+
+		key := elem.Key()
+		seen[key] = true
+		child := append(path[:len(path):len(path)], key)
+
+		switch prop, ok := n.properties[key]; {
+		case ok:
+			v.node(child, prop, elem.Value())
+		case n.closed:
+			v.report(child, "additionalProperties", "field is not allowed")
+		case n.additional != nil:
+			v.node(child, n.additional, elem.Value())
+		}
+	}
+
+	for _, key := range n.required {
+		if !seen[key] {
+			v.report(append(path[:len(path):len(path)], key), "required", "field is missing")
+		}
+	}
+}
+
+func (v *validator) array(path birch.Path, n *node, val *birch.Value) {
+	if n.items == nil && n.tuple == nil {
+		return
+	}
+
+	idx := 0
+	for item, err := range v.values(val) {
+		if err != nil {
+			v.err = err
+			return
+		}
+
+		child := append(path[:len(path):len(path)], strconv.Itoa(idx))
+		switch {
+		case n.items != nil:
+			v.node(child, n.items, item)
+		case idx < len(n.tuple):
+			v.node(child, n.tuple[idx], item)
+		}
+		idx++
+	}
+}
+
+// elements iterates over the elements of a document value, reading
+// them from the encoded value when validating a reader.
+func (v *validator) elements(val *birch.Value) iter.Seq2[*birch.Element, error] {
+	if v.reader {
+		return val.Reader().Iterator()
+	}
+
+	return func(yield func(*birch.Element, error) bool) {
+		for elem := range val.MutableDocument().Iterator() {
+			if !yield(elem, nil) {
+				return
+			}
+		}
+	}
+}
+
+// values iterates over the values in an array value, in the same
+// manner as elements.
+func (v *validator) values(val *birch.Value) iter.Seq2[*birch.Value, error] {
+	return func(yield func(*birch.Value, error) bool) {
+		if !v.reader {
+			for item := range val.MutableArray().Iterator() {
+				if !yield(item, nil) {
+					return
+				}
+			}
+			return
+		}
+
+		for elem, err := range val.Reader().Iterator() {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(elem.Value(), nil) {
+				return
+			}
+		}
+	}
+}
+
+func isNumber(val *birch.Value) bool {
+	switch val.Type() {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		return true
+	default:
+		return false
+	}
+}
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidSchema, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,196 @@
+package schema
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/internal/birchtest"
+)
+
+func TestSchema(t *testing.T) {
+	const user = `{"$jsonSchema":{
+		"bsonType":"object",
+		"required":["name","age"],
+		"additionalProperties":false,
+		"properties":{
+			"_id":{},
+			"name":{"bsonType":"string","pattern":"^[A-Z]"},
+			"age":{"bsonType":"int","minimum":0,"maximum":150},
+			"score":{"bsonType":"number","minimum":0,"exclusiveMinimum":true},
+			"role":{"enum":["admin","user",null]},
+			"tags":{"bsonType":"array","items":{"bsonType":"string"}},
+			"point":{"bsonType":"array","items":[{"bsonType":"double"},{"bsonType":"double"}]},
+			"address":{
+				"bsonType":"object",
+				"required":["city"],
+				"properties":{"city":{"bsonType":"string"}},
+				"additionalProperties":{"bsonType":"string"}
+			},
+			"contact":{"oneOf":[{"bsonType":"string","pattern":"@"},{"bsonType":"string","pattern":"^\\+"}]},
+			"id":{"anyOf":[{"bsonType":"string"},{"bsonType":"long"}]},
+			"level":{"allOf":[{"bsonType":"int"},{"minimum":1},{"maximum":3}]}
+		}
+	}}`
+
+	s, err := Compile(birchtest.Document(t, user))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		doc        string
+		violations []string
+	}{
+		{
+			name: "Valid",
+			doc: `{"_id":1,"name":"Ada","age":36,"score":1.5,"role":"admin","tags":["a"],"point":[1.5,2.5],` +
+				`"address":{"city":"London","street":"x"},"contact":"ada@example.com","id":"x","level":2}`,
+		},
+		{
+			name: "Minimal",
+			doc:  `{"name":"Ada","age":0,"role":null}`,
+		},
+		{
+			name:       "Required",
+			doc:        `{}`,
+			violations: []string{"name: required", "age: required"},
+		},
+		{
+			name:       "BsonType",
+			doc:        `{"name":1,"age":"old"}`,
+			violations: []string{"name: bsonType", "age: bsonType"},
+		},
+		{
+			name:       "Pattern",
+			doc:        `{"name":"ada","age":1}`,
+			violations: []string{"name: pattern"},
+		},
+		{
+			name:       "Range",
+			doc:        `{"name":"Ada","age":151,"score":0}`,
+			violations: []string{"age: maximum", "score: minimum"},
+		},
+		{
+			name:       "Enum",
+			doc:        `{"name":"Ada","age":1,"role":"root"}`,
+			violations: []string{"role: enum"},
+		},
+		{
+			name:       "AdditionalProperties",
+			doc:        `{"name":"Ada","age":1,"extra":true,"address":{"city":"x","zip":1}}`,
+			violations: []string{"extra: additionalProperties", "address.zip: bsonType"},
+		},
+		{
+			name:       "Items",
+			doc:        `{"name":"Ada","age":1,"tags":["a",2,"c",{}],"point":[1.5,"x",3]}`,
+			violations: []string{"tags.1: bsonType", "tags.3: bsonType", "point.1: bsonType"},
+		},
+		{
+			name:       "Nested",
+			doc:        `{"name":"Ada","age":1,"address":{"street":"x"}}`,
+			violations: []string{"address.city: required"},
+		},
+		{
+			name:       "OneOf",
+			doc:        `{"name":"Ada","age":1,"contact":"+1@x"}`,
+			violations: []string{"contact: oneOf"},
+		},
+		{
+			name:       "OneOfNone",
+			doc:        `{"name":"Ada","age":1,"contact":"x"}`,
+			violations: []string{"contact: oneOf"},
+		},
+		{
+			name:       "AnyOf",
+			doc:        `{"name":"Ada","age":1,"id":5}`,
+			violations: []string{"id: anyOf"},
+		},
+		{
+			name:       "AllOf",
+			doc:        `{"name":"Ada","age":1,"level":4.5}`,
+			violations: []string{"level: bsonType", "level: maximum"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := birchtest.Document(t, tc.doc)
+			data, err := doc.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, err := range map[string]error{
+				"Document": s.Validate(doc),
+				"Reader":   s.ValidateReader(data),
+			} {
+				if len(tc.violations) == 0 {
+					if err != nil {
+						t.Errorf("%s: unexpected error %v", name, err)
+					}
+					continue
+				}
+
+				var verr *ValidationError
+				if !errors.As(err, &verr) || !errors.Is(err, ErrValidation) {
+					t.Fatalf("%s: unexpected error %v", name, err)
+				}
+				out := make([]string, 0, len(verr.Violations))
+				for _, v := range verr.Violations {
+					out = append(out, v.Path.String()+": "+v.Keyword)
+				}
+				if !slices.Equal(out, tc.violations) {
+					t.Errorf("%s: got %v, expected %v", name, out, tc.violations)
+				}
+			}
+		})
+	}
+	t.Run("ErrorMessage", func(t *testing.T) {
+		err := s.Validate(birchtest.Document(t, `{"name":"Ada"}`))
+		if err == nil || err.Error() != `document failed validation: "age": required: field is missing` {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("Unwrapped", func(t *testing.T) {
+		s, err := Compile(birchtest.Document(t, `{"bsonType":"object","required":["a"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Validate(birchtest.Document(t, `{"a":1}`)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("InvalidReader", func(t *testing.T) {
+		var verr *ValidationError
+		if err := s.ValidateReader(birch.Reader{5, 0, 0, 0, 1}); err == nil || errors.As(err, &verr) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		for _, spec := range []string{
+			`{"$jsonSchema":1}`,
+			`{"bsonType":"integer"}`,
+			`{"bsonType":1}`,
+			`{"required":[]}`,
+			`{"required":[1]}`,
+			`{"properties":[]}`,
+			`{"properties":{"a":1}}`,
+			`{"properties":{"a":{"unknown":1}}}`,
+			`{"additionalProperties":1}`,
+			`{"items":1}`,
+			`{"enum":[]}`,
+			`{"minimum":"1"}`,
+			`{"exclusiveMaximum":1}`,
+			`{"pattern":"("}`,
+			`{"oneOf":[]}`,
+			`{"anyOf":[1]}`,
+			`{"title":1}`,
+			`{"type":"object"}`,
+		} {
+			if _, err := Compile(birchtest.Document(t, spec)); !errors.Is(err, ErrInvalidSchema) {
+				t.Errorf("%s: unexpected error %v", spec, err)
+			}
+		}
+	})
+}
@@ -11,6 +11,7 @@ package types
 
 import (
 	"fmt"
+	"math/big"
 	"strconv"
 	"strings"
 )
@@ -51,20 +52,8 @@ func (d Decimal128) String() string {
 		return "-Infinity"[pos:]
 	}
 
-	l = d.l
-
-	if d.h>>61&3 == 3 {
-		// Bits: 1*sign 2*ignored 14*exponent 111*significand.
-		// Implicit 0b100 prefix in significand.
-		e = int(d.h>>47&(1<<14-1)) - 6176
-		//h = 4<<47 | d.h&(1<<47-1)
-		// Spec says all of these values are out of range.
-		h, l = 0, 0
-	} else {
-		// Bits: 1*sign 14*exponent 113*significand
-		e = int(d.h>>49&(1<<14-1)) - 6176
-		h = d.h & (1<<49 - 1)
-	}
+	// significands that are out of range are zero.
+	_, h, l, e = d.decompose()
 
 	// Would be handled by the logic below, but that's trivial and common.
 	if h == 0 && l == 0 && e == 0 {
@@ -125,6 +114,63 @@ Loop:
 	return string(repr[last+pos:])
 }
 
+// IsNaN reports whether the value is not a number.
+func (d Decimal128) IsNaN() bool { return d.h>>58&(1<<5-1) == 0x1F }
+
+// IsInf reports whether the value is an infinity: positive infinity
+// when sign > 0, negative infinity when sign < 0, and either when sign
+// is 0, as math.IsInf does.
+func (d Decimal128) IsInf(sign int) bool {
+	if d.h>>58&(1<<5-1) != 0x1E {
+		return false
+	}
+
+	neg := d.h>>63&1 == 1
+
+	return sign == 0 || sign > 0 && !neg || sign < 0 && neg
+}
+
+// decompose returns the sign, significand and exponent of a finite
+// value, which is the significand multiplied by ten to the exponent.
+func (d Decimal128) decompose() (neg bool, h, l uint64, exp int) {
+	neg = d.h>>63&1 == 1
+
+	if d.h>>61&3 == 3 {
+		// the significand of values in this form is larger than
+		// the maximum, so the spec treats them as zero.
+		return neg, 0, 0, int(d.h>>47&(1<<14-1)) - 6176
+	}
+
+	h, l, exp = d.h&(1<<49-1), d.l, int(d.h>>49&(1<<14-1))-6176
+	if h > decimalMaxCoefHigh || h == decimalMaxCoefHigh && l > decimalMaxCoefLow {
+		// as are significands in this form that are larger than
+		// the maximum.
+		return neg, 0, 0, exp
+	}
+
+	return neg, h, l, exp
+}
+
+// BigRat returns the exact value of the decimal as a rational number,
+// or false if the value is NaN or an infinity.
+func (d Decimal128) BigRat() (*big.Rat, bool) {
+	if d.IsNaN() || d.IsInf(0) {
+		return nil, false
+	}
+
+	neg, coef, exp := d.parts()
+	if neg {
+		coef.Neg(coef)
+	}
+
+	scale := pow10(max(exp, -exp))
+	if exp < 0 {
+		return new(big.Rat).SetFrac(coef, scale), true
+	}
+
+	return new(big.Rat).SetInt(coef.Mul(coef, scale)), true
+}
+
 func divmod(h, l uint64, div uint32) (qh, ql uint64, rem uint32) {
 	div64 := uint64(div)
 	a := h >> 32
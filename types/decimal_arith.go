@@ -0,0 +1,579 @@
+package types
+
+import (
+	"cmp"
+	"math"
+	"math/big"
+)
+
+const (
+	decimalDigits = 34
+	decimalMinExp = -6176
+	decimalMaxExp = 6111
+
+	// the high and low words of the largest significand.
+	decimalMaxCoefHigh = 0x1ed09bead87c0
+	decimalMaxCoefLow  = 0x378d8e63ffffffff
+)
+
+var (
+	bigOne = big.NewInt(1)
+	bigTen = big.NewInt(10)
+
+	bigMaxUint64 = new(big.Int).SetUint64(math.MaxUint64)
+
+	// decimalMaxCoef is the largest significand, 10^34-1.
+	decimalMaxCoef = new(big.Int).Sub(new(big.Int).Exp(bigTen, big.NewInt(decimalDigits), nil), bigOne)
+)
+
+// RoundingMode determines how results that cannot be represented
+// exactly as a Decimal128 are rounded, as the rounding-direction
+// attributes of IEEE 754-2008 do. The names match those of
+// big.RoundingMode.
+type RoundingMode byte
+
+const (
+	// ToNearestEven rounds to the nearest value, and to the value
+	// with an even least significant digit for ties. It is the
+	// default rounding mode.
+	ToNearestEven RoundingMode = iota
+	// ToNearestAway rounds to the nearest value, and away from zero
+	// for ties.
+	ToNearestAway
+	// ToZero truncates towards zero.
+	ToZero
+	// AwayFromZero rounds away from zero.
+	AwayFromZero
+	// ToNegativeInf rounds towards negative infinity.
+	ToNegativeInf
+	// ToPositiveInf rounds towards positive infinity.
+	ToPositiveInf
+)
+
+// DecimalContext performs decimal arithmetic and conversions with a
+// rounding mode. The zero value rounds to the nearest value, with ties
+// to even.
+//
+// The operations follow IEEE 754-2008 for decimal128: results are
+// exact when they fit in 34 significant digits, and are otherwise
+// rounded. Exact results use the exponent closest to the preferred
+// exponent of the operation. Results that overflow become infinities,
+// or the largest finite value, depending on the rounding mode, and
+// results that underflow lose precision down to 0E-6176. The
+// big.Accuracy that the operations return reports whether the result
+// is exactly the value of the operation, or below or above it.
+type DecimalContext struct {
+	Rounding RoundingMode
+}
+
+// Add returns x+y.
+func (c DecimalContext) Add(x, y Decimal128) (Decimal128, big.Accuracy) {
+	switch {
+	case x.IsNaN() || y.IsNaN():
+		return dNaN, big.Exact
+	case x.IsInf(0) && y.IsInf(0):
+		if x.signbit() != y.signbit() {
+			return dNaN, big.Exact
+		}
+		return x, big.Exact
+	case x.IsInf(0):
+		return x, big.Exact
+	case y.IsInf(0):
+		return y, big.Exact
+	}
+
+	xneg, xcoef, xexp := x.parts()
+	yneg, ycoef, yexp := y.parts()
+
+	// align the operands to the smaller exponent, which is the
+	// preferred exponent of the result.
+	exp := min(xexp, yexp)
+	xcoef.Mul(xcoef, pow10(xexp-exp))
+	ycoef.Mul(ycoef, pow10(yexp-exp))
+	if xneg {
+		xcoef.Neg(xcoef)
+	}
+	if yneg {
+		ycoef.Neg(ycoef)
+	}
+
+	sum := xcoef.Add(xcoef, ycoef)
+	if sum.Sign() == 0 {
+		// the sum of operands with opposite signs is positive
+		// zero, except when rounding towards negative infinity.
+		neg := xneg && yneg || xneg != yneg && c.Rounding == ToNegativeInf
+		return c.round(neg, sum, exp)
+	}
+
+	neg := sum.Sign() < 0
+
+	return c.round(neg, sum.Abs(sum), exp)
+}
+
+// Sub returns x-y.
+func (c DecimalContext) Sub(x, y Decimal128) (Decimal128, big.Accuracy) {
+	return c.Add(x, y.Neg())
+}
+
+// Mul returns x*y.
+func (c DecimalContext) Mul(x, y Decimal128) (Decimal128, big.Accuracy) {
+	neg := x.signbit() != y.signbit()
+
+	switch {
+	case x.IsNaN() || y.IsNaN():
+		return dNaN, big.Exact
+	case x.IsInf(0) || y.IsInf(0):
+		if x.IsZero() || y.IsZero() {
+			return dNaN, big.Exact
+		}
+		return infinity(neg), big.Exact
+	}
+
+	_, xcoef, xexp := x.parts()
+	_, ycoef, yexp := y.parts()
+
+	return c.round(neg, xcoef.Mul(xcoef, ycoef), xexp+yexp)
+}
+
+// Quo returns x/y. Division by zero returns an infinity for non-zero
+// dividends, and NaN for zero dividends.
+func (c DecimalContext) Quo(x, y Decimal128) (Decimal128, big.Accuracy) {
+	neg := x.signbit() != y.signbit()
+
+	switch {
+	case x.IsNaN() || y.IsNaN():
+		return dNaN, big.Exact
+	case x.IsInf(0) && y.IsInf(0):
+		return dNaN, big.Exact
+	case x.IsInf(0):
+		return infinity(neg), big.Exact
+	case y.IsInf(0):
+		return c.round(neg, new(big.Int), decimalMinExp)
+	case y.IsZero():
+		if x.IsZero() {
+			return dNaN, big.Exact
+		}
+		return infinity(neg), big.Exact
+	}
+
+	_, xcoef, xexp := x.parts()
+	_, ycoef, yexp := y.parts()
+
+	if xcoef.Sign() == 0 {
+		return c.round(neg, xcoef, xexp-yexp)
+	}
+
+	return c.divide(neg, xcoef, ycoef, xexp-yexp)
+}
+
+// FromBigInt returns the decimal value of the integer.
+func (c DecimalContext) FromBigInt(i *big.Int) (Decimal128, big.Accuracy) {
+	return c.round(i.Sign() < 0, new(big.Int).Abs(i), 0)
+}
+
+// FromBigFloat returns the decimal value of the float. The sign of
+// zeros and infinities is preserved.
+func (c DecimalContext) FromBigFloat(f *big.Float) (Decimal128, big.Accuracy) {
+	switch {
+	case f.IsInf():
+		return infinity(f.Signbit()), big.Exact
+	case f.Sign() == 0:
+		return c.round(f.Signbit(), new(big.Int), 0)
+	}
+
+	r, _ := f.Rat(nil)
+
+	return c.fromRat(f.Signbit(), r)
+}
+
+// FromFloat64 returns the decimal value of the float. Because the
+// conversion uses the exact binary value of the float, the result of
+// converting 0.1 is 0.1000000000000000055511151231257827, and is not
+// exact. Use ParseDecimal128 with strconv.FormatFloat to convert the
+// shortest decimal representation of a float instead.
+func (c DecimalContext) FromFloat64(f float64) (Decimal128, big.Accuracy) {
+	switch {
+	case math.IsNaN(f):
+		return dNaN, big.Exact
+	case math.IsInf(f, 0):
+		return infinity(f < 0), big.Exact
+	case f == 0:
+		return c.round(math.Signbit(f), new(big.Int), 0)
+	}
+
+	return c.fromRat(f < 0, new(big.Rat).SetFloat64(f))
+}
+
+// fromRat returns the decimal value of a non-zero rational number,
+// using the exponent closest to zero for exact values.
+func (c DecimalContext) fromRat(neg bool, r *big.Rat) (Decimal128, big.Accuracy) {
+	return c.divide(neg, new(big.Int).Abs(r.Num()), new(big.Int).Set(r.Denom()), 0)
+}
+
+// divide returns the decimal value of num/denom×10^preferred, for
+// positive integers that divide may modify. Exact results use the
+// exponent closest to the preferred exponent.
+func (c DecimalContext) divide(neg bool, num, denom *big.Int, preferred int) (Decimal128, big.Accuracy) {
+	// scale the dividend so that the quotient has at least one
+	// more digit than the result can hold.
+	shift := max(0, decimalDigits+1+digits(denom)-digits(num))
+	num.Mul(num, pow10(shift))
+
+	quo, rem := num.QuoRem(num, denom, new(big.Int))
+	exp := preferred - shift
+
+	if rem.Sign() != 0 {
+		return c.round(neg, sticky(quo), exp-1)
+	}
+
+	for exp < preferred {
+		q, r := new(big.Int).QuoRem(quo, bigTen, new(big.Int))
+		if r.Sign() != 0 {
+			break
+		}
+		quo, exp = q, exp+1
+	}
+
+	return c.round(neg, quo, exp)
+}
+
+// round returns the decimal closest to coef×10^exp, with the sign,
+// that fits in the range of the format. The coefficient is not
+// negative, and round may modify it.
+func (c DecimalContext) round(neg bool, coef *big.Int, exp int) (Decimal128, big.Accuracy) {
+	acc := big.Exact
+
+	if drop := max(digits(coef)-decimalDigits, decimalMinExp-exp); drop > 0 {
+		coef, acc = c.roundDigits(neg, coef, drop)
+		exp += drop
+
+		if coef.Cmp(decimalMaxCoef) > 0 {
+			// rounding carried into a new digit, and the
+			// coefficient ends in zero.
+			coef.Quo(coef, bigTen)
+			exp++
+		}
+	}
+
+	if exp > decimalMaxExp {
+		switch {
+		case coef.Sign() == 0:
+			exp = decimalMaxExp
+		case digits(coef)+exp-decimalMaxExp <= decimalDigits:
+			// pad the coefficient with zeros to reduce the
+			// exponent, which is exact.
+			coef.Mul(coef, pow10(exp-decimalMaxExp))
+			exp = decimalMaxExp
+		default:
+			return c.overflow(neg)
+		}
+	}
+
+	return encodeDecimal(neg, coef, exp), acc
+}
+
+// roundDigits removes the given number of digits from the end of the
+// coefficient, rounding the result.
+func (c DecimalContext) roundDigits(neg bool, coef *big.Int, drop int) (*big.Int, big.Accuracy) {
+	div := pow10(drop)
+	quo, rem := new(big.Int).QuoRem(coef, div, new(big.Int))
+	if rem.Sign() == 0 {
+		return quo, big.Exact
+	}
+
+	half := rem.Lsh(rem, 1).Cmp(div)
+
+	var up bool
+	switch c.Rounding {
+	case ToNearestEven:
+		up = half > 0 || half == 0 && quo.Bit(0) == 1
+	case ToNearestAway:
+		up = half >= 0
+	case ToZero:
+		up = false
+	case AwayFromZero:
+		up = true
+	case ToNegativeInf:
+		up = neg
+	case ToPositiveInf:
+		up = !neg
+	}
+
+	if up {
+		quo.Add(quo, bigOne)
+	}
+
+	return quo, accuracy(neg, up)
+}
+
+// overflow returns the result of an operation whose magnitude is too
+// large to represent: either an infinity or the largest finite value,
+// depending on the rounding mode.
+func (c DecimalContext) overflow(neg bool) (Decimal128, big.Accuracy) {
+	var inf bool
+	switch c.Rounding {
+	case ToNearestEven, ToNearestAway, AwayFromZero:
+		inf = true
+	case ToNegativeInf:
+		inf = neg
+	case ToPositiveInf:
+		inf = !neg
+	}
+
+	if inf {
+		return infinity(neg), accuracy(neg, true)
+	}
+
+	return encodeDecimal(neg, new(big.Int).Set(decimalMaxCoef), decimalMaxExp), accuracy(neg, false)
+}
+
+// accuracy returns the accuracy of a rounded result with the sign,
+// from whether rounding increased its magnitude.
+func accuracy(neg, up bool) big.Accuracy {
+	if up != neg {
+		return big.Above
+	}
+	return big.Below
+}
+
+func infinity(neg bool) Decimal128 {
+	if neg {
+		return dNegInf
+	}
+	return dPosInf
+}
+
+// sticky appends a one to the coefficient of an inexact result, so
+// that it rounds as a value between its neighbors.
+func sticky(coef *big.Int) *big.Int {
+	coef.Mul(coef, bigTen)
+	return coef.Add(coef, bigOne)
+}
+
+func encodeDecimal(neg bool, coef *big.Int, exp int) Decimal128 {
+	h := new(big.Int).Rsh(coef, 64).Uint64() | uint64(exp-decimalMinExp)<<49
+	if neg {
+		h |= 1 << 63
+	}
+
+	return Decimal128{h: h, l: new(big.Int).And(coef, bigMaxUint64).Uint64()}
+}
+
+// digits returns the number of decimal digits in the non-negative
+// integer, which is 0 for zero.
+func digits(i *big.Int) int {
+	if i.Sign() == 0 {
+		return 0
+	}
+
+	// the estimate from the bit length is within a digit of the
+	// exact count.
+	n := int(float64(i.BitLen())*math.Log10(2)) + 1
+	switch {
+	case i.CmpAbs(pow10(n-1)) < 0:
+		n--
+	case i.CmpAbs(pow10(n)) >= 0:
+		n++
+	}
+
+	return n
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+// Add returns d+o, rounded to the nearest value with ties to even.
+func (d Decimal128) Add(o Decimal128) Decimal128 { r, _ := (DecimalContext{}).Add(d, o); return r }
+
+// Sub returns d-o, rounded to the nearest value with ties to even.
+func (d Decimal128) Sub(o Decimal128) Decimal128 { r, _ := (DecimalContext{}).Sub(d, o); return r }
+
+// Mul returns d*o, rounded to the nearest value with ties to even.
+func (d Decimal128) Mul(o Decimal128) Decimal128 { r, _ := (DecimalContext{}).Mul(d, o); return r }
+
+// Quo returns d/o, rounded to the nearest value with ties to even.
+func (d Decimal128) Quo(o Decimal128) Decimal128 { r, _ := (DecimalContext{}).Quo(d, o); return r }
+
+// Neg returns the value with the opposite sign. The negation of NaN is
+// NaN.
+func (d Decimal128) Neg() Decimal128 {
+	if d.IsNaN() {
+		return d
+	}
+	return Decimal128{h: d.h ^ 1<<63, l: d.l}
+}
+
+// IsZero reports whether the value is a positive or negative zero, with
+// any exponent.
+func (d Decimal128) IsZero() bool {
+	if d.IsNaN() || d.IsInf(0) {
+		return false
+	}
+
+	_, h, l, _ := d.decompose()
+
+	return h == 0 && l == 0
+}
+
+// Sign returns -1, 0 or 1 when the value is less than, equal to, or
+// greater than zero. The sign of NaN is 0.
+func (d Decimal128) Sign() int {
+	switch {
+	case d.IsNaN() || d.IsZero():
+		return 0
+	case d.signbit():
+		return -1
+	default:
+		return 1
+	}
+}
+
+// Cmp compares the values and returns -1, 0 or 1, comparing numbers by
+// their value regardless of their exponent, so that 1.0 and 1 are
+// equal. For a total order, NaN is equal to NaN and less than every
+// other value.
+func (d Decimal128) Cmp(o Decimal128) int {
+	switch dn, on := d.IsNaN(), o.IsNaN(); {
+	case dn && on:
+		return 0
+	case dn:
+		return -1
+	case on:
+		return 1
+	}
+
+	if d.IsInf(0) || o.IsInf(0) {
+		return compareInfinities(d, o)
+	}
+
+	dr, _ := d.BigRat()
+	or, _ := o.BigRat()
+
+	return dr.Cmp(or)
+}
+
+func compareInfinities(d, o Decimal128) int {
+	rank := func(v Decimal128) int {
+		switch {
+		case v.IsInf(1):
+			return 1
+		case v.IsInf(-1):
+			return -1
+		default:
+			return 0
+		}
+	}
+
+	return cmp.Compare(rank(d), rank(o))
+}
+
+// BigInt returns the value truncated to an integer, and the accuracy
+// of the truncation. NaN and infinities return nil; the accuracy is
+// Below for positive infinity and Above for negative infinity, as
+// big.Float.Int reports.
+func (d Decimal128) BigInt() (*big.Int, big.Accuracy) {
+	switch {
+	case d.IsNaN():
+		return nil, big.Exact
+	case d.IsInf(0):
+		return nil, accuracy(d.signbit(), false)
+	}
+
+	neg, coef, exp := d.parts()
+	if exp >= 0 {
+		coef.Mul(coef, pow10(exp))
+	} else {
+		var rem *big.Int
+		coef, rem = coef.QuoRem(coef, pow10(-exp), new(big.Int))
+		if rem.Sign() != 0 {
+			if neg {
+				return coef.Neg(coef), big.Above
+			}
+			return coef, big.Below
+		}
+	}
+
+	if neg {
+		coef.Neg(coef)
+	}
+
+	return coef, big.Exact
+}
+
+// BigFloat returns the value as a float with the given precision, in
+// bits, rounded to the nearest value with ties to even, and the
+// accuracy of the conversion. A precision of 0 uses 113 bits, which
+// holds every significand exactly. NaN returns nil.
+func (d Decimal128) BigFloat(prec uint) (*big.Float, big.Accuracy) {
+	if prec == 0 {
+		prec = 113
+	}
+
+	f := new(big.Float).SetPrec(prec)
+
+	switch {
+	case d.IsNaN():
+		return nil, big.Exact
+	case d.IsInf(0):
+		return f.SetInf(d.signbit()), big.Exact
+	case d.IsZero():
+		if d.signbit() {
+			f.Neg(f)
+		}
+		return f, big.Exact
+	}
+
+	r, _ := d.BigRat()
+	f.SetRat(r)
+
+	return f, f.Acc()
+}
+
+// Float64 returns the float closest to the value, and the accuracy of
+// the conversion. NaN returns NaN, and values outside of the range of
+// a float64 return an infinity.
+func (d Decimal128) Float64() (float64, big.Accuracy) {
+	switch {
+	case d.IsNaN():
+		return math.NaN(), big.Exact
+	case d.IsInf(0):
+		return math.Inf(d.Sign()), big.Exact
+	case d.IsZero():
+		if d.signbit() {
+			return math.Copysign(0, -1), big.Exact
+		}
+		return 0, big.Exact
+	}
+
+	r, _ := d.BigRat()
+
+	f, exact := r.Float64()
+	switch {
+	case exact:
+		return f, big.Exact
+	case math.IsInf(f, 1):
+		return f, big.Above
+	case math.IsInf(f, -1):
+		return f, big.Below
+	}
+
+	if new(big.Rat).SetFloat64(f).Cmp(r) > 0 {
+		return f, big.Above
+	}
+
+	return f, big.Below
+}
+
+func (d Decimal128) signbit() bool { return d.h>>63&1 == 1 }
+
+// parts returns the sign, significand and exponent of a finite value,
+// with the significand as an integer that the caller may modify.
+func (d Decimal128) parts() (bool, *big.Int, int) {
+	neg, h, l, exp := d.decompose()
+
+	coef := new(big.Int).SetUint64(h)
+	coef.Lsh(coef, 64).Or(coef, new(big.Int).SetUint64(l))
+
+	return neg, coef, exp
+}
@@ -0,0 +1,556 @@
+package types
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func mustParseDecimal(t *testing.T, s string) Decimal128 {
+	t.Helper()
+
+	d, err := ParseDecimal128(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDecimalCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "testdata", "bson-corpus", "decimal128-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no corpus files")
+	}
+
+	type corpusValid struct {
+		Description      string `json:"description"`
+		CanonicalBSON    string `json:"canonical_bson"`
+		CanonicalExtJSON string `json:"canonical_extjson"`
+		Lossy            bool   `json:"lossy"`
+	}
+
+	var cases []corpusValid
+	for _, fn := range files {
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var corpus struct {
+			Valid []corpusValid `json:"valid"`
+		}
+		if err := json.Unmarshal(data, &corpus); err != nil {
+			t.Fatalf("%s: %v", fn, err)
+		}
+		cases = append(cases, corpus.Valid...)
+	}
+
+	extjson := regexp.MustCompile(`"\$numberDecimal"\s*:\s*"([^"]+)"`)
+
+	for _, test := range cases {
+		t.Run(test.Description, func(t *testing.T) {
+			raw, err := hex.DecodeString(test.CanonicalBSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the value is the last 16 bytes before the
+			// document's terminator, with the low bits first.
+			value := raw[len(raw)-17 : len(raw)-1]
+			expected := NewDecimal128(binary.LittleEndian.Uint64(value[8:]), binary.LittleEndian.Uint64(value[:8]))
+			str := extjson.FindStringSubmatch(test.CanonicalExtJSON)[1]
+
+			// lossy values, such as NaNs with payloads, format as
+			// their canonical string, which parses as a different
+			// value.
+			if test.Lossy {
+				if expected.String() != str {
+					t.Fatalf("got %s, expected %s", expected, str)
+				}
+				if !expected.IsNaN() && expected.Cmp(mustParseDecimal(t, str)) != 0 {
+					t.Fatalf("%v should be equal to %s", expected, str)
+				}
+				return
+			}
+
+			d := mustParseDecimal(t, str)
+			if d != expected {
+				t.Fatalf("parsed %s as %v, expected %v", str, d, expected)
+			}
+			if d.String() != str {
+				t.Fatalf("got %s, expected %s", d, str)
+			}
+			if d.Cmp(expected) != 0 {
+				t.Fatal("decimal should be equal to itself")
+			}
+
+			if d.IsNaN() || d.IsInf(0) {
+				if _, ok := d.BigRat(); ok {
+					t.Fatal("special values are not rational")
+				}
+				return
+			}
+
+			// conversions through other types produce equal
+			// values. 128 bits distinguish every pair of
+			// 34-digit decimals.
+			f, _ := d.BigFloat(128)
+			if out, _ := (DecimalContext{}).FromBigFloat(f); out.Cmp(d) != 0 {
+				t.Fatalf("big.Float round trip produced %s", out)
+			}
+
+			r, _ := d.BigRat()
+			i, acc := d.BigInt()
+			if r.IsInt() != (acc == big.Exact) || r.IsInt() && r.Num().Cmp(i) != 0 {
+				t.Fatalf("unexpected integer %v (%v)", i, acc)
+			}
+
+			sum, acc := (DecimalContext{}).Add(d, NewDecimal128(0x3040000000000000, 0))
+			if sum.Cmp(d) != 0 || acc != big.Exact {
+				t.Fatalf("adding zero produced %s (%v)", sum, acc)
+			}
+		})
+	}
+}
+
+// TestDecimalArithmetic runs the decQuad cases of the General Decimal
+// Arithmetic test suite, in testdata/dq*.decTest, for the operations
+// that DecimalContext implements. The files are the upstream files
+// without modification; cases in rounding modes that DecimalContext
+// does not have, and with values that Decimal128 cannot hold, are
+// skipped.
+func TestDecimalArithmetic(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "dq*.decTest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no decTest files")
+	}
+
+	for _, fn := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(fn), ".decTest"), func(t *testing.T) {
+			runDecTest(t, fn)
+		})
+	}
+}
+
+// decTestFields splits a line of a decTest file into its tokens,
+// removing the quotes from quoted tokens and dropping comments.
+func decTestFields(line string) []string {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || strings.HasPrefix(line, "--") {
+			return fields
+		}
+
+		if quote := line[0]; quote == '\'' || quote == '"' {
+			var token strings.Builder
+			idx := 1
+			for ; idx < len(line); idx++ {
+				if line[idx] != quote {
+					token.WriteByte(line[idx])
+					continue
+				}
+				// a doubled quote is a literal quote.
+				if idx+1 < len(line) && line[idx+1] == quote {
+					token.WriteByte(quote)
+					idx++
+					continue
+				}
+				idx++
+				break
+			}
+			fields = append(fields, token.String())
+			line = line[idx:]
+			continue
+		}
+
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+}
+
+func runDecTest(t *testing.T, fn string) {
+	file, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	modes := map[string]RoundingMode{
+		"half_even": ToNearestEven,
+		"half_up":   ToNearestAway,
+		"down":      ToZero,
+		"up":        AwayFromZero,
+		"floor":     ToNegativeInf,
+		"ceiling":   ToPositiveInf,
+	}
+	// the context of the cases must be that of Decimal128.
+	decimal128 := map[string]string{
+		"precision":   "34",
+		"maxexponent": "6144",
+		"minexponent": "-6143",
+		"clamp":       "1",
+	}
+
+	var (
+		ctx         DecimalContext
+		count       int
+		unsupported = map[string]string{}
+		skipped     = map[string]int{}
+	)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := decTestFields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if directive, ok := strings.CutSuffix(strings.ToLower(fields[0]), ":"); ok {
+			if len(fields) != 2 {
+				t.Fatalf("invalid directive %q", scanner.Text())
+			}
+			value := strings.ToLower(fields[1])
+			delete(unsupported, directive)
+
+			switch expected, ok := decimal128[directive]; {
+			case directive == "rounding":
+				mode, ok := modes[value]
+				if !ok {
+					unsupported[directive] = value
+				}
+				ctx.Rounding = mode
+			case ok && value != expected:
+				unsupported[directive] = value
+			}
+			continue
+		}
+
+		arrow := slices.Index(fields, "->")
+		if arrow < 2 || arrow+1 >= len(fields) {
+			t.Fatalf("invalid test case %q", scanner.Text())
+		}
+		id, op, operands := fields[0], fields[1], fields[2:arrow]
+		result, conditions := fields[arrow+1], fields[arrow+2:]
+		if len(unsupported) > 0 || !slices.Contains([]string{"add", "subtract", "multiply", "divide"}, op) {
+			continue
+		}
+		if reason := unsupportedDecTest(append(operands, result)); reason != "" {
+			skipped[reason]++
+			continue
+		}
+		if len(operands) != 2 {
+			t.Fatalf("invalid test case %q", scanner.Text())
+		}
+
+		x, err := ParseDecimal128(operands[0])
+		if err != nil {
+			t.Errorf("%s: %v", id, err)
+			continue
+		}
+		y, err := ParseDecimal128(operands[1])
+		if err != nil {
+			t.Errorf("%s: %v", id, err)
+			continue
+		}
+
+		var (
+			out   Decimal128
+			acc   big.Accuracy
+			exact func(a, b *big.Rat) *big.Rat
+		)
+		switch op {
+		case "add":
+			out, acc = ctx.Add(x, y)
+			exact = new(big.Rat).Add
+		case "subtract":
+			out, acc = ctx.Sub(x, y)
+			exact = new(big.Rat).Sub
+		case "multiply":
+			out, acc = ctx.Mul(x, y)
+			exact = new(big.Rat).Mul
+		case "divide":
+			out, acc = ctx.Quo(x, y)
+			exact = new(big.Rat).Quo
+		default:
+			t.Fatalf("%s: unknown operation %q", id, op)
+		}
+		count++
+
+		if out.String() != result {
+			t.Errorf("%s: %s %s %s got %s, expected %s", id, op, x, y, out, result)
+			continue
+		}
+		if inexact := slices.Contains(conditions, "Inexact"); inexact != (acc != big.Exact) {
+			t.Errorf("%s: accuracy is %v, expected inexact=%t", id, acc, inexact)
+			continue
+		}
+		if acc == big.Exact {
+			continue
+		}
+
+		// check the direction of rounding against the exact
+		// result of the operation.
+		expected := big.Below
+		switch {
+		case out.IsInf(1):
+			expected = big.Above
+		case out.IsInf(-1):
+		default:
+			xr, _ := x.BigRat()
+			yr, _ := y.BigRat()
+			or, _ := out.BigRat()
+			if or.Cmp(exact(xr, yr)) > 0 {
+				expected = big.Above
+			}
+		}
+		if acc != expected {
+			t.Errorf("%s: accuracy is %v, expected %v", id, acc, expected)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Fatal("no test cases")
+	}
+	for reason, n := range skipped {
+		t.Logf("skipped %d cases: %s", n, reason)
+	}
+}
+
+// unsupportedDecTest returns the reason that a case with the operands
+// and result is not supported, or an empty string.
+func unsupportedDecTest(values []string) string {
+	for _, value := range values {
+		switch lower := strings.ToLower(value); {
+		case value == "#":
+			return "null operands"
+		case strings.Contains(lower, "nan") && strings.TrimPrefix(lower, "+") != "nan":
+			return "Decimal128 values have a single NaN, without a sign, payload or signaling form"
+		case strings.Contains(lower, ".e") || strings.HasSuffix(lower, "."):
+			return "ParseDecimal128 requires digits after a decimal point"
+		}
+	}
+	return ""
+}
+
+func TestDecimalConversions(t *testing.T) {
+	t.Run("FromFloat64", func(t *testing.T) {
+		for _, test := range []struct {
+			in       float64
+			mode     RoundingMode
+			expected string
+			acc      big.Accuracy
+		}{
+			{in: 0.1, expected: "0.1000000000000000055511151231257827", acc: big.Below},
+			{in: 0.1, mode: ToPositiveInf, expected: "0.1000000000000000055511151231257828", acc: big.Above},
+			{in: -1.0 / 3, expected: "-0.3333333333333333148296162562473910", acc: big.Below},
+			{in: 2.5, expected: "2.5", acc: big.Exact},
+			{in: 100, expected: "100", acc: big.Exact},
+			{in: math.Copysign(0, -1), expected: "-0", acc: big.Exact},
+			{in: 1e300, expected: "1.000000000000000052504760255204420E+300", acc: big.Below},
+			{in: math.MaxFloat64, expected: "1.797693134862315708145274237317044E+308", acc: big.Above},
+			{in: math.SmallestNonzeroFloat64, expected: "4.940656458412465441765687928682214E-324", acc: big.Above},
+			{in: math.Inf(-1), expected: "-Infinity", acc: big.Exact},
+			{in: math.NaN(), expected: "NaN", acc: big.Exact},
+		} {
+			out, acc := DecimalContext{Rounding: test.mode}.FromFloat64(test.in)
+			if out.String() != test.expected || acc != test.acc {
+				t.Errorf("%v: got %s (%v), expected %s (%v)", test.in, out, acc, test.expected, test.acc)
+			}
+		}
+	})
+	t.Run("Float64", func(t *testing.T) {
+		for _, test := range []struct {
+			in       string
+			expected float64
+			acc      big.Accuracy
+		}{
+			{in: "0.1", expected: 0.1, acc: big.Above},
+			{in: "2.5", expected: 2.5, acc: big.Exact},
+			{in: "-2.50", expected: -2.5, acc: big.Exact},
+			{in: "-0", expected: math.Copysign(0, -1), acc: big.Exact},
+			{in: "1E+400", expected: math.Inf(1), acc: big.Above},
+			{in: "-1E+400", expected: math.Inf(-1), acc: big.Below},
+			{in: "1E-400", expected: 0, acc: big.Below},
+			{in: "-Infinity", expected: math.Inf(-1), acc: big.Exact},
+		} {
+			out, acc := mustParseDecimal(t, test.in).Float64()
+			if out != test.expected || math.Signbit(out) != math.Signbit(test.expected) || acc != test.acc {
+				t.Errorf("%s: got %v (%v), expected %v (%v)", test.in, out, acc, test.expected, test.acc)
+			}
+		}
+
+		if out, _ := mustParseDecimal(t, "NaN").Float64(); !math.IsNaN(out) {
+			t.Errorf("got %v, expected NaN", out)
+		}
+	})
+	t.Run("BigInt", func(t *testing.T) {
+		for _, test := range []struct {
+			in       string
+			expected string
+			acc      big.Accuracy
+		}{
+			{in: "1.5", expected: "1", acc: big.Below},
+			{in: "-1.5", expected: "-1", acc: big.Above},
+			{in: "12.000", expected: "12", acc: big.Exact},
+			{in: "1E+40", expected: "10000000000000000000000000000000000000000", acc: big.Exact},
+			{in: "-0.5", expected: "0", acc: big.Above},
+		} {
+			out, acc := mustParseDecimal(t, test.in).BigInt()
+			if out.String() != test.expected || acc != test.acc {
+				t.Errorf("%s: got %v (%v), expected %s (%v)", test.in, out, acc, test.expected, test.acc)
+			}
+		}
+
+		if out, acc := mustParseDecimal(t, "Infinity").BigInt(); out != nil || acc != big.Below {
+			t.Errorf("got %v (%v) for infinity", out, acc)
+		}
+
+		for _, test := range []struct {
+			in       string
+			mode     RoundingMode
+			expected string
+			acc      big.Accuracy
+		}{
+			{in: "-123", expected: "-123", acc: big.Exact},
+			{in: "10000000000000000000000000000000000000000", expected: "1.000000000000000000000000000000000E+40", acc: big.Exact},
+			{in: "10000000000000000000000000000000000000001", expected: "1.000000000000000000000000000000000E+40", acc: big.Below},
+			{in: "10000000000000000000000000000000000000001", mode: AwayFromZero, expected: "1.000000000000000000000000000000001E+40", acc: big.Above},
+			{in: "1" + strings.Repeat("0", 6145), expected: "Infinity", acc: big.Above},
+			{in: "-1" + strings.Repeat("0", 6145), mode: ToZero, expected: "-9.999999999999999999999999999999999E+6144", acc: big.Above},
+		} {
+			i, _ := new(big.Int).SetString(test.in, 10)
+			out, acc := DecimalContext{Rounding: test.mode}.FromBigInt(i)
+			if out.String() != test.expected || acc != test.acc {
+				t.Errorf("%.40s: got %s (%v), expected %s (%v)", test.in, out, acc, test.expected, test.acc)
+			}
+		}
+	})
+	t.Run("BigFloat", func(t *testing.T) {
+		f, acc := mustParseDecimal(t, "0.5").BigFloat(0)
+		if f.String() != "0.5" || acc != big.Exact {
+			t.Errorf("got %v (%v)", f, acc)
+		}
+		if f, acc = mustParseDecimal(t, "0.1").BigFloat(53); acc != big.Above {
+			t.Errorf("got %v (%v)", f, acc)
+		}
+		if f, _ = mustParseDecimal(t, "-0").BigFloat(0); !f.Signbit() || f.Sign() != 0 {
+			t.Errorf("got %v, expected negative zero", f)
+		}
+		if f, _ = mustParseDecimal(t, "NaN").BigFloat(0); f != nil {
+			t.Errorf("got %v for NaN", f)
+		}
+
+		out, acc := DecimalContext{}.FromBigFloat(new(big.Float).SetFloat64(0.375))
+		if out.String() != "0.375" || acc != big.Exact {
+			t.Errorf("got %s (%v)", out, acc)
+		}
+		if out, _ = (DecimalContext{}).FromBigFloat(new(big.Float).SetInf(true)); !out.IsInf(-1) {
+			t.Errorf("got %s, expected -Infinity", out)
+		}
+	})
+	t.Run("Compare", func(t *testing.T) {
+		ordered := []string{"NaN", "-Infinity", "-1E+10", "-1.5", "-0", "1E-6176", "0.1", "1", "1.5", "1E+6144", "Infinity"}
+		for i := range ordered {
+			for j := range ordered {
+				expected := 0
+				switch {
+				case i < j:
+					expected = -1
+				case i > j:
+					expected = 1
+				}
+				if c := mustParseDecimal(t, ordered[i]).Cmp(mustParseDecimal(t, ordered[j])); c != expected {
+					t.Errorf("%s cmp %s = %d, expected %d", ordered[i], ordered[j], c, expected)
+				}
+			}
+		}
+
+		for _, pair := range [][2]string{{"1", "1.000"}, {"0", "-0E+10"}, {"1E+3", "1000"}} {
+			if mustParseDecimal(t, pair[0]).Cmp(mustParseDecimal(t, pair[1])) != 0 {
+				t.Errorf("%s and %s should be equal", pair[0], pair[1])
+			}
+		}
+
+		for _, test := range []struct {
+			in   string
+			sign int
+		}{{"-1", -1}, {"-0", 0}, {"0E+10", 0}, {"2", 1}, {"NaN", 0}, {"-Infinity", -1}} {
+			if s := mustParseDecimal(t, test.in).Sign(); s != test.sign {
+				t.Errorf("sign of %s is %d, expected %d", test.in, s, test.sign)
+			}
+		}
+	})
+	t.Run("NonCanonical", func(t *testing.T) {
+		if max := new(big.Int).SetUint64(decimalMaxCoefHigh); max.Lsh(max, 64).Or(max, new(big.Int).SetUint64(decimalMaxCoefLow)).Cmp(decimalMaxCoef) != 0 {
+			t.Fatalf("got %v, expected %v", max, decimalMaxCoef)
+		}
+
+		// significands larger than 10^34-1 are zero, with the
+		// exponent of the value.
+		for _, test := range []struct {
+			in       Decimal128
+			expected string
+		}{
+			{NewDecimal128(6176<<49|(1<<49-1), ^uint64(0)), "0"},
+			{NewDecimal128(1<<63|6176<<49|decimalMaxCoefHigh, decimalMaxCoefLow+1), "-0"},
+			{NewDecimal128(6178<<49|decimalMaxCoefHigh+1, 0), "0E+2"},
+			{NewDecimal128(0x6c10000000000000, 0), "0"},
+		} {
+			if !test.in.IsZero() || test.in.Sign() != 0 || test.in.String() != test.expected {
+				t.Errorf("%s (%v) is not zero", test.in, test.in.IsZero())
+			}
+			if test.in.Cmp(mustParseDecimal(t, "0")) != 0 {
+				t.Errorf("%s is not equal to zero", test.in)
+			}
+			if r, _ := test.in.BigRat(); r.Sign() != 0 {
+				t.Errorf("got %v, expected zero", r)
+			}
+			if sum := test.in.Add(mustParseDecimal(t, "1")); sum.String() != "1" {
+				t.Errorf("got %s, expected 1", sum)
+			}
+		}
+
+		if d := NewDecimal128(6176<<49|decimalMaxCoefHigh, decimalMaxCoefLow); d.IsZero() || d.String() != "9999999999999999999999999999999999" {
+			t.Errorf("got %s, expected the largest significand", d)
+		}
+	})
+	t.Run("Methods", func(t *testing.T) {
+		a, b := mustParseDecimal(t, "10.25"), mustParseDecimal(t, "0.75")
+		for _, test := range []struct {
+			out      Decimal128
+			expected string
+		}{
+			{a.Add(b), "11.00"},
+			{a.Sub(b), "9.50"},
+			{a.Mul(b), "7.6875"},
+			{a.Quo(b), "13.66666666666666666666666666666667"},
+			{a.Neg(), "-10.25"},
+			{mustParseDecimal(t, "NaN").Neg(), "NaN"},
+		} {
+			if test.out.String() != test.expected {
+				t.Errorf("got %s, expected %s", test.out, test.expected)
+			}
+		}
+	})
+}
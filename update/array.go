@@ -0,0 +1,344 @@
+package update
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/match"
+)
+
+var compare = match.Compare
+
+// pushSpec holds the values and modifiers for $push and $addToSet.
+type pushSpec struct {
+	values   []*birch.Value
+	position *int64
+	slice    *int64
+	sort     func(a, b *birch.Value) int
+}
+
+func compilePushSpec(operand *birch.Value, modifiers bool) (*pushSpec, error) {
+	spec := &pushSpec{}
+
+	doc, ok := operand.MutableDocumentOK()
+	if !ok || doc.Lookup("$each") == nil {
+		spec.values = []*birch.Value{operand}
+		return spec, nil
+	}
+
+	for elem := range doc.Iterator() {
+		val := elem.Value()
+
+		switch key := elem.Key(); {
+		case key == "$each":
+			arr, ok := val.MutableArrayOK()
+			if !ok {
+				return nil, invalidf("$each requires an array")
+			}
+			spec.values = slices.Collect(arr.Iterator())
+		case key == "$position" && modifiers:
+			pos, ok := asInt(val)
+			if !ok {
+				return nil, invalidf("$position requires an integer")
+			}
+			spec.position = &pos
+		case key == "$slice" && modifiers:
+			size, ok := asInt(val)
+			if !ok {
+				return nil, invalidf("$slice requires an integer")
+			}
+			spec.slice = &size
+		case key == "$sort" && modifiers:
+			cmp, err := compileSort(val)
+			if err != nil {
+				return nil, err
+			}
+			spec.sort = cmp
+		default:
+			return nil, invalidf("unsupported modifier %q", key)
+		}
+	}
+
+	return spec, nil
+}
+
+// items returns copies of the values to add, which the target array
+// does not share with the update.
+func (spec *pushSpec) items() ([]*birch.Value, error) {
+	out := make([]*birch.Value, len(spec.values))
+	for idx, val := range spec.values {
+		var err error
+		if out[idx], err = cloneValue(val); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// compileSort converts a $sort modifier, which is either 1 or -1 to sort
+// elements by value, or a document of fields and directions to sort
+// embedded documents, into a comparison function.
+func compileSort(spec *birch.Value) (func(a, b *birch.Value) int, error) {
+	if dir, ok := asInt(spec); ok {
+		if dir != 1 && dir != -1 {
+			return nil, invalidf("$sort direction must be 1 or -1")
+		}
+		return func(a, b *birch.Value) int { return int(dir) * compare(a, b) }, nil
+	}
+
+	doc, ok := spec.MutableDocumentOK()
+	if !ok || doc.Len() == 0 {
+		return nil, invalidf("$sort requires 1, -1, or a document of fields")
+	}
+
+	type sortKey struct {
+		path birch.Path
+		dir  int
+	}
+
+	keys := make([]sortKey, 0, doc.Len())
+	for elem := range doc.Iterator() {
+		path, err := parsePath(elem.Key())
+		if err != nil {
+			return nil, err
+		}
+		dir, ok := asInt(elem.Value())
+		if !ok || (dir != 1 && dir != -1) {
+			return nil, invalidf("$sort direction for %q must be 1 or -1", elem.Key())
+		}
+		keys = append(keys, sortKey{path: path, dir: int(dir)})
+	}
+
+	return func(a, b *birch.Value) int {
+		for _, key := range keys {
+			if c := compare(sortValue(a, key.path), sortValue(b, key.path)); c != 0 {
+				return key.dir * c
+			}
+		}
+		return 0
+	}, nil
+}
+
+// sortValue returns the value at the path in an embedded document, or
+// null when the value is not a document or the path is missing.
+func sortValue(val *birch.Value, path birch.Path) *birch.Value {
+	if doc, ok := val.MutableDocumentOK(); ok {
+		if out := lookup(doc, path); out != nil {
+			return out
+		}
+	}
+	return birch.VC.Null()
+}
+
+// arrayValues returns the elements of the array at the path, and
+// whether the path exists. Values that are not arrays are an error.
+func arrayValues(doc *birch.Document, path birch.Path) ([]*birch.Value, bool, error) {
+	val := lookup(doc, path)
+	if val == nil {
+		return nil, false, nil
+	}
+
+	arr, ok := val.MutableArrayOK()
+	if !ok {
+		return nil, true, typeError(path, val, "the field must be an array")
+	}
+
+	return slices.Collect(arr.Iterator()), true, nil
+}
+
+func setArray(doc *birch.Document, path birch.Path, values []*birch.Value) error {
+	return doc.SetPath(path, birch.VC.ArrayFromValues(values...))
+}
+
+func compilePush(path birch.Path, operand *birch.Value) (operation, error) {
+	spec, err := compilePushSpec(operand, true)
+	if err != nil {
+		return operation{}, err
+	}
+
+	return operation{apply: func(doc *birch.Document) (bool, error) {
+		values, exists, err := arrayValues(doc, path)
+		if err != nil {
+			return false, err
+		}
+		before := slices.Clone(values)
+
+		pos := len(values)
+		if spec.position != nil {
+			pos = clampIndex(*spec.position, len(values))
+		}
+		items, err := spec.items()
+		if err != nil {
+			return false, err
+		}
+		values = slices.Insert(values, pos, items...)
+
+		if spec.sort != nil {
+			slices.SortStableFunc(values, spec.sort)
+		}
+
+		if spec.slice != nil {
+			if n := *spec.slice; n >= 0 {
+				values = values[:min(int(n), len(values))]
+			} else {
+				values = values[len(values)-min(int(-n), len(values)):]
+			}
+		}
+
+		if exists && slices.EqualFunc(before, values, (*birch.Value).Equal) {
+			return false, nil
+		}
+
+		return true, setArray(doc, path, values)
+	}}, nil
+}
+
+// clampIndex converts a $position, which counts from the end of the
+// array when negative, into an insertion index.
+func clampIndex(pos int64, size int) int {
+	if pos < 0 {
+		pos += int64(size)
+	}
+	return int(max(0, min(pos, int64(size))))
+}
+
+func compileAddToSet(path birch.Path, operand *birch.Value) (operation, error) {
+	spec, err := compilePushSpec(operand, false)
+	if err != nil {
+		return operation{}, err
+	}
+
+	return operation{apply: func(doc *birch.Document) (bool, error) {
+		values, exists, err := arrayValues(doc, path)
+		if err != nil {
+			return false, err
+		}
+
+		added := false
+		items, err := spec.items()
+		if err != nil {
+			return false, err
+		}
+		for _, val := range items {
+			if !slices.ContainsFunc(values, func(existing *birch.Value) bool { return match.Equal(existing, val) }) {
+				values = append(values, val)
+				added = true
+			}
+		}
+
+		if exists && !added {
+			return false, nil
+		}
+
+		return true, setArray(doc, path, values)
+	}}, nil
+}
+
+func compilePop(path birch.Path, operand *birch.Value) (operation, error) {
+	dir, ok := asInt(operand)
+	if !ok || (dir != 1 && dir != -1) {
+		return operation{}, invalidf("$pop requires 1 or -1")
+	}
+
+	return operation{apply: func(doc *birch.Document) (bool, error) {
+		values, _, err := arrayValues(doc, path)
+		if err != nil || len(values) == 0 {
+			return false, err
+		}
+
+		if dir == 1 {
+			values = values[:len(values)-1]
+		} else {
+			values = values[1:]
+		}
+
+		return true, setArray(doc, path, values)
+	}}, nil
+}
+
+func compilePull(path birch.Path, operand *birch.Value) (operation, error) {
+	cond, err := match.CompileElement(operand)
+	if err != nil {
+		return operation{}, fmt.Errorf("%w: %w", ErrInvalidUpdate, err)
+	}
+
+	return operation{apply: func(doc *birch.Document) (bool, error) {
+		values, _, err := arrayValues(doc, path)
+		if err != nil {
+			return false, err
+		}
+
+		kept := slices.DeleteFunc(slices.Clone(values), cond.Match)
+		if len(kept) == len(values) {
+			return false, nil
+		}
+
+		return true, setArray(doc, path, kept)
+	}}, nil
+}
+
+func isNumeric(val *birch.Value) bool {
+	switch val.Type() {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double:
+		return true
+	default:
+		return false
+	}
+}
+
+// asInt converts numeric values with integral values to an int64.
+func asInt(val *birch.Value) (int64, bool) {
+	switch val.Type() {
+	case bsontype.Int32:
+		return int64(val.Int32()), true
+	case bsontype.Int64:
+		return val.Int64(), true
+	case bsontype.Double:
+		f := val.Double()
+		if f != math.Trunc(f) || math.Abs(f) > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(f), true
+	default:
+		return 0, false
+	}
+}
+
+// multiply multiplies two numeric values, using the widest type of the
+// two operands, with the same promotion rules as
+// birch.Document.IncrementPath.
+func multiply(a, b *birch.Value) (*birch.Value, error) {
+	switch {
+	case a.Type() == bsontype.Double || b.Type() == bsontype.Double:
+		return birch.VC.Double(asFloat(a) * asFloat(b)), nil
+	case a.Type() == bsontype.Int32 && b.Type() == bsontype.Int32:
+		product := int64(a.Int32()) * int64(b.Int32())
+		if product > math.MaxInt32 || product < math.MinInt32 {
+			return birch.VC.Int64(product), nil
+		}
+		return birch.VC.Int32(int32(product)), nil
+	default:
+		x, _ := asInt(a)
+		y, _ := asInt(b)
+		product := x * y
+		if x != 0 && (product/x != y || (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64)) {
+			return nil, bsonerr.NumericOverflow
+		}
+		return birch.VC.Int64(product), nil
+	}
+}
+
+func asFloat(val *birch.Value) float64 {
+	switch val.Type() {
+	case bsontype.Int32:
+		return float64(val.Int32())
+	case bsontype.Int64:
+		return float64(val.Int64())
+	default:
+		return val.Double()
+	}
+}
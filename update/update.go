@@ -0,0 +1,458 @@
+// Package update applies MongoDB update documents to birch documents.
+//
+// Update documents are either documents of update operators ($set,
+// $unset, $inc, $mul, $min, $max, $rename, $currentDate, $push,
+// $addToSet, $pop, and $pull), or replacement documents that contain
+// no operators and replace every field except _id. As in mongod, an
+// update that modifies the same path (or a path and one of its
+// prefixes) more than once is rejected.
+package update
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsontype"
+)
+
+var (
+	// ErrInvalidUpdate is returned (wrapped) by Compile when an update
+	// document is malformed or uses an unsupported operator.
+	ErrInvalidUpdate = errors.New("invalid update")
+
+	// ErrConflict is returned (wrapped) by Compile when two operators
+	// in an update modify the same path or overlapping paths.
+	ErrConflict = errors.New("conflicting update paths")
+
+	// ErrTypeMismatch is returned (wrapped) by Apply when an operator
+	// is applied to a value of the wrong type, such as $push on a
+	// field that is not an array.
+	ErrTypeMismatch = errors.New("type mismatch")
+
+	// ErrImmutableField is returned (wrapped) by Apply when an update
+	// would change the _id of a document.
+	ErrImmutableField = errors.New("immutable field")
+)
+
+// now is the clock used by $currentDate.
+var now = time.Now
+
+// Update is a compiled update document. Updates are immutable and
+// safe for concurrent use.
+type Update struct {
+	ops         []operation
+	replacement *birch.Document
+}
+
+// operation applies a single operator to one path in a document, and
+// reports whether it modified the document.
+type operation struct {
+	name  string
+	path  birch.Path
+	apply func(*birch.Document) (bool, error)
+}
+
+// Compile converts an update document into an Update.
+func Compile(update *birch.Document) (*Update, error) {
+	if update == nil {
+		return nil, invalidf("nil update document")
+	}
+
+	// the operands are retained, so the update is a copy that the
+	// caller cannot modify.
+	update, err := clone(update)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.Len() == 0 || !strings.HasPrefix(update.ElementAt(0).Key(), "$") {
+		return compileReplacement(update)
+	}
+
+	out := &Update{}
+	var paths []birch.Path
+
+	for elem := range update.Iterator() {
+		name := elem.Key()
+		if !strings.HasPrefix(name, "$") {
+			return nil, invalidf("cannot mix update operators and fields (%q)", name)
+		}
+
+		compile, ok := operators[name]
+		if !ok {
+			return nil, invalidf("unsupported operator %q", name)
+		}
+
+		fields, ok := elem.Value().MutableDocumentOK()
+		if !ok {
+			return nil, invalidf("%s requires a document", name)
+		}
+
+		for field := range fields.Iterator() {
+			path, err := parsePath(field.Key())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+
+			op, err := compile(path, field.Value())
+			if err != nil {
+				return nil, fmt.Errorf("%s %q: %w", name, path.String(), err)
+			}
+			op.name, op.path = name, path
+
+			targets := []birch.Path{path}
+			if name == "$rename" {
+				targets = append(targets, birch.ParsePath(field.Value().StringValue()))
+			}
+
+			for _, target := range targets {
+				for _, existing := range paths {
+					if overlaps(existing, target) {
+						return nil, fmt.Errorf("%w: updating the path %q would create a conflict at %q",
+							ErrConflict, target.String(), shorter(existing, target).String())
+					}
+				}
+				paths = append(paths, target)
+			}
+
+			out.ops = append(out.ops, op)
+		}
+	}
+
+	return out, nil
+}
+
+func compileReplacement(update *birch.Document) (*Update, error) {
+	for elem := range update.Iterator() {
+		key := elem.Key()
+		if strings.HasPrefix(key, "$") {
+			return nil, invalidf("cannot mix update operators and fields (%q)", key)
+		}
+		if key == "" || strings.Contains(key, ".") {
+			return nil, invalidf("replacement documents cannot contain the field %q", key)
+		}
+	}
+
+	return &Update{replacement: update}, nil
+}
+
+// Apply modifies the document according to the update and reports
+// whether the document changed. If the update fails, the document is
+// not modified.
+func (u *Update) Apply(doc *birch.Document) (bool, error) {
+	if doc == nil {
+		return false, invalidf("nil document")
+	}
+
+	if u.replacement != nil {
+		return u.replace(doc)
+	}
+
+	// operators are applied to a deep copy of the document so that a
+	// failure part way through the update leaves it untouched.
+	work, err := clone(doc)
+	if err != nil {
+		return false, err
+	}
+
+	var changed bool
+	for _, op := range u.ops {
+		modified, err := op.apply(work)
+		if err != nil {
+			return false, fmt.Errorf("%s %q: %w", op.name, op.path.String(), err)
+		}
+		changed = changed || modified
+	}
+
+	if changed {
+		doc.Reset()
+		doc.Append(work.Elements()...)
+	}
+
+	return changed, nil
+}
+
+func (u *Update) replace(doc *birch.Document) (bool, error) {
+	id := doc.Lookup("_id")
+	if newID := u.replacement.Lookup("_id"); id != nil && newID != nil && !id.Equal(newID) {
+		return false, fmt.Errorf("%w: the replacement document changes _id", ErrImmutableField)
+	}
+
+	// the document receives a copy of the replacement, so that
+	// changes to the document do not change the update.
+	replacement, err := clone(u.replacement)
+	if err != nil {
+		return false, err
+	}
+
+	out := birch.DC.Make(replacement.Len() + 1)
+	if id != nil {
+		out.Append(birch.EC.Value("_id", id))
+	}
+	for elem := range replacement.Iterator() {
+		if id != nil && elem.Key() == "_id" {
+			continue
+		}
+		out.Append(elem)
+	}
+
+	before, err := doc.MarshalBSON()
+	if err != nil {
+		return false, err
+	}
+	after, err := out.MarshalBSON()
+	if err != nil {
+		return false, err
+	}
+	if string(before) == string(after) {
+		return false, nil
+	}
+
+	doc.Reset()
+	doc.Append(out.Elements()...)
+
+	return true, nil
+}
+
+// clone returns a copy of the document that does not share storage
+// with it.
+func clone(doc *birch.Document) (*birch.Document, error) {
+	data, err := doc.MarshalBSON()
+	if err != nil {
+		return nil, err
+	}
+	return birch.ReadDocument(data)
+}
+
+// cloneValue returns a copy of the value that does not share storage
+// with it, so that operands stored in documents are not shared with
+// the update or with other documents.
+func cloneValue(v *birch.Value) (*birch.Value, error) {
+	doc, err := clone(birch.DC.Elements(birch.EC.Value("v", v)))
+	if err != nil {
+		return nil, err
+	}
+	return doc.ElementAt(0).Value(), nil
+}
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidUpdate, fmt.Sprintf(format, args...))
+}
+
+func parsePath(key string) (birch.Path, error) {
+	path := birch.ParsePath(key)
+	if len(path) == 0 {
+		return nil, invalidf("empty field name")
+	}
+
+	for _, part := range path {
+		switch {
+		case part == "":
+			return nil, invalidf("empty field name in %q", key)
+		case strings.HasPrefix(part, "$"):
+			return nil, invalidf("unsupported positional or operator path %q", key)
+		}
+	}
+
+	return path, nil
+}
+
+// overlaps reports whether either path is a prefix of the other.
+func overlaps(a, b birch.Path) bool {
+	n := min(len(a), len(b))
+	return slices.Equal(a[:n], b[:n])
+}
+
+func shorter(a, b birch.Path) birch.Path {
+	if len(a) <= len(b) {
+		return a
+	}
+	return b
+}
+
+// lookup returns the value at the path, or nil if there is no value.
+func lookup(doc *birch.Document, path birch.Path) *birch.Value {
+	elem, err := doc.Search(path...)
+	if err != nil {
+		return nil
+	}
+	return elem.Value()
+}
+
+func typeError(path birch.Path, val *birch.Value, format string, args ...any) error {
+	return &birch.PathError{
+		Path:  path,
+		Depth: len(path),
+		Type:  val.Type(),
+		Err:   fmt.Errorf("%w: %s", ErrTypeMismatch, fmt.Sprintf(format, args...)),
+	}
+}
+
+// set stores the value at the path and reports whether it differs from
+// the previous value.
+func set(doc *birch.Document, path birch.Path, fn func(*birch.Value) (*birch.Value, error)) (bool, error) {
+	var changed bool
+	err := doc.UpsertPath(path, func(current *birch.Value) (*birch.Value, error) {
+		val, err := fn(current)
+		if err != nil {
+			return nil, err
+		}
+		changed = current == nil || !current.Equal(val)
+		return cloneValue(val)
+	})
+	return changed, err
+}
+
+var operators = map[string]func(birch.Path, *birch.Value) (operation, error){
+	"$set":         compileSet,
+	"$unset":       compileUnset,
+	"$inc":         compileInc,
+	"$mul":         compileMul,
+	"$min":         compileMinMax(func(c int) bool { return c < 0 }),
+	"$max":         compileMinMax(func(c int) bool { return c > 0 }),
+	"$rename":      compileRename,
+	"$currentDate": compileCurrentDate,
+	"$push":        compilePush,
+	"$addToSet":    compileAddToSet,
+	"$pop":         compilePop,
+	"$pull":        compilePull,
+}
+
+func compileSet(path birch.Path, operand *birch.Value) (operation, error) {
+	return operation{apply: func(doc *birch.Document) (bool, error) {
+		return set(doc, path, func(*birch.Value) (*birch.Value, error) { return operand, nil })
+	}}, nil
+}
+
+func compileUnset(path birch.Path, _ *birch.Value) (operation, error) {
+	return operation{apply: func(doc *birch.Document) (bool, error) {
+		elem, err := doc.DeletePath(path)
+		return elem != nil, err
+	}}, nil
+}
+
+func compileInc(path birch.Path, operand *birch.Value) (operation, error) {
+	if !isNumeric(operand) {
+		return operation{}, invalidf("cannot increment with a non-numeric argument")
+	}
+
+	return operation{apply: func(doc *birch.Document) (bool, error) {
+		delta, err := cloneValue(operand)
+		if err != nil {
+			return false, err
+		}
+		before := lookup(doc, path)
+		after, err := doc.IncrementPath(path, delta)
+		if err != nil {
+			return false, err
+		}
+		return before == nil || !before.Equal(after), nil
+	}}, nil
+}
+
+func compileMul(path birch.Path, operand *birch.Value) (operation, error) {
+	if !isNumeric(operand) {
+		return operation{}, invalidf("cannot multiply with a non-numeric argument")
+	}
+
+	return operation{apply: func(doc *birch.Document) (bool, error) {
+		return set(doc, path, func(current *birch.Value) (*birch.Value, error) {
+			if current == nil {
+				// missing fields are set to zero, with the type of the
+				// operand.
+				return multiply(birch.VC.Int32(0), operand)
+			}
+			if !isNumeric(current) {
+				return nil, typeError(path, current, "cannot multiply a non-numeric value")
+			}
+			val, err := multiply(current, operand)
+			if err != nil {
+				return nil, &birch.PathError{Path: path, Depth: len(path), Type: current.Type(), Err: err}
+			}
+			return val, nil
+		})
+	}}, nil
+}
+
+func compileMinMax(replace func(int) bool) func(birch.Path, *birch.Value) (operation, error) {
+	return func(path birch.Path, operand *birch.Value) (operation, error) {
+		return operation{apply: func(doc *birch.Document) (bool, error) {
+			if current := lookup(doc, path); current != nil && !replace(compare(operand, current)) {
+				return false, nil
+			}
+			return set(doc, path, func(*birch.Value) (*birch.Value, error) { return operand, nil })
+		}}, nil
+	}
+}
+
+func compileRename(path birch.Path, operand *birch.Value) (operation, error) {
+	name, ok := operand.StringValueOK()
+	if !ok {
+		return operation{}, invalidf("$rename requires a string")
+	}
+
+	target, err := parsePath(name)
+	if err != nil {
+		return operation{}, err
+	}
+
+	return operation{apply: func(doc *birch.Document) (bool, error) {
+		if err := checkArrays(doc, path); err != nil {
+			return false, err
+		}
+		if err := checkArrays(doc, target); err != nil {
+			return false, err
+		}
+
+		elem, err := doc.DeletePath(path)
+		if err != nil || elem == nil {
+			return false, err
+		}
+
+		return true, doc.SetPath(target, elem.Value())
+	}}, nil
+}
+
+// checkArrays returns an error if the path traverses an array, which
+// $rename does not support.
+func checkArrays(doc *birch.Document, path birch.Path) error {
+	for depth := 1; depth < len(path); depth++ {
+		if val := lookup(doc, path[:depth]); val != nil && val.Type() == bsontype.Array {
+			return typeError(path[:depth], val, "$rename cannot traverse arrays")
+		}
+	}
+	return nil
+}
+
+func compileCurrentDate(path birch.Path, operand *birch.Value) (operation, error) {
+	timestamp := false
+
+	switch operand.Type() {
+	case bsontype.Boolean:
+	case bsontype.EmbeddedDocument:
+		spec := operand.MutableDocument()
+		kind, ok := "", false
+		if val := spec.Lookup("$type"); val != nil {
+			kind, ok = val.StringValueOK()
+		}
+		if spec.Len() != 1 || !ok || (kind != "date" && kind != "timestamp") {
+			return operation{}, invalidf(`$currentDate requires true or {"$type": "date"|"timestamp"}`)
+		}
+		timestamp = kind == "timestamp"
+	default:
+		return operation{}, invalidf(`$currentDate requires true or {"$type": "date"|"timestamp"}`)
+	}
+
+	return operation{apply: func(doc *birch.Document) (bool, error) {
+		ts := now()
+		val := birch.VC.Time(ts)
+		if timestamp {
+			val = birch.VC.Timestamp(uint32(ts.Unix()), 1)
+		}
+		return set(doc, path, func(*birch.Value) (*birch.Value, error) { return val, nil })
+	}}, nil
+}
@@ -0,0 +1,343 @@
+package update
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/internal/birchtest"
+)
+
+func requireJSON(t *testing.T, doc *birch.Document, expected string) {
+	t.Helper()
+	out, err := doc.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != expected {
+		t.Errorf("expected %s, got %s", expected, out)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		doc      string
+		update   string
+		expected string
+		changed  bool
+	}{
+		{
+			name:     "Set",
+			doc:      `{"a":1}`,
+			update:   `{"$set":{"a":2,"b.c":"x"}}`,
+			expected: `{"a":2,"b":{"c":"x"}}`,
+			changed:  true,
+		},
+		{
+			name:     "SetSameValue",
+			doc:      `{"a":1}`,
+			update:   `{"$set":{"a":1}}`,
+			expected: `{"a":1}`,
+		},
+		{
+			name:     "SetArrayIndex",
+			doc:      `{"a":[1,2]}`,
+			update:   `{"$set":{"a.3":4}}`,
+			expected: `{"a":[1,2,null,4]}`,
+			changed:  true,
+		},
+		{
+			name:     "Unset",
+			doc:      `{"a":1,"b":{"c":1,"d":2},"e":[1,2]}`,
+			update:   `{"$unset":{"a":"","b.c":"","e.0":"","missing":""}}`,
+			expected: `{"b":{"d":2},"e":[null,2]}`,
+			changed:  true,
+		},
+		{
+			name:     "UnsetMissing",
+			doc:      `{"a":1}`,
+			update:   `{"$unset":{"b":""}}`,
+			expected: `{"a":1}`,
+		},
+		{
+			name:     "Inc",
+			doc:      `{"a":1,"b":{"c":1.5}}`,
+			update:   `{"$inc":{"a":2,"b.c":1,"d":5}}`,
+			expected: `{"a":3,"b":{"c":2.500000},"d":5}`,
+			changed:  true,
+		},
+		{
+			name:     "IncZero",
+			doc:      `{"a":1}`,
+			update:   `{"$inc":{"a":0}}`,
+			expected: `{"a":1}`,
+		},
+		{
+			name:     "Mul",
+			doc:      `{"a":3,"b":2}`,
+			update:   `{"$mul":{"a":4,"b":0.5,"c":3}}`,
+			expected: `{"a":12,"b":1.000000,"c":0}`,
+			changed:  true,
+		},
+		{
+			name:     "Min",
+			doc:      `{"a":5,"b":1}`,
+			update:   `{"$min":{"a":3,"b":3,"c":3}}`,
+			expected: `{"a":3,"b":1,"c":3}`,
+			changed:  true,
+		},
+		{
+			name:     "Max",
+			doc:      `{"a":5,"b":1}`,
+			update:   `{"$max":{"a":3,"b":"x"}}`,
+			expected: `{"a":5,"b":"x"}`,
+			changed:  true,
+		},
+		{
+			name:     "MaxUnchanged",
+			doc:      `{"a":5}`,
+			update:   `{"$max":{"a":5.0}}`,
+			expected: `{"a":5}`,
+		},
+		{
+			name:     "Rename",
+			doc:      `{"a":1,"b":{"c":2}}`,
+			update:   `{"$rename":{"a":"x.y","b.c":"z","missing":"q"}}`,
+			expected: `{"b":{},"x":{"y":1},"z":2}`,
+			changed:  true,
+		},
+		{
+			name:     "Push",
+			doc:      `{"a":[1]}`,
+			update:   `{"$push":{"a":2,"b":{"c":1}}}`,
+			expected: `{"a":[1,2],"b":[{"c":1}]}`,
+			changed:  true,
+		},
+		{
+			name:     "PushEach",
+			doc:      `{"a":[5,1]}`,
+			update:   `{"$push":{"a":{"$each":[4,2,3],"$sort":-1,"$slice":3}}}`,
+			expected: `{"a":[5,4,3]}`,
+			changed:  true,
+		},
+		{
+			name:     "PushNegativeSlice",
+			doc:      `{"a":[1,2]}`,
+			update:   `{"$push":{"a":{"$each":[3],"$slice":-2}}}`,
+			expected: `{"a":[2,3]}`,
+			changed:  true,
+		},
+		{
+			name:     "PushPosition",
+			doc:      `{"a":[1,4]}`,
+			update:   `{"$push":{"a":{"$each":[2,3],"$position":1}}}`,
+			expected: `{"a":[1,2,3,4]}`,
+			changed:  true,
+		},
+		{
+			name:     "PushSortDocuments",
+			doc:      `{"a":[{"n":2,"s":"b"},{"n":1,"s":"c"}]}`,
+			update:   `{"$push":{"a":{"$each":[{"n":2,"s":"a"}],"$sort":{"n":1,"s":1}}}}`,
+			expected: `{"a":[{"n":1,"s":"c"},{"n":2,"s":"a"},{"n":2,"s":"b"}]}`,
+			changed:  true,
+		},
+		{
+			name:     "PushSliceOnly",
+			doc:      `{"a":[1,2,3]}`,
+			update:   `{"$push":{"a":{"$each":[],"$slice":2}}}`,
+			expected: `{"a":[1,2]}`,
+			changed:  true,
+		},
+		{
+			name:     "PushEmptyEach",
+			doc:      `{"a":[1]}`,
+			update:   `{"$push":{"a":{"$each":[]}}}`,
+			expected: `{"a":[1]}`,
+		},
+		{
+			name:     "AddToSet",
+			doc:      `{"a":[1,"x"]}`,
+			update:   `{"$addToSet":{"a":{"$each":[1.0,"y","y"]},"b":1}}`,
+			expected: `{"a":[1,"x","y"],"b":[1]}`,
+			changed:  true,
+		},
+		{
+			name:     "AddToSetPresent",
+			doc:      `{"a":[{"b":1}]}`,
+			update:   `{"$addToSet":{"a":{"b":1}}}`,
+			expected: `{"a":[{"b":1}]}`,
+		},
+		{
+			name:     "Pop",
+			doc:      `{"a":[1,2,3],"b":[1,2,3],"c":[]}`,
+			update:   `{"$pop":{"a":1,"b":-1,"c":1,"d":1}}`,
+			expected: `{"a":[1,2],"b":[2,3],"c":[]}`,
+			changed:  true,
+		},
+		{
+			name:     "Pull",
+			doc:      `{"a":[1,2,3,2],"b":[{"x":1,"y":1},{"x":2,"y":1}],"c":[1,5,9]}`,
+			update:   `{"$pull":{"a":2,"b":{"x":2},"c":{"$gte":5}}}`,
+			expected: `{"a":[1,3],"b":[{"x":1,"y":1}],"c":[1]}`,
+			changed:  true,
+		},
+		{
+			name:     "PullNothing",
+			doc:      `{"a":[1]}`,
+			update:   `{"$pull":{"a":2,"b":1}}`,
+			expected: `{"a":[1]}`,
+		},
+		{
+			name:     "Replacement",
+			doc:      `{"_id":1,"a":1,"b":2}`,
+			update:   `{"c":3}`,
+			expected: `{"_id":1,"c":3}`,
+			changed:  true,
+		},
+		{
+			name:     "ReplacementSameID",
+			doc:      `{"_id":1,"a":1}`,
+			update:   `{"a":1,"_id":1}`,
+			expected: `{"_id":1,"a":1}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := Compile(birchtest.Document(t, tc.update))
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc := birchtest.Document(t, tc.doc)
+			changed, err := u.Apply(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tc.changed {
+				t.Errorf("expected changed=%t", tc.changed)
+			}
+			requireJSON(t, doc, tc.expected)
+		})
+	}
+	t.Run("CurrentDate", func(t *testing.T) {
+		defer func(orig func() time.Time) { now = orig }(now)
+		ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		now = func() time.Time { return ts }
+
+		u, err := Compile(birchtest.Document(t, `{"$currentDate":{"a":true,"b":{"$type":"timestamp"}}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := birch.DC.New()
+		if _, err := u.Apply(doc); err != nil {
+			t.Fatal(err)
+		}
+		if !doc.Lookup("a").Time().Equal(ts) {
+			t.Errorf("unexpected date %v", doc.Lookup("a").Time())
+		}
+		if sec, _ := doc.Lookup("b").Timestamp(); doc.Lookup("b").Type() != bsontype.Timestamp || int64(sec) != ts.Unix() {
+			t.Errorf("unexpected timestamp %v", doc.Lookup("b").Interface())
+		}
+	})
+	t.Run("CompileErrors", func(t *testing.T) {
+		for _, tc := range []struct {
+			update string
+			err    error
+		}{
+			{update: `{"$set":{"a":1},"b":1}`, err: ErrInvalidUpdate},
+			{update: `{"a":1,"$set":{"b":1}}`, err: ErrInvalidUpdate},
+			{update: `{"a.b":1}`, err: ErrInvalidUpdate},
+			{update: `{"$setOnInsert":{"a":1}}`, err: ErrInvalidUpdate},
+			{update: `{"$set":1}`, err: ErrInvalidUpdate},
+			{update: `{"$set":{"a..b":1}}`, err: ErrInvalidUpdate},
+			{update: `{"$set":{"a.$":1}}`, err: ErrInvalidUpdate},
+			{update: `{"$inc":{"a":"x"}}`, err: ErrInvalidUpdate},
+			{update: `{"$rename":{"a":1}}`, err: ErrInvalidUpdate},
+			{update: `{"$pop":{"a":2}}`, err: ErrInvalidUpdate},
+			{update: `{"$currentDate":{"a":{"$type":"string"}}}`, err: ErrInvalidUpdate},
+			{update: `{"$push":{"a":{"$each":1}}}`, err: ErrInvalidUpdate},
+			{update: `{"$push":{"a":{"$each":[],"$sort":2}}}`, err: ErrInvalidUpdate},
+			{update: `{"$addToSet":{"a":{"$each":[],"$slice":2}}}`, err: ErrInvalidUpdate},
+			{update: `{"$pull":{"a":{"$bad":1}}}`, err: ErrInvalidUpdate},
+			{update: `{"$set":{"a":1},"$inc":{"a":1}}`, err: ErrConflict},
+			{update: `{"$set":{"a":1},"$unset":{"a.b":1}}`, err: ErrConflict},
+			{update: `{"$set":{"a.b.c":1,"a.b":1}}`, err: ErrConflict},
+			{update: `{"$rename":{"a":"b"},"$set":{"b.c":1}}`, err: ErrConflict},
+		} {
+			if _, err := Compile(birchtest.Document(t, tc.update)); !errors.Is(err, tc.err) {
+				t.Errorf("%s: expected %v, got %v", tc.update, tc.err, err)
+			}
+		}
+	})
+	t.Run("Immutable", func(t *testing.T) {
+		// changing an updated document, or the update document,
+		// does not change the update.
+		for _, tc := range []struct {
+			update   string
+			path     string
+			operand  string
+			expected string
+		}{
+			{update: `{"$set":{"arr":{"x":1}}}`, path: "arr.x", operand: "$set.arr.x", expected: `{"arr":{"x":1}}`},
+			{update: `{"$push":{"arr":{"x":1}}}`, path: "arr.0.x", operand: "$push.arr.x", expected: `{"arr":[{"x":1}]}`},
+			{update: `{"$push":{"arr":{"$each":[{"x":1}]}}}`, path: "arr.0.x", operand: "$push.arr.$each.0.x", expected: `{"arr":[{"x":1}]}`},
+			{update: `{"$addToSet":{"arr":{"x":1}}}`, path: "arr.0.x", operand: "$addToSet.arr.x", expected: `{"arr":[{"x":1}]}`},
+			{update: `{"$max":{"arr":{"x":1}}}`, path: "arr.x", operand: "$max.arr.x", expected: `{"arr":{"x":1}}`},
+			{update: `{"arr":{"x":1}}`, path: "arr.x", operand: "arr.x", expected: `{"arr":{"x":1}}`},
+		} {
+			spec := birchtest.Document(t, tc.update)
+			u, err := Compile(spec)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.update, err)
+			}
+
+			first := birch.DC.New()
+			if _, err := u.Apply(first); err != nil {
+				t.Fatalf("%s: %v", tc.update, err)
+			}
+			if err := first.SetPath(birch.ParsePath(tc.path), birch.VC.Int32(99)); err != nil {
+				t.Fatalf("%s: %v", tc.update, err)
+			}
+			requireJSON(t, spec, tc.update)
+			if err := spec.SetPath(birch.ParsePath(tc.operand), birch.VC.Int32(98)); err != nil {
+				t.Fatal(err)
+			}
+
+			second := birch.DC.New()
+			if _, err := u.Apply(second); err != nil {
+				t.Fatalf("%s: %v", tc.update, err)
+			}
+			requireJSON(t, second, tc.expected)
+		}
+	})
+	t.Run("ApplyErrors", func(t *testing.T) {
+		const original = `{"_id":1,"a":"x","b":[1],"c":{"d":[{"e":1}]},"n":9223372036854775807}`
+		for _, tc := range []struct {
+			update string
+			err    error
+		}{
+			{update: `{"$set":{"z":1},"$inc":{"a":1}}`, err: bsonerr.NonNumeric},
+			{update: `{"$set":{"z":1},"$mul":{"a":2}}`, err: ErrTypeMismatch},
+			{update: `{"$mul":{"n":2}}`, err: bsonerr.NumericOverflow},
+			{update: `{"$set":{"z":1},"$push":{"a":1}}`, err: ErrTypeMismatch},
+			{update: `{"$addToSet":{"a":1}}`, err: ErrTypeMismatch},
+			{update: `{"$pull":{"a":1}}`, err: ErrTypeMismatch},
+			{update: `{"$pop":{"a":1}}`, err: ErrTypeMismatch},
+			{update: `{"$set":{"a.b":1}}`, err: bsonerr.InvalidDepthTraversal},
+			{update: `{"$rename":{"c.d.0.e":"f"}}`, err: ErrTypeMismatch},
+			{update: `{"_id":2}`, err: ErrImmutableField},
+		} {
+			u, err := Compile(birchtest.Document(t, tc.update))
+			if err != nil {
+				t.Fatalf("%s: %v", tc.update, err)
+			}
+			doc := birchtest.Document(t, original)
+			if changed, err := u.Apply(doc); !errors.Is(err, tc.err) || changed {
+				t.Errorf("%s: expected %v, got %v", tc.update, tc.err, err)
+			}
+			requireJSON(t, doc, original)
+		}
+	})
+}
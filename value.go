@@ -66,21 +66,20 @@ func (v *Value) Set(v2 *Value) {
 // elements to map[string]any or []any as possible.
 //
 // The underlying types of the values returned by this method are
-// their native corresponding type when possible.
+// their native corresponding type when possible. Functions registered
+// with DefaultRegistry.RegisterInterface take precedence.
 func (v *Value) Interface() any {
-	if v == nil {
-		return nil
-	}
+	return DefaultRegistry.Interface(v)
+}
 
+// scalarInterface converts values other than documents and arrays to
+// the corresponding Go type.
+func (v *Value) scalarInterface() any {
 	switch v.Type() {
 	case bsontype.Double:
 		return v.Double()
 	case bsontype.String:
 		return v.StringValue()
-	case bsontype.EmbeddedDocument:
-		return v.MutableDocument().ExportMap()
-	case bsontype.Array:
-		return v.MutableArray().Interface()
 	case bsontype.Binary:
 		_, data := v.Binary()
 		return data
@@ -218,6 +217,10 @@ func (v *Value) validate(sizeOnly bool) (uint32, error) {
 		l := readi32(v.data[v.offset : v.offset+4])
 		total += 4
 
+		if l < 1 {
+			return total, bsonerr.InvalidString
+		}
+
 		if int32(v.offset)+4+l > int32(len(v.data)) {
 			return total, errTooSmall
 		}
@@ -316,7 +319,11 @@ func (v *Value) validate(sizeOnly bool) (uint32, error) {
 		l := readi32(v.data[v.offset : v.offset+4])
 		total += 5
 
-		if v.data[v.offset+4] > '\x05' && v.data[v.offset+4] < '\x80' {
+		if l < 0 {
+			return total, bsonerr.InvalidLength
+		}
+
+		if v.data[v.offset+4] > '\x09' && v.data[v.offset+4] < '\x80' {
 			return total, bsonerr.InvalidBinarySubtype
 		}
 
@@ -374,9 +381,17 @@ func (v *Value) validate(sizeOnly bool) (uint32, error) {
 		l := readi32(v.data[v.offset : v.offset+4])
 		total += 4
 
+		if l < 1 {
+			return total, bsonerr.InvalidString
+		}
+
 		if int32(v.offset)+4+l+12 > int32(len(v.data)) {
 			return total, errTooSmall
 		}
+		// the namespace is a string, with a null terminator.
+		if !sizeOnly && v.data[v.offset+4+uint32(l)-1] != 0x00 {
+			return total, bsonerr.InvalidString
+		}
 
 		total += uint32(l) + 12
 	case '\x0F':
@@ -1148,9 +1163,10 @@ func (v *Value) Decimal128() types.Decimal128 {
 		panic(bsonerr.NewElementTypeError("compact.Element.Decimal128", bsontype.Type(v.data[v.start])))
 	}
 
+	// the low bits are stored first, see elements.Decimal128.Encode
 	return types.NewDecimal128(
-		binary.LittleEndian.Uint64(v.data[v.offset:v.offset+8]),
-		binary.LittleEndian.Uint64(v.data[v.offset+8:v.offset+16]))
+		binary.LittleEndian.Uint64(v.data[v.offset+8:v.offset+16]),
+		binary.LittleEndian.Uint64(v.data[v.offset:v.offset+8]))
 }
 
 // Decimal128OK is the same as Decimal128, except that it returns a boolean
@@ -7,6 +7,7 @@ import (
 
 	"github.com/tychoish/birch/bsonerr"
 	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/types"
 )
 
 func TestValue(t *testing.T) {
@@ -94,6 +95,26 @@ func TestValue(t *testing.T) {
 			t.Errorf("Unexpected result. got %s; want %s", got, want)
 		}
 	})
+	t.Run("decimal128", func(t *testing.T) {
+		want := types.NewDecimal128(0x3040000000000000, 12345)
+		doc := DC.Elements(EC.Decimal128("foo", want))
+		b, err := doc.MarshalBSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ReadDocument(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []*Value{doc.Lookup("foo"), VC.Decimal128(want), parsed.Lookup("foo")} {
+			if got := v.Decimal128(); got != want {
+				t.Errorf("Unexpected result. got %v; want %v", got, want)
+			}
+		}
+		if got := parsed.Lookup("foo").Decimal128().String(); got != "12345" {
+			t.Errorf("Unexpected result. got %s; want 12345", got)
+		}
+	})
 	t.Run("Equal", func(t *testing.T) {
 		codewithscopeval := func() *Value {
 			b, err := DC.Elements(
@@ -101,6 +101,18 @@ func BenchmarkBSON(b *testing.B) {
 					}
 				}
 			})
+			b.Run("Append", func(b *testing.B) {
+				doc := birch.DC.MapString(input)
+				buf := make([]byte, 0, len(output))
+				b.ResetTimer()
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					buf, err = doc.AppendBSON(buf[:0])
+					if err != nil || len(buf) == 0 {
+						b.Fatal()
+					}
+				}
+			})
 			b.Run("Combined", func(b *testing.B) {
 				b.ReportAllocs()
 				for i := 0; i < b.N; i++ {
@@ -217,6 +229,15 @@ func BenchmarkBSON(b *testing.B) {
 					}
 				}
 			})
+			b.Run("Lazy", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					resolved, err := birch.ReadLazyDocument(output)
+					if err != nil || resolved.Lookup("key50") == nil {
+						b.Fatal(err)
+					}
+				}
+			})
 		})
 		b.Run("EVG", func(b *testing.B) {
 			b.Run("Export", func(b *testing.B) {
@@ -82,3 +82,64 @@ func (d *Document) Validate() (uint32, error) {
 
 	return size, nil
 }
+
+// Merge combines the overlay document into the document in the same
+// manner as birch.Document.Merge: keys that are only in the overlay
+// are added after the existing keys, and the values of keys in both
+// documents are merged as determined by the options. When the merge
+// returns an error, the document is not modified.
+func (d *Document) Merge(overlay *Document, opts birch.MergeOptions) error {
+	type change struct {
+		key   string
+		value *birch.Value
+	}
+
+	current := map[string]*birch.Value{}
+	for e := d.Front(); e.Ok(); e = e.Next() {
+		if _, ok := current[e.Value().Key()]; !ok {
+			current[e.Value().Key()] = e.Value().Value()
+		}
+	}
+
+	changes := []change{}
+	for e := overlay.Front(); e.Ok(); e = e.Next() {
+		key := e.Value().Key()
+
+		out, err := opts.MergeValue(birch.Path{key}, current[key], e.Value().Value())
+		if err != nil {
+			return err
+		}
+
+		current[key] = out
+		changes = append(changes, change{key: key, value: out})
+	}
+
+	for _, c := range changes {
+		if c.value == nil {
+			d.Delete(c.key)
+			continue
+		}
+
+		elem := birch.EC.Value(c.key, c.value)
+		if !d.replace(elem) {
+			d.PushBack(elem)
+		}
+	}
+
+	return nil
+}
+
+// MergePatch applies the patch to the document as an RFC 7396 JSON
+// Merge Patch, in the same manner as birch.Document.MergePatch.
+func (d *Document) MergePatch(patch *Document) error {
+	return d.Merge(patch, birch.MergeOptions{NullDeletes: true})
+}
+
+func (d *Document) replace(elem *birch.Element) bool {
+	for e := d.Front(); e.Ok(); e = e.Next() {
+		if e.Value().Key() == elem.Key() {
+			return e.Set(elem)
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package blist
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsonerr"
+)
+
+func TestMerge(t *testing.T) {
+	elems := func() []*birch.Element {
+		return []*birch.Element{
+			birch.EC.String("name", "service"),
+			birch.EC.SubDocumentFromElements("server", birch.EC.String("host", "localhost"), birch.EC.Int32("port", 8080)),
+			birch.EC.ArrayFromElements("tags", birch.VC.String("a")),
+		}
+	}
+	overlay := func() []*birch.Element {
+		return []*birch.Element{
+			birch.EC.SubDocumentFromElements("server", birch.EC.Int32("port", 9090)),
+			birch.EC.ArrayFromElements("tags", birch.VC.String("a"), birch.VC.String("b")),
+			birch.EC.Null("name"),
+			birch.EC.String("env", "prod"),
+		}
+	}
+	toDocument := func(d *Document) *birch.Document {
+		out := birch.DC.New()
+		for e := d.Front(); e.Ok(); e = e.Next() {
+			out.Append(e.Value())
+		}
+		return out
+	}
+
+	for _, opts := range []birch.MergeOptions{
+		{},
+		{NullDeletes: true},
+		{Arrays: birch.ArrayUnion},
+		{Arrays: birch.ArrayAppend, NullDeletes: true},
+	} {
+		doc := (&Document{}).Append(elems()...)
+		if err := doc.Merge((&Document{}).Append(overlay()...), opts); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := birch.DC.Elements(elems()...)
+		if err := expected.Merge(birch.DC.Elements(overlay()...), opts); err != nil {
+			t.Fatal(err)
+		}
+
+		if out := toDocument(doc); out.String() != expected.String() {
+			t.Errorf("%+v: got %s, expected %s", opts, out, expected)
+		}
+	}
+
+	t.Run("MergePatch", func(t *testing.T) {
+		doc := (&Document{}).Append(elems()...)
+		if err := doc.MergePatch((&Document{}).Append(overlay()...)); err != nil {
+			t.Fatal(err)
+		}
+		for e := doc.Front(); e.Ok(); e = e.Next() {
+			if e.Value().Key() == "name" {
+				t.Fatalf("unexpected document %s", toDocument(doc))
+			}
+		}
+	})
+	t.Run("ConflictError", func(t *testing.T) {
+		doc := (&Document{}).Append(elems()...)
+		before := toDocument(doc).String()
+
+		err := doc.Merge((&Document{}).Append(overlay()...), birch.MergeOptions{
+			OnConflict: func(birch.Path, *birch.Value, *birch.Value) (*birch.Value, error) { return nil, bsonerr.DuplicateKey },
+		})
+		if !errors.Is(err, bsonerr.DuplicateKey) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if out := toDocument(doc).String(); out != before {
+			t.Fatalf("document modified: %s", out)
+		}
+	})
+}
@@ -11,7 +11,6 @@ import (
 	"github.com/tychoish/birch/bsontype"
 	"github.com/tychoish/birch/types"
 	"github.com/tychoish/birch/x/ftdc/testutil"
-	"github.com/tychoish/birch/x/ftdc/util"
 )
 
 func TestFlattenArray(t *testing.T) {
@@ -134,8 +133,7 @@ func TestReadDocument(t *testing.T) {
 				Time:    time.Now(),
 				Counter: 42,
 			},
-			len:        3,
-			shouldSkip: util.GlobalMarshaler() == nil,
+			len: 3,
 		},
 		{
 			name: "StructWithValues",
@@ -148,8 +146,7 @@ func TestReadDocument(t *testing.T) {
 				Time:    time.Now(),
 				Counter: 42,
 			},
-			shouldSkip: util.GlobalMarshaler() == nil,
-			len:        3,
+			len: 3,
 		},
 		{
 			name: "Reader",
@@ -44,10 +44,10 @@ func readDocument(in any) (*birch.Document, error) {
 	default:
 		marshaler := util.GlobalMarshaler()
 		if marshaler == nil {
-			return nil, errors.New("no registerged marshler")
+			return birch.DCE.Interface(in)
 		}
 
-		data, err := util.GlobalMarshaler()(in)
+		data, err := marshaler(in)
 		if err != nil {
 			return nil, fmt.Errorf("problem with fallback marshaling: %w", err)
 		}
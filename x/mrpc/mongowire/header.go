@@ -3,6 +3,8 @@ package mongowire
 import (
 	"fmt"
 	"io"
+
+	"github.com/tychoish/birch"
 )
 
 type MessageHeader struct {
@@ -19,7 +21,19 @@ func (h *MessageHeader) WriteTo(wr io.Writer) {
 	writeInt32(int32(h.OpCode), wr)
 }
 
+// Parse parses the body of a message, without limits on the
+// documents in the message.
 func (h *MessageHeader) Parse(body []byte) (Message, error) {
+	return h.parse(body, nil)
+}
+
+// ParseOptions parses the body of a message, rejecting documents in the
+// message that exceed the limits.
+func (h *MessageHeader) ParseOptions(body []byte, opts birch.DecodeOptions) (Message, error) {
+	return h.parse(body, &opts)
+}
+
+func (h *MessageHeader) parse(body []byte, opts *birch.DecodeOptions) (Message, error) {
 	var (
 		m   Message
 		err error
@@ -27,25 +41,25 @@ func (h *MessageHeader) Parse(body []byte) (Message, error) {
 
 	switch h.OpCode {
 	case OP_REPLY:
-		m, err = h.parseReplyMessage(body)
+		m, err = h.parseReplyMessage(body, opts)
 	case OP_UPDATE:
-		m, err = h.parseUpdateMessage(body)
+		m, err = h.parseUpdateMessage(body, opts)
 	case OP_INSERT:
-		m, err = h.parseInsertMessage(body)
+		m, err = h.parseInsertMessage(body, opts)
 	case OP_QUERY:
-		m, err = h.parseQueryMessage(body)
+		m, err = h.parseQueryMessage(body, opts)
 	case OP_GET_MORE:
 		m, err = h.parseGetMoreMessage(body)
 	case OP_DELETE:
-		m, err = h.parseDeleteMessage(body)
+		m, err = h.parseDeleteMessage(body, opts)
 	case OP_KILL_CURSORS:
 		m, err = h.parseKillCursorsMessage(body)
 	case OP_COMMAND:
-		m, err = h.parseCommandMessage(body)
+		m, err = h.parseCommandMessage(body, opts)
 	case OP_COMMAND_REPLY:
-		m, err = h.parseCommandReplyMessage(body)
+		m, err = h.parseCommandReplyMessage(body, opts)
 	case OP_MSG:
-		m, err = h.parseMsgBody(body)
+		m, err = h.parseMsgBody(body, opts)
 	default:
 		return nil, fmt.Errorf("unknown op code: %s", h.OpCode)
 	}
@@ -7,11 +7,48 @@ import (
 	"io"
 
 	"errors"
+
+	"github.com/tychoish/birch"
 )
 
 const MaxInt32 = 2147483647
 
+// DefaultMaxMessageSize is the size of the largest message that
+// ReadMessage accepts, when the options do not specify one.
+const DefaultMaxMessageSize = 200 * 1024 * 1024
+
+// ErrMessageTooLarge indicates that the size of a message is larger
+// than the maximum.
+var ErrMessageTooLarge = errors.New("message too big")
+
+// ReadOptions control the limits that ReadMessageOptions applies to
+// messages from peers.
+type ReadOptions struct {
+	// MaxMessageSize is the size, in bytes, of the largest message
+	// to accept. When zero, the limit is DefaultMaxMessageSize.
+	MaxMessageSize int
+
+	// Decode limits the documents in the message.
+	Decode birch.DecodeOptions
+}
+
+// ReadMessage reads a message from the reader, rejecting messages
+// larger than DefaultMaxMessageSize, without limits on the documents
+// in the message.
 func ReadMessage(ctx context.Context, reader io.Reader) (Message, error) {
+	return readMessage(ctx, reader, DefaultMaxMessageSize, nil)
+}
+
+// ReadMessageOptions reads a message from the reader, rejecting
+// messages and documents that exceed the limits.
+func ReadMessageOptions(ctx context.Context, reader io.Reader, opts ReadOptions) (Message, error) {
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return readMessage(ctx, reader, opts.MaxMessageSize, &opts.Decode)
+}
+
+func readMessage(ctx context.Context, reader io.Reader, maxMessageSize int, decode *birch.DecodeOptions) (Message, error) {
 	type readResult struct {
 		n   int
 		err error
@@ -46,11 +83,11 @@ func ReadMessage(ctx context.Context, reader io.Reader) (Message, error) {
 
 	header := MessageHeader{}
 	header.Size = readInt32(sizeBuf)
-	if header.Size > int32(200*1024*1024) {
+	if int(header.Size) > maxMessageSize {
 		if header.Size == 542393671 {
-			return nil, fmt.Errorf("message too big, probably http request %d", header.Size)
+			return nil, fmt.Errorf("%w, probably http request %d", ErrMessageTooLarge, header.Size)
 		}
-		return nil, fmt.Errorf("message too big %d", header.Size)
+		return nil, fmt.Errorf("%w %d", ErrMessageTooLarge, header.Size)
 	}
 	if header.Size < 0 || header.Size-4 > MaxInt32 {
 		return nil, errors.New("message header has invalid size")
@@ -95,7 +132,7 @@ func ReadMessage(ctx context.Context, reader io.Reader) (Message, error) {
 	header.ResponseTo = readInt32(buf[4:])
 	header.OpCode = OpType(readInt32(buf[8:]))
 
-	return header.Parse(buf[12:])
+	return header.parse(buf[12:], decode)
 }
 
 func SendMessage(ctx context.Context, m Message, writer io.Writer) error {
@@ -3,11 +3,13 @@ package mongowire
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"sync"
 	"testing"
 
 	"github.com/tychoish/birch"
+	"github.com/tychoish/birch/bsonerr"
 )
 
 func TestReadMessage(t *testing.T) {
@@ -99,6 +101,88 @@ func TestReadMessage(t *testing.T) {
 	}
 }
 
+func TestReadMessageOptions(t *testing.T) {
+	nested := birch.DC.Elements(birch.EC.SubDocumentFromElements("a", birch.EC.SubDocumentFromElements("b", birch.EC.Int32("c", 1))))
+	duplicate := birch.DC.Elements(birch.EC.Int32("a", 1), birch.EC.Int32("a", 2))
+
+	for _, test := range []struct {
+		name    string
+		message Message
+		opts    ReadOptions
+		err     error
+	}{
+		{
+			name:    "MessageTooLarge",
+			message: createLargeMessage(t, 1024),
+			opts:    ReadOptions{MaxMessageSize: 1024},
+			err:     ErrMessageTooLarge,
+		},
+		{
+			name:    "DocumentTooLarge",
+			message: createLargeMessage(t, 1024),
+			opts:    ReadOptions{Decode: birch.DecodeOptions{MaxDocumentSize: 1024}},
+			err:     bsonerr.DocumentTooLarge,
+		},
+		{
+			name:    "MaxDepth",
+			message: NewQuery("ns", 0, 0, 1, nested, nil),
+			opts:    ReadOptions{Decode: birch.DecodeOptions{MaxDepth: 2}},
+			err:     bsonerr.MaxDepthExceeded,
+		},
+		{
+			name:    "DuplicateKeys",
+			message: NewQuery("ns", 0, 0, 1, duplicate, nil),
+			opts:    ReadOptions{Decode: birch.DecodeOptions{RejectDuplicateKeys: true}},
+			err:     bsonerr.DuplicateKey,
+		},
+		{
+			name:    "WithinLimits",
+			message: NewQuery("ns", 0, 0, 1, nested, duplicate),
+			opts:    ReadOptions{MaxMessageSize: 1024, Decode: birch.DecodeOptions{MaxDepth: 3}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := ReadMessageOptions(context.TODO(), bytes.NewReader(test.message.Serialize()), test.opts)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err == nil && !bytes.Equal(test.message.Serialize(), message.Serialize()) {
+				t.Error("values should be equal")
+			}
+		})
+	}
+	t.Run("Unlimited", func(t *testing.T) {
+		// ReadMessage and Parse do not limit documents, as before
+		// the limits existed, so they accept documents that are
+		// deeper than the default limit.
+		deep := birch.DC.Elements(birch.EC.Int32("a", 1))
+		for range birch.DefaultMaxDepth {
+			deep = birch.DC.Elements(birch.EC.SubDocument("a", deep))
+		}
+		message := NewQuery("ns", 0, 0, 1, deep, nil)
+
+		if _, err := ReadMessageOptions(context.TODO(), bytes.NewReader(message.Serialize()), ReadOptions{}); !errors.Is(err, bsonerr.MaxDepthExceeded) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		out, err := ReadMessage(context.TODO(), bytes.NewReader(message.Serialize()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(message.Serialize(), out.Serialize()) {
+			t.Error("values should be equal")
+		}
+
+		header := message.Header()
+		if _, err := header.Parse(message.Serialize()[16:]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := header.ParseOptions(message.Serialize()[16:], birch.DecodeOptions{}); !errors.Is(err, bsonerr.MaxDepthExceeded) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
+
 func TestSendMessage(t *testing.T) {
 	t.Run("CanceledContext", func(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
@@ -59,7 +59,7 @@ func (m *CommandMessage) Serialize() []byte {
 	return buf.Bytes()
 }
 
-func (h *MessageHeader) parseCommandMessage(buf []byte) (Message, error) {
+func (h *MessageHeader) parseCommandMessage(buf []byte, opts *birch.DecodeOptions) (Message, error) {
 	var err error
 
 	cmd := &CommandMessage{
@@ -85,7 +85,7 @@ func (h *MessageHeader) parseCommandMessage(buf []byte) (Message, error) {
 	}
 	buf = buf[len(cmd.CmdName)+1:]
 
-	cmd.CommandArgs, err = birch.ReadDocument(buf)
+	cmd.CommandArgs, err = readDocument(opts, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +100,7 @@ func (h *MessageHeader) parseCommandMessage(buf []byte) (Message, error) {
 	}
 	buf = buf[size:]
 
-	cmd.Metadata, err = birch.ReadDocument(buf)
+	cmd.Metadata, err = readDocument(opts, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -116,7 +116,7 @@ func (h *MessageHeader) parseCommandMessage(buf []byte) (Message, error) {
 	buf = buf[size:]
 
 	for len(buf) > 0 {
-		doc, err := birch.ReadDocument(buf)
+		doc, err := readDocument(opts, buf)
 		if err != nil {
 			return nil, err
 		}
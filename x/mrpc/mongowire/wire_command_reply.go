@@ -46,14 +46,14 @@ func (m *CommandReplyMessage) Serialize() []byte {
 	return buf.Bytes()
 }
 
-func (h *MessageHeader) parseCommandReplyMessage(buf []byte) (Message, error) {
+func (h *MessageHeader) parseCommandReplyMessage(buf []byte, opts *birch.DecodeOptions) (Message, error) {
 	rm := &CommandReplyMessage{
 		header: *h,
 	}
 
 	var err error
 
-	rm.CommandReply, err = birch.ReadDocument(buf)
+	rm.CommandReply, err = readDocument(opts, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +64,7 @@ func (h *MessageHeader) parseCommandReplyMessage(buf []byte) (Message, error) {
 	}
 	buf = buf[replySize:]
 
-	rm.Metadata, err = birch.ReadDocument(buf)
+	rm.Metadata, err = readDocument(opts, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +75,7 @@ func (h *MessageHeader) parseCommandReplyMessage(buf []byte) (Message, error) {
 	buf = buf[metaSize:]
 
 	for len(buf) > 0 {
-		doc, err := birch.ReadDocument(buf)
+		doc, err := readDocument(opts, buf)
 		if err != nil {
 			return nil, err
 		}
@@ -45,7 +45,7 @@ func (m *deleteMessage) Serialize() []byte {
 	return buf.Bytes()
 }
 
-func (h *MessageHeader) parseDeleteMessage(buf []byte) (Message, error) {
+func (h *MessageHeader) parseDeleteMessage(buf []byte, opts *birch.DecodeOptions) (Message, error) {
 	var (
 		err error
 		loc int
@@ -73,7 +73,7 @@ func (h *MessageHeader) parseDeleteMessage(buf []byte) (Message, error) {
 	m.Flags = readInt32(buf[loc:])
 	loc += 4
 
-	m.Filter, err = birch.ReadDocument(buf[loc:])
+	m.Filter, err = readDocument(opts, buf[loc:])
 	if err != nil {
 		return nil, err
 	}
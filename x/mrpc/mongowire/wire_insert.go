@@ -50,7 +50,7 @@ func (m *insertMessage) Serialize() []byte {
 	return buf.Bytes()
 }
 
-func (h *MessageHeader) parseInsertMessage(buf []byte) (Message, error) {
+func (h *MessageHeader) parseInsertMessage(buf []byte, opts *birch.DecodeOptions) (Message, error) {
 	m := &insertMessage{
 		header: *h,
 	}
@@ -72,7 +72,7 @@ func (h *MessageHeader) parseInsertMessage(buf []byte) (Message, error) {
 	loc += len(m.Namespace) + 1
 
 	for loc < len(buf) {
-		doc, err := birch.ReadDocument(buf[loc:])
+		doc, err := readDocument(opts, buf[loc:])
 		if err != nil {
 			return nil, err
 		}
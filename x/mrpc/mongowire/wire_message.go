@@ -181,7 +181,7 @@ func NewOpMessage(moreToCome bool, documents []birch.Document, items ...model.Se
 	return msg
 }
 
-func (h *MessageHeader) parseMsgBody(body []byte) (Message, error) {
+func (h *MessageHeader) parseMsgBody(body []byte, opts *birch.DecodeOptions) (Message, error) {
 	if len(body) < 4 {
 		return nil, errors.New("invalid op message - message must have length of at least 4 bytes")
 	}
@@ -204,7 +204,7 @@ func (h *MessageHeader) parseMsgBody(body []byte) (Message, error) {
 		case OpMessageSectionBody:
 			section := &opMessagePayloadType0{}
 			docSize := int(readInt32(body[loc:]))
-			section.Document, err = birch.ReadDocument(body[loc : loc+docSize])
+			section.Document, err = readDocument(opts, body[loc:loc+docSize])
 			loc += getDocSize(section.Document)
 			msg.Items = append(msg.Items, section)
 		case OpMessageSectionDocumentSequence:
@@ -219,7 +219,7 @@ func (h *MessageHeader) parseMsgBody(body []byte) (Message, error) {
 
 			for remaining := int(section.Size) - 1 - 4 - len(section.Identifier) - 1; remaining > 0; {
 				docSize := int(readInt32(body[loc:]))
-				doc, err := birch.ReadDocument(body[loc : loc+docSize])
+				doc, err := readDocument(opts, body[loc:loc+docSize])
 				if err != nil {
 					return nil, fmt.Errorf("could not read payload document: %w", err)
 				}
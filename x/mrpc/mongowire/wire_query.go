@@ -67,7 +67,7 @@ func (m *queryMessage) convertToCommand() *CommandMessage {
 	}
 }
 
-func (h *MessageHeader) parseQueryMessage(buf []byte) (Message, error) {
+func (h *MessageHeader) parseQueryMessage(buf []byte, opts *birch.DecodeOptions) (Message, error) {
 	if len(buf) < 4 {
 		return nil, errors.New("invalid query message -- message must have length of at least 4 bytes")
 	}
@@ -99,14 +99,14 @@ func (h *MessageHeader) parseQueryMessage(buf []byte) (Message, error) {
 	qm.NReturn = readInt32(buf[loc:])
 	loc += 4
 
-	qm.Query, err = birch.ReadDocument(buf[loc:])
+	qm.Query, err = readDocument(opts, buf[loc:])
 	if err != nil {
 		return nil, err
 	}
 	loc += getDocSize(qm.Query)
 
 	if loc < len(buf) {
-		qm.Project, err = birch.ReadDocument(buf[loc:])
+		qm.Project, err = readDocument(opts, buf[loc:])
 		if err != nil {
 			return nil, err
 		}
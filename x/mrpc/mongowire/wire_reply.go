@@ -48,7 +48,7 @@ func (m *ReplyMessage) Serialize() []byte {
 	return buf.Bytes()
 }
 
-func (h *MessageHeader) parseReplyMessage(buf []byte) (Message, error) {
+func (h *MessageHeader) parseReplyMessage(buf []byte, opts *birch.DecodeOptions) (Message, error) {
 	var loc int
 
 	if len(buf) < 20 {
@@ -72,7 +72,7 @@ func (h *MessageHeader) parseReplyMessage(buf []byte) (Message, error) {
 	loc += 4
 
 	for loc < len(buf) {
-		doc, err := birch.ReadDocument(buf[loc:])
+		doc, err := readDocument(opts, buf[loc:])
 		if err != nil {
 			return nil, err
 		}
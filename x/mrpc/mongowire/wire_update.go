@@ -49,7 +49,7 @@ func (m *updateMessage) Serialize() []byte {
 	return buf.Bytes()
 }
 
-func (h *MessageHeader) parseUpdateMessage(buf []byte) (Message, error) {
+func (h *MessageHeader) parseUpdateMessage(buf []byte, opts *birch.DecodeOptions) (Message, error) {
 	var (
 		err error
 		loc int
@@ -79,7 +79,7 @@ func (h *MessageHeader) parseUpdateMessage(buf []byte) (Message, error) {
 	m.Flags = readInt32(buf[loc:])
 	loc += 4
 
-	m.Filter, err = birch.ReadDocument(buf[loc:])
+	m.Filter, err = readDocument(opts, buf[loc:])
 	if err != nil {
 		return nil, err
 	}
@@ -89,7 +89,7 @@ func (h *MessageHeader) parseUpdateMessage(buf []byte) (Message, error) {
 		return m, errors.New("invalid update message -- message length is too short")
 	}
 
-	m.Update, err = birch.ReadDocument(buf[loc:])
+	m.Update, err = readDocument(opts, buf[loc:])
 	if err != nil {
 		return nil, err
 	}
@@ -32,6 +32,15 @@ func must[T any](arg T, err error) T {
 	return arg
 }
 
+// readDocument reads a document within the limits, or without limits
+// when the options are nil.
+func readDocument(opts *birch.DecodeOptions, b []byte) (*birch.Document, error) {
+	if opts == nil {
+		return birch.ReadDocument(b)
+	}
+	return opts.ReadDocument(b)
+}
+
 func writeInt32(i int32, wr io.Writer) int {
 	return int(must(wr.Write(encodeInt32(i))))
 }
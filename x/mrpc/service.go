@@ -25,14 +25,23 @@ type basicService struct {
 	addr          string
 	registry      *OperationRegistry
 	errorHandlers []func(error)
+	readOpts      mongowire.ReadOptions
 }
 
 // NewService starts a generic wire protocol service listening on the given host
 // and port.
 func NewBasicService(host string, port int) Service {
+	return NewBasicServiceOptions(host, port, mongowire.ReadOptions{})
+}
+
+// NewBasicServiceOptions is the same as NewBasicService, except that the
+// service rejects messages from clients that exceed the limits in the
+// options.
+func NewBasicServiceOptions(host string, port int, opts mongowire.ReadOptions) Service {
 	return &basicService{
 		addr:     fmt.Sprintf("%s:%d", host, port),
 		registry: &OperationRegistry{ops: make(map[mongowire.OpScope]HandlerFunc)},
+		readOpts: opts,
 	}
 }
 
@@ -99,7 +108,7 @@ func (s *basicService) dispatchRequest(ctx context.Context, conn net.Conn) {
 	}
 
 	for {
-		m, err := mongowire.ReadMessage(ctx, conn)
+		m, err := mongowire.ReadMessageOptions(ctx, conn, s.readOpts)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				// Connection was likely closed
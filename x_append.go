@@ -0,0 +1,136 @@
+package birch
+
+import (
+	"strconv"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// AppendBSON appends the BSON representation of the document to dst,
+// growing it as needed, and returns the extended slice. Lengths are
+// written after the content they describe, so unlike MarshalBSON,
+// the document is encoded in a single pass, and callers can reuse dst
+// between documents to avoid allocating.
+//
+// If an error occurs, the contents of the returned slice beyond
+// len(dst) are undefined.
+func (d *Document) AppendBSON(dst []byte) ([]byte, error) {
+	if d == nil {
+		return dst, bsonerr.NilDocument
+	}
+
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+
+	var err error
+	for _, elem := range d.elems {
+		if dst, err = elem.AppendBSON(dst); err != nil {
+			return dst, err
+		}
+	}
+
+	dst = append(dst, 0x00)
+	putLength(dst, start)
+
+	return dst, nil
+}
+
+// AppendBSON appends the BSON representation of the array, which is a
+// document with the indexes of the values as keys, to dst.
+func (a *Array) AppendBSON(dst []byte) ([]byte, error) {
+	if a == nil || a.doc == nil {
+		return dst, bsonerr.NilDocument
+	}
+
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+
+	var err error
+	for idx, elem := range a.doc.elems {
+		if elem == nil || elem.value == nil || elem.value.data == nil {
+			return dst, bsonerr.UninitializedElement
+		}
+
+		dst = append(dst, elem.value.data[elem.value.start])
+		dst = strconv.AppendInt(dst, int64(idx), 10)
+		dst = append(dst, 0x00)
+
+		if dst, err = elem.value.AppendBSON(dst); err != nil {
+			return dst, err
+		}
+	}
+
+	dst = append(dst, 0x00)
+	putLength(dst, start)
+
+	return dst, nil
+}
+
+// AppendBSON appends the BSON representation of the element,
+// including its type and key, to dst.
+func (e *Element) AppendBSON(dst []byte) ([]byte, error) {
+	if e == nil {
+		return dst, bsonerr.NilElement
+	}
+	if e.value == nil || e.value.data == nil {
+		return dst, bsonerr.UninitializedElement
+	}
+
+	if _, err := e.validateKey(); err != nil {
+		return dst, err
+	}
+
+	dst = append(dst, e.value.data[e.value.start:e.value.offset]...)
+
+	return e.value.AppendBSON(dst)
+}
+
+// AppendBSON appends the BSON representation of the value, without a
+// type or key, to dst.
+func (v *Value) AppendBSON(dst []byte) ([]byte, error) {
+	if v == nil || v.offset == 0 || v.data == nil {
+		return dst, bsonerr.UninitializedElement
+	}
+
+	if v.d != nil {
+		switch v.Type() {
+		case bsontype.EmbeddedDocument:
+			return v.d.AppendBSON(dst)
+		case bsontype.Array:
+			return (&Array{doc: v.d}).AppendBSON(dst)
+		case bsontype.CodeWithScope:
+			codeLength := readi32(v.data[v.offset+4 : v.offset+8])
+			if codeLength < 1 || int(v.offset)+8+int(codeLength) > len(v.data) {
+				return dst, bsonerr.InvalidString
+			}
+
+			start := len(dst)
+			dst = append(dst, 0, 0, 0, 0)
+			dst = append(dst, v.data[v.offset+4:v.offset+8+uint32(codeLength)]...)
+
+			var err error
+			if dst, err = v.d.AppendBSON(dst); err != nil {
+				return dst, err
+			}
+
+			putLength(dst, start)
+
+			return dst, nil
+		}
+	}
+
+	size, err := v.validate(false)
+	if err != nil {
+		return dst, err
+	}
+
+	return append(dst, v.data[v.offset:v.offset+size]...), nil
+}
+
+// putLength writes the length of the data from start to the end of
+// dst into the four bytes at start.
+func putLength(dst []byte, start int) {
+	l := int32(len(dst) - start)
+	dst[start], dst[start+1], dst[start+2], dst[start+3] = byte(l), byte(l>>8), byte(l>>16), byte(l>>24)
+}
@@ -0,0 +1,132 @@
+package birch
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/tychoish/birch/bsonerr"
+)
+
+func TestAppendBSON(t *testing.T) {
+	prefix := []byte("prefix")
+
+	t.Run("Document", func(t *testing.T) {
+		for _, test := range makeDocumentTestCases(0) {
+			t.Run(test.Name, func(t *testing.T) {
+				// compare with the encoding that computes the
+				// size before writing the document.
+				size, err := test.Doc.Validate()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected := make([]byte, size)
+				if _, err := test.Doc.writeByteSlice(0, size, expected); err != nil {
+					t.Fatal(err)
+				}
+
+				out, err := test.Doc.AppendBSON(append([]byte{}, prefix...))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasPrefix(out, prefix) || !bytes.Equal(out[len(prefix):], expected) {
+					t.Fatalf("got %X, expected %X", out[len(prefix):], expected)
+				}
+
+				// documents read from bytes are appended from
+				// their underlying buffers.
+				doc, err := ReadDocument(expected)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out, err = doc.AppendBSON(nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out, expected) {
+					t.Fatalf("got %X, expected %X", out, expected)
+				}
+
+				for elem := range test.Doc.Iterator() {
+					expected, err := elem.MarshalBSON()
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					out, err := elem.AppendBSON(nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(out, expected) {
+						t.Fatalf("element %q: got %X, expected %X", elem.Key(), out, expected)
+					}
+
+					header := 1 + len(elem.Key()) + 1
+					out, err = elem.Value().AppendBSON(nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(out, expected[header:]) {
+						t.Fatalf("value %q: got %X, expected %X", elem.Key(), out, expected[header:])
+					}
+				}
+			})
+		}
+	})
+	t.Run("Array", func(t *testing.T) {
+		for _, test := range makeArrayTestCases(0) {
+			t.Run(test.Name, func(t *testing.T) {
+				expected, err := test.Array.MarshalBSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				out, err := test.Array.AppendBSON(append([]byte{}, prefix...))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out[len(prefix):], expected) {
+					t.Fatalf("got %X, expected %X", out[len(prefix):], expected)
+				}
+			})
+		}
+	})
+	t.Run("ReuseBuffer", func(t *testing.T) {
+		buf := make([]byte, 0, 1024)
+		for _, doc := range []*Document{
+			DC.Elements(EC.String("a", "first")),
+			DC.Elements(EC.Int64("b", 2), EC.SubDocumentFromElements("c", EC.Boolean("d", true))),
+		} {
+			expected, err := doc.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := doc.AppendBSON(buf[:0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if &out[0] != &buf[:1][0] {
+				t.Fatal("buffer was not reused")
+			}
+			if !bytes.Equal(out, expected) {
+				t.Fatalf("got %X, expected %X", out, expected)
+			}
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		var doc *Document
+		if _, err := doc.AppendBSON(nil); !errors.Is(err, bsonerr.NilDocument) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		var elem *Element
+		if _, err := elem.AppendBSON(nil); !errors.Is(err, bsonerr.NilElement) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if _, err := (&Value{}).AppendBSON(nil); !errors.Is(err, bsonerr.UninitializedElement) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
@@ -0,0 +1,511 @@
+package birch
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// CanonicalTypeOrder returns the position of the type in the BSON
+// comparison order, which MongoDB uses to compare values of different
+// types. Types with the same position, such as the numeric types, are
+// compared by value. Unknown types return 0 and sort first.
+func CanonicalTypeOrder(t bsontype.Type) int {
+	switch t {
+	case bsontype.MinKey:
+		return 1
+	case bsontype.Null, bsontype.Undefined:
+		return 2
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		return 3
+	case bsontype.String, bsontype.Symbol:
+		return 4
+	case bsontype.EmbeddedDocument:
+		return 5
+	case bsontype.Array:
+		return 6
+	case bsontype.Binary:
+		return 7
+	case bsontype.ObjectID:
+		return 8
+	case bsontype.Boolean:
+		return 9
+	case bsontype.DateTime:
+		return 10
+	case bsontype.Timestamp:
+		return 11
+	case bsontype.Regex:
+		return 12
+	case bsontype.DBPointer:
+		return 13
+	case bsontype.JavaScript:
+		return 14
+	case bsontype.CodeWithScope:
+		return 15
+	case bsontype.MaxKey:
+		return 16
+	default:
+		return 0
+	}
+}
+
+// Compare orders two values in the BSON comparison order, first by
+// the canonical order of their types and then by value, and returns
+// -1, 0 or 1. A nil value compares as null.
+//
+// Numbers of all types compare exactly by their value, so that an
+// int64 and a double that differ only beyond the precision of a
+// float64 are not equal. NaN is equal to itself and sorts before all
+// other numbers. Documents compare element by element, by the type,
+// key and value of each element; arrays compare value by value; and
+// in both cases a prefix sorts first.
+func Compare(a, b *Value) int {
+	ta, tb := compareType(a), compareType(b)
+	if c := cmp.Compare(CanonicalTypeOrder(ta), CanonicalTypeOrder(tb)); c != 0 || a == nil || b == nil {
+		return c
+	}
+
+	switch ta {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		return compareNumbers(a, b)
+	case bsontype.String, bsontype.Symbol:
+		return strings.Compare(compareString(a), compareString(b))
+	case bsontype.EmbeddedDocument:
+		return CompareDocuments(a.MutableDocument(), b.MutableDocument())
+	case bsontype.Array:
+		return compareArrays(a.MutableArray(), b.MutableArray())
+	case bsontype.Binary:
+		sa, da := a.Binary()
+		sb, db := b.Binary()
+		if c := cmp.Compare(len(da), len(db)); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(sa, sb); c != 0 {
+			return c
+		}
+		return bytes.Compare(da, db)
+	case bsontype.ObjectID:
+		oa, ob := a.ObjectID(), b.ObjectID()
+		return bytes.Compare(oa[:], ob[:])
+	case bsontype.Boolean:
+		return compareBool(a.Boolean(), b.Boolean())
+	case bsontype.DateTime:
+		return cmp.Compare(a.DateTime(), b.DateTime())
+	case bsontype.Timestamp:
+		ta, ia := a.Timestamp()
+		tb, ib := b.Timestamp()
+		if c := cmp.Compare(ta, tb); c != 0 {
+			return c
+		}
+		return cmp.Compare(ia, ib)
+	case bsontype.Regex:
+		pa, oa := a.Regex()
+		pb, ob := b.Regex()
+		if c := strings.Compare(pa, pb); c != 0 {
+			return c
+		}
+		return strings.Compare(oa, ob)
+	case bsontype.DBPointer:
+		na, oa := a.DBPointer()
+		nb, ob := b.DBPointer()
+		if c := cmp.Compare(len(na), len(nb)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(na, nb); c != 0 {
+			return c
+		}
+		return bytes.Compare(oa[:], ob[:])
+	case bsontype.JavaScript:
+		return strings.Compare(a.JavaScript(), b.JavaScript())
+	case bsontype.CodeWithScope:
+		ca, da := a.MutableJavaScriptWithScope()
+		cb, db := b.MutableJavaScriptWithScope()
+		if c := strings.Compare(ca, cb); c != 0 {
+			return c
+		}
+		return CompareDocuments(da, db)
+	default:
+		// null, undefined, MinKey and MaxKey have no value, and
+		// unknown types cannot be compared.
+		return 0
+	}
+}
+
+// CompareDocuments orders two documents in the BSON comparison order
+// and returns -1, 0 or 1. The documents compare element by element:
+// first by the canonical order of the types of the values, then by
+// key and then by value. When one document is a prefix of the other,
+// it sorts first. A nil document compares as an empty document.
+func CompareDocuments(a, b *Document) int {
+	var la, lb int
+	if a != nil {
+		la = a.Len()
+	}
+	if b != nil {
+		lb = b.Len()
+	}
+
+	for idx := 0; idx < la && idx < lb; idx++ {
+		ea, eb := a.ElementAt(uint(idx)), b.ElementAt(uint(idx))
+		if c := cmp.Compare(CanonicalTypeOrder(compareType(ea.Value())), CanonicalTypeOrder(compareType(eb.Value()))); c != 0 {
+			return c
+		}
+		if c := strings.Compare(ea.Key(), eb.Key()); c != 0 {
+			return c
+		}
+		if c := Compare(ea.Value(), eb.Value()); c != 0 {
+			return c
+		}
+	}
+
+	return cmp.Compare(la, lb)
+}
+
+func compareArrays(a, b *Array) int {
+	for idx := 0; idx < a.Len() && idx < b.Len(); idx++ {
+		va, _ := a.Lookup(uint(idx))
+		vb, _ := b.Lookup(uint(idx))
+		if c := Compare(va, vb); c != 0 {
+			return c
+		}
+	}
+
+	return cmp.Compare(a.Len(), b.Len())
+}
+
+func compareType(v *Value) bsontype.Type {
+	if v == nil {
+		return bsontype.Null
+	}
+	return v.Type()
+}
+
+func compareString(v *Value) string {
+	if v.Type() == bsontype.Symbol {
+		return v.Symbol()
+	}
+	return v.StringValue()
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// compareNumbers compares two numeric values exactly. Integers and
+// doubles are compared without conversion, and decimals are compared
+// as rational numbers.
+func compareNumbers(a, b *Value) int {
+	if a.Type() == bsontype.Decimal128 || b.Type() == bsontype.Decimal128 {
+		return compareRationals(a, b)
+	}
+
+	ia, aInt := compareInteger(a)
+	ib, bInt := compareInteger(b)
+
+	switch {
+	case aInt && bInt:
+		return cmp.Compare(ia, ib)
+	case aInt:
+		return -compareDoubleInteger(b.Double(), ia)
+	case bInt:
+		return compareDoubleInteger(a.Double(), ib)
+	default:
+		// cmp.Compare orders NaN before other numbers and
+		// treats NaNs as equal.
+		return cmp.Compare(a.Double(), b.Double())
+	}
+}
+
+func compareInteger(v *Value) (int64, bool) {
+	switch v.Type() {
+	case bsontype.Int32:
+		return int64(v.Int32()), true
+	case bsontype.Int64:
+		return v.Int64(), true
+	default:
+		return 0, false
+	}
+}
+
+// compareDoubleInteger compares a double and an integer by comparing
+// the integer part of the double and then the sign of its fractional
+// part, which avoids rounding the integer to a double.
+func compareDoubleInteger(f float64, i int64) int {
+	switch {
+	case math.IsNaN(f), f < math.MinInt64:
+		return -1
+	case f >= -math.MinInt64:
+		return 1
+	}
+
+	t := math.Trunc(f)
+	if c := cmp.Compare(int64(t), i); c != 0 {
+		return c
+	}
+
+	return cmp.Compare(f-t, 0)
+}
+
+// compareRationals compares numbers, at least one of which is a
+// decimal, by their exact value. NaN sorts before negative infinity,
+// which sorts before all finite numbers.
+func compareRationals(a, b *Value) int {
+	ra, ca := numberRat(a)
+	rb, cb := numberRat(b)
+
+	if ca != 0 || cb != 0 {
+		return cmp.Compare(ca, cb)
+	}
+
+	return ra.Cmp(rb)
+}
+
+// numberRat returns the exact value of a finite number, or classifies
+// a number that is not finite: -2 for NaN, -1 for negative infinity
+// and 1 for positive infinity.
+func numberRat(v *Value) (*big.Rat, int) {
+	switch v.Type() {
+	case bsontype.Int32:
+		return new(big.Rat).SetInt64(int64(v.Int32())), 0
+	case bsontype.Int64:
+		return new(big.Rat).SetInt64(v.Int64()), 0
+	case bsontype.Double:
+		f := v.Double()
+		switch {
+		case math.IsNaN(f):
+			return nil, -2
+		case math.IsInf(f, -1):
+			return nil, -1
+		case math.IsInf(f, 1):
+			return nil, 1
+		}
+		return new(big.Rat).SetFloat64(f), 0
+	default:
+		d := v.Decimal128()
+		switch {
+		case d.IsNaN():
+			return nil, -2
+		case d.IsInf(-1):
+			return nil, -1
+		case d.IsInf(1):
+			return nil, 1
+		}
+		r, _ := d.BigRat()
+		return r, 0
+	}
+}
+
+type sortField struct {
+	path Path
+	dir  int
+}
+
+// CompareBy returns a function that orders documents by a sort
+// specification, a document such as {a: 1, "b.c": -1} whose keys are
+// dotted paths and whose values are 1, for ascending order, or -1, for
+// descending order. Documents that compare equal for a key are
+// ordered by the next key.
+//
+// As in MongoDB, a missing field sorts as null, and an empty array
+// sorts before null. A path that resolves to the values in an array
+// sorts by the smallest of those values in ascending order, and by the
+// largest in descending order.
+//
+// Invalid specifications return an error that wraps
+// bsonerr.InvalidSortSpec.
+func CompareBy(spec *Document) (func(a, b *Document) int, error) {
+	fields, err := parseSortSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(a, b *Document) int {
+		for _, field := range fields {
+			if c := compareSortKeys(field.key(a), field.key(b)); c != 0 {
+				return field.dir * c
+			}
+		}
+		return 0
+	}, nil
+}
+
+// SortDocuments sorts the documents, in place, by a sort
+// specification, as described by CompareBy. The sort is stable, so
+// documents that compare equal keep their order.
+func SortDocuments(docs []*Document, spec *Document) error {
+	fields, err := parseSortSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	// resolve each sort key once, rather than once per
+	// comparison.
+	type keyed struct {
+		doc  *Document
+		keys []*Value
+	}
+
+	items := make([]keyed, len(docs))
+	for idx, doc := range docs {
+		items[idx].doc = doc
+		items[idx].keys = make([]*Value, len(fields))
+		for fidx, field := range fields {
+			items[idx].keys[fidx] = field.key(doc)
+		}
+	}
+
+	slices.SortStableFunc(items, func(a, b keyed) int {
+		for idx, field := range fields {
+			if c := compareSortKeys(a.keys[idx], b.keys[idx]); c != 0 {
+				return field.dir * c
+			}
+		}
+		return 0
+	})
+
+	for idx := range items {
+		docs[idx] = items[idx].doc
+	}
+
+	return nil
+}
+
+func parseSortSpec(spec *Document) ([]sortField, error) {
+	if spec == nil || spec.Len() == 0 {
+		return nil, fmt.Errorf("%w: no sort keys", bsonerr.InvalidSortSpec)
+	}
+
+	fields := make([]sortField, 0, spec.Len())
+	for elem := range spec.Iterator() {
+		path := ParsePath(elem.Key())
+		if len(path) == 0 || slices.Contains(path, "") {
+			return nil, fmt.Errorf("%w: invalid path %q", bsonerr.InvalidSortSpec, elem.Key())
+		}
+
+		dir, ok := sortDirection(elem.Value())
+		if !ok {
+			return nil, fmt.Errorf("%w: direction for %q must be 1 or -1, not %v", bsonerr.InvalidSortSpec, elem.Key(), elem.Value())
+		}
+
+		fields = append(fields, sortField{path: path, dir: dir})
+	}
+
+	return fields, nil
+}
+
+func sortDirection(v *Value) (int, bool) {
+	if CanonicalTypeOrder(v.Type()) != CanonicalTypeOrder(bsontype.Int32) {
+		return 0, false
+	}
+
+	for _, dir := range []int32{1, -1} {
+		if Compare(v, VC.Int32(dir)) == 0 {
+			return int(dir), true
+		}
+	}
+
+	return 0, false
+}
+
+// key returns the value that the document sorts by for the field: the
+// smallest or largest of the values at the path, depending on the
+// direction of the field, or nil for an empty array.
+func (f sortField) key(doc *Document) *Value {
+	var values []*Value
+	if doc != nil {
+		if v := doc.Lookup(f.path[0]); v != nil {
+			values = sortValues(v, f.path[1:], values)
+		}
+	}
+
+	if len(values) == 0 {
+		return VC.Null()
+	}
+
+	out := values[0]
+	for _, v := range values[1:] {
+		if c := compareSortKeys(v, out); c*f.dir < 0 {
+			out = v
+		}
+	}
+
+	return out
+}
+
+// sortValues appends the values at the path within the value to out.
+// Paths traverse arrays both by index and through the documents that
+// the arrays contain. Documents in arrays that lack the rest of the
+// path contribute null, and empty arrays at the end of the path
+// contribute nil.
+func sortValues(v *Value, path Path, out []*Value) []*Value {
+	if len(path) == 0 {
+		arr, ok := v.MutableArrayOK()
+		if !ok {
+			return append(out, v)
+		}
+		if arr.Len() == 0 {
+			return append(out, nil)
+		}
+		for item := range arr.Iterator() {
+			out = append(out, item)
+		}
+		return out
+	}
+
+	switch v.Type() {
+	case bsontype.EmbeddedDocument:
+		next := v.MutableDocument().Lookup(path[0])
+		if next == nil {
+			return append(out, VC.Null())
+		}
+		return sortValues(next, path[1:], out)
+	case bsontype.Array:
+		arr := v.MutableArray()
+		if idx, err := strconv.ParseUint(path[0], 10, 32); err == nil {
+			if item, err := arr.Lookup(uint(idx)); err == nil {
+				out = sortValues(item, path[1:], out)
+			}
+		}
+		for item := range arr.Iterator() {
+			if item.Type() == bsontype.EmbeddedDocument {
+				out = sortValues(item, path, out)
+			}
+		}
+		return out
+	default:
+		return append(out, VC.Null())
+	}
+}
+
+// compareSortKeys compares sort keys, where nil represents an empty
+// array, which sorts after MinKey and before all other values.
+func compareSortKeys(a, b *Value) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		if b.Type() == bsontype.MinKey {
+			return 1
+		}
+		return -1
+	case b == nil:
+		return -compareSortKeys(b, a)
+	default:
+		return Compare(a, b)
+	}
+}
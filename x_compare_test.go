@@ -0,0 +1,238 @@
+package birch
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/types"
+)
+
+func TestCompare(t *testing.T) {
+	decimal := func(t *testing.T, s string) *Value {
+		t.Helper()
+
+		d, err := types.ParseDecimal128(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return VC.Decimal128(d)
+	}
+
+	t.Run("TypeOrder", func(t *testing.T) {
+		// each value sorts before the values that follow it.
+		ordered := []*Value{
+			VC.MinKey(),
+			VC.Null(),
+			VC.Int32(1),
+			VC.String("a"),
+			VC.DocumentFromElements(EC.Int32("a", 1)),
+			VC.ArrayFromValues(VC.Int32(1)),
+			VC.Binary([]byte{1}),
+			VC.ObjectID(types.NewObjectID()),
+			VC.Boolean(false),
+			VC.DateTime(1),
+			VC.Timestamp(1, 1),
+			VC.Regex("a", "i"),
+			VC.DBPointer("db.coll", types.NewObjectID()),
+			VC.JavaScript("code"),
+			VC.CodeWithScope("code", DC.New()),
+			VC.MaxKey(),
+		}
+
+		for i := range ordered {
+			for j := range ordered {
+				expected := 0
+				switch {
+				case i < j:
+					expected = -1
+				case i > j:
+					expected = 1
+				}
+				if c := Compare(ordered[i], ordered[j]); c != expected {
+					t.Errorf("Compare(%s, %s) = %d, expected %d", ordered[i].Type(), ordered[j].Type(), c, expected)
+				}
+			}
+		}
+
+		shuffled := slices.Clone(ordered)
+		slices.Reverse(shuffled)
+		slices.SortFunc(shuffled, Compare)
+		for idx := range ordered {
+			if shuffled[idx] != ordered[idx] {
+				t.Fatalf("%d: got %s, expected %s", idx, shuffled[idx].Type(), ordered[idx].Type())
+			}
+		}
+	})
+	t.Run("Values", func(t *testing.T) {
+		oid := types.NewObjectID()
+
+		for _, test := range []struct {
+			name     string
+			a, b     *Value
+			expected int
+		}{
+			{name: "NilNull", a: nil, b: VC.Null(), expected: 0},
+			{name: "NullUndefined", a: VC.Null(), b: VC.Undefined(), expected: 0},
+			{name: "NilNumber", a: nil, b: VC.Int32(0), expected: -1},
+			{name: "Int32Int64", a: VC.Int32(2), b: VC.Int64(2), expected: 0},
+			{name: "Int64Double", a: VC.Int64(3), b: VC.Double(2.5), expected: 1},
+			{name: "DoubleFraction", a: VC.Double(2.5), b: VC.Int32(2), expected: 1},
+			{name: "NegativeFraction", a: VC.Double(-2.5), b: VC.Int32(-2), expected: -1},
+			{name: "Int64Precision", a: VC.Int64(1<<53 + 1), b: VC.Double(1 << 53), expected: 1},
+			{name: "Int64Max", a: VC.Int64(math.MaxInt64), b: VC.Double(math.MaxInt64), expected: -1},
+			{name: "Int64Min", a: VC.Int64(math.MinInt64), b: VC.Double(math.MinInt64), expected: 0},
+			{name: "Infinity", a: VC.Double(math.Inf(1)), b: VC.Int64(math.MaxInt64), expected: 1},
+			{name: "NegativeInfinity", a: VC.Double(math.Inf(-1)), b: VC.Int64(math.MinInt64), expected: -1},
+			{name: "NaN", a: VC.Double(math.NaN()), b: VC.Double(math.Inf(-1)), expected: -1},
+			{name: "NaNInteger", a: VC.Int32(math.MinInt32), b: VC.Double(math.NaN()), expected: 1},
+			{name: "NaNEqual", a: VC.Double(math.NaN()), b: VC.Double(math.NaN()), expected: 0},
+			{name: "NegativeZero", a: VC.Double(math.Copysign(0, -1)), b: VC.Int32(0), expected: 0},
+			{name: "DecimalInteger", a: decimal(t, "2.00"), b: VC.Int32(2), expected: 0},
+			{name: "DecimalDouble", a: decimal(t, "0.1"), b: VC.Double(0.1), expected: -1},
+			{name: "DecimalExponent", a: decimal(t, "1E+3"), b: decimal(t, "999.9"), expected: 1},
+			{name: "DecimalPrecision", a: decimal(t, "9223372036854775807.5"), b: VC.Int64(math.MaxInt64), expected: 1},
+			{name: "DecimalNaN", a: decimal(t, "NaN"), b: VC.Double(math.NaN()), expected: 0},
+			{name: "DecimalInfinity", a: decimal(t, "-Infinity"), b: VC.Double(-math.MaxFloat64), expected: -1},
+			{name: "DecimalInfinities", a: decimal(t, "Infinity"), b: VC.Double(math.Inf(1)), expected: 0},
+			{name: "DecimalNonCanonical", a: VC.Decimal128(types.NewDecimal128(6176<<49|(1<<49-1), ^uint64(0))), b: VC.Int32(0), expected: 0},
+			{name: "StringSymbol", a: VC.String("a"), b: VC.Symbol("b"), expected: -1},
+			{name: "StringBytes", a: VC.String("B"), b: VC.String("a"), expected: -1},
+			{name: "DocumentKey", a: VC.DocumentFromElements(EC.Int32("a", 2)), b: VC.DocumentFromElements(EC.Int32("b", 1)), expected: -1},
+			{name: "DocumentType", a: VC.DocumentFromElements(EC.String("a", "x")), b: VC.DocumentFromElements(EC.Int32("a", 1)), expected: 1},
+			{name: "DocumentNumbers", a: VC.DocumentFromElements(EC.Int32("a", 1)), b: VC.DocumentFromElements(EC.Double("a", 1)), expected: 0},
+			{name: "DocumentPrefix", a: VC.DocumentFromElements(EC.Int32("a", 1)), b: VC.DocumentFromElements(EC.Int32("a", 1), EC.Null("b")), expected: -1},
+			{name: "Array", a: VC.ArrayFromValues(VC.Int32(1), VC.Int32(3)), b: VC.ArrayFromValues(VC.Int32(2)), expected: -1},
+			{name: "ArrayPrefix", a: VC.ArrayFromValues(VC.Int32(1), VC.Int32(3)), b: VC.ArrayFromValues(VC.Int32(1)), expected: 1},
+			{name: "BinaryLength", a: VC.Binary([]byte{2}), b: VC.Binary([]byte{1, 1}), expected: -1},
+			{name: "BinarySubtype", a: VC.BinaryWithSubtype([]byte{2}, 0x80), b: VC.Binary([]byte{1}), expected: 1},
+			{name: "Boolean", a: VC.Boolean(false), b: VC.Boolean(true), expected: -1},
+			{name: "Timestamp", a: VC.Timestamp(2, 1), b: VC.Timestamp(1, 2), expected: 1},
+			{name: "DBPointerLength", a: VC.DBPointer("b.c", oid), b: VC.DBPointer("a.bc", oid), expected: -1},
+			{name: "CodeWithScope", a: VC.CodeWithScope("f", DC.Elements(EC.Int32("a", 1))), b: VC.CodeWithScope("f", DC.Elements(EC.Int32("a", 2))), expected: -1},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				if c := Compare(test.a, test.b); c != test.expected {
+					t.Fatalf("got %d, expected %d", c, test.expected)
+				}
+				if c := Compare(test.b, test.a); c != -test.expected {
+					t.Fatalf("reversed got %d, expected %d", c, -test.expected)
+				}
+			})
+		}
+	})
+	t.Run("Elements", func(t *testing.T) {
+		elems := Elements{
+			EC.String("b", "x"),
+			EC.Int64("a", 3),
+			EC.Double("a", 2.5),
+			EC.Null("a"),
+		}
+		sort.Sort(elems)
+
+		if elems[0].Value().Type() != bsontype.Null || elems[1].Value().Double() != 2.5 || elems[2].Value().Int64() != 3 || elems[3].Key() != "b" {
+			t.Fatalf("unexpected order %v", elems)
+		}
+	})
+}
+
+func TestSortDocuments(t *testing.T) {
+	docs := []*Document{
+		DC.Elements(EC.Int32("id", 0), EC.Int32("a", 2), EC.String("b", "x")),
+		DC.Elements(EC.Int32("id", 1), EC.Int32("a", 1), EC.String("b", "y")),
+		DC.Elements(EC.Int32("id", 2), EC.Double("a", 2), EC.String("b", "z")),
+		DC.Elements(EC.Int32("id", 3), EC.String("b", "w")),
+		DC.Elements(EC.Int32("id", 4), EC.ArrayFromElements("a", VC.Int32(0), VC.Int32(5))),
+		DC.Elements(EC.Int32("id", 5), EC.ArrayFromElements("a")),
+		DC.Elements(EC.Int32("id", 6), EC.SubDocumentFromElements("c", EC.Int32("d", 2))),
+		DC.Elements(EC.Int32("id", 7), EC.ArrayFromElements("c", VC.DocumentFromElements(EC.Int32("d", 3)), VC.DocumentFromElements(EC.Int32("d", 1)))),
+	}
+
+	ids := func(docs []*Document) []int32 {
+		out := make([]int32, 0, len(docs))
+		for _, doc := range docs {
+			out = append(out, doc.Lookup("id").Int32())
+		}
+		return out
+	}
+
+	for _, test := range []struct {
+		name     string
+		spec     *Document
+		expected []int32
+	}{
+		{
+			name:     "Ascending",
+			spec:     DC.Elements(EC.Int32("a", 1)),
+			expected: []int32{5, 3, 6, 7, 4, 1, 0, 2},
+		},
+		{
+			name:     "Descending",
+			spec:     DC.Elements(EC.Int32("a", -1)),
+			expected: []int32{4, 0, 2, 1, 3, 6, 7, 5},
+		},
+		{
+			name:     "Compound",
+			spec:     DC.Elements(EC.Int32("a", -1), EC.Double("b", -1)),
+			expected: []int32{4, 2, 0, 1, 3, 6, 7, 5},
+		},
+		{
+			name:     "NestedPath",
+			spec:     DC.Elements(EC.Int64("c.d", 1), EC.Int32("id", -1)),
+			expected: []int32{5, 4, 3, 2, 1, 0, 7, 6},
+		},
+		{
+			name:     "NestedPathDescending",
+			spec:     DC.Elements(EC.Int64("c.d", -1), EC.Int32("id", 1)),
+			expected: []int32{7, 6, 0, 1, 2, 3, 4, 5},
+		},
+		{
+			name:     "ArrayIndex",
+			spec:     DC.Elements(EC.Int32("a.1", -1), EC.Int32("id", 1)),
+			expected: []int32{4, 0, 1, 2, 3, 5, 6, 7},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sorted := slices.Clone(docs)
+			if err := SortDocuments(sorted, test.spec); err != nil {
+				t.Fatal(err)
+			}
+			if out := ids(sorted); !slices.Equal(out, test.expected) {
+				t.Fatalf("got %v, expected %v", out, test.expected)
+			}
+
+			compare, err := CompareBy(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sorted = slices.Clone(docs)
+			slices.SortStableFunc(sorted, compare)
+			if out := ids(sorted); !slices.Equal(out, test.expected) {
+				t.Fatalf("got %v, expected %v", out, test.expected)
+			}
+		})
+	}
+	t.Run("InvalidSpec", func(t *testing.T) {
+		for _, spec := range []*Document{
+			nil,
+			DC.New(),
+			DC.Elements(EC.Int32("a", 2)),
+			DC.Elements(EC.Double("a", 1.5)),
+			DC.Elements(EC.String("a", "asc")),
+			DC.Elements(EC.Int32("", 1)),
+			DC.Elements(EC.Int32("a..b", 1)),
+		} {
+			if err := SortDocuments(slices.Clone(docs), spec); !errors.Is(err, bsonerr.InvalidSortSpec) {
+				t.Errorf("%v: unexpected error %v", spec, err)
+			}
+		}
+
+		if _, err := CompareBy(DC.Elements(EC.Double("a", -1), EC.Int64("b", 1))); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
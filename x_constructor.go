@@ -164,6 +164,10 @@ func (DocumentConstructor) MapInterfaceInterface(in map[any]any) *Document {
 	return out
 }
 
+// Interface constructs a document from the value, which may be one of
+// the map types, a document, a reader, a marshaler, or a struct (or
+// pointer to a struct) which is converted using reflection. If the
+// value cannot be converted, Interface returns an empty document.
 func (DocumentConstructor) Interface(value any) *Document {
 	var (
 		doc *Document
@@ -192,6 +196,8 @@ func (DocumentConstructor) Interface(value any) *Document {
 		doc, err = DCE.Marshaler(t)
 	case []*Element:
 		doc = DC.Elements(t...)
+	default:
+		doc, err = DefaultRegistry.reflectDocument(t)
 	}
 
 	if err != nil || doc == nil {
@@ -201,6 +207,9 @@ func (DocumentConstructor) Interface(value any) *Document {
 	return doc
 }
 
+// Interface constructs a document from the value in the same manner
+// as DC.Interface, but returns an error if the value cannot be
+// converted.
 func (DocumentConstructorError) Interface(value any) (*Document, error) {
 	switch t := value.(type) {
 	case map[string]string:
@@ -221,8 +230,10 @@ func (DocumentConstructorError) Interface(value any) (*Document, error) {
 		return t.MarshalDocument()
 	case Marshaler:
 		return DCE.Marshaler(t)
-	default:
+	case nil:
 		return nil, fmt.Errorf("value '%s' is of type '%T' which is not convertable to a document.", t, t)
+	default:
+		return DefaultRegistry.reflectDocument(t)
 	}
 }
 
@@ -0,0 +1,60 @@
+package birch
+
+import (
+	"math/big"
+
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/types"
+)
+
+// Decimal128String parses the string as a decimal, with
+// types.ParseDecimal128, and creates a decimal element.
+func (ElementConstructorError) Decimal128String(key, value string) (*Element, error) {
+	d, err := types.ParseDecimal128(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return EC.Decimal128(key, d), nil
+}
+
+// Decimal128String parses the string as a decimal, with
+// types.ParseDecimal128, and creates a decimal value.
+func (ValueConstructorError) Decimal128String(value string) (*Value, error) {
+	elem, err := ECE.Decimal128String("", value)
+	if err != nil {
+		return nil, err
+	}
+
+	return elem.value, nil
+}
+
+// AsDecimal128 converts a numeric value (int32, int64, double or
+// decimal) to a decimal, rounding to the nearest decimal when the value
+// has more than 34 significant digits, and reports the accuracy of the
+// conversion. Doubles convert from their exact binary value, as
+// types.DecimalContext.FromFloat64 does. The boolean is false for
+// values of other types.
+func (v *Value) AsDecimal128() (types.Decimal128, big.Accuracy, bool) {
+	if v == nil || v.offset == 0 || v.data == nil {
+		return types.Decimal128{}, big.Exact, false
+	}
+
+	var ctx types.DecimalContext
+
+	switch v.Type() {
+	case bsontype.Int32:
+		d, acc := ctx.FromBigInt(big.NewInt(int64(v.Int32())))
+		return d, acc, true
+	case bsontype.Int64:
+		d, acc := ctx.FromBigInt(big.NewInt(v.Int64()))
+		return d, acc, true
+	case bsontype.Double:
+		d, acc := ctx.FromFloat64(v.Double())
+		return d, acc, true
+	case bsontype.Decimal128:
+		return v.Decimal128(), big.Exact, true
+	default:
+		return types.Decimal128{}, big.Exact, false
+	}
+}
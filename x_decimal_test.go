@@ -0,0 +1,73 @@
+package birch
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/tychoish/birch/types"
+)
+
+func TestDecimalValues(t *testing.T) {
+	t.Run("Constructors", func(t *testing.T) {
+		v, err := VCE.Decimal128String("1.50")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Decimal128().String() != "1.50" {
+			t.Fatalf("unexpected value %v", v)
+		}
+
+		elem, err := ECE.Decimal128String("a", "-Infinity")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elem.Key() != "a" || !elem.Value().Decimal128().IsInf(-1) {
+			t.Fatalf("unexpected element %s", elem)
+		}
+
+		if _, err := VCE.Decimal128String("1.2.3"); err == nil {
+			t.Fatal("expected error for invalid decimal")
+		}
+		if _, err := ECE.Decimal128String("a", ""); err == nil {
+			t.Fatal("expected error for invalid decimal")
+		}
+	})
+	t.Run("AsDecimal128", func(t *testing.T) {
+		for _, test := range []struct {
+			value    *Value
+			expected string
+			acc      big.Accuracy
+			ok       bool
+		}{
+			{value: VC.Int32(-42), expected: "-42", acc: big.Exact, ok: true},
+			{value: VC.Int64(1 << 62), expected: "4611686018427387904", acc: big.Exact, ok: true},
+			{value: VC.Double(0.25), expected: "0.25", acc: big.Exact, ok: true},
+			{value: VC.Double(0.1), expected: "0.1000000000000000055511151231257827", acc: big.Below, ok: true},
+			{value: VC.Decimal128(types.NewDecimal128(0x3040000000000000, 7)), expected: "7", acc: big.Exact, ok: true},
+			{value: VC.String("1"), expected: "0E-6176", acc: big.Exact},
+			{value: nil, expected: "0E-6176", acc: big.Exact},
+		} {
+			d, acc, ok := test.value.AsDecimal128()
+			if d.String() != test.expected || acc != test.acc || ok != test.ok {
+				t.Errorf("%v: got %s (%v, %t)", test.value, d, acc, ok)
+			}
+		}
+
+		// converted values are usable with decimal arithmetic.
+		price, _, _ := VC.Int32(3).AsDecimal128()
+		total := price.Mul(mustDecimal(t, "19.99"))
+		if total.String() != "59.97" {
+			t.Fatalf("got %s", total)
+		}
+	})
+}
+
+func mustDecimal(t *testing.T, s string) types.Decimal128 {
+	t.Helper()
+
+	d, err := types.ParseDecimal128(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
@@ -0,0 +1,257 @@
+package birch
+
+import (
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// DecodeOptions limit the documents that the decoding functions accept,
+// for reading BSON from untrusted sources. The zero value applies the
+// default size and depth limits, and no others.
+//
+// Violations of the limits return errors that wrap
+// bsonerr.DocumentTooLarge, bsonerr.MaxDepthExceeded,
+// bsonerr.TooManyElements, bsonerr.InvalidUTF8 and bsonerr.DuplicateKey.
+type DecodeOptions struct {
+	// MaxDocumentSize is the size, in bytes, of the largest
+	// document to accept. When zero, the limit is
+	// DefaultMaxDocumentSize.
+	MaxDocumentSize int
+
+	// MaxDepth is the number of levels of documents and arrays to
+	// accept, including the top level document. When zero, the
+	// limit is DefaultMaxDepth.
+	MaxDepth int
+
+	// MaxElements is the number of elements to accept, counting
+	// the elements of embedded documents and arrays. When zero,
+	// there is no limit.
+	MaxElements int
+
+	// ValidateUTF8 rejects documents with keys, strings,
+	// JavaScript code, symbols, regular expressions or DBPointer
+	// namespaces that are not valid UTF-8.
+	ValidateUTF8 bool
+
+	// RejectDuplicateKeys rejects documents, including embedded
+	// documents and arrays, that have more than one element with
+	// the same key.
+	RejectDuplicateKeys bool
+}
+
+func (opts DecodeOptions) normalize() DecodeOptions {
+	if opts.MaxDocumentSize <= 0 {
+		opts.MaxDocumentSize = DefaultMaxDocumentSize
+	}
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = DefaultMaxDepth
+	}
+	return opts
+}
+
+// Validate validates the document, including its embedded documents
+// and arrays, within the limits, and returns its size. Unlike
+// Reader.Validate, it checks the contents of every value and does not
+// recurse more deeply than the depth limit.
+func (opts DecodeOptions) Validate(r Reader) (uint32, error) {
+	opts = opts.normalize()
+
+	if len(r) >= 4 {
+		if size := int(readi32(r[0:4])); size > opts.MaxDocumentSize {
+			return 0, fmt.Errorf("%w: %d is larger than %d", bsonerr.DocumentTooLarge, size, opts.MaxDocumentSize)
+		}
+	}
+
+	v := &decodeValidator{opts: opts}
+
+	return v.validate(r, 1)
+}
+
+// ReadDocument validates b within the limits and constructs a Document
+// from it, as ReadDocument does.
+func (opts DecodeOptions) ReadDocument(b []byte) (*Document, error) {
+	if _, err := opts.Validate(b); err != nil {
+		return nil, err
+	}
+
+	return ReadDocument(b)
+}
+
+// ReadLazyDocument validates b within the limits and constructs a
+// LazyDocument from it, as ReadLazyDocument does.
+func (opts DecodeOptions) ReadLazyDocument(b []byte) (*LazyDocument, error) {
+	if _, err := opts.Validate(b); err != nil {
+		return nil, err
+	}
+
+	return ReadLazyDocument(b)
+}
+
+// NewFromIOReader reads a document from r, as NewFromIOReader does,
+// and validates it within the limits. It checks the declared length of
+// the document before allocating a buffer for it.
+func (opts DecodeOptions) NewFromIOReader(r io.Reader) (Reader, error) {
+	if r == nil {
+		return nil, bsonerr.NilReader
+	}
+
+	opts = opts.normalize()
+
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := readi32(header[:])
+	switch {
+	case length < 5:
+		return nil, bsonerr.InvalidLength
+	case int(length) > opts.MaxDocumentSize:
+		return nil, fmt.Errorf("%w: %d is larger than %d", bsonerr.DocumentTooLarge, length, opts.MaxDocumentSize)
+	}
+
+	doc := make(Reader, length)
+	copy(doc, header[:])
+
+	if _, err := io.ReadFull(r, doc[4:]); err != nil {
+		return nil, err
+	}
+
+	if _, err := opts.Validate(doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// Unmarshal validates b within the limits and unmarshals the document
+// into the value, as Document.Unmarshal does.
+func (opts DecodeOptions) Unmarshal(b []byte, into any) error {
+	doc, err := opts.ReadDocument(b)
+	if err != nil {
+		return err
+	}
+
+	return doc.Unmarshal(into)
+}
+
+// decodeValidator tracks the state of validating a document within a
+// set of limits, across its embedded documents.
+type decodeValidator struct {
+	opts     DecodeOptions
+	elements int
+}
+
+func (dv *decodeValidator) validate(r Reader, depth int) (uint32, error) {
+	if depth > dv.opts.MaxDepth {
+		return 0, fmt.Errorf("%w: %d", bsonerr.MaxDepthExceeded, dv.opts.MaxDepth)
+	}
+
+	var keys map[string]struct{}
+	if dv.opts.RejectDuplicateKeys {
+		keys = map[string]struct{}{}
+	}
+
+	return r.readElements(func(elem *Element) error {
+		dv.elements++
+		if dv.opts.MaxElements > 0 && dv.elements > dv.opts.MaxElements {
+			return fmt.Errorf("%w: %d", bsonerr.TooManyElements, dv.opts.MaxElements)
+		}
+
+		key := elem.Key()
+		if dv.opts.ValidateUTF8 && !utf8.ValidString(key) {
+			return fmt.Errorf("%w: key %q", bsonerr.InvalidUTF8, key)
+		}
+		if keys != nil {
+			if _, ok := keys[key]; ok {
+				return fmt.Errorf("%w: %q", bsonerr.DuplicateKey, key)
+			}
+			keys[key] = struct{}{}
+		}
+
+		return dv.validateValue(key, elem.value, depth)
+	})
+}
+
+func (dv *decodeValidator) validateValue(key string, v *Value, depth int) error {
+	switch v.Type() {
+	case bsontype.EmbeddedDocument, bsontype.Array:
+		// the sizes of nested documents were checked when the
+		// element was read.
+		_, err := dv.validate(v.getReader(), depth+1)
+		return err
+	case bsontype.CodeWithScope:
+		return dv.validateCodeWithScope(key, v, depth)
+	}
+
+	if _, err := v.validate(false); err != nil {
+		return err
+	}
+
+	if !dv.opts.ValidateUTF8 {
+		return nil
+	}
+
+	var valid bool
+	switch v.Type() {
+	case bsontype.String, bsontype.JavaScript, bsontype.Symbol, bsontype.DBPointer:
+		// these types, including the namespace of a DBPointer,
+		// begin with a length-prefixed string.
+		l := readi32(v.data[v.offset : v.offset+4])
+		if l < 1 || int64(v.offset)+4+int64(l) > int64(len(v.data)) {
+			return fmt.Errorf("%w: value of %q", bsonerr.InvalidString, key)
+		}
+		valid = utf8.Valid(v.data[v.offset+4 : v.offset+4+uint32(l)-1])
+	case bsontype.Regex:
+		pattern, options := v.Regex()
+		valid = utf8.ValidString(pattern) && utf8.ValidString(options)
+	default:
+		return nil
+	}
+
+	if !valid {
+		return fmt.Errorf("%w: value of %q", bsonerr.InvalidUTF8, key)
+	}
+
+	return nil
+}
+
+// validateCodeWithScope validates the code and scope of a JavaScript
+// code with scope value, which Value.validate does not do within the
+// depth limit.
+func (dv *decodeValidator) validateCodeWithScope(key string, v *Value, depth int) error {
+	if _, err := v.validate(true); err != nil {
+		return err
+	}
+
+	l := readi32(v.data[v.offset : v.offset+4])
+	if l < 14 {
+		return bsonerr.InvalidLength
+	}
+
+	sLength := readi32(v.data[v.offset+4 : v.offset+8])
+	if sLength < 1 || sLength > l-13 {
+		return bsonerr.StringLargerThanContainer
+	}
+
+	code := v.data[v.offset+8 : v.offset+8+uint32(sLength)]
+	if code[len(code)-1] != 0x00 {
+		return bsonerr.InvalidString
+	}
+	if dv.opts.ValidateUTF8 && !utf8.Valid(code[:len(code)-1]) {
+		return fmt.Errorf("%w: value of %q", bsonerr.InvalidUTF8, key)
+	}
+
+	scope := Reader(v.data[v.offset+8+uint32(sLength) : v.offset+uint32(l)])
+	if readi32(scope[0:4]) != int32(len(scope)) {
+		return bsonerr.InvalidLength
+	}
+
+	_, err := dv.validate(scope, depth+1)
+
+	return err
+}
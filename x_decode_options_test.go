@@ -0,0 +1,241 @@
+package birch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/types"
+)
+
+func TestDecodeOptions(t *testing.T) {
+	marshal := func(t *testing.T, doc *Document) []byte {
+		t.Helper()
+
+		out, err := doc.MarshalBSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// nest wraps the element in documents and arrays, alternately,
+	// so that the result has the given depth.
+	nest := func(depth int, elem *Element) *Document {
+		for level := depth; level > 1; level-- {
+			if level%2 == 0 {
+				elem = EC.ArrayFromElements("a", elem.Value())
+			} else {
+				elem = EC.SubDocumentFromElements("d", elem)
+			}
+		}
+		return DC.Elements(elem)
+	}
+
+	t.Run("Limits", func(t *testing.T) {
+		for _, test := range []struct {
+			name string
+			doc  *Document
+			opts DecodeOptions
+			err  error
+		}{
+			{
+				name: "Valid",
+				doc:  DC.Elements(EC.String("a", "b"), EC.SubDocumentFromElements("c", EC.Int32("d", 1))),
+				opts: DecodeOptions{MaxElements: 3, ValidateUTF8: true, RejectDuplicateKeys: true},
+			},
+			{
+				name: "DocumentTooLarge",
+				doc:  DC.Elements(EC.Binary("a", make([]byte, 128))),
+				opts: DecodeOptions{MaxDocumentSize: 128},
+				err:  bsonerr.DocumentTooLarge,
+			},
+			{
+				name: "MaxDepth",
+				doc:  nest(4, EC.Int32("x", 1)),
+				opts: DecodeOptions{MaxDepth: 4},
+			},
+			{
+				name: "MaxDepthExceeded",
+				doc:  nest(5, EC.Int32("x", 1)),
+				opts: DecodeOptions{MaxDepth: 4},
+				err:  bsonerr.MaxDepthExceeded,
+			},
+			{
+				name: "DefaultMaxDepth",
+				doc:  nest(DefaultMaxDepth+1, EC.Int32("x", 1)),
+				err:  bsonerr.MaxDepthExceeded,
+			},
+			{
+				name: "CodeWithScopeDepth",
+				doc:  nest(3, EC.CodeWithScope("x", "code", nest(2, EC.Int32("y", 1)))),
+				opts: DecodeOptions{MaxDepth: 4},
+				err:  bsonerr.MaxDepthExceeded,
+			},
+			{
+				name: "TooManyElements",
+				doc:  DC.Elements(EC.Int32("a", 1), EC.SubDocumentFromElements("b", EC.Int32("c", 1), EC.Int32("d", 1))),
+				opts: DecodeOptions{MaxElements: 3},
+				err:  bsonerr.TooManyElements,
+			},
+			{
+				name: "DuplicateKey",
+				doc:  DC.Elements(EC.Int32("a", 1), EC.Int32("a", 2)),
+				opts: DecodeOptions{RejectDuplicateKeys: true},
+				err:  bsonerr.DuplicateKey,
+			},
+			{
+				name: "NestedDuplicateKey",
+				doc:  DC.Elements(EC.Int32("a", 1), EC.SubDocumentFromElements("b", EC.Int32("a", 1), EC.Int32("a", 2))),
+				opts: DecodeOptions{RejectDuplicateKeys: true},
+				err:  bsonerr.DuplicateKey,
+			},
+			{
+				name: "AllowDuplicateKeys",
+				doc:  DC.Elements(EC.Int32("a", 1), EC.Int32("a", 2)),
+			},
+			{
+				name: "InvalidUTF8Key",
+				doc:  DC.Elements(EC.Int32("\xff", 1)),
+				opts: DecodeOptions{ValidateUTF8: true},
+				err:  bsonerr.InvalidUTF8,
+			},
+			{
+				name: "InvalidUTF8String",
+				doc:  DC.Elements(EC.String("a", "\xc3\x28")),
+				opts: DecodeOptions{ValidateUTF8: true},
+				err:  bsonerr.InvalidUTF8,
+			},
+			{
+				name: "InvalidUTF8Symbol",
+				doc:  DC.Elements(EC.Symbol("a", "\xff")),
+				opts: DecodeOptions{ValidateUTF8: true},
+				err:  bsonerr.InvalidUTF8,
+			},
+			{
+				name: "InvalidUTF8Regex",
+				doc:  DC.Elements(EC.Regex("a", "\xff", "i")),
+				opts: DecodeOptions{ValidateUTF8: true},
+				err:  bsonerr.InvalidUTF8,
+			},
+			{
+				name: "InvalidUTF8DBPointer",
+				doc:  DC.Elements(EC.DBPointer("a", "db.\xff", types.ObjectID{})),
+				opts: DecodeOptions{ValidateUTF8: true},
+				err:  bsonerr.InvalidUTF8,
+			},
+			{
+				name: "InvalidUTF8Code",
+				doc:  DC.Elements(EC.CodeWithScope("a", "\xff", DC.New())),
+				opts: DecodeOptions{ValidateUTF8: true},
+				err:  bsonerr.InvalidUTF8,
+			},
+			{
+				name: "InvalidUTF8Scope",
+				doc:  DC.Elements(EC.CodeWithScope("a", "code", DC.Elements(EC.String("b", "\xff")))),
+				opts: DecodeOptions{ValidateUTF8: true},
+				err:  bsonerr.InvalidUTF8,
+			},
+			{
+				name: "AllowInvalidUTF8",
+				doc:  DC.Elements(EC.String("\xff", "\xff")),
+			},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				data := marshal(t, test.doc)
+
+				check := func(t *testing.T, err error) {
+					t.Helper()
+
+					if test.err == nil && err != nil {
+						t.Fatal(err)
+					}
+					if !errors.Is(err, test.err) {
+						t.Fatalf("unexpected error %v", err)
+					}
+				}
+
+				size, err := test.opts.Validate(data)
+				check(t, err)
+				if err == nil && int(size) != len(data) {
+					t.Fatalf("size is %d, expected %d", size, len(data))
+				}
+
+				doc, err := test.opts.ReadDocument(data)
+				check(t, err)
+				if err == nil && !VC.Document(doc).Equal(VC.Document(test.doc)) {
+					t.Fatalf("got %s, expected %s", doc, test.doc)
+				}
+
+				_, err = test.opts.ReadLazyDocument(data)
+				check(t, err)
+
+				_, err = test.opts.NewFromIOReader(bytes.NewReader(data))
+				check(t, err)
+
+				out := map[string]any{}
+				check(t, test.opts.Unmarshal(data, &out))
+
+				dec := NewDecoder(bytes.NewReader(data), DecoderOptions{Limits: test.opts})
+				_, err = dec.Decode()
+				check(t, err)
+			})
+		}
+	})
+	t.Run("NewFromIOReader", func(t *testing.T) {
+		data := marshal(t, DC.Elements(EC.Binary("a", make([]byte, 1024))))
+
+		// the declared length is checked before reading the
+		// rest of the document.
+		r := io.MultiReader(bytes.NewReader(data[:4]), iotest.ErrReader(errors.New("read past header")))
+		if _, err := (DecodeOptions{MaxDocumentSize: 1024}).NewFromIOReader(r); !errors.Is(err, bsonerr.DocumentTooLarge) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if _, err := (DecodeOptions{}).NewFromIOReader(bytes.NewReader(data[:100])); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if _, err := (DecodeOptions{}).NewFromIOReader(bytes.NewReader([]byte{0x04, 0, 0, 0})); !errors.Is(err, bsonerr.InvalidLength) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if _, err := (DecodeOptions{}).NewFromIOReader(nil); !errors.Is(err, bsonerr.NilReader) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		data := marshal(t, DC.Elements(EC.String("a", "b")))
+
+		// unlike Reader.Validate, the decode options check the
+		// terminators of strings.
+		data[len(data)-2] = 'x'
+		if _, err := Reader(data).Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (DecodeOptions{}).Validate(data); !errors.Is(err, bsonerr.InvalidString) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// the namespace length of a DBPointer follows the type
+		// and the key "a" at offset 7.
+		for _, length := range []int32{0, -3, 0x7f} {
+			data = marshal(t, DC.Elements(EC.DBPointer("a", "db.c", types.NewObjectID())))
+			binary.LittleEndian.PutUint32(data[7:], uint32(length))
+			for _, opts := range []DecodeOptions{{}, {ValidateUTF8: true}} {
+				_, err := opts.Validate(data)
+				if err == nil || length < 1 && !errors.Is(err, bsonerr.InvalidString) {
+					t.Errorf("length %d: unexpected error %v", length, err)
+				}
+			}
+		}
+
+		data = marshal(t, DC.Elements(EC.CodeWithScope("a", "code", DC.Elements(EC.Int32("b", 1)))))
+		data[11] = 0x7f
+		if _, err := (DecodeOptions{}).Validate(data); !errors.Is(err, bsonerr.StringLargerThanContainer) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
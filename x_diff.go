@@ -0,0 +1,680 @@
+package birch
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// PatchOp is the kind of a patch operation, named as in RFC 6902 (JSON
+// Patch).
+type PatchOp string
+
+const (
+	// PatchAdd adds the value at the path. Adding to a key that
+	// exists in a document replaces the value; adding to an index in
+	// an array inserts the value before that index, and the index "-"
+	// appends the value to the array.
+	PatchAdd PatchOp = "add"
+	// PatchRemove removes the value at the path, which must exist.
+	// Removing a value from an array shifts the values after it.
+	PatchRemove PatchOp = "remove"
+	// PatchReplace replaces the value at the path, which must exist.
+	PatchReplace PatchOp = "replace"
+	// PatchMove removes the value at From and adds it at the path.
+	PatchMove PatchOp = "move"
+)
+
+// PatchOperation is a single change to a document. Value is set for
+// add and replace operations, and From for move operations.
+type PatchOperation struct {
+	Op    PatchOp
+	Path  Path
+	From  Path
+	Value *Value
+}
+
+// PatchOperations is an ordered list of changes produced by Diff and
+// applied by Patch. They serialize, with MarshalJSON, as an RFC 6902
+// JSON Patch, with values in relaxed Extended JSON, and with
+// MarshalDocument, as a BSON array (a document whose keys are
+// indexes) of documents with the same fields.
+type PatchOperations []PatchOperation
+
+// DiffOptions control how Diff compares values. The zero value
+// compares documents with their keys in order, and numbers of
+// different types as different values.
+type DiffOptions struct {
+	// IgnoreKeyOrder compares documents as sets of keys, so that
+	// documents with the same keys and values in a different order
+	// are equal. Arrays are always ordered.
+	IgnoreKeyOrder bool
+	// NumericEquality compares numbers by value, so that, for
+	// example, int32(1) and 1.0 are equal.
+	NumericEquality bool
+}
+
+// Diff returns the operations that convert document a into document
+// b, with the default options.
+func Diff(a, b *Document) PatchOperations { return DiffOptions{}.Diff(a, b) }
+
+// Diff returns the operations that convert document a into document
+// b: applying them with Patch produces a document equal to b, as
+// determined by the options. Values that differ in documents (or
+// arrays) that exist in both a and b produce operations on the nested
+// values rather than a replacement of the whole document. Keys whose
+// value is unchanged, but which are renamed, produce move operations,
+// as do values that change position in an array.
+func (opts DiffOptions) Diff(a, b *Document) PatchOperations {
+	return opts.diffDocuments(nil, a, b, nil)
+}
+
+// Equal reports whether the values are equal as determined by the
+// options.
+func (opts DiffOptions) Equal(a, b *Value) bool {
+	ta, tb := a.Type(), b.Type()
+	if ta != tb {
+		return opts.NumericEquality && isNumber(ta) && isNumber(tb) && Compare(a, b) == 0
+	}
+
+	switch ta {
+	case bsontype.EmbeddedDocument:
+		return opts.equalDocuments(a.MutableDocument(), b.MutableDocument())
+	case bsontype.Array:
+		av, bv := a.MutableArray().doc.elems, b.MutableArray().doc.elems
+		return slices.EqualFunc(av, bv, func(a, b *Element) bool { return opts.Equal(a.value, b.value) })
+	case bsontype.Double, bsontype.Decimal128:
+		if opts.NumericEquality {
+			return Compare(a, b) == 0
+		}
+		return a.Equal(b)
+	default:
+		return a.Equal(b)
+	}
+}
+
+func (opts DiffOptions) equalDocuments(a, b *Document) bool {
+	if a.Len() != b.Len() {
+		return false
+	}
+
+	if !opts.IgnoreKeyOrder {
+		return slices.EqualFunc(a.elems, b.elems, func(a, b *Element) bool {
+			return a.Key() == b.Key() && opts.Equal(a.value, b.value)
+		})
+	}
+
+	for _, elem := range a.elems {
+		other := b.LookupElement(elem.Key())
+		if other == nil || !opts.Equal(elem.value, other.value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isNumber(t bsontype.Type) bool {
+	switch t {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double, bsontype.Decimal128:
+		return true
+	default:
+		return false
+	}
+}
+
+func (opts DiffOptions) diffValues(path Path, a, b *Value, ops PatchOperations) PatchOperations {
+	if opts.Equal(a, b) {
+		return ops
+	}
+
+	switch {
+	case a.Type() == bsontype.EmbeddedDocument && b.Type() == bsontype.EmbeddedDocument:
+		return opts.diffDocuments(path, a.MutableDocument(), b.MutableDocument(), ops)
+	case a.Type() == bsontype.Array && b.Type() == bsontype.Array:
+		return opts.diffArrays(path, a.MutableArray(), b.MutableArray(), ops)
+	default:
+		return append(ops, PatchOperation{Op: PatchReplace, Path: path, Value: b})
+	}
+}
+
+// diffDocuments produces operations for the keys that are retained
+// in place, then removes the other keys in a, and then adds the other
+// keys in b, in order, so that added keys follow the retained keys.
+func (opts DiffOptions) diffDocuments(path Path, a, b *Document, ops PatchOperations) PatchOperations {
+	retained := opts.retainedKeys(a, b)
+
+	for _, elem := range b.elems {
+		if retained[elem.Key()] {
+			ops = opts.diffValues(patchPath(path, elem.Key()), a.LookupElement(elem.Key()).value, elem.value, ops)
+		}
+	}
+
+	var removed, added []*Element
+	for _, elem := range a.elems {
+		if !retained[elem.Key()] {
+			removed = append(removed, elem)
+		}
+	}
+	for _, elem := range b.elems {
+		if !retained[elem.Key()] {
+			added = append(added, elem)
+		}
+	}
+
+	// a removed key whose value is added under a new key is a move,
+	// as long as b does not have the removed key, which could
+	// otherwise be added before the move.
+	sources := make(map[int]*Element, len(added))
+	used := make([]bool, len(removed))
+	for idx, add := range added {
+		for rdx, rem := range removed {
+			if used[rdx] || b.LookupElement(rem.Key()) != nil || !opts.Equal(rem.value, add.value) {
+				continue
+			}
+			used[rdx] = true
+			sources[idx] = rem
+			break
+		}
+	}
+
+	for rdx, rem := range removed {
+		if !used[rdx] {
+			ops = append(ops, PatchOperation{Op: PatchRemove, Path: patchPath(path, rem.Key())})
+		}
+	}
+
+	for idx, add := range added {
+		if rem, ok := sources[idx]; ok {
+			ops = append(ops, PatchOperation{Op: PatchMove, From: patchPath(path, rem.Key()), Path: patchPath(path, add.Key())})
+			continue
+		}
+		ops = append(ops, PatchOperation{Op: PatchAdd, Path: patchPath(path, add.Key()), Value: add.value})
+	}
+
+	return ops
+}
+
+// retainedKeys returns the keys in both documents that remain in
+// place. When key order matters, these are the longest prefix of the
+// keys in b that appear in a in the same order, since all other keys
+// are added after them.
+func (opts DiffOptions) retainedKeys(a, b *Document) map[string]bool {
+	out := make(map[string]bool, b.Len())
+
+	if opts.IgnoreKeyOrder {
+		for _, elem := range b.elems {
+			if a.LookupElement(elem.Key()) != nil {
+				out[elem.Key()] = true
+			}
+		}
+		return out
+	}
+
+	positions := make(map[string]int, a.Len())
+	for idx, elem := range a.elems {
+		if _, ok := positions[elem.Key()]; !ok {
+			positions[elem.Key()] = idx
+		}
+	}
+
+	last := -1
+	for _, elem := range b.elems {
+		pos, ok := positions[elem.Key()]
+		if !ok || pos < last || out[elem.Key()] {
+			break
+		}
+		out[elem.Key()] = true
+		last = pos
+	}
+
+	return out
+}
+
+// diffArrays converts the array a into b one index at a time, keeping
+// track of the intermediate state of the array so that the indexes in
+// the operations are correct when they are applied in order.
+func (opts DiffOptions) diffArrays(path Path, a, b *Array, ops PatchOperations) PatchOperations {
+	current := make([]*Value, 0, a.Len())
+	for _, elem := range a.doc.elems {
+		current = append(current, elem.value)
+	}
+
+	target := make([]*Value, 0, b.Len())
+	for _, elem := range b.doc.elems {
+		target = append(target, elem.value)
+	}
+
+	for idx := 0; idx < len(target); {
+		if idx < len(current) && opts.Equal(current[idx], target[idx]) {
+			idx++
+			continue
+		}
+
+		source := opts.indexOf(current, target[idx], idx+1)
+		needed := idx < len(current) && opts.indexOf(target, current[idx], idx) >= 0
+		switch {
+		case idx < len(current) && !needed && source >= 0:
+			ops = append(ops, PatchOperation{Op: PatchRemove, Path: patchPath(path, strconv.Itoa(idx))})
+			current = slices.Delete(current, idx, idx+1)
+			continue
+		case idx < len(current) && !needed:
+			ops = opts.diffValues(patchPath(path, strconv.Itoa(idx)), current[idx], target[idx], ops)
+			current[idx] = target[idx]
+		case source >= 0:
+			ops = append(ops, PatchOperation{Op: PatchMove, From: patchPath(path, strconv.Itoa(source)), Path: patchPath(path, strconv.Itoa(idx))})
+			value := current[source]
+			current = slices.Insert(slices.Delete(current, source, source+1), idx, value)
+		default:
+			ops = append(ops, PatchOperation{Op: PatchAdd, Path: patchPath(path, strconv.Itoa(idx)), Value: target[idx]})
+			current = slices.Insert(current, idx, target[idx])
+		}
+		idx++
+	}
+
+	for idx := len(current) - 1; idx >= len(target); idx-- {
+		ops = append(ops, PatchOperation{Op: PatchRemove, Path: patchPath(path, strconv.Itoa(idx))})
+	}
+
+	return ops
+}
+
+func (opts DiffOptions) indexOf(values []*Value, v *Value, start int) int {
+	for idx := start; idx < len(values); idx++ {
+		if opts.Equal(values[idx], v) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// patchPath returns a new path, which does not share storage with
+// the parent path.
+func patchPath(parent Path, key string) Path {
+	return append(parent[:len(parent):len(parent)], key)
+}
+
+// Patch applies the operations to a copy of the document, and returns
+// the copy. When an operation cannot be applied, Patch returns an
+// error and the document is not modified.
+func Patch(doc *Document, ops PatchOperations) (*Document, error) {
+	raw, err := doc.MarshalBSON()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ReadDocument(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, op := range ops {
+		if err := out.applyPatch(op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %q): %w", idx, op.Op, op.Path.pointer(), err)
+		}
+	}
+
+	return out, nil
+}
+
+func (d *Document) applyPatch(op PatchOperation) error {
+	switch op.Op {
+	case PatchAdd:
+		if op.Value == nil {
+			return fmt.Errorf("%w: missing value", bsonerr.InvalidPatch)
+		}
+		// the value is copied so that the patched document does not
+		// share storage with the operations.
+		return d.patchAdd(op.Path, EC.Value("", op.Value).Value())
+	case PatchRemove:
+		_, err := d.patchRemove(op.Path)
+		return err
+	case PatchReplace:
+		if op.Value == nil {
+			return fmt.Errorf("%w: missing value", bsonerr.InvalidPatch)
+		}
+		return d.patchReplace(op.Path, EC.Value("", op.Value).Value())
+	case PatchMove:
+		if len(op.From) < len(op.Path) && slices.Equal(op.From, op.Path[:len(op.From)]) {
+			return fmt.Errorf("%w: cannot move %q into itself", bsonerr.InvalidPatch, op.From.pointer())
+		}
+		value, err := d.patchRemove(op.From)
+		if err != nil {
+			return err
+		}
+		return d.patchAdd(op.Path, value)
+	default:
+		return fmt.Errorf("%w: unknown operation %q", bsonerr.InvalidPatch, op.Op)
+	}
+}
+
+// patchParent returns the document or array that contains the last
+// key of the path, which must exist.
+func (d *Document) patchParent(path Path) (*pathParent, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: operations on the whole document are not supported", bsonerr.InvalidPatch)
+	}
+
+	parent, err := d.resolvePath(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		return nil, &PathError{Path: path, Err: bsonerr.ElementNotFound}
+	}
+
+	return parent, nil
+}
+
+// patchIndex parses the last key of the path as an index into the
+// parent array, which must be less than limit.
+func patchIndex(path Path, limit int) (int, error) {
+	index, err := strconv.ParseUint(path[len(path)-1], 10, 32)
+	if err != nil {
+		return 0, &PathError{Path: path, Depth: len(path) - 1, Type: bsontype.Array, Err: bsonerr.InvalidArrayKey}
+	}
+	if int(index) >= limit {
+		return 0, &PathError{Path: path, Depth: len(path) - 1, Type: bsontype.Array, Err: bsonerr.OutOfBounds}
+	}
+
+	return int(index), nil
+}
+
+func (d *Document) patchAdd(path Path, value *Value) error {
+	parent, err := d.patchParent(path)
+	if err != nil {
+		return err
+	}
+
+	if parent.doc != nil {
+		parent.doc.Set(EC.Value(path[len(path)-1], value))
+		return nil
+	}
+
+	if path[len(path)-1] == "-" {
+		parent.arr.Append(value)
+		return nil
+	}
+
+	index, err := patchIndex(path, parent.arr.Len()+1)
+	if err != nil {
+		return err
+	}
+	parent.arr.doc.elems = slices.Insert(parent.arr.doc.elems, index, &Element{value: value})
+	parent.arr.doc.cacheValid = false
+
+	return nil
+}
+
+func (d *Document) patchRemove(path Path) (*Value, error) {
+	parent, err := d.patchParent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent.doc != nil {
+		elem := parent.doc.Delete(path[len(path)-1])
+		if elem == nil {
+			return nil, &PathError{Path: path, Depth: len(path) - 1, Type: bsontype.EmbeddedDocument, Err: bsonerr.ElementNotFound}
+		}
+		return elem.value, nil
+	}
+
+	index, err := patchIndex(path, parent.arr.Len())
+	if err != nil {
+		return nil, err
+	}
+
+	return parent.arr.Delete(uint(index)), nil
+}
+
+func (d *Document) patchReplace(path Path, value *Value) error {
+	parent, err := d.patchParent(path)
+	if err != nil {
+		return err
+	}
+
+	if parent.doc != nil {
+		if parent.doc.LookupElement(path[len(path)-1]) == nil {
+			return &PathError{Path: path, Depth: len(path) - 1, Type: bsontype.EmbeddedDocument, Err: bsonerr.ElementNotFound}
+		}
+		parent.doc.Set(EC.Value(path[len(path)-1], value))
+		return nil
+	}
+
+	index, err := patchIndex(path, parent.arr.Len())
+	if err != nil {
+		return err
+	}
+	parent.arr.Set(uint(index), value)
+
+	return nil
+}
+
+// pointer renders the path as an RFC 6901 JSON Pointer.
+func (p Path) pointer() string {
+	var buf strings.Builder
+	for _, key := range p {
+		buf.WriteByte('/')
+		buf.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(key))
+	}
+	return buf.String()
+}
+
+// parsePointer parses an RFC 6901 JSON Pointer as a path.
+func parsePointer(pointer string) (Path, error) {
+	if pointer == "" {
+		return Path{}, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("%w: invalid JSON pointer %q", bsonerr.InvalidPatch, pointer)
+	}
+
+	keys := strings.Split(pointer[1:], "/")
+	for idx, key := range keys {
+		keys[idx] = strings.NewReplacer("~1", "/", "~0", "~").Replace(key)
+	}
+
+	return Path(keys), nil
+}
+
+// MarshalDocument returns the operation as a document with the
+// fields of an RFC 6902 operation, with paths as JSON Pointers.
+func (op PatchOperation) MarshalDocument() (*Document, error) {
+	doc := DC.Elements(EC.String("op", string(op.Op)))
+
+	if op.Op == PatchMove {
+		doc.Append(EC.String("from", op.From.pointer()))
+	}
+	doc.Append(EC.String("path", op.Path.pointer()))
+	if op.Value != nil {
+		doc.Append(EC.Value("value", op.Value))
+	}
+
+	return doc, nil
+}
+
+// UnmarshalDocument populates the operation from a document in the
+// form produced by MarshalDocument.
+func (op *PatchOperation) UnmarshalDocument(doc *Document) error {
+	var (
+		out PatchOperation
+		err error
+	)
+
+	for _, elem := range doc.elems {
+		switch elem.Key() {
+		case "op":
+			str, ok := elem.value.StringValueOK()
+			if !ok {
+				return fmt.Errorf("%w: op is %s", bsonerr.InvalidPatch, elem.value.Type())
+			}
+			out.Op = PatchOp(str)
+		case "path", "from":
+			str, ok := elem.value.StringValueOK()
+			if !ok {
+				return fmt.Errorf("%w: %s is %s", bsonerr.InvalidPatch, elem.Key(), elem.value.Type())
+			}
+			path, err := parsePointer(str)
+			if err != nil {
+				return err
+			}
+			if elem.Key() == "path" {
+				out.Path = path
+			} else {
+				out.From = path
+			}
+		case "value":
+			out.Value = elem.value.Copy()
+		}
+	}
+
+	if err = out.validate(); err != nil {
+		return err
+	}
+
+	*op = out
+
+	return nil
+}
+
+func (op PatchOperation) validate() error {
+	switch op.Op {
+	case PatchAdd, PatchReplace:
+		if op.Value == nil {
+			return fmt.Errorf("%w: %s operation without a value", bsonerr.InvalidPatch, op.Op)
+		}
+	case PatchMove:
+		if op.From == nil {
+			return fmt.Errorf("%w: move operation without from", bsonerr.InvalidPatch)
+		}
+	case PatchRemove:
+	default:
+		return fmt.Errorf("%w: unknown operation %q", bsonerr.InvalidPatch, op.Op)
+	}
+
+	if op.Path == nil {
+		return fmt.Errorf("%w: %s operation without a path", bsonerr.InvalidPatch, op.Op)
+	}
+
+	return nil
+}
+
+// MarshalDocument returns the operations as a BSON array: a document
+// whose keys are the indexes of the operations.
+func (ops PatchOperations) MarshalDocument() (*Document, error) {
+	doc := DC.Make(len(ops))
+	for idx, op := range ops {
+		opDoc, err := op.MarshalDocument()
+		if err != nil {
+			return nil, err
+		}
+		doc.Append(EC.SubDocument(strconv.Itoa(idx), opDoc))
+	}
+
+	return doc, nil
+}
+
+// UnmarshalDocument replaces the operations with the operations in a
+// document in the form produced by MarshalDocument.
+func (ops *PatchOperations) UnmarshalDocument(doc *Document) error {
+	out := make(PatchOperations, 0, doc.Len())
+	for _, elem := range doc.elems {
+		opDoc, ok := elem.value.MutableDocumentOK()
+		if !ok {
+			return fmt.Errorf("%w: operation %q is %s", bsonerr.InvalidPatch, elem.Key(), elem.value.Type())
+		}
+
+		var op PatchOperation
+		if err := op.UnmarshalDocument(opDoc); err != nil {
+			return err
+		}
+		out = append(out, op)
+	}
+
+	*ops = out
+
+	return nil
+}
+
+// MarshalJSON returns the operations as an RFC 6902 JSON Patch, with
+// values in relaxed Extended JSON.
+func (ops PatchOperations) MarshalJSON() ([]byte, error) {
+	var err error
+
+	out := []byte{'['}
+	for idx, op := range ops {
+		if idx > 0 {
+			out = append(out, ',')
+		}
+
+		out = append(out, `{"op":`...)
+		out = appendJSONString(out, string(op.Op))
+		if op.Op == PatchMove {
+			out = append(out, `,"from":`...)
+			out = appendJSONString(out, op.From.pointer())
+		}
+		out = append(out, `,"path":`...)
+		out = appendJSONString(out, op.Path.pointer())
+		if op.Value != nil {
+			out = append(out, `,"value":`...)
+			if out, err = op.Value.appendExtJSON(out, false); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, '}')
+	}
+
+	return append(out, ']'), nil
+}
+
+// UnmarshalJSON parses an RFC 6902 JSON Patch, with values in
+// Extended JSON. The copy and test operations are not supported.
+func (ops *PatchOperations) UnmarshalJSON(in []byte) error {
+	var raw []struct {
+		Op    string          `json:"op"`
+		Path  *string         `json:"path"`
+		From  *string         `json:"from"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(in, &raw); err != nil {
+		return fmt.Errorf("%w: %w", bsonerr.InvalidPatch, err)
+	}
+
+	out := make(PatchOperations, 0, len(raw))
+	for _, item := range raw {
+		op := PatchOperation{Op: PatchOp(item.Op)}
+
+		var err error
+		if item.Path != nil {
+			if op.Path, err = parsePointer(*item.Path); err != nil {
+				return err
+			}
+		}
+		if item.From != nil {
+			if op.From, err = parsePointer(*item.From); err != nil {
+				return err
+			}
+		}
+		if item.Value != nil {
+			op.Value = &Value{}
+			if err = op.Value.UnmarshalExtJSON(item.Value); err != nil {
+				return err
+			}
+		}
+
+		if err = op.validate(); err != nil {
+			return err
+		}
+		out = append(out, op)
+	}
+
+	*ops = out
+
+	return nil
+}
@@ -0,0 +1,299 @@
+package birch
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/tychoish/birch/bsonerr"
+)
+
+func TestDiff(t *testing.T) {
+	base := func() *Document {
+		return DC.Elements(
+			EC.Int32("a", 1),
+			EC.SubDocumentFromElements("b",
+				EC.String("c", "x"),
+				EC.ArrayFromElements("d", VC.Int32(1), VC.Int32(2), VC.Int32(3)),
+			),
+			EC.String("e", "moved"),
+		)
+	}
+
+	for _, test := range []struct {
+		name string
+		opts DiffOptions
+		a, b *Document
+		// ops is the expected number of operations, or -1 to only
+		// check the result of applying them.
+		ops int
+	}{
+		{name: "Equal", a: base(), b: base(), ops: 0},
+		{name: "Empty", a: DC.New(), b: base(), ops: 3},
+		{name: "RemoveAll", a: base(), b: DC.New(), ops: 3},
+		{
+			name: "Replace",
+			a:    base(),
+			b:    base().Set(EC.Int64("a", 1)),
+			ops:  1,
+		},
+		{
+			name: "Nested",
+			a:    base(),
+			b: DC.Elements(
+				EC.Int32("a", 1),
+				EC.SubDocumentFromElements("b",
+					EC.String("c", "y"),
+					EC.ArrayFromElements("d", VC.Int32(1), VC.Int32(2), VC.Int32(3)),
+				),
+				EC.String("e", "moved"),
+			),
+			ops: 1,
+		},
+		{
+			name: "Rename",
+			a:    base(),
+			b:    DC.Elements(EC.Int32("a", 1), EC.SubDocument("b", base().Lookup("b").MutableDocument()), EC.String("f", "moved")),
+			ops:  1,
+		},
+		{
+			name: "Reorder",
+			a:    base(),
+			b:    DC.Elements(EC.String("e", "moved"), EC.Int32("a", 1), EC.SubDocument("b", base().Lookup("b").MutableDocument())),
+			ops:  4,
+		},
+		{
+			name: "ReorderIgnored",
+			opts: DiffOptions{IgnoreKeyOrder: true},
+			a:    base(),
+			b:    DC.Elements(EC.String("e", "moved"), EC.Int32("a", 1), EC.SubDocument("b", base().Lookup("b").MutableDocument())),
+			ops:  0,
+		},
+		{
+			name: "Numeric",
+			opts: DiffOptions{NumericEquality: true},
+			a:    DC.Elements(EC.Int32("a", 1), EC.Double("b", 2)),
+			b:    DC.Elements(EC.Int64("a", 1), EC.Int32("b", 2)),
+			ops:  0,
+		},
+		{
+			name: "NumericDifferent",
+			opts: DiffOptions{NumericEquality: true},
+			a:    DC.Elements(EC.Int32("a", 1)),
+			b:    DC.Elements(EC.Double("a", 1.5)),
+			ops:  1,
+		},
+		{
+			name: "ArrayAppend",
+			a:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1))),
+			b:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1), VC.Int32(2), VC.Int32(3))),
+			ops:  2,
+		},
+		{
+			name: "ArrayInsert",
+			a:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1), VC.Int32(3))),
+			b:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1), VC.Int32(2), VC.Int32(3))),
+			ops:  1,
+		},
+		{
+			name: "ArrayRemove",
+			a:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1), VC.Int32(2), VC.Int32(3))),
+			b:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1), VC.Int32(3))),
+			ops:  1,
+		},
+		{
+			name: "ArrayTruncate",
+			a:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1), VC.Int32(2), VC.Int32(3))),
+			b:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1))),
+			ops:  2,
+		},
+		{
+			name: "ArrayMove",
+			a:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1), VC.Int32(2), VC.Int32(3))),
+			b:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(3), VC.Int32(1), VC.Int32(2))),
+			ops:  1,
+		},
+		{
+			name: "ArrayReverse",
+			a:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1), VC.Int32(2), VC.Int32(3), VC.Int32(4))),
+			b:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(4), VC.Int32(3), VC.Int32(2), VC.Int32(1))),
+			ops:  3,
+		},
+		{
+			name: "ArrayNested",
+			a:    DC.Elements(EC.ArrayFromElements("a", VC.DocumentFromElements(EC.Int32("x", 1)), VC.Int32(2))),
+			b:    DC.Elements(EC.ArrayFromElements("a", VC.DocumentFromElements(EC.Int32("x", 2)), VC.Int32(2))),
+			ops:  1,
+		},
+		{
+			name: "ArrayDuplicates",
+			a:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1), VC.Int32(1), VC.Int32(2), VC.Int32(1))),
+			b:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(2), VC.Int32(1), VC.Int32(1), VC.Int32(3), VC.Int32(1))),
+			ops:  -1,
+		},
+		{
+			name: "TypeChange",
+			a:    DC.Elements(EC.ArrayFromElements("a", VC.Int32(1))),
+			b:    DC.Elements(EC.SubDocumentFromElements("a", EC.Int32("0", 1))),
+			ops:  1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			before := test.a.String()
+			ops := test.opts.Diff(test.a, test.b)
+			if test.ops >= 0 && len(ops) != test.ops {
+				t.Errorf("got %d operations, expected %d: %v", len(ops), test.ops, ops)
+			}
+
+			out, err := Patch(test.a, ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.a.String() != before {
+				t.Fatalf("patch modified the document: %s", test.a)
+			}
+			if !test.opts.Equal(VC.Document(out), VC.Document(test.b)) {
+				t.Fatalf("got %s, expected %s (%v)", out, test.b, ops)
+			}
+			if !test.opts.IgnoreKeyOrder && !test.opts.NumericEquality && out.String() != test.b.String() {
+				t.Fatalf("got %s, expected %s", out, test.b)
+			}
+		})
+	}
+	t.Run("Operations", func(t *testing.T) {
+		ops := Diff(base(), DC.Elements(
+			EC.Int32("a", 2),
+			EC.SubDocumentFromElements("b", EC.ArrayFromElements("d", VC.Int32(1), VC.Int32(3))),
+			EC.String("f", "moved"),
+		))
+		expected := `[{"op":"replace","path":"/a","value":2},` +
+			`{"op":"remove","path":"/b/d/1"},` +
+			`{"op":"remove","path":"/b/c"},` +
+			`{"op":"move","from":"/e","path":"/f"}]`
+
+		out, err := json.Marshal(ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expected {
+			t.Fatalf("got %s, expected %s", out, expected)
+		}
+	})
+	t.Run("Serialization", func(t *testing.T) {
+		ops := PatchOperations{
+			{Op: PatchAdd, Path: Path{"a/b", "c~d"}, Value: VC.DocumentFromElements(EC.Int32("n", 1))},
+			{Op: PatchRemove, Path: Path{"x", "0"}},
+			{Op: PatchReplace, Path: Path{"y"}, Value: VC.Double(1.5)},
+			{Op: PatchMove, From: Path{"z"}, Path: Path{"w", "-"}},
+		}
+
+		t.Run("JSON", func(t *testing.T) {
+			data, err := json.Marshal(ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := `{"op":"add","path":"/a~1b/c~0d","value":{"n":1}}`; string(data[1:len(expected)+1]) != expected {
+				t.Fatalf("unexpected JSON %s", data)
+			}
+
+			var out PatchOperations
+			if err := json.Unmarshal(data, &out); err != nil {
+				t.Fatal(err)
+			}
+			comparePatchOperations(t, out, ops)
+		})
+		t.Run("BSON", func(t *testing.T) {
+			doc, err := ops.MarshalDocument()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc.Lookup("3").MutableDocument().Lookup("from").StringValue() != "/z" {
+				t.Fatalf("unexpected document %s", doc)
+			}
+
+			var out PatchOperations
+			if err := out.UnmarshalDocument(doc); err != nil {
+				t.Fatal(err)
+			}
+			comparePatchOperations(t, out, ops)
+		})
+		t.Run("Invalid", func(t *testing.T) {
+			var out PatchOperations
+			for _, in := range []string{
+				`[{"op":"copy","from":"/a","path":"/b"}]`,
+				`[{"op":"add","path":"/a"}]`,
+				`[{"op":"move","path":"/a"}]`,
+				`[{"op":"remove"}]`,
+				`[{"op":"remove","path":"a"}]`,
+				`{}`,
+			} {
+				if err := json.Unmarshal([]byte(in), &out); !errors.Is(err, bsonerr.InvalidPatch) {
+					t.Errorf("%s: unexpected error %v", in, err)
+				}
+			}
+			if err := out.UnmarshalDocument(DC.Elements(EC.Int32("0", 1))); !errors.Is(err, bsonerr.InvalidPatch) {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	})
+	t.Run("Patch", func(t *testing.T) {
+		doc := DC.Elements(
+			EC.SubDocumentFromElements("a", EC.Int32("b", 1)),
+			EC.ArrayFromElements("list", VC.Int32(1), VC.Int32(2)),
+		)
+
+		out, err := Patch(doc, PatchOperations{
+			{Op: PatchAdd, Path: Path{"list", "-"}, Value: VC.Int32(3)},
+			{Op: PatchAdd, Path: Path{"list", "0"}, Value: VC.Int32(0)},
+			{Op: PatchAdd, Path: Path{"a", "b"}, Value: VC.String("x")},
+			{Op: PatchMove, From: Path{"a"}, Path: Path{"list", "1"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := DC.Elements(EC.ArrayFromElements("list", VC.Int32(0), VC.DocumentFromElements(EC.String("b", "x")), VC.Int32(1), VC.Int32(2), VC.Int32(3)))
+		if out.String() != expected.String() {
+			t.Fatalf("got %s, expected %s", out, expected)
+		}
+
+		for _, test := range []struct {
+			name string
+			op   PatchOperation
+			err  error
+		}{
+			{name: "Root", op: PatchOperation{Op: PatchRemove, Path: Path{}}, err: bsonerr.InvalidPatch},
+			{name: "Unknown", op: PatchOperation{Op: "test", Path: Path{"a"}}, err: bsonerr.InvalidPatch},
+			{name: "MissingValue", op: PatchOperation{Op: PatchAdd, Path: Path{"a"}}, err: bsonerr.InvalidPatch},
+			{name: "RemoveMissing", op: PatchOperation{Op: PatchRemove, Path: Path{"x"}}, err: bsonerr.ElementNotFound},
+			{name: "RemoveMissingParent", op: PatchOperation{Op: PatchRemove, Path: Path{"x", "y"}}, err: bsonerr.ElementNotFound},
+			{name: "ReplaceMissing", op: PatchOperation{Op: PatchReplace, Path: Path{"a", "c"}, Value: VC.Null()}, err: bsonerr.ElementNotFound},
+			{name: "ReplaceOutOfBounds", op: PatchOperation{Op: PatchReplace, Path: Path{"list", "2"}, Value: VC.Null()}, err: bsonerr.OutOfBounds},
+			{name: "AddOutOfBounds", op: PatchOperation{Op: PatchAdd, Path: Path{"list", "3"}, Value: VC.Null()}, err: bsonerr.OutOfBounds},
+			{name: "InvalidIndex", op: PatchOperation{Op: PatchRemove, Path: Path{"list", "x"}}, err: bsonerr.InvalidArrayKey},
+			{name: "Traversal", op: PatchOperation{Op: PatchRemove, Path: Path{"a", "b", "c"}}, err: bsonerr.InvalidDepthTraversal},
+			{name: "MoveIntoItself", op: PatchOperation{Op: PatchMove, From: Path{"a"}, Path: Path{"a", "c"}}, err: bsonerr.InvalidPatch},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				if _, err := Patch(doc, PatchOperations{test.op}); !errors.Is(err, test.err) {
+					t.Fatalf("unexpected error %v", err)
+				}
+			})
+		}
+	})
+}
+
+func comparePatchOperations(t *testing.T, out, expected PatchOperations) {
+	t.Helper()
+
+	if len(out) != len(expected) {
+		t.Fatalf("got %d operations, expected %d", len(out), len(expected))
+	}
+	for idx := range out {
+		if out[idx].Op != expected[idx].Op || out[idx].Path.pointer() != expected[idx].Path.pointer() || out[idx].From.pointer() != expected[idx].From.pointer() {
+			t.Errorf("%d: got %v, expected %v", idx, out[idx], expected[idx])
+		}
+		if (out[idx].Value == nil) != (expected[idx].Value == nil) || out[idx].Value != nil && !out[idx].Value.Equal(expected[idx].Value) {
+			t.Errorf("%d: got %v, expected %v", idx, out[idx].Value, expected[idx].Value)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"sort"
 
 	"github.com/tychoish/birch/bsonerr"
-	"github.com/tychoish/birch/bsontype"
 	"github.com/tychoish/fun/irt"
 )
 
@@ -46,29 +45,7 @@ func (c Elements) Less(i, j int) bool {
 		return ik < jk
 	}
 
-	it := c[i].value.Type()
-	jt := c[j].value.Type()
-
-	if it != jt {
-		return it < jt
-	}
-
-	switch it {
-	case bsontype.Double:
-		return c[i].Value().Double() < c[j].Value().Double()
-	case bsontype.String:
-		return c[i].Value().StringValue() < c[j].Value().StringValue()
-	case bsontype.ObjectID:
-		return c[i].Value().ObjectID().Hex() < c[j].Value().ObjectID().Hex()
-	case bsontype.DateTime:
-		return c[i].Value().Time().Before(c[j].Value().Time())
-	case bsontype.Int32:
-		return c[i].Value().Int32() < c[j].Value().Int32()
-	case bsontype.Int64:
-		return c[i].Value().Int64() < c[j].Value().Int64()
-	default:
-		return false
-	}
+	return Compare(c[i].value, c[j].value) < 0
 }
 
 // Copy returns a new Elements slice with the same underlying
@@ -0,0 +1,474 @@
+package birch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/elements"
+	"github.com/tychoish/birch/types"
+)
+
+// DefaultMaxDepth is the nesting depth that document writers allow when
+// the options do not specify one. This matches the nesting limit that
+// MongoDB enforces.
+const DefaultMaxDepth = 100
+
+// documentWriterBuffer is the amount of data that a document writer
+// buffers before writing to its underlying io.WriteSeeker.
+const documentWriterBuffer = 32 * 1024
+
+var (
+	errNoOpenDocument  = errors.New("document writer has no open document")
+	errDocumentStarted = errors.New("document writer has already started a document")
+)
+
+// DocumentWriterOptions control the behavior of a DocumentWriter.
+type DocumentWriterOptions struct {
+	// MaxSize is the size, in bytes, of the largest document
+	// that the writer will produce. When zero, the writer uses
+	// DefaultMaxDocumentSize.
+	MaxSize int
+
+	// MaxDepth is the number of documents and arrays that may be
+	// open at once, including the top level document. When zero,
+	// the writer uses DefaultMaxDepth.
+	MaxDepth int
+
+	// UniqueKeys causes the writer to reject keys that already
+	// exist in the document being written.
+	UniqueKeys bool
+}
+
+// DocumentWriter produces a single BSON document incrementally, without
+// constructing Document, Array or Element values for its contents,
+// which makes it possible to write very large results with constant
+// memory overhead.
+//
+// Callers start the document with Begin, add elements with the Write
+// methods, open nested documents and arrays with BeginDocument and
+// BeginArray, and close each with End. Within arrays, the writer
+// generates the keys and ignores the keys that callers pass.
+//
+// Lengths are not known until a document or array ends, so the writer
+// reserves space for them and fills them in afterwards: either in its
+// buffer or, once data has been written, by seeking backwards in the
+// underlying io.WriteSeeker.
+type DocumentWriter struct {
+	w       io.WriteSeeker
+	opts    DocumentWriterOptions
+	buf     []byte
+	scratch []byte
+	stack   []documentWriterFrame
+	base    int64
+	flushed int64
+	done    bool
+	err     error
+}
+
+type documentWriterFrame struct {
+	start int64
+	array bool
+	index int
+	keys  map[string]struct{}
+}
+
+// NewDocumentWriter constructs a DocumentWriter that writes a document
+// to w, starting at w's current offset. When w is nil, the writer
+// accumulates the document in memory, and Bytes returns it after the
+// top level document ends.
+func NewDocumentWriter(w io.WriteSeeker, opts DocumentWriterOptions) *DocumentWriter {
+	if opts.MaxSize <= 0 || opts.MaxSize > math.MaxInt32 {
+		opts.MaxSize = min(DefaultMaxDocumentSize, math.MaxInt32)
+	}
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = DefaultMaxDepth
+	}
+
+	return &DocumentWriter{w: w, opts: opts}
+}
+
+// Bytes returns the document written to an in-memory writer, or nil if
+// the document is not complete or the writer has an io.WriteSeeker.
+func (w *DocumentWriter) Bytes() []byte {
+	if w.w != nil || !w.done {
+		return nil
+	}
+	return w.buf
+}
+
+// Size returns the number of bytes that the writer has produced.
+func (w *DocumentWriter) Size() int { return int(w.size()) }
+
+// Depth returns the number of documents and arrays that are open.
+func (w *DocumentWriter) Depth() int { return len(w.stack) }
+
+// Begin starts the top level document.
+func (w *DocumentWriter) Begin() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.done || len(w.stack) > 0 {
+		return errDocumentStarted
+	}
+
+	if w.w != nil {
+		base, err := w.w.Seek(0, io.SeekCurrent)
+		if err != nil {
+			w.err = err
+			return err
+		}
+		w.base = base
+	}
+
+	w.stack = append(w.stack, documentWriterFrame{start: 0})
+	w.scratch = append(w.scratch[:0], 0, 0, 0, 0)
+
+	return w.emit(w.scratch)
+}
+
+// BeginDocument starts an embedded document with the given key, which
+// remains open until the matching call to End.
+func (w *DocumentWriter) BeginDocument(key string) error {
+	return w.begin(bsontype.EmbeddedDocument, key)
+}
+
+// BeginArray starts an array with the given key, which remains open
+// until the matching call to End.
+func (w *DocumentWriter) BeginArray(key string) error {
+	return w.begin(bsontype.Array, key)
+}
+
+func (w *DocumentWriter) begin(t bsontype.Type, key string) error {
+	if len(w.stack) >= w.opts.MaxDepth {
+		return fmt.Errorf("%w: %d", bsonerr.MaxDepthExceeded, w.opts.MaxDepth)
+	}
+	if err := w.header(t, key); err != nil {
+		return err
+	}
+
+	w.stack = append(w.stack, documentWriterFrame{
+		start: w.size() + int64(len(w.scratch)),
+		array: t == bsontype.Array,
+	})
+
+	w.scratch = append(w.scratch, 0, 0, 0, 0)
+	if err := w.emit(w.scratch); err != nil {
+		w.stack = w.stack[:len(w.stack)-1]
+		return err
+	}
+
+	w.record(&w.stack[len(w.stack)-2], key)
+
+	return nil
+}
+
+// End closes the most recently opened document or array and writes its
+// length. When End closes the top level document, the writer flushes
+// any buffered data to the underlying io.WriteSeeker.
+func (w *DocumentWriter) End() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.stack) == 0 {
+		return errNoOpenDocument
+	}
+
+	frame := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+
+	w.scratch = append(w.scratch[:0], 0x00)
+	if err := w.emit(w.scratch); err != nil {
+		w.stack = append(w.stack, frame)
+		return err
+	}
+
+	if err := w.patch(frame.start, int32(w.size()-frame.start)); err != nil {
+		return err
+	}
+
+	if len(w.stack) == 0 {
+		w.done = true
+		return w.flush()
+	}
+
+	return nil
+}
+
+// WriteElement writes an existing element to the open document.
+func (w *DocumentWriter) WriteElement(elem *Element) error {
+	if elem == nil {
+		return bsonerr.NilElement
+	}
+	if elem.value == nil || elem.value.data == nil {
+		return bsonerr.UninitializedElement
+	}
+
+	return w.WriteValue(elem.Key(), elem.value)
+}
+
+// WriteValue writes an existing value to the open document with the
+// given key.
+func (w *DocumentWriter) WriteValue(key string, val *Value) error {
+	if val == nil || val.offset == 0 || val.data == nil {
+		return bsonerr.UninitializedElement
+	}
+
+	if err := w.header(val.Type(), key); err != nil {
+		return err
+	}
+
+	var err error
+	if w.scratch, err = val.AppendBSON(w.scratch); err != nil {
+		return err
+	}
+
+	return w.commit(key)
+}
+
+// WriteReader writes an already encoded document as an embedded
+// document with the given key.
+func (w *DocumentWriter) WriteReader(key string, r Reader) error {
+	size, err := r.Validate()
+	if err != nil {
+		return err
+	}
+
+	return w.write(bsontype.EmbeddedDocument, key, int(size), func(start uint, b []byte) (int, error) {
+		return elements.Document.Encode(start, b, r[:size])
+	})
+}
+
+// WriteDouble writes a double with the given key.
+func (w *DocumentWriter) WriteDouble(key string, f float64) error {
+	return w.write(bsontype.Double, key, 8, func(start uint, b []byte) (int, error) {
+		return elements.Double.Encode(start, b, f)
+	})
+}
+
+// WriteString writes a string with the given key.
+func (w *DocumentWriter) WriteString(key, str string) error {
+	return w.write(bsontype.String, key, 4+len(str)+1, func(start uint, b []byte) (int, error) {
+		return elements.String.Encode(start, b, str)
+	})
+}
+
+// WriteBinary writes binary data of the given subtype with the given
+// key.
+func (w *DocumentWriter) WriteBinary(key string, data []byte, subtype byte) error {
+	size := 4 + 1 + len(data)
+	if subtype == 2 {
+		size += 4
+	}
+
+	return w.write(bsontype.Binary, key, size, func(start uint, b []byte) (int, error) {
+		return elements.Binary.Encode(start, b, data, subtype)
+	})
+}
+
+// WriteObjectID writes an ObjectID with the given key.
+func (w *DocumentWriter) WriteObjectID(key string, oid types.ObjectID) error {
+	return w.write(bsontype.ObjectID, key, 12, func(start uint, b []byte) (int, error) {
+		return elements.ObjectID.Encode(start, b, oid)
+	})
+}
+
+// WriteBoolean writes a boolean with the given key.
+func (w *DocumentWriter) WriteBoolean(key string, val bool) error {
+	return w.write(bsontype.Boolean, key, 1, func(start uint, b []byte) (int, error) {
+		return elements.Boolean.Encode(start, b, val)
+	})
+}
+
+// WriteDateTime writes a datetime, in milliseconds since the epoch,
+// with the given key.
+func (w *DocumentWriter) WriteDateTime(key string, dt int64) error {
+	return w.write(bsontype.DateTime, key, 8, func(start uint, b []byte) (int, error) {
+		return elements.DateTime.Encode(start, b, dt)
+	})
+}
+
+// WriteTime writes a time as a datetime with the given key.
+func (w *DocumentWriter) WriteTime(key string, t time.Time) error {
+	return w.WriteDateTime(key, t.Unix()*1000+int64(t.Nanosecond()/1e6))
+}
+
+// WriteNull writes a null with the given key.
+func (w *DocumentWriter) WriteNull(key string) error {
+	return w.write(bsontype.Null, key, 0, nil)
+}
+
+// WriteInt32 writes a 32-bit integer with the given key.
+func (w *DocumentWriter) WriteInt32(key string, i int32) error {
+	return w.write(bsontype.Int32, key, 4, func(start uint, b []byte) (int, error) {
+		return elements.Int32.Encode(start, b, i)
+	})
+}
+
+// WriteTimestamp writes a timestamp with the given key.
+func (w *DocumentWriter) WriteTimestamp(key string, t uint32, i uint32) error {
+	return w.write(bsontype.Timestamp, key, 8, func(start uint, b []byte) (int, error) {
+		return elements.Timestamp.Encode(start, b, t, i)
+	})
+}
+
+// WriteInt64 writes a 64-bit integer with the given key.
+func (w *DocumentWriter) WriteInt64(key string, i int64) error {
+	return w.write(bsontype.Int64, key, 8, func(start uint, b []byte) (int, error) {
+		return elements.Int64.Encode(start, b, i)
+	})
+}
+
+// WriteDecimal128 writes a decimal128 with the given key.
+func (w *DocumentWriter) WriteDecimal128(key string, d types.Decimal128) error {
+	return w.write(bsontype.Decimal128, key, 16, func(start uint, b []byte) (int, error) {
+		return elements.Decimal128.Encode(start, b, d)
+	})
+}
+
+// write encodes an element into the scratch buffer, using encode to
+// write the size bytes of the value after the element's header.
+func (w *DocumentWriter) write(t bsontype.Type, key string, size int, encode func(uint, []byte) (int, error)) error {
+	if err := w.header(t, key); err != nil {
+		return err
+	}
+
+	if encode != nil {
+		start := len(w.scratch)
+		w.scratch = slices.Grow(w.scratch, size)[:start+size]
+		if _, err := encode(uint(start), w.scratch); err != nil {
+			return err
+		}
+	}
+
+	return w.commit(key)
+}
+
+// commit emits the element in the scratch buffer to the open document.
+func (w *DocumentWriter) commit(key string) error {
+	if err := w.emit(w.scratch); err != nil {
+		return err
+	}
+
+	w.record(&w.stack[len(w.stack)-1], key)
+
+	return nil
+}
+
+// header validates the key for the open document and writes the type
+// and key of an element to the start of the scratch buffer. Callers
+// must call record once the element is written.
+func (w *DocumentWriter) header(t bsontype.Type, key string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.stack) == 0 {
+		return errNoOpenDocument
+	}
+
+	frame := &w.stack[len(w.stack)-1]
+	w.scratch = append(w.scratch[:0], byte(t))
+
+	if frame.array {
+		w.scratch = strconv.AppendInt(w.scratch, int64(frame.index), 10)
+		w.scratch = append(w.scratch, 0x00)
+		return nil
+	}
+
+	if strings.IndexByte(key, 0x00) >= 0 {
+		return fmt.Errorf("%w: %q contains a null byte", bsonerr.InvalidKey, key)
+	}
+	if _, ok := frame.keys[key]; ok {
+		return fmt.Errorf("%w: %q", bsonerr.DuplicateKey, key)
+	}
+
+	w.scratch = append(w.scratch, key...)
+	w.scratch = append(w.scratch, 0x00)
+
+	return nil
+}
+
+// record advances the index of an array, or tracks the keys of a
+// document when the writer enforces unique keys.
+func (w *DocumentWriter) record(frame *documentWriterFrame, key string) {
+	switch {
+	case frame.array:
+		frame.index++
+	case w.opts.UniqueKeys:
+		if frame.keys == nil {
+			frame.keys = map[string]struct{}{}
+		}
+		frame.keys[key] = struct{}{}
+	}
+}
+
+// emit adds encoded data to the document, provided that the document
+// remains within the maximum size once all open documents end.
+func (w *DocumentWriter) emit(data []byte) error {
+	if size := w.size() + int64(len(data)) + int64(len(w.stack)); size > int64(w.opts.MaxSize) {
+		return fmt.Errorf("%w: %d is larger than %d", bsonerr.DocumentTooLarge, size, w.opts.MaxSize)
+	}
+
+	w.buf = append(w.buf, data...)
+
+	if w.w != nil && len(w.buf) >= documentWriterBuffer {
+		return w.flush()
+	}
+
+	return nil
+}
+
+// patch writes a length at the given offset from the start of the
+// document, seeking backwards when the offset is no longer buffered.
+func (w *DocumentWriter) patch(offset int64, length int32) error {
+	if offset >= w.flushed {
+		putLength(w.buf, int(offset-w.flushed))
+		return nil
+	}
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	var buf [4]byte
+	buf[0], buf[1], buf[2], buf[3] = byte(length), byte(length>>8), byte(length>>16), byte(length>>24)
+
+	if _, err := w.w.Seek(w.base+offset, io.SeekStart); err != nil {
+		w.err = err
+		return err
+	}
+	if _, err := w.w.Write(buf[:]); err != nil {
+		w.err = err
+		return err
+	}
+	if _, err := w.w.Seek(w.base+w.flushed, io.SeekStart); err != nil {
+		w.err = err
+		return err
+	}
+
+	return nil
+}
+
+func (w *DocumentWriter) flush() error {
+	if w.w == nil || len(w.buf) == 0 {
+		return nil
+	}
+
+	n, err := w.w.Write(w.buf)
+	w.flushed += int64(n)
+	w.buf = w.buf[:0]
+	if err != nil {
+		w.err = err
+	}
+
+	return err
+}
+
+func (w *DocumentWriter) size() int64 { return w.flushed + int64(len(w.buf)) }
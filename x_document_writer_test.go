@@ -0,0 +1,338 @@
+package birch
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/types"
+)
+
+func TestDocumentWriter(t *testing.T) {
+	now := time.Unix(1700000000, 123000000)
+	oid := types.ObjectID{0x5a, 0x5b, 0x5c, 0x5d, 0x5e, 0x5f, 0x60, 0x61, 0x62, 0x63, 0x64, 0x65}
+	inner := DC.Elements(EC.String("x", "y"))
+	innerBytes, err := inner.MarshalBSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := DC.Elements(
+		EC.Double("double", 3.5),
+		EC.String("string", "value"),
+		EC.SubDocumentFromElements("doc",
+			EC.Int32("int32", 42),
+			EC.ArrayFromElements("arr",
+				VC.Int64(1),
+				VC.Boolean(true),
+				VC.DocumentFromElements(EC.Null("null")),
+				VC.ArrayFromValues(VC.String("nested")),
+			),
+		),
+		EC.Binary("bin", []byte("data")),
+		EC.BinaryWithSubtype("old", []byte("data"), 2),
+		EC.ObjectID("oid", oid),
+		EC.Time("time", now),
+		EC.Timestamp("ts", 10, 20),
+		EC.Decimal128("dec", types.NewDecimal128(1, 2)),
+		EC.SubDocument("reader", inner),
+		EC.Int64("elem", 7),
+		EC.String("value", "copied"),
+	)
+
+	write := func(t *testing.T, w *DocumentWriter) {
+		t.Helper()
+
+		for _, err := range []error{
+			w.Begin(),
+			w.WriteDouble("double", 3.5),
+			w.WriteString("string", "value"),
+			w.BeginDocument("doc"),
+			w.WriteInt32("int32", 42),
+			w.BeginArray("arr"),
+			w.WriteInt64("ignored", 1),
+			w.WriteBoolean("", true),
+			w.BeginDocument(""),
+			w.WriteNull("null"),
+			w.End(),
+			w.BeginArray(""),
+			w.WriteString("", "nested"),
+			w.End(),
+			w.End(),
+			w.End(),
+			w.WriteBinary("bin", []byte("data"), 0),
+			w.WriteBinary("old", []byte("data"), 2),
+			w.WriteObjectID("oid", oid),
+			w.WriteTime("time", now),
+			w.WriteTimestamp("ts", 10, 20),
+			w.WriteDecimal128("dec", types.NewDecimal128(1, 2)),
+			w.WriteReader("reader", innerBytes),
+			w.WriteElement(EC.Int64("elem", 7)),
+			w.WriteValue("value", VC.String("copied")),
+			w.End(),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if w.Depth() != 0 {
+			t.Fatalf("depth is %d after the document ends", w.Depth())
+		}
+	}
+
+	t.Run("Buffer", func(t *testing.T) {
+		want, err := expected.MarshalBSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := NewDocumentWriter(nil, DocumentWriterOptions{UniqueKeys: true})
+		write(t, w)
+
+		if !bytes.Equal(w.Bytes(), want) {
+			t.Fatalf("got %X, expected %X", w.Bytes(), want)
+		}
+		if w.Size() != len(want) {
+			t.Fatalf("size is %d, expected %d", w.Size(), len(want))
+		}
+	})
+	t.Run("File", func(t *testing.T) {
+		want, err := expected.MarshalBSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Create(filepath.Join(t.TempDir(), "doc.bson"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		// the document starts at the current offset of the file.
+		prefix := []byte("prefix")
+		if _, err := f.Write(prefix); err != nil {
+			t.Fatal(err)
+		}
+
+		w := NewDocumentWriter(f, DocumentWriterOptions{})
+		write(t, w)
+		if w.Bytes() != nil {
+			t.Fatal("writers with files should not return bytes")
+		}
+
+		out, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, append(prefix, want...)) {
+			t.Fatalf("got %X, expected %X", out, want)
+		}
+	})
+	t.Run("LargeArray", func(t *testing.T) {
+		// large enough that lengths are patched after the writer
+		// flushes, so that it must seek.
+		const count = 100000
+
+		f, err := os.Create(filepath.Join(t.TempDir(), "array.bson"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		w := NewDocumentWriter(f, DocumentWriterOptions{})
+		if err := w.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.BeginArray("values"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			if err := w.WriteInt64("", int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.End(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteString("after", "array"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.End(); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := ReadDocument(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		arr, ok := doc.Lookup("values").MutableArrayOK()
+		if !ok || arr.Len() != count {
+			t.Fatalf("invalid array in %d byte document", len(out))
+		}
+		if last, err := arr.Lookup(count - 1); err != nil || last.Int64() != count-1 {
+			t.Fatalf("last element is %v (%v)", last, err)
+		}
+		if doc.Lookup("after").StringValue() != "array" {
+			t.Fatal("element after the array is missing")
+		}
+	})
+	t.Run("MaxSize", func(t *testing.T) {
+		w := NewDocumentWriter(nil, DocumentWriterOptions{MaxSize: 32})
+		if err := w.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.BeginArray("a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteInt64("", 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteString("", "too long to fit"); !errors.Is(err, bsonerr.DocumentTooLarge) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// a failed write does not consume an index.
+		if err := w.WriteInt32("", 2); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.End(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.End(); err != nil {
+			t.Fatal(err)
+		}
+
+		doc, err := ReadDocument(w.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := DC.Elements(EC.ArrayFromElements("a", VC.Int64(1), VC.Int32(2)))
+		if !VC.Document(doc).Equal(VC.Document(want)) {
+			t.Fatalf("got %s, expected %s", doc, want)
+		}
+		if len(w.Bytes()) > 32 {
+			t.Fatalf("document is %d bytes", len(w.Bytes()))
+		}
+	})
+	t.Run("MaxDepth", func(t *testing.T) {
+		w := NewDocumentWriter(nil, DocumentWriterOptions{MaxDepth: 3})
+		if err := w.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.BeginDocument("a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.BeginArray("b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.BeginDocument("c"); !errors.Is(err, bsonerr.MaxDepthExceeded) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if w.Depth() != 3 {
+			t.Fatalf("depth is %d", w.Depth())
+		}
+	})
+	t.Run("Keys", func(t *testing.T) {
+		w := NewDocumentWriter(nil, DocumentWriterOptions{UniqueKeys: true})
+		if err := w.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteInt32("a", 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteInt32("a", 2); !errors.Is(err, bsonerr.DuplicateKey) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := w.BeginDocument("a"); !errors.Is(err, bsonerr.DuplicateKey) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := w.WriteString("b\x00c", "value"); !errors.Is(err, bsonerr.InvalidKey) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// keys are unique per document.
+		if err := w.BeginDocument("b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteInt32("a", 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.End(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.End(); err != nil {
+			t.Fatal(err)
+		}
+
+		// without the option, duplicate keys are written as-is.
+		w = NewDocumentWriter(nil, DocumentWriterOptions{})
+		for _, err := range []error{w.Begin(), w.WriteInt32("a", 1), w.WriteInt32("a", 2), w.End()} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := Reader(w.Bytes()).Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("State", func(t *testing.T) {
+		w := NewDocumentWriter(nil, DocumentWriterOptions{})
+		if err := w.WriteInt32("a", 1); err == nil {
+			t.Fatal("expected error writing before the document begins")
+		}
+		if err := w.End(); err == nil {
+			t.Fatal("expected error ending before the document begins")
+		}
+		if w.Bytes() != nil {
+			t.Fatal("incomplete documents should not return bytes")
+		}
+		if err := w.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Begin(); err == nil {
+			t.Fatal("expected error beginning twice")
+		}
+		if err := w.WriteElement(nil); !errors.Is(err, bsonerr.NilElement) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := w.WriteReader("r", Reader{0x01}); err == nil {
+			t.Fatal("expected error writing an invalid reader")
+		}
+		if err := w.End(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteInt32("a", 1); err == nil {
+			t.Fatal("expected error writing after the document ends")
+		}
+		if !bytes.Equal(w.Bytes(), []byte{5, 0, 0, 0, 0}) {
+			t.Fatalf("unexpected document %X", w.Bytes())
+		}
+	})
+	t.Run("WriteError", func(t *testing.T) {
+		w := NewDocumentWriter(failingWriteSeeker{}, DocumentWriterOptions{})
+		if err := w.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.End(); !errors.Is(err, io.ErrShortWrite) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := w.Begin(); !errors.Is(err, io.ErrShortWrite) {
+			t.Fatalf("errors should be sticky, got %v", err)
+		}
+	})
+}
+
+type failingWriteSeeker struct{}
+
+func (failingWriteSeeker) Write([]byte) (int, error)      { return 0, io.ErrShortWrite }
+func (failingWriteSeeker) Seek(int64, int) (int64, error) { return 0, nil }
@@ -0,0 +1,325 @@
+package birch
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/types"
+)
+
+// Primitive is the set of Go types that Get, GetOr, Set and Elem
+// convert to and from BSON values.
+type Primitive interface {
+	bool | int32 | int64 | int | float64 | string | []byte | time.Time |
+		types.ObjectID | types.Decimal128 | types.Timestamp | types.Regex |
+		types.DBPointer | types.Binary | *Document | *Array | *Value
+}
+
+// Container is the set of types that Get and GetOr can read values
+// from.
+type Container interface {
+	*Document | *Array | Reader
+}
+
+// Get returns the value at the path, which is a sequence of keys into
+// nested documents and indexes into arrays, as a T. Numeric values
+// convert to a wider type when no information is lost: int32 values
+// to int64, int, float64 and types.Decimal128, int64 values to int,
+// float64 values that can represent them exactly and
+// types.Decimal128, and float64 values to types.Decimal128 values that
+// represent them exactly. Strings may also be read from symbol values.
+//
+// Errors are *PathError values, and wrap bsonerr.ElementNotFound when
+// there is no value at the path, or bsonerr.TypeMismatch when the
+// value cannot be converted to T.
+func Get[T Primitive, C Container](src C, path ...string) (T, error) {
+	var out T
+
+	val, err := lookupPath(src, path)
+	if err != nil {
+		return out, err
+	}
+
+	if out, err = valueAs[T](val); err != nil {
+		return out, &PathError{Path: path, Depth: len(path), Type: val.Type(), Err: err}
+	}
+
+	return out, nil
+}
+
+// GetOr returns the value at the path, in the same manner as Get, or
+// the default value if Get would return an error.
+func GetOr[T Primitive, C Container](src C, def T, path ...string) T {
+	out, err := Get[T](src, path...)
+	if err != nil {
+		return def
+	}
+
+	return out
+}
+
+// Set stores the value at the path, in the same manner as
+// Document.SetPath, creating missing documents and padding arrays as
+// needed.
+func Set[T Primitive, C *Document | *Array](dst C, value T, path ...string) error {
+	val := valueOf(value)
+
+	var parent *pathParent
+	switch d := any(dst).(type) {
+	case *Document:
+		parent = &pathParent{doc: d}
+	case *Array:
+		parent = &pathParent{arr: d}
+	}
+
+	parent, err := parent.resolve(path, true)
+	if err != nil {
+		return err
+	}
+
+	return parent.set(path, val)
+}
+
+// Elem constructs an element from the key and value.
+func Elem[T Primitive](key string, value T) *Element {
+	return EC.Value(key, valueOf(value))
+}
+
+// lookupPath returns the value at the path in the document, array or
+// reader. Nested values are read from the reader without constructing
+// documents.
+func lookupPath(src any, path Path) (*Value, error) {
+	if len(path) == 0 {
+		return nil, &PathError{Path: path, Err: bsonerr.EmptyKey}
+	}
+
+	var typ bsontype.Type
+	if _, ok := src.(*Array); ok {
+		typ = bsontype.Array
+	}
+
+	for depth, key := range path {
+		var index uint64
+		if typ == bsontype.Array {
+			var err error
+			if index, err = strconv.ParseUint(key, 10, 32); err != nil {
+				return nil, &PathError{Path: path, Depth: depth, Type: typ, Err: bsonerr.InvalidArrayKey}
+			}
+			key = strconv.FormatUint(index, 10)
+		}
+
+		var next *Value
+		switch c := src.(type) {
+		case *Document:
+			if elem := c.LookupElement(key); elem != nil {
+				next = elem.value
+			}
+		case *Array:
+			next, _ = c.Lookup(uint(index))
+		case Reader:
+			elem, err := c.RecursiveLookup(key)
+			if err != nil && !errors.Is(err, bsonerr.ElementNotFound) {
+				return nil, &PathError{Path: path, Depth: depth, Type: typ, Err: err}
+			}
+			if elem != nil {
+				next = elem.value
+			}
+		}
+
+		if next == nil {
+			return nil, &PathError{Path: path, Depth: depth, Type: typ, Err: bsonerr.ElementNotFound}
+		}
+		if depth == len(path)-1 {
+			return next, nil
+		}
+
+		_, isReader := src.(Reader)
+		typ = next.Type()
+		switch {
+		case typ == bsontype.EmbeddedDocument && isReader:
+			src = next.ReaderDocument()
+		case typ == bsontype.EmbeddedDocument:
+			src = next.MutableDocument()
+		case typ == bsontype.Array && isReader:
+			src = next.ReaderArray()
+		case typ == bsontype.Array:
+			src = next.MutableArray()
+		default:
+			return nil, &PathError{Path: path, Depth: depth + 1, Type: typ, Err: bsonerr.InvalidDepthTraversal}
+		}
+	}
+
+	return nil, nil
+}
+
+// valueAs converts the value to a T, allowing only the lossless
+// conversions described by Get.
+func valueAs[T Primitive](v *Value) (T, error) {
+	var (
+		out T
+		ok  bool
+	)
+
+	switch p := any(&out).(type) {
+	case *bool:
+		*p, ok = v.BooleanOK()
+	case *int32:
+		*p, ok = v.Int32OK()
+	case *int64:
+		*p, ok = widenInt64(v)
+	case *int:
+		var num int64
+		if num, ok = widenInt64(v); ok {
+			if int64(int(num)) != num {
+				return out, fmt.Errorf("%w: %d overflows int", bsonerr.NumericOverflow, num)
+			}
+			*p = int(num)
+		}
+	case *float64:
+		*p, ok = widenFloat64(v)
+	case *string:
+		switch v.Type() {
+		case bsontype.String:
+			*p, ok = v.StringValue(), true
+		case bsontype.Symbol:
+			*p, ok = v.Symbol(), true
+		}
+	case *[]byte:
+		_, *p, ok = v.BinaryOK()
+	case *time.Time:
+		*p, ok = v.TimeOK()
+	case *types.ObjectID:
+		*p, ok = v.ObjectIDOK()
+	case *types.Decimal128:
+		*p, ok = widenDecimal128(v)
+	case *types.Timestamp:
+		p.T, p.I, ok = v.TimestampOK()
+	case *types.Regex:
+		if ok = v.Type() == bsontype.Regex; ok {
+			p.Pattern, p.Options = v.Regex()
+		}
+	case *types.DBPointer:
+		p.DB, p.Pointer, ok = v.DBPointerOK()
+	case *types.Binary:
+		p.Subtype, p.Data, ok = v.BinaryOK()
+	case **Document:
+		*p, ok = v.MutableDocumentOK()
+	case **Array:
+		*p, ok = v.MutableArrayOK()
+	case **Value:
+		*p, ok = v, true
+	}
+
+	if !ok {
+		var zero T
+		return zero, fmt.Errorf("%w: cannot convert to %T", bsonerr.TypeMismatch, zero)
+	}
+
+	return out, nil
+}
+
+func widenInt64(v *Value) (int64, bool) {
+	switch v.Type() {
+	case bsontype.Int32:
+		return int64(v.Int32()), true
+	case bsontype.Int64:
+		return v.Int64(), true
+	default:
+		return 0, false
+	}
+}
+
+func widenFloat64(v *Value) (float64, bool) {
+	switch v.Type() {
+	case bsontype.Double:
+		return v.Double(), true
+	case bsontype.Int32:
+		return float64(v.Int32()), true
+	case bsontype.Int64:
+		num := v.Int64()
+		out := float64(num)
+		// float64(math.MaxInt64) rounds up to 2^63, which does not
+		// convert back to an int64.
+		if out >= math.MaxInt64 || int64(out) != num {
+			return 0, false
+		}
+		return out, true
+	default:
+		return 0, false
+	}
+}
+
+func widenDecimal128(v *Value) (types.Decimal128, bool) {
+	var ctx types.DecimalContext
+
+	switch v.Type() {
+	case bsontype.Decimal128:
+		return v.Decimal128(), true
+	case bsontype.Int32, bsontype.Int64:
+		num, _ := widenInt64(v)
+		out, _ := ctx.FromBigInt(big.NewInt(num))
+		return out, true
+	case bsontype.Double:
+		out, acc := ctx.FromFloat64(v.Double())
+		return out, acc == big.Exact
+	default:
+		return types.Decimal128{}, false
+	}
+}
+
+// valueOf constructs a value from one of the primitive types.
+func valueOf[T Primitive](value T) *Value {
+	switch v := any(value).(type) {
+	case bool:
+		return VC.Boolean(v)
+	case int32:
+		return VC.Int32(v)
+	case int64:
+		return VC.Int64(v)
+	case int:
+		return VC.Int(v)
+	case float64:
+		return VC.Double(v)
+	case string:
+		return VC.String(v)
+	case []byte:
+		return VC.Binary(v)
+	case time.Time:
+		return VC.Time(v)
+	case types.ObjectID:
+		return VC.ObjectID(v)
+	case types.Decimal128:
+		return VC.Decimal128(v)
+	case types.Timestamp:
+		return VC.Timestamp(v.T, v.I)
+	case types.Regex:
+		return VC.Regex(v.Pattern, v.Options)
+	case types.DBPointer:
+		return VC.DBPointer(v.DB, v.Pointer)
+	case types.Binary:
+		return VC.BinaryWithSubtype(v.Data, v.Subtype)
+	case *Document:
+		if v == nil {
+			return VC.Null()
+		}
+		return VC.Document(v)
+	case *Array:
+		if v == nil {
+			return VC.Null()
+		}
+		return VC.Array(v)
+	case *Value:
+		if v == nil {
+			return VC.Null()
+		}
+		return v
+	default:
+		return VC.Null()
+	}
+}
@@ -0,0 +1,266 @@
+package birch
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/types"
+)
+
+func TestGeneric(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+	oid := types.NewObjectID()
+	doc := DC.Elements(
+		EC.Int32("i32", 42),
+		EC.Int64("i64", math.MaxInt64),
+		EC.Double("f", 1.5),
+		EC.String("s", "hello"),
+		EC.Symbol("sym", "sym"),
+		EC.Boolean("b", true),
+		EC.Time("t", now),
+		EC.ObjectID("oid", oid),
+		EC.Null("null"),
+		EC.SubDocumentFromElements("nested",
+			EC.ArrayFromElements("list", VC.Int32(1), VC.DocumentFromElements(EC.String("name", "two"))),
+		),
+	)
+	reader, err := doc.MarshalBSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		for name, get := range map[string]func(path ...string) (*Value, error){
+			"Document": func(path ...string) (*Value, error) { return Get[*Value](doc, path...) },
+			"Reader":   func(path ...string) (*Value, error) { return Get[*Value](Reader(reader), path...) },
+		} {
+			t.Run(name, func(t *testing.T) {
+				val, err := get("nested", "list", "1", "name")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if val.StringValue() != "two" {
+					t.Fatalf("unexpected value %v", val)
+				}
+
+				_, err = get("nested", "list", "2")
+				var pathErr *PathError
+				if !errors.As(err, &pathErr) || !errors.Is(err, bsonerr.ElementNotFound) || pathErr.Depth != 2 || pathErr.Type != bsontype.Array {
+					t.Fatalf("unexpected error %v", err)
+				}
+
+				_, err = get("nested", "list", "x")
+				if !errors.Is(err, bsonerr.InvalidArrayKey) {
+					t.Fatalf("unexpected error %v", err)
+				}
+
+				_, err = get("s", "x")
+				if !errors.As(err, &pathErr) || !errors.Is(err, bsonerr.InvalidDepthTraversal) || pathErr.Type != bsontype.String {
+					t.Fatalf("unexpected error %v", err)
+				}
+
+				if _, err = get(); !errors.Is(err, bsonerr.EmptyKey) {
+					t.Fatalf("unexpected error %v", err)
+				}
+			})
+		}
+	})
+	t.Run("Array", func(t *testing.T) {
+		arr := NewArray(VC.String("a"), VC.DocumentFromElements(EC.Int32("x", 7)))
+		if out, err := Get[int64](arr, "1", "x"); err != nil || out != 7 {
+			t.Fatalf("unexpected value %d (%v)", out, err)
+		}
+		if out, err := Get[string](arr, "0"); err != nil || out != "a" {
+			t.Fatalf("unexpected value %q (%v)", out, err)
+		}
+		if _, err := Get[string](arr, "a"); !errors.Is(err, bsonerr.InvalidArrayKey) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("Conversions", func(t *testing.T) {
+		check := func(t *testing.T, ok bool, err error) {
+			t.Helper()
+			if ok && err != nil {
+				t.Fatal(err)
+			}
+			if !ok && !errors.Is(err, bsonerr.TypeMismatch) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+
+		for _, test := range []struct {
+			name string
+			run  func(t *testing.T)
+		}{
+			{name: "Int32", run: func(t *testing.T) {
+				out, err := Get[int32](doc, "i32")
+				check(t, out == 42, err)
+			}},
+			{name: "Int32FromInt64", run: func(t *testing.T) {
+				_, err := Get[int32](doc, "i64")
+				check(t, false, err)
+			}},
+			{name: "Int64FromInt32", run: func(t *testing.T) {
+				out, err := Get[int64](doc, "i32")
+				check(t, out == 42, err)
+			}},
+			{name: "IntFromInt64", run: func(t *testing.T) {
+				out, err := Get[int](doc, "i64")
+				check(t, out == math.MaxInt64, err)
+			}},
+			{name: "Int64FromDouble", run: func(t *testing.T) {
+				_, err := Get[int64](doc, "f")
+				check(t, false, err)
+			}},
+			{name: "DoubleFromInt32", run: func(t *testing.T) {
+				out, err := Get[float64](doc, "i32")
+				check(t, out == 42, err)
+			}},
+			{name: "DoubleFromInexactInt64", run: func(t *testing.T) {
+				_, err := Get[float64](doc, "i64")
+				check(t, false, err)
+			}},
+			{name: "DoubleFromExactInt64", run: func(t *testing.T) {
+				out, err := Get[float64](DC.Elements(EC.Int64("a", 1<<60)), "a")
+				check(t, out == 1<<60, err)
+			}},
+			{name: "DecimalFromDouble", run: func(t *testing.T) {
+				out, err := Get[types.Decimal128](doc, "f")
+				check(t, out.String() == "1.5", err)
+			}},
+			{name: "DecimalFromInexactDouble", run: func(t *testing.T) {
+				_, err := Get[types.Decimal128](DC.Elements(EC.Double("a", 0.1)), "a")
+				check(t, false, err)
+			}},
+			{name: "DecimalFromInt64", run: func(t *testing.T) {
+				out, err := Get[types.Decimal128](doc, "i64")
+				check(t, out.String() == "9223372036854775807", err)
+			}},
+			{name: "String", run: func(t *testing.T) {
+				out, err := Get[string](doc, "s")
+				check(t, out == "hello", err)
+			}},
+			{name: "StringFromSymbol", run: func(t *testing.T) {
+				out, err := Get[string](doc, "sym")
+				check(t, out == "sym", err)
+			}},
+			{name: "StringFromInt", run: func(t *testing.T) {
+				_, err := Get[string](doc, "i32")
+				check(t, false, err)
+			}},
+			{name: "Bool", run: func(t *testing.T) {
+				out, err := Get[bool](doc, "b")
+				check(t, out, err)
+			}},
+			{name: "Time", run: func(t *testing.T) {
+				out, err := Get[time.Time](doc, "t")
+				check(t, out.Equal(now), err)
+			}},
+			{name: "ObjectID", run: func(t *testing.T) {
+				out, err := Get[types.ObjectID](doc, "oid")
+				check(t, out == oid, err)
+			}},
+			{name: "Null", run: func(t *testing.T) {
+				_, err := Get[*Document](doc, "null")
+				check(t, false, err)
+			}},
+			{name: "Document", run: func(t *testing.T) {
+				out, err := Get[*Document](Reader(reader), "nested")
+				check(t, out != nil && out.Len() == 1, err)
+			}},
+			{name: "Array", run: func(t *testing.T) {
+				out, err := Get[*Array](doc, "nested", "list")
+				check(t, out != nil && out.Len() == 2, err)
+			}},
+		} {
+			t.Run(test.name, test.run)
+		}
+	})
+	t.Run("ErrorMessage", func(t *testing.T) {
+		_, err := Get[int32](doc, "nested", "list", "1", "name")
+		if err == nil || err.Error() != `invalid path "nested.list.1.name" at "nested.list.1.name" (string): type mismatch: cannot convert to int32` {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("GetOr", func(t *testing.T) {
+		if out := GetOr(doc, "default", "s"); out != "hello" {
+			t.Fatalf("unexpected value %q", out)
+		}
+		if out := GetOr(doc, "default", "missing"); out != "default" {
+			t.Fatalf("unexpected value %q", out)
+		}
+		if out := GetOr(Reader(reader), int64(-1), "s"); out != -1 {
+			t.Fatalf("unexpected value %d", out)
+		}
+	})
+	t.Run("Set", func(t *testing.T) {
+		out := DC.New()
+		if err := Set(out, int64(3), "a", "b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := Set(out, "x", "list", "2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := Set(out, now, "a", "when"); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := Get[int64](out, "a", "b"); err != nil || v != 3 {
+			t.Fatalf("unexpected value %d (%v)", v, err)
+		}
+		if v, err := Get[time.Time](out, "a", "when"); err != nil || !v.Equal(now) {
+			t.Fatalf("unexpected value %s (%v)", v, err)
+		}
+		if v := out.Lookup("list"); v.Type() != bsontype.EmbeddedDocument {
+			t.Fatalf("unexpected value %v", v)
+		}
+		if err := Set(out, true, "a", "b", "c"); !errors.Is(err, bsonerr.InvalidDepthTraversal) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		arr := NewArray(VC.String("a"))
+		if err := Set(arr, int32(5), "2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := Set(arr, "y", "3", "x"); err != nil {
+			t.Fatal(err)
+		}
+		if arr.Len() != 4 || GetOr(arr, int32(0), "2") != 5 || GetOr(arr, "", "3", "x") != "y" {
+			t.Fatalf("unexpected array %s", arr)
+		}
+		if v, _ := arr.Lookup(1); v.Type() != bsontype.Null {
+			t.Fatalf("unexpected value %v", v)
+		}
+		if err := Set(arr, 1, "x"); !errors.Is(err, bsonerr.InvalidArrayKey) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("Elem", func(t *testing.T) {
+		for _, test := range []struct {
+			elem *Element
+			typ  bsontype.Type
+		}{
+			{elem: Elem("a", 1), typ: bsontype.Int32},
+			{elem: Elem("a", math.MaxInt64), typ: bsontype.Int64},
+			{elem: Elem("a", 1.5), typ: bsontype.Double},
+			{elem: Elem("a", []byte("data")), typ: bsontype.Binary},
+			{elem: Elem("a", types.Regex{Pattern: "^a", Options: "i"}), typ: bsontype.Regex},
+			{elem: Elem("a", types.Timestamp{T: 1, I: 2}), typ: bsontype.Timestamp},
+			{elem: Elem("a", DC.New()), typ: bsontype.EmbeddedDocument},
+			{elem: Elem[*Document]("a", nil), typ: bsontype.Null},
+			{elem: Elem("a", NewArray()), typ: bsontype.Array},
+		} {
+			if test.elem.Key() != "a" || test.elem.Value().Type() != test.typ {
+				t.Errorf("unexpected element %s, expected %s", test.elem, test.typ)
+			}
+		}
+
+		bin := Elem("b", types.Binary{Subtype: 0x80, Data: []byte{1}})
+		if out, err := Get[types.Binary](DC.Elements(bin), "b"); err != nil || out.Subtype != 0x80 || len(out.Data) != 1 {
+			t.Fatalf("unexpected value %v (%v)", out, err)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package birch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"slices"
+	"strconv"
+
+	"github.com/tychoish/birch/bsontype"
+)
+
+// HashOptions control how Hash and EqualWith compare documents. The
+// zero value compares documents as Value.Equal does: with their keys
+// in order, and numbers of different types as different values.
+type HashOptions struct {
+	// IgnoreKeyOrder compares documents as sets of keys, so that
+	// documents with the same keys and values in a different order
+	// are equal. Arrays are always ordered.
+	IgnoreKeyOrder bool
+	// NumericEquality compares numbers by value, as Compare does, so
+	// that, for example, int32(1), int64(1) and 1.0 are equal.
+	NumericEquality bool
+	// IgnorePaths are the paths of values to skip. Paths within
+	// arrays use the index of the element, as in "tags.0".
+	IgnorePaths []Path
+}
+
+// Hash returns a 64-bit FNV-1a hash of the document. Documents that
+// are equal, as determined by EqualWith with the same options, have
+// the same hash. The hash only depends on the content of the
+// document, and is stable across processes, so it is suitable as a
+// key for caching or deduplicating documents.
+func Hash(doc *Document, opts HashOptions) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(opts.canonical(doc))
+	return h.Sum64()
+}
+
+// Hash128 returns a 128-bit FNV-1a hash of the document, as Hash
+// does, for sets of documents large enough that collisions of the
+// 64-bit hash are a concern.
+func Hash128(doc *Document, opts HashOptions) [16]byte {
+	var out [16]byte
+	h := fnv.New128a()
+	_, _ = h.Write(opts.canonical(doc))
+	h.Sum(out[:0])
+	return out
+}
+
+// EqualWith reports whether the documents are equal as determined by
+// the options. A nil document is equal to an empty document.
+func EqualWith(a, b *Document, opts HashOptions) bool {
+	return bytes.Equal(opts.canonical(a), opts.canonical(b))
+}
+
+// canonical returns an encoding of the document that is equal to the
+// encoding of every document that is equal to it under the options.
+func (opts HashOptions) canonical(doc *Document) []byte {
+	if doc == nil {
+		return opts.appendElements(nil, nil, nil, true)
+	}
+	return opts.appendElements(nil, nil, doc.elems, true)
+}
+
+// appendElements encodes the count of elements that are not ignored,
+// followed by the elements, with their keys when they are in a
+// document, sorted by their encoding when key order is ignored.
+func (opts HashOptions) appendElements(dst []byte, path Path, elems []*Element, keyed bool) []byte {
+	paths := make([]Path, len(elems))
+	if len(opts.IgnorePaths) > 0 {
+		kept := make([]*Element, 0, len(elems))
+		paths = paths[:0]
+		for idx, elem := range elems {
+			key := elem.Key()
+			if !keyed {
+				key = strconv.Itoa(idx)
+			}
+
+			child := append(path[:len(path):len(path)], key)
+			if !opts.ignored(child) {
+				kept = append(kept, elem)
+				paths = append(paths, child)
+			}
+		}
+		elems = kept
+	}
+
+	dst = binary.AppendUvarint(dst, uint64(len(elems)))
+
+	if !keyed || !opts.IgnoreKeyOrder {
+		for idx, elem := range elems {
+			dst = opts.appendElement(dst, paths[idx], elem, keyed)
+		}
+		return dst
+	}
+
+	encoded := make([][]byte, 0, len(elems))
+	for idx, elem := range elems {
+		encoded = append(encoded, opts.appendElement(nil, paths[idx], elem, keyed))
+	}
+	slices.SortFunc(encoded, bytes.Compare)
+
+	for _, elem := range encoded {
+		dst = append(dst, elem...)
+	}
+	return dst
+}
+
+// appendElement encodes the key of an element in a document and its
+// value, which is at the path.
+func (opts HashOptions) appendElement(dst []byte, path Path, elem *Element, keyed bool) []byte {
+	if keyed {
+		dst = appendHashString(dst, elem.Key())
+	}
+	return opts.appendValue(dst, path, elem.value)
+}
+
+// appendValue encodes the type of the value followed by its content:
+// the elements of documents and arrays, and the bytes of other
+// values.
+func (opts HashOptions) appendValue(dst []byte, path Path, v *Value) []byte {
+	t := v.Type()
+
+	switch {
+	case opts.NumericEquality && isNumber(t):
+		return appendHashNumber(dst, v)
+	case t == bsontype.EmbeddedDocument:
+		return opts.appendElements(append(dst, byte(t)), path, v.MutableDocument().elems, true)
+	case t == bsontype.Array:
+		return opts.appendElements(append(dst, byte(t)), path, v.MutableArray().doc.elems, false)
+	case t == bsontype.CodeWithScope:
+		code, scope := v.MutableJavaScriptWithScope()
+		dst = appendHashString(append(dst, byte(t)), code)
+		return opts.appendElements(dst, path, scope.elems, true)
+	default:
+		size, _ := v.valueSize()
+		return append(append(dst, byte(t)), v.data[v.offset:v.offset+size]...)
+	}
+}
+
+// appendHashNumber encodes the exact value of a number, so that
+// numbers of different types that Compare as equal have the same
+// encoding: NaN, the infinities, and the finite numbers as reduced
+// fractions.
+func appendHashNumber(dst []byte, v *Value) []byte {
+	dst = append(dst, byte(bsontype.Decimal128))
+
+	if i, ok := compareInteger(v); ok {
+		return appendHashString(append(dst, 2), strconv.FormatInt(i, 10))
+	}
+
+	r, class := numberRat(v)
+	dst = append(dst, byte(class+2))
+	if class != 0 {
+		return dst
+	}
+	return appendHashString(dst, r.RatString())
+}
+
+func appendHashString(dst []byte, s string) []byte {
+	return append(binary.AppendUvarint(dst, uint64(len(s))), s...)
+}
+
+func (opts HashOptions) ignored(path Path) bool {
+	return slices.ContainsFunc(opts.IgnorePaths, func(p Path) bool { return slices.Equal(p, path) })
+}
@@ -0,0 +1,177 @@
+package birch
+
+import (
+	"math"
+	"testing"
+
+	"github.com/tychoish/birch/types"
+)
+
+func TestHash(t *testing.T) {
+	base := func() *Document {
+		return DC.Elements(
+			EC.Int32("a", 1),
+			EC.SubDocumentFromElements("b",
+				EC.String("c", "x"),
+				EC.ArrayFromElements("d", VC.Int32(1), VC.Double(2.5)),
+			),
+			EC.ObjectID("_id", types.NewObjectID()),
+		)
+	}
+	doc := base()
+	half, err := types.ParseDecimal128("0.50")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		opts  HashOptions
+		a, b  *Document
+		equal bool
+	}{
+		{name: "Same", a: doc, b: doc.Copy(), equal: true},
+		{name: "Empty", a: DC.New(), b: nil, equal: true},
+		{name: "EmptyValue", a: DC.New(), b: DC.Elements(EC.Null("")), equal: false},
+		{name: "Different", a: doc, b: doc.Copy().Set(EC.Int32("a", 2)), equal: false},
+		{name: "Extra", a: doc, b: doc.Copy().Append(EC.Null("z")), equal: false},
+		{
+			name:  "KeyOrder",
+			a:     DC.Elements(EC.Int32("a", 1), EC.Int32("b", 2)),
+			b:     DC.Elements(EC.Int32("b", 2), EC.Int32("a", 1)),
+			equal: false,
+		},
+		{
+			name:  "IgnoreKeyOrder",
+			opts:  HashOptions{IgnoreKeyOrder: true},
+			a:     DC.Elements(EC.Int32("a", 1), EC.SubDocumentFromElements("b", EC.Int32("c", 1), EC.Int32("d", 2))),
+			b:     DC.Elements(EC.SubDocumentFromElements("b", EC.Int32("d", 2), EC.Int32("c", 1)), EC.Int32("a", 1)),
+			equal: true,
+		},
+		{
+			name:  "IgnoreKeyOrderArrays",
+			opts:  HashOptions{IgnoreKeyOrder: true},
+			a:     DC.Elements(EC.ArrayFromElements("a", VC.Int32(1), VC.Int32(2))),
+			b:     DC.Elements(EC.ArrayFromElements("a", VC.Int32(2), VC.Int32(1))),
+			equal: false,
+		},
+		{
+			name:  "IgnoreKeyOrderSwappedValues",
+			opts:  HashOptions{IgnoreKeyOrder: true},
+			a:     DC.Elements(EC.Int32("a", 1), EC.Int32("b", 2)),
+			b:     DC.Elements(EC.Int32("a", 2), EC.Int32("b", 1)),
+			equal: false,
+		},
+		{
+			name:  "NumericTypes",
+			a:     DC.Elements(EC.Int32("a", 1)),
+			b:     DC.Elements(EC.Int64("a", 1)),
+			equal: false,
+		},
+		{
+			name:  "NumericEquality",
+			opts:  HashOptions{NumericEquality: true},
+			a:     DC.Elements(EC.Int32("a", 1), EC.Double("b", 0.5), EC.Double("c", 0)),
+			b:     DC.Elements(EC.Int64("a", 1), EC.Decimal128("b", half), EC.Double("c", math.Copysign(0, -1))),
+			equal: true,
+		},
+		{
+			name:  "NumericEqualityMixed",
+			opts:  HashOptions{NumericEquality: true},
+			a:     DC.Elements(EC.Double("a", 1), EC.Int64("b", math.MaxInt64)),
+			b:     DC.Elements(EC.Int32("a", 1), EC.Double("b", math.MaxInt64)),
+			equal: false,
+		},
+		{
+			name:  "NumericEqualityNaN",
+			opts:  HashOptions{NumericEquality: true},
+			a:     DC.Elements(EC.Double("a", math.NaN()), EC.Double("b", math.Inf(1))),
+			b:     DC.Elements(EC.Double("a", math.NaN()), EC.Double("b", math.Inf(1))),
+			equal: true,
+		},
+		{
+			name:  "NumericEqualityStrings",
+			opts:  HashOptions{NumericEquality: true},
+			a:     DC.Elements(EC.Int32("a", 1)),
+			b:     DC.Elements(EC.String("a", "1")),
+			equal: false,
+		},
+		{
+			name:  "IgnorePaths",
+			opts:  HashOptions{IgnorePaths: []Path{{"_id"}, {"b", "d", "1"}}},
+			a:     doc,
+			b:     base().Set(EC.SubDocumentFromElements("b", EC.String("c", "x"), EC.ArrayFromElements("d", VC.Int32(1), VC.Int32(7)))),
+			equal: true,
+		},
+		{
+			name:  "IgnorePathsMissing",
+			opts:  HashOptions{IgnorePaths: []Path{{"_id"}}},
+			a:     base(),
+			b:     DC.Elements(base().elems[:2]...),
+			equal: true,
+		},
+		{
+			name:  "IgnorePathsArrayIndex",
+			opts:  HashOptions{IgnorePaths: []Path{{"d", "0"}, {"d", "1", "x"}}},
+			a:     DC.Elements(EC.ArrayFromElements("d", VC.Int32(1), VC.DocumentFromElements(EC.Int32("x", 1)), VC.Int32(3))),
+			b:     DC.Elements(EC.ArrayFromElements("d", VC.Int32(9), VC.DocumentFromElements(EC.Int32("x", 2)), VC.Int32(3))),
+			equal: true,
+		},
+		{
+			name:  "IgnorePathsNested",
+			opts:  HashOptions{IgnorePaths: []Path{{"c"}}},
+			a:     DC.Elements(EC.SubDocumentFromElements("b", EC.Int32("c", 1))),
+			b:     DC.Elements(EC.SubDocumentFromElements("b", EC.Int32("c", 2))),
+			equal: false,
+		},
+		{
+			name:  "AllOptions",
+			opts:  HashOptions{IgnoreKeyOrder: true, NumericEquality: true, IgnorePaths: []Path{{"_id"}}},
+			a:     doc,
+			b:     DC.Elements(EC.SubDocumentFromElements("b", EC.ArrayFromElements("d", VC.Int64(1), VC.Double(2.5)), EC.String("c", "x")), EC.Double("a", 1)),
+			equal: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if out := EqualWith(test.a, test.b, test.opts); out != test.equal {
+				t.Fatalf("got %t, expected %t for %s and %s", out, test.equal, test.a, test.b)
+			}
+			if out := EqualWith(test.b, test.a, test.opts); out != test.equal {
+				t.Fatal("equality is not symmetric")
+			}
+			if out := Hash(test.a, test.opts) == Hash(test.b, test.opts); out != test.equal {
+				t.Errorf("64-bit hash equality is %t", out)
+			}
+			if out := Hash128(test.a, test.opts) == Hash128(test.b, test.opts); out != test.equal {
+				t.Errorf("128-bit hash equality is %t", out)
+			}
+		})
+	}
+	t.Run("Stable", func(t *testing.T) {
+		doc := DC.Elements(EC.String("hello", "world"), EC.Int32("n", 1))
+		if Hash(doc, HashOptions{}) != Hash(doc.Copy(), HashOptions{}) {
+			t.Fatal("hash changed between copies")
+		}
+		data, err := doc.MarshalBSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ReadDocument(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Hash(doc, HashOptions{}) != Hash(parsed, HashOptions{}) {
+			t.Fatal("hash changed after a round trip")
+		}
+		if Hash(doc, HashOptions{}) != 0x116cc67398447d98 {
+			t.Errorf("unexpected hash %#x", Hash(doc, HashOptions{}))
+		}
+	})
+	t.Run("CodeWithScope", func(t *testing.T) {
+		a := DC.Elements(EC.CodeWithScope("f", "x", DC.Elements(EC.Int32("a", 1), EC.Int32("b", 2))))
+		b := DC.Elements(EC.CodeWithScope("f", "x", DC.Elements(EC.Int32("b", 2), EC.Int32("a", 1))))
+		if EqualWith(a, b, HashOptions{}) || !EqualWith(a, b, HashOptions{IgnoreKeyOrder: true}) {
+			t.Fatal("unexpected scope equality")
+		}
+	})
+}
@@ -0,0 +1,914 @@
+package birch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/birch/types"
+)
+
+const (
+	// extJSONDateFormat is the ISO-8601 format used for dates in
+	// relaxed mode, which omits the milliseconds when they are zero.
+	extJSONDateFormat = "2006-01-02T15:04:05.999Z07:00"
+
+	// maxRelaxedDate is the last millisecond of the year 9999, after
+	// which relaxed mode uses the canonical form for dates.
+	maxRelaxedDate = 253402300799999
+
+	// canonicalNaN is the quiet NaN that parsed NaN values use.
+	canonicalNaN = 0x7FF8000000000000
+)
+
+// MarshalExtJSON produces a MongoDB Extended JSON (v2) representation of
+// the document. Canonical mode preserves the type of every value, so
+// that parsing the output produces an identical document. Relaxed mode
+// uses plain JSON numbers and ISO-8601 dates where the value allows,
+// which is easier to read but loses the distinction between the
+// numeric types.
+func (d *Document) MarshalExtJSON(canonical bool) ([]byte, error) {
+	return d.appendExtJSON(nil, canonical)
+}
+
+// MarshalExtJSON produces a MongoDB Extended JSON (v2) representation of
+// the array, in canonical or relaxed mode.
+func (a *Array) MarshalExtJSON(canonical bool) ([]byte, error) {
+	return a.appendExtJSON(nil, canonical)
+}
+
+// MarshalExtJSON produces a MongoDB Extended JSON (v2) representation of
+// the value, in canonical or relaxed mode.
+func (v *Value) MarshalExtJSON(canonical bool) ([]byte, error) {
+	return v.appendExtJSON(nil, canonical)
+}
+
+func (d *Document) appendExtJSON(dst []byte, canonical bool) ([]byte, error) {
+	if d == nil {
+		return nil, bsonerr.NilDocument
+	}
+
+	var err error
+
+	dst = append(dst, '{')
+	for idx, elem := range d.elems {
+		if idx > 0 {
+			dst = append(dst, ',')
+		}
+
+		dst = appendJSONString(dst, elem.Key())
+		dst = append(dst, ':')
+
+		if dst, err = elem.value.appendExtJSON(dst, canonical); err != nil {
+			return nil, fmt.Errorf("problem marshaling value for key %q: %w", elem.Key(), err)
+		}
+	}
+
+	return append(dst, '}'), nil
+}
+
+func (a *Array) appendExtJSON(dst []byte, canonical bool) ([]byte, error) {
+	if a == nil {
+		return nil, bsonerr.NilDocument
+	}
+
+	var err error
+
+	dst = append(dst, '[')
+	for idx, elem := range a.doc.elems {
+		if idx > 0 {
+			dst = append(dst, ',')
+		}
+
+		if dst, err = elem.value.appendExtJSON(dst, canonical); err != nil {
+			return nil, fmt.Errorf("problem marshaling array value for index %d: %w", idx, err)
+		}
+	}
+
+	return append(dst, ']'), nil
+}
+
+func (v *Value) appendExtJSON(dst []byte, canonical bool) ([]byte, error) {
+	if v == nil || v.data == nil {
+		return nil, bsonerr.UninitializedElement
+	}
+
+	switch v.Type() {
+	case bsontype.Double:
+		f := v.Double()
+		if !canonical && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return append(dst, formatExtJSONDouble(f)...), nil
+		}
+
+		dst = append(dst, `{"$numberDouble":"`...)
+		dst = append(dst, formatExtJSONDouble(f)...)
+		return append(dst, `"}`...), nil
+	case bsontype.String:
+		return appendJSONString(dst, v.StringValue()), nil
+	case bsontype.EmbeddedDocument:
+		return v.MutableDocument().appendExtJSON(dst, canonical)
+	case bsontype.Array:
+		return v.MutableArray().appendExtJSON(dst, canonical)
+	case bsontype.Binary:
+		subtype, data := v.Binary()
+
+		dst = append(dst, `{"$binary":{"base64":"`...)
+		dst = base64.StdEncoding.AppendEncode(dst, data)
+		dst = append(dst, `","subType":"`...)
+		dst = hex.AppendEncode(dst, []byte{subtype})
+		return append(dst, `"}}`...), nil
+	case bsontype.Undefined:
+		return append(dst, `{"$undefined":true}`...), nil
+	case bsontype.ObjectID:
+		dst = append(dst, `{"$oid":"`...)
+		dst = append(dst, v.ObjectID().Hex()...)
+		return append(dst, `"}`...), nil
+	case bsontype.Boolean:
+		return strconv.AppendBool(dst, v.Boolean()), nil
+	case bsontype.DateTime:
+		ms := v.DateTime()
+		if !canonical && ms >= 0 && ms <= maxRelaxedDate {
+			dst = append(dst, `{"$date":"`...)
+			dst = time.UnixMilli(ms).UTC().AppendFormat(dst, extJSONDateFormat)
+			return append(dst, `"}`...), nil
+		}
+
+		dst = append(dst, `{"$date":{"$numberLong":"`...)
+		dst = strconv.AppendInt(dst, ms, 10)
+		return append(dst, `"}}`...), nil
+	case bsontype.Null:
+		return append(dst, "null"...), nil
+	case bsontype.Regex:
+		pattern, options := v.Regex()
+
+		dst = append(dst, `{"$regularExpression":{"pattern":`...)
+		dst = appendJSONString(dst, pattern)
+		dst = append(dst, `,"options":`...)
+		dst = appendJSONString(dst, sortRegexOptions(options))
+		return append(dst, `}}`...), nil
+	case bsontype.DBPointer:
+		ns, oid := v.DBPointer()
+
+		dst = append(dst, `{"$dbPointer":{"$ref":`...)
+		dst = appendJSONString(dst, ns)
+		dst = append(dst, `,"$id":{"$oid":"`...)
+		dst = append(dst, oid.Hex()...)
+		return append(dst, `"}}}`...), nil
+	case bsontype.JavaScript:
+		dst = append(dst, `{"$code":`...)
+		dst = appendJSONString(dst, v.JavaScript())
+		return append(dst, '}'), nil
+	case bsontype.Symbol:
+		dst = append(dst, `{"$symbol":`...)
+		dst = appendJSONString(dst, v.Symbol())
+		return append(dst, '}'), nil
+	case bsontype.CodeWithScope:
+		code, scope := v.MutableJavaScriptWithScope()
+
+		dst = append(dst, `{"$code":`...)
+		dst = appendJSONString(dst, code)
+		dst = append(dst, `,"$scope":`...)
+
+		var err error
+		if dst, err = scope.appendExtJSON(dst, canonical); err != nil {
+			return nil, err
+		}
+
+		return append(dst, '}'), nil
+	case bsontype.Int32:
+		if !canonical {
+			return strconv.AppendInt(dst, int64(v.Int32()), 10), nil
+		}
+
+		dst = append(dst, `{"$numberInt":"`...)
+		dst = strconv.AppendInt(dst, int64(v.Int32()), 10)
+		return append(dst, `"}`...), nil
+	case bsontype.Timestamp:
+		t, i := v.Timestamp()
+
+		dst = append(dst, `{"$timestamp":{"t":`...)
+		dst = strconv.AppendUint(dst, uint64(t), 10)
+		dst = append(dst, `,"i":`...)
+		dst = strconv.AppendUint(dst, uint64(i), 10)
+		return append(dst, `}}`...), nil
+	case bsontype.Int64:
+		if !canonical {
+			return strconv.AppendInt(dst, v.Int64(), 10), nil
+		}
+
+		dst = append(dst, `{"$numberLong":"`...)
+		dst = strconv.AppendInt(dst, v.Int64(), 10)
+		return append(dst, `"}`...), nil
+	case bsontype.Decimal128:
+		dst = append(dst, `{"$numberDecimal":"`...)
+		dst = append(dst, v.Decimal128().String()...)
+		return append(dst, `"}`...), nil
+	case bsontype.MinKey:
+		return append(dst, `{"$minKey":1}`...), nil
+	case bsontype.MaxKey:
+		return append(dst, `{"$maxKey":1}`...), nil
+	default:
+		return nil, fmt.Errorf("cannot represent type '%s' in extended JSON", v.Type())
+	}
+}
+
+// formatExtJSONDouble renders a double as a string that parses to the
+// same value, always including either a decimal point or an exponent
+// so that it cannot be mistaken for an integer.
+func formatExtJSONDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+
+	out := strconv.FormatFloat(f, 'G', -1, 64)
+	if !strings.ContainsAny(out, ".E") {
+		out += ".0"
+	}
+
+	return out
+}
+
+func sortRegexOptions(options string) string {
+	opts := []byte(options)
+	slices.Sort(opts)
+	return string(opts)
+}
+
+// appendJSONString appends a quoted JSON string, escaping quotes,
+// backslashes, and control characters. Other characters, including
+// non-ASCII characters, are written as-is.
+func appendJSONString(dst []byte, s string) []byte {
+	const hexDigits = "0123456789abcdef"
+
+	dst = append(dst, '"')
+
+	start := 0
+	for idx := 0; idx < len(s); idx++ {
+		c := s[idx]
+		if c >= 0x20 && c != '"' && c != '\\' {
+			continue
+		}
+
+		dst = append(dst, s[start:idx]...)
+		switch c {
+		case '"', '\\':
+			dst = append(dst, '\\', c)
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\t':
+			dst = append(dst, '\\', 't')
+		default:
+			dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+		}
+		start = idx + 1
+	}
+
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
+
+// UnmarshalExtJSON parses MongoDB Extended JSON (v2), in either canonical
+// or relaxed mode, and appends the elements to the document. The legacy
+// $binary/$type and $regex/$options forms are also accepted.
+//
+// In relaxed mode, JSON numbers with a fractional part or exponent are
+// doubles, and integers are int32 values if they fit and int64 values
+// otherwise.
+func (d *Document) UnmarshalExtJSON(in []byte) error {
+	node, err := parseExtJSON(in)
+	if err != nil {
+		return err
+	}
+
+	if node.kind != '{' {
+		return fmt.Errorf("%w: cannot unmarshal %s into a document", bsonerr.InvalidExtendedJSON, node.kindName())
+	}
+
+	if _, ok := node.wrapper(); ok {
+		return fmt.Errorf("%w: cannot unmarshal a type wrapper into a document", bsonerr.InvalidExtendedJSON)
+	}
+
+	return node.appendTo(d)
+}
+
+// UnmarshalExtJSON parses a MongoDB Extended JSON (v2) array, and
+// appends its values to the array.
+func (a *Array) UnmarshalExtJSON(in []byte) error {
+	node, err := parseExtJSON(in)
+	if err != nil {
+		return err
+	}
+
+	if node.kind != '[' {
+		return fmt.Errorf("%w: cannot unmarshal %s into an array", bsonerr.InvalidExtendedJSON, node.kindName())
+	}
+
+	for _, item := range node.values {
+		val, err := item.toValue()
+		if err != nil {
+			return err
+		}
+
+		a.Append(val)
+	}
+
+	return nil
+}
+
+// UnmarshalExtJSON parses a MongoDB Extended JSON (v2) value, replacing
+// the contents of the value.
+func (v *Value) UnmarshalExtJSON(in []byte) error {
+	node, err := parseExtJSON(in)
+	if err != nil {
+		return err
+	}
+
+	val, err := node.toValue()
+	if err != nil {
+		return err
+	}
+
+	v.Set(val)
+
+	return nil
+}
+
+// extJSONNode is a parsed JSON value, which preserves the order of
+// object keys and the text of numbers, so that type wrappers can be
+// identified before converting the value to BSON.
+type extJSONNode struct {
+	// kind is one of '{', '[', '"' (string), '0' (number), 't'
+	// (boolean), and 'n' (null).
+	kind   byte
+	str    string
+	num    json.Number
+	bool   bool
+	keys   []string
+	values []*extJSONNode
+}
+
+func (n *extJSONNode) kindName() string {
+	switch n.kind {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "string"
+	case '0':
+		return "number"
+	case 't':
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+func parseExtJSON(in []byte) (*extJSONNode, error) {
+	if !utf8.Valid(in) {
+		return nil, fmt.Errorf("%w: input is not valid UTF-8", bsonerr.InvalidExtendedJSON)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(in))
+	dec.UseNumber()
+
+	node, err := readExtJSONNode(dec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", bsonerr.InvalidExtendedJSON, err)
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: unexpected data after value", bsonerr.InvalidExtendedJSON)
+	}
+
+	return node, nil
+}
+
+func readExtJSONNode(dec *json.Decoder) (*extJSONNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tv := tok.(type) {
+	case json.Delim:
+		node := &extJSONNode{kind: byte(tv)}
+		for dec.More() {
+			if tv == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, key.(string))
+			}
+
+			val, err := readExtJSONNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			node.values = append(node.values, val)
+		}
+
+		// consume the closing delimiter.
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+
+		return node, nil
+	case string:
+		return &extJSONNode{kind: '"', str: tv}, nil
+	case json.Number:
+		return &extJSONNode{kind: '0', num: tv}, nil
+	case bool:
+		return &extJSONNode{kind: 't', bool: tv}, nil
+	default:
+		return &extJSONNode{kind: 'n'}, nil
+	}
+}
+
+// extJSONWrappers maps the key that identifies each type wrapper to the
+// other keys that may appear alongside it.
+var extJSONWrappers = map[string][]string{
+	"$oid":               nil,
+	"$symbol":            nil,
+	"$numberInt":         nil,
+	"$numberLong":        nil,
+	"$numberDouble":      nil,
+	"$numberDecimal":     nil,
+	"$binary":            {"$type"},
+	"$uuid":              nil,
+	"$code":              {"$scope"},
+	"$timestamp":         nil,
+	"$regularExpression": nil,
+	"$regex":             {"$options"},
+	"$dbPointer":         nil,
+	"$date":              nil,
+	"$minKey":            nil,
+	"$maxKey":            nil,
+	"$undefined":         nil,
+}
+
+// wrapper returns the key of the type wrapper that the object
+// represents, if any. Objects with other keys that begin with "$", such
+// as DBRefs and query operators, are documents.
+func (n *extJSONNode) wrapper() (string, bool) {
+	if n.kind != '{' {
+		return "", false
+	}
+
+	for idx, key := range n.keys {
+		if _, ok := extJSONWrappers[key]; !ok {
+			continue
+		}
+
+		// $regex is also a query operator, and is only the legacy
+		// regular expression form when its value is a string.
+		if key == "$regex" && n.values[idx].kind != '"' {
+			continue
+		}
+
+		return key, true
+	}
+
+	return "", false
+}
+
+func (n *extJSONNode) get(key string) (*extJSONNode, bool) {
+	for idx, k := range n.keys {
+		if k == key {
+			return n.values[idx], true
+		}
+	}
+	return nil, false
+}
+
+func (n *extJSONNode) appendTo(doc *Document) error {
+	for idx, key := range n.keys {
+		if strings.IndexByte(key, 0) >= 0 {
+			return fmt.Errorf("%w: key %q contains a null byte", bsonerr.InvalidExtendedJSON, key)
+		}
+
+		val, err := n.values[idx].toValue()
+		if err != nil {
+			return fmt.Errorf("problem parsing value for key %q: %w", key, err)
+		}
+
+		doc.Append(EC.Value(key, val))
+	}
+
+	return nil
+}
+
+func (n *extJSONNode) toValue() (*Value, error) {
+	switch n.kind {
+	case '"':
+		return VC.String(n.str), nil
+	case 't':
+		return VC.Boolean(n.bool), nil
+	case 'n':
+		return VC.Null(), nil
+	case '0':
+		return parseRelaxedNumber(n.num)
+	case '[':
+		array := MakeArray(len(n.values))
+		for _, item := range n.values {
+			val, err := item.toValue()
+			if err != nil {
+				return nil, err
+			}
+			array.Append(val)
+		}
+		return VC.Array(array), nil
+	}
+
+	key, ok := n.wrapper()
+	if !ok {
+		doc := DC.Make(len(n.keys))
+		if err := n.appendTo(doc); err != nil {
+			return nil, err
+		}
+		return VC.Document(doc), nil
+	}
+
+	if err := n.checkKeys(append([]string{key}, extJSONWrappers[key]...)...); err != nil {
+		return nil, err
+	}
+
+	val, err := n.parseWrapper(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid %s: %w", bsonerr.InvalidExtendedJSON, key, err)
+	}
+
+	return val, nil
+}
+
+// checkKeys returns an error if the object has keys other than the
+// allowed keys, or has any key more than once.
+func (n *extJSONNode) checkKeys(allowed ...string) error {
+	for idx, key := range n.keys {
+		if !slices.Contains(allowed, key) {
+			return fmt.Errorf("%w: unexpected key %q in %s", bsonerr.InvalidExtendedJSON, key, allowed[0])
+		}
+		if slices.Contains(n.keys[:idx], key) {
+			return fmt.Errorf("%w: duplicate key %q in %s", bsonerr.InvalidExtendedJSON, key, allowed[0])
+		}
+	}
+	return nil
+}
+
+func (n *extJSONNode) stringValue() (string, error) {
+	if n.kind != '"' {
+		return "", fmt.Errorf("expected a string, not %s", n.kindName())
+	}
+	return n.str, nil
+}
+
+func (n *extJSONNode) object(keys ...string) ([]*extJSONNode, error) {
+	if n.kind != '{' {
+		return nil, fmt.Errorf("expected an object, not %s", n.kindName())
+	}
+	if err := n.checkKeys(keys...); err != nil {
+		return nil, err
+	}
+
+	out := make([]*extJSONNode, len(keys))
+	for idx, key := range keys {
+		val, ok := n.get(key)
+		if !ok {
+			return nil, fmt.Errorf("missing %q", key)
+		}
+		out[idx] = val
+	}
+
+	return out, nil
+}
+
+func (n *extJSONNode) parseWrapper(key string) (*Value, error) {
+	val, _ := n.get(key)
+
+	switch key {
+	case "$oid":
+		oid, err := parseExtJSONObjectID(val)
+		if err != nil {
+			return nil, err
+		}
+		return VC.ObjectID(oid), nil
+	case "$symbol":
+		str, err := val.stringValue()
+		if err != nil {
+			return nil, err
+		}
+		return VC.Symbol(str), nil
+	case "$numberInt":
+		str, err := val.stringValue()
+		if err != nil {
+			return nil, err
+		}
+		i, err := strconv.ParseInt(str, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		return VC.Int32(int32(i)), nil
+	case "$numberLong":
+		i, err := parseExtJSONInt64(val)
+		if err != nil {
+			return nil, err
+		}
+		return VC.Int64(i), nil
+	case "$numberDouble":
+		str, err := val.stringValue()
+		if err != nil {
+			return nil, err
+		}
+		f, err := parseExtJSONDouble(str)
+		if err != nil {
+			return nil, err
+		}
+		return VC.Double(f), nil
+	case "$numberDecimal":
+		str, err := val.stringValue()
+		if err != nil {
+			return nil, err
+		}
+		d, err := types.ParseDecimal128(str)
+		if err != nil {
+			return nil, err
+		}
+		return VC.Decimal128(d), nil
+	case "$binary":
+		return n.parseBinary(val)
+	case "$uuid":
+		str, err := val.stringValue()
+		if err != nil {
+			return nil, err
+		}
+		data, err := parseUUID(str)
+		if err != nil {
+			return nil, err
+		}
+		return VC.BinaryWithSubtype(data, 0x04), nil
+	case "$code":
+		code, err := val.stringValue()
+		if err != nil {
+			return nil, err
+		}
+
+		scope, ok := n.get("$scope")
+		if !ok {
+			return VC.JavaScript(code), nil
+		}
+		if _, isWrapper := scope.wrapper(); scope.kind != '{' || isWrapper {
+			return nil, fmt.Errorf("$scope must be a document, not %s", scope.kindName())
+		}
+
+		doc := DC.Make(len(scope.keys))
+		if err := scope.appendTo(doc); err != nil {
+			return nil, err
+		}
+		return VC.CodeWithScope(code, doc), nil
+	case "$timestamp":
+		fields, err := val.object("t", "i")
+		if err != nil {
+			return nil, err
+		}
+
+		var ts [2]uint32
+		for idx, field := range fields {
+			if field.kind != '0' {
+				return nil, fmt.Errorf("expected a number, not %s", field.kindName())
+			}
+			n, err := strconv.ParseUint(field.num.String(), 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			ts[idx] = uint32(n)
+		}
+		return VC.Timestamp(ts[0], ts[1]), nil
+	case "$regularExpression":
+		fields, err := val.object("pattern", "options")
+		if err != nil {
+			return nil, err
+		}
+		return parseExtJSONRegex(fields[0], fields[1])
+	case "$regex":
+		options, ok := n.get("$options")
+		if !ok {
+			return nil, fmt.Errorf("missing %q", "$options")
+		}
+		return parseExtJSONRegex(val, options)
+	case "$dbPointer":
+		fields, err := val.object("$ref", "$id")
+		if err != nil {
+			return nil, err
+		}
+
+		ns, err := fields[0].stringValue()
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := fields[1].object("$oid")
+		if err != nil {
+			return nil, err
+		}
+
+		oid, err := parseExtJSONObjectID(id[0])
+		if err != nil {
+			return nil, err
+		}
+		return VC.DBPointer(ns, oid), nil
+	case "$date":
+		switch val.kind {
+		case '"':
+			date, err := time.Parse(time.RFC3339Nano, val.str)
+			if err != nil {
+				// offsets without a colon are also valid ISO-8601.
+				var ierr error
+				if date, ierr = time.Parse("2006-01-02T15:04:05.999999999Z0700", val.str); ierr != nil {
+					return nil, err
+				}
+			}
+			return VC.DateTime(date.UnixMilli()), nil
+		case '{':
+			fields, err := val.object("$numberLong")
+			if err != nil {
+				return nil, err
+			}
+			ms, err := parseExtJSONInt64(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			return VC.DateTime(ms), nil
+		default:
+			return nil, fmt.Errorf("expected a string or an object, not %s", val.kindName())
+		}
+	case "$minKey", "$maxKey":
+		if val.kind != '0' || val.num.String() != "1" {
+			return nil, fmt.Errorf("expected the number 1")
+		}
+		if key == "$minKey" {
+			return VC.MinKey(), nil
+		}
+		return VC.MaxKey(), nil
+	case "$undefined":
+		if val.kind != 't' || !val.bool {
+			return nil, fmt.Errorf("expected true")
+		}
+		return VC.Undefined(), nil
+	default:
+		return nil, fmt.Errorf("unsupported type wrapper")
+	}
+}
+
+func (n *extJSONNode) parseBinary(val *extJSONNode) (*Value, error) {
+	var payload, subtype *extJSONNode
+
+	if val.kind == '{' {
+		if _, ok := n.get("$type"); ok {
+			return nil, fmt.Errorf("unexpected %q", "$type")
+		}
+
+		fields, err := val.object("base64", "subType")
+		if err != nil {
+			return nil, err
+		}
+		payload, subtype = fields[0], fields[1]
+	} else {
+		// the legacy form: {"$binary": <base64>, "$type": <hex>}
+		var ok bool
+		if subtype, ok = n.get("$type"); !ok {
+			return nil, fmt.Errorf("missing %q", "$type")
+		}
+		payload = val
+	}
+
+	str, err := payload.stringValue()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+
+	str, err = subtype.stringValue()
+	if err != nil {
+		return nil, err
+	}
+	if len(str) == 0 || len(str) > 2 {
+		return nil, fmt.Errorf("subtype %q must be one or two hex digits", str)
+	}
+	st, err := strconv.ParseUint(str, 16, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	return VC.BinaryWithSubtype(data, byte(st)), nil
+}
+
+func parseExtJSONObjectID(n *extJSONNode) (types.ObjectID, error) {
+	str, err := n.stringValue()
+	if err != nil {
+		return types.ObjectID{}, err
+	}
+	if len(str) != 24 {
+		return types.ObjectID{}, fmt.Errorf("object id %q must be 24 hex digits", str)
+	}
+	return types.ObjectIDFromHex(str)
+}
+
+func parseExtJSONInt64(n *extJSONNode) (int64, error) {
+	str, err := n.stringValue()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(str, 10, 64)
+}
+
+func parseExtJSONRegex(pattern, options *extJSONNode) (*Value, error) {
+	p, err := pattern.stringValue()
+	if err != nil {
+		return nil, err
+	}
+	o, err := options.stringValue()
+	if err != nil {
+		return nil, err
+	}
+	if strings.IndexByte(p, 0) >= 0 || strings.IndexByte(o, 0) >= 0 {
+		return nil, fmt.Errorf("regular expressions cannot contain null bytes")
+	}
+
+	return VC.Regex(p, sortRegexOptions(o)), nil
+}
+
+// parseExtJSONDouble parses the string form of a double, which is
+// either a decimal number, or one of Infinity, -Infinity, and NaN.
+func parseExtJSONDouble(str string) (float64, error) {
+	switch str {
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.Float64frombits(canonicalNaN), nil
+	}
+
+	// strconv also accepts hexadecimal and spelled out special
+	// values, which are not valid here.
+	for _, c := range str {
+		if !strings.ContainsRune("0123456789+-.eE", c) {
+			return 0, fmt.Errorf("invalid double %q", str)
+		}
+	}
+
+	return strconv.ParseFloat(str, 64)
+}
+
+// parseRelaxedNumber converts a JSON number into a double if it has a
+// fractional part or an exponent, and otherwise into the smallest
+// integer type that holds it.
+func parseRelaxedNumber(num json.Number) (*Value, error) {
+	str := num.String()
+
+	if !strings.ContainsAny(str, ".eE") {
+		if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+			if i >= math.MinInt32 && i <= math.MaxInt32 {
+				return VC.Int32(int32(i)), nil
+			}
+			return VC.Int64(i), nil
+		}
+	}
+
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid number %q: %w", bsonerr.InvalidExtendedJSON, str, err)
+	}
+
+	return VC.Double(f), nil
+}
+
+func parseUUID(str string) ([]byte, error) {
+	if len(str) != 36 || str[8] != '-' || str[13] != '-' || str[18] != '-' || str[23] != '-' {
+		return nil, fmt.Errorf("invalid uuid %q", str)
+	}
+
+	return hex.DecodeString(str[:8] + str[9:13] + str[14:18] + str[19:23] + str[24:])
+}
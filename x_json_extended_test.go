@@ -0,0 +1,387 @@
+package birch
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/types"
+)
+
+type corpusFile struct {
+	Description  string            `json:"description"`
+	BSONType     string            `json:"bson_type"`
+	TestKey      string            `json:"test_key"`
+	Valid        []corpusValid     `json:"valid"`
+	DecodeErrors []corpusDecodeErr `json:"decodeErrors"`
+	ParseErrors  []corpusParseErr  `json:"parseErrors"`
+}
+
+type corpusValid struct {
+	Description       string `json:"description"`
+	CanonicalBSON     string `json:"canonical_bson"`
+	CanonicalExtJSON  string `json:"canonical_extjson"`
+	RelaxedExtJSON    string `json:"relaxed_extjson"`
+	DegenerateBSON    string `json:"degenerate_bson"`
+	DegenerateExtJSON string `json:"degenerate_extjson"`
+	Lossy             bool   `json:"lossy"`
+}
+
+type corpusDecodeErr struct {
+	Description string `json:"description"`
+	BSON        string `json:"bson"`
+}
+
+type corpusParseErr struct {
+	Description string `json:"description"`
+	String      string `json:"string"`
+}
+
+// normalizeJSON removes insignificant whitespace and normalizes string
+// escapes, preserving the order of keys and the text of numbers, so
+// that equivalent JSON compares equal.
+func normalizeJSON(t *testing.T, in string) string {
+	t.Helper()
+
+	node, err := parseExtJSON([]byte(in))
+	if err != nil {
+		t.Fatalf("invalid JSON %s: %v", in, err)
+	}
+
+	var write func([]byte, *extJSONNode) []byte
+	write = func(dst []byte, n *extJSONNode) []byte {
+		switch n.kind {
+		case '{':
+			dst = append(dst, '{')
+			for idx, key := range n.keys {
+				if idx > 0 {
+					dst = append(dst, ',')
+				}
+				dst = appendJSONString(dst, key)
+				dst = append(dst, ':')
+				dst = write(dst, n.values[idx])
+			}
+			return append(dst, '}')
+		case '[':
+			dst = append(dst, '[')
+			for idx, val := range n.values {
+				if idx > 0 {
+					dst = append(dst, ',')
+				}
+				dst = write(dst, val)
+			}
+			return append(dst, ']')
+		case '"':
+			return appendJSONString(dst, n.str)
+		case '0':
+			return append(dst, n.num...)
+		case 't':
+			if n.bool {
+				return append(dst, "true"...)
+			}
+			return append(dst, "false"...)
+		default:
+			return append(dst, "null"...)
+		}
+	}
+
+	return string(write(nil, node))
+}
+
+func mustHex(t *testing.T, in string) []byte {
+	t.Helper()
+
+	out, err := hex.DecodeString(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func checkExtJSON(t *testing.T, doc *Document, canonical bool, expected string) {
+	t.Helper()
+
+	out, err := doc.MarshalExtJSON(canonical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := normalizeJSON(t, expected); string(out) != want {
+		t.Fatalf("extended json (canonical=%t):\n got: %s\nwant: %s", canonical, out, want)
+	}
+}
+
+func checkExtJSONToBSON(t *testing.T, in string, expected []byte) {
+	t.Helper()
+
+	doc := DC.New()
+	if err := doc.UnmarshalExtJSON([]byte(in)); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := doc.MarshalBSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bson from %s:\n got: %X\nwant: %X", in, out, expected)
+	}
+}
+
+// corpusSkips are the cases of the upstream corpus that this package
+// does not support, by file and description, with the reason.
+var corpusSkips = map[string]string{
+	"binary/DecodeError/subtype 0x02 length too long ":                                "validation does not check the inner length of the old binary subtype",
+	"binary/DecodeError/subtype 0x02 length too short":                                "validation does not check the inner length of the old binary subtype",
+	"binary/DecodeError/subtype 0x02 length negative one":                             "validation does not check the inner length of the old binary subtype",
+	"code/DecodeError/code string is not null-terminated":                             "validation does not check the lengths of strings within values",
+	"code/DecodeError/invalid UTF-8":                                                  "validation does not check that strings are valid UTF-8",
+	"code_w_scope/DecodeError/bad code string: length too short":                      "validation does not check the lengths of strings within values",
+	"code_w_scope/DecodeError/bad code string: length too long (clips scope)":         "validation does not check the lengths of strings within values",
+	"code_w_scope/DecodeError/bad code string: negative length":                       "validation does not check the lengths of strings within values",
+	"code_w_scope/DecodeError/bad code string: length longer than field":              "validation does not check the lengths of strings within values",
+	"code_w_scope/DecodeError/bad scope doc (field has bad string length)":            "validation does not check the lengths of strings within values",
+	"dbpointer/DecodeError/String not null terminated":                                "validation does not check the lengths of strings within values",
+	"dbpointer/DecodeError/String with bad UTF-8":                                     "validation does not check that strings are valid UTF-8",
+	"string/DecodeError/string is not null-terminated":                                "validation does not check the lengths of strings within values",
+	"string/DecodeError/invalid UTF-8":                                                "validation does not check that strings are valid UTF-8",
+	"symbol/DecodeError/symbol is not null-terminated":                                "validation does not check the lengths of strings within values",
+	"symbol/DecodeError/invalid UTF-8":                                                "validation does not check that strings are valid UTF-8",
+	"top/DecodeError/Stated length less than byte count, with garbage after envelope": "documents are read from their stated length, ignoring trailing bytes",
+}
+
+// runCorpus runs the cases of a corpus file, skipping the cases in
+// corpusSkips.
+func runCorpus(t *testing.T, name string, corpus corpusFile) {
+	skip := func(t *testing.T, description string) {
+		t.Helper()
+		if reason, ok := corpusSkips[name+"/"+description]; ok {
+			t.Skip(reason)
+		}
+	}
+
+	for _, test := range corpus.Valid {
+		t.Run(test.Description, func(t *testing.T) {
+			skip(t, test.Description)
+			cb := mustHex(t, test.CanonicalBSON)
+
+			doc, err := ReadDocument(cb)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := doc.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, cb) {
+				t.Fatalf("bson round trip:\n got: %X\nwant: %X", out, cb)
+			}
+
+			checkExtJSON(t, doc, true, test.CanonicalExtJSON)
+			if !test.Lossy {
+				checkExtJSONToBSON(t, test.CanonicalExtJSON, cb)
+			}
+
+			if test.RelaxedExtJSON != "" {
+				checkExtJSON(t, doc, false, test.RelaxedExtJSON)
+
+				relaxed := DC.New()
+				if err := relaxed.UnmarshalExtJSON([]byte(test.RelaxedExtJSON)); err != nil {
+					t.Fatal(err)
+				}
+				checkExtJSON(t, relaxed, false, test.RelaxedExtJSON)
+			}
+
+			if test.DegenerateBSON != "" {
+				degenerate, err := ReadDocument(mustHex(t, test.DegenerateBSON))
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkExtJSON(t, degenerate, true, test.CanonicalExtJSON)
+			}
+
+			if test.DegenerateExtJSON != "" && !test.Lossy {
+				checkExtJSONToBSON(t, test.DegenerateExtJSON, cb)
+			}
+		})
+	}
+
+	for _, test := range corpus.DecodeErrors {
+		t.Run("DecodeError/"+test.Description, func(t *testing.T) {
+			skip(t, "DecodeError/"+test.Description)
+			// documents are decoded lazily, so validation
+			// reports errors in nested values.
+			if _, err := Reader(mustHex(t, test.BSON)).Validate(); err == nil {
+				t.Fatal("expected decoding to fail")
+			}
+		})
+	}
+
+	for _, test := range corpus.ParseErrors {
+		t.Run("ParseError/"+test.Description, func(t *testing.T) {
+			skip(t, "ParseError/"+test.Description)
+			// the parse errors of the decimal128 files are
+			// decimal strings rather than Extended JSON.
+			if corpus.BSONType == "0x13" {
+				if _, err := types.ParseDecimal128(test.String); err == nil {
+					t.Fatalf("expected parsing %q to fail", test.String)
+				}
+				return
+			}
+
+			err := DC.New().UnmarshalExtJSON([]byte(test.String))
+			if !errors.Is(err, bsonerr.InvalidExtendedJSON) {
+				t.Fatalf("expected invalid extended JSON error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestExtendedJSON(t *testing.T) {
+	t.Run("Corpus", func(t *testing.T) {
+		files, err := filepath.Glob(filepath.Join("testdata", "bson-corpus", "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 0 {
+			t.Fatal("no corpus files")
+		}
+
+		for _, fn := range files {
+			data, err := os.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var corpus corpusFile
+			if err := json.Unmarshal(data, &corpus); err != nil {
+				t.Fatalf("%s: %v", fn, err)
+			}
+
+			name := strings.TrimSuffix(filepath.Base(fn), ".json")
+			t.Run(name, func(t *testing.T) { runCorpus(t, name, corpus) })
+		}
+	})
+	t.Run("LegacyCorpus", func(t *testing.T) {
+		// cases for the legacy Extended JSON forms and for errors
+		// that the upstream corpus does not cover, in the format of
+		// the corpus.
+		data, err := os.ReadFile(filepath.Join("testdata", "bson-corpus-legacy.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var files []corpusFile
+		if err := json.Unmarshal(data, &files); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, corpus := range files {
+			t.Run(corpus.Description, func(t *testing.T) { runCorpus(t, "legacy", corpus) })
+		}
+	})
+	t.Run("Value", func(t *testing.T) {
+		oid := types.MustObjectIDFromHex("5df67fa01cbe64e51b598f18")
+		date := time.Date(2020, 2, 29, 12, 30, 15, 250*int(time.Millisecond), time.UTC)
+
+		for _, test := range []struct {
+			Name      string
+			Value     *Value
+			Canonical string
+			Relaxed   string
+		}{
+			{
+				Name:      "Int32",
+				Value:     VC.Int32(42),
+				Canonical: `{"$numberInt":"42"}`,
+				Relaxed:   `42`,
+			},
+			{
+				Name:      "Int64",
+				Value:     VC.Int64(math.MaxInt32 + 1),
+				Canonical: `{"$numberLong":"2147483648"}`,
+				Relaxed:   `2147483648`,
+			},
+			{
+				Name:      "WholeDouble",
+				Value:     VC.Double(42),
+				Canonical: `{"$numberDouble":"42.0"}`,
+				Relaxed:   `42.0`,
+			},
+			{
+				Name:      "Date",
+				Value:     VC.Time(date),
+				Canonical: `{"$date":{"$numberLong":"1582979415250"}}`,
+				Relaxed:   `{"$date":"2020-02-29T12:30:15.25Z"}`,
+			},
+			{
+				Name:      "Binary",
+				Value:     VC.BinaryWithSubtype([]byte("hello"), 0x80),
+				Canonical: `{"$binary":{"base64":"aGVsbG8=","subType":"80"}}`,
+				Relaxed:   `{"$binary":{"base64":"aGVsbG8=","subType":"80"}}`,
+			},
+			{
+				Name:      "Array",
+				Value:     VC.ArrayFromValues(VC.Int32(1), VC.ObjectID(oid)),
+				Canonical: `[{"$numberInt":"1"},{"$oid":"5df67fa01cbe64e51b598f18"}]`,
+				Relaxed:   `[1,{"$oid":"5df67fa01cbe64e51b598f18"}]`,
+			},
+			{
+				Name:      "EscapedKey",
+				Value:     VC.DocumentFromElements(EC.String("a\"b", "c\\d")),
+				Canonical: `{"a\"b":"c\\d"}`,
+				Relaxed:   `{"a\"b":"c\\d"}`,
+			},
+		} {
+			t.Run(test.Name, func(t *testing.T) {
+				for canonical, expected := range map[bool]string{true: test.Canonical, false: test.Relaxed} {
+					out, err := test.Value.MarshalExtJSON(canonical)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(out) != expected {
+						t.Fatalf("canonical=%t: got %s, want %s", canonical, out, expected)
+					}
+				}
+
+				val := &Value{}
+				if err := val.UnmarshalExtJSON([]byte(test.Canonical)); err != nil {
+					t.Fatal(err)
+				}
+				if !val.Equal(test.Value) {
+					t.Fatalf("round trip of %s produced %s", test.Canonical, val.Interface())
+				}
+			})
+		}
+	})
+	t.Run("RelaxedNumbers", func(t *testing.T) {
+		arr := NewArray()
+		if err := arr.UnmarshalExtJSON([]byte(`[1, 2147483648, 1.0, 1e3, 12345678901234567890]`)); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := NewArray(VC.Int32(1), VC.Int64(2147483648), VC.Double(1), VC.Double(1000), VC.Double(12345678901234567890))
+		if !VC.Array(arr).Equal(VC.Array(expected)) {
+			t.Fatalf("got %s", arr)
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		if err := NewArray().UnmarshalExtJSON([]byte(`{"a":1}`)); !errors.Is(err, bsonerr.InvalidExtendedJSON) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := DC.New().UnmarshalExtJSON([]byte(`{"$numberInt":"1"}`)); !errors.Is(err, bsonerr.InvalidExtendedJSON) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if err := DC.New().UnmarshalExtJSON([]byte("{\"a\":\"\xff\"}")); !errors.Is(err, bsonerr.InvalidExtendedJSON) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
@@ -1,7 +1,8 @@
 package birch
 
 import (
-	"time"
+	"encoding/base64"
+	"encoding/hex"
 
 	"github.com/tychoish/birch/bsontype"
 	"github.com/tychoish/birch/jsonx"
@@ -51,12 +52,12 @@ func (v *Value) toJSON() *jsonx.Value {
 	case bsontype.Array:
 		return jsonx.VC.Array(v.MutableArray().toJSON())
 	case bsontype.Binary:
-		t, d := v.Binary()
+		subtype, data := v.Binary()
 
 		return jsonx.VC.ObjectFromElements(
 			jsonx.EC.ObjectFromElements("$binary",
-				jsonx.EC.String("base64", string(t)),
-				jsonx.EC.String("subType", string(d)),
+				jsonx.EC.String("base64", base64.StdEncoding.EncodeToString(data)),
+				jsonx.EC.String("subType", hex.EncodeToString([]byte{subtype})),
 			),
 		)
 	case bsontype.Undefined:
@@ -66,7 +67,7 @@ func (v *Value) toJSON() *jsonx.Value {
 	case bsontype.Boolean:
 		return jsonx.VC.Boolean(v.Boolean())
 	case bsontype.DateTime:
-		return jsonx.VC.ObjectFromElements(jsonx.EC.String("$date", v.Time().Format(time.RFC3339)))
+		return jsonx.VC.ObjectFromElements(jsonx.EC.String("$date", v.Time().Format(extJSONDateFormat)))
 	case bsontype.Null:
 		return jsonx.VC.Nil()
 	case bsontype.Regex:
@@ -270,6 +270,11 @@ func makeValueTestCases(depth int) []jsonValueTestCase {
 			Val:      VC.ObjectID(types.MustObjectIDFromHex("5df67fa01cbe64e51b598f18")),
 			Expected: `{"$oid":"5df67fa01cbe64e51b598f18"}`,
 		},
+		{
+			Name:     "Binary",
+			Val:      VC.BinaryWithSubtype([]byte("hello"), 0x80),
+			Expected: `{"$binary":{"base64":"aGVsbG8=","subType":"80"}}`,
+		},
 		{
 			Name:     "SingleKeyDoc",
 			Val:      VC.Document(DC.Elements(EC.Int("a", 1))),
@@ -2,8 +2,10 @@ package birch
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/tychoish/birch/jsonx"
@@ -253,6 +255,14 @@ func convertJSONElements(ctx context.Context, in *jsonx.Element) (*Element, erro
 
 			return EC.Regex(in.Key(), pattern, options), nil
 		case "$date":
+			if ms, ok := indoc.ElementAtIndex(0).Value().DocumentOK(); ok {
+				val, err := strconv.ParseInt(ms.ElementAtIndex(0).Value().StringValue(), 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("problem parsing date at %q: %w", in.Key(), err)
+				}
+				return EC.DateTime(in.Key(), val), nil
+			}
+
 			date, err := time.Parse(time.RFC3339, indoc.ElementAtIndex(0).Value().StringValue())
 			if err != nil {
 				return nil, err
@@ -268,7 +278,26 @@ func convertJSONElements(ctx context.Context, in *jsonx.Element) (*Element, erro
 		case "$undefined":
 			return EC.Undefined(in.Key()), nil
 		case "$binary":
-			return EC.Binary(in.Key(), []byte(indoc.ElementAtIndex(0).Value().StringValue())), nil
+			var (
+				data    []byte
+				subtype uint64
+				err     error
+			)
+
+			bin := indoc.ElementAtIndex(0).Value().Document()
+			for elem := range bin.Iterator() {
+				switch elem.Key() {
+				case "base64":
+					data, err = base64.StdEncoding.DecodeString(elem.Value().StringValue())
+				case "subType":
+					subtype, err = strconv.ParseUint(elem.Value().StringValue(), 16, 8)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("problem decoding binary at %q: %w", in.Key(), err)
+				}
+			}
+
+			return EC.BinaryWithSubtype(in.Key(), data, byte(subtype)), nil
 		default:
 			doc := DC.Make(indoc.Len())
 
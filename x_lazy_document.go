@@ -0,0 +1,513 @@
+package birch
+
+import (
+	"iter"
+	"strconv"
+	"strings"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// LazyDocument is a document backed by its encoded bytes that decodes
+// elements only when they are used. The first access builds an index of
+// the offsets of the top level elements, without decoding their
+// values; lookups then materialize only the elements that they return.
+// Encoding the document copies the bytes of untouched elements from
+// the original buffer, and only re-encodes elements that callers have
+// accessed or modified.
+//
+// LazyDocument is useful for proxies and readers that inspect or
+// change a few fields of large documents. Like Reader, it does not copy
+// the bytes it is constructed with, and callers must not modify them
+// while the LazyDocument is in use.
+//
+// When the bytes are not a valid document, the first operation that
+// builds the index records the error: lookups do not find any element,
+// modifications have no effect, and the methods that return errors
+// return this error.
+type LazyDocument struct {
+	raw      Reader
+	entries  []lazyEntry
+	indexed  bool
+	modified bool
+	err      error
+}
+
+// lazyEntry records the location of an element in the original
+// document, as the offsets of its type, value and end. Entries for
+// elements that have been returned to callers or added to the document
+// hold the element, and entries for documents or arrays that nested
+// lookups have traversed hold a LazyDocument for the value.
+type lazyEntry struct {
+	start  uint32
+	offset uint32
+	end    uint32
+	elem   *Element
+	child  *LazyDocument
+}
+
+// ReadLazyDocument constructs a LazyDocument from the document at the
+// beginning of b. It only checks the length of the document: the
+// elements are validated as they are indexed, and the values as they
+// are used.
+func ReadLazyDocument(b []byte) (*LazyDocument, error) {
+	if len(b) < 5 {
+		return nil, errTooSmall
+	}
+
+	length := readi32(b[0:4])
+	if length < 5 || int(length) > len(b) {
+		return nil, bsonerr.InvalidLength
+	}
+
+	return &LazyDocument{raw: Reader(b[:length])}, nil
+}
+
+// index builds the offsets of the elements in the document, if it has
+// not been built, and returns the error from building it.
+func (d *LazyDocument) index() error {
+	if d.indexed {
+		return d.err
+	}
+	d.indexed = true
+
+	end := uint32(len(d.raw))
+	pos := uint32(4)
+
+	for {
+		if pos >= end {
+			d.err = bsonerr.InvalidReadOnlyDocument
+			break
+		}
+
+		if d.raw[pos] == '\x00' {
+			if pos != end-1 {
+				d.err = bsonerr.InvalidReadOnlyDocument
+			}
+			break
+		}
+
+		start := pos
+		n, err := d.raw.validateKey(pos+1, end)
+		if err != nil {
+			d.err = err
+			break
+		}
+		pos += 1 + n
+
+		value := Value{start: start, offset: pos, data: d.raw}
+		if n, err = value.validate(true); err != nil {
+			d.err = err
+			break
+		}
+
+		d.entries = append(d.entries, lazyEntry{start: start, offset: pos, end: pos + n})
+		pos += n
+	}
+
+	if d.err != nil {
+		d.entries = nil
+	}
+
+	return d.err
+}
+
+// key returns the key of the entry at idx.
+func (d *LazyDocument) key(idx int) string {
+	ent := &d.entries[idx]
+	if ent.elem != nil {
+		return ent.elem.Key()
+	}
+
+	return string(d.raw[ent.start+1 : ent.offset-1])
+}
+
+// find returns the index of the first entry with the key, or -1.
+func (d *LazyDocument) find(key string) int {
+	if d.index() != nil {
+		return -1
+	}
+
+	for idx := range d.entries {
+		ent := &d.entries[idx]
+		if ent.elem != nil {
+			if ent.elem.Key() == key {
+				return idx
+			}
+			continue
+		}
+
+		if string(d.raw[ent.start+1:ent.offset-1]) == key {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// element materializes the element for the entry at idx. Elements for
+// untouched entries share the document's buffer.
+func (d *LazyDocument) element(idx int) *Element {
+	ent := &d.entries[idx]
+	if ent.elem != nil {
+		return ent.elem
+	}
+
+	if ent.child == nil {
+		ent.elem = newElement(ent.start, ent.offset)
+		ent.elem.value.data = d.raw
+
+		return ent.elem
+	}
+
+	// nested lookups may have materialized, and callers may have
+	// modified, elements of the child, so encode it rather than
+	// using the original bytes.
+	data := append([]byte{}, d.raw[ent.start:ent.offset]...)
+	data, err := ent.child.AppendBSON(data)
+	if err != nil {
+		// the child's elements cannot be encoded, so fall
+		// back to the original bytes of the value.
+		data = d.raw[ent.start:ent.end]
+	}
+
+	ent.elem = newElement(0, ent.offset-ent.start)
+	ent.elem.value.data = data
+	ent.child = nil
+
+	return ent.elem
+}
+
+// untouched reports whether the entry at idx can be encoded by copying
+// its bytes from the original document.
+func (d *LazyDocument) untouched(idx int) bool {
+	ent := &d.entries[idx]
+	if ent.child != nil || ent.end == 0 {
+		return false
+	}
+	if ent.elem == nil {
+		return true
+	}
+
+	// elements returned to callers share the original buffer until
+	// they are modified.
+	v := ent.elem.value
+	return v != nil && v.d == nil && v.start == ent.start && v.offset == ent.offset &&
+		len(v.data) == len(d.raw) && &v.data[0] == &d.raw[0]
+}
+
+// Len returns the number of elements in the document.
+func (d *LazyDocument) Len() int {
+	if d.index() != nil {
+		return 0
+	}
+
+	return len(d.entries)
+}
+
+// Keys returns a sequence of the keys of the elements in the document,
+// without materializing the elements.
+func (d *LazyDocument) Keys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		if d.index() != nil {
+			return
+		}
+
+		for idx := range d.entries {
+			if !yield(d.key(idx)) {
+				return
+			}
+		}
+	}
+}
+
+// Iterator returns a sequence of the elements in the document, which
+// materializes each element. If the document is not valid, the
+// sequence yields only the error.
+func (d *LazyDocument) Iterator() iter.Seq2[*Element, error] {
+	return func(yield func(*Element, error) bool) {
+		if err := d.index(); err != nil {
+			yield(nil, err)
+			return
+		}
+
+		for idx := 0; idx < len(d.entries); idx++ {
+			if !yield(d.element(idx), nil) {
+				return
+			}
+		}
+	}
+}
+
+// LookupElement returns the first element with the key, or nil if the
+// document does not have an element with the key. It is NOT recursive.
+func (d *LazyDocument) LookupElement(key string) *Element {
+	idx := d.find(key)
+	if idx < 0 {
+		return nil
+	}
+
+	return d.element(idx)
+}
+
+// Lookup returns the value of the first element with the key, or nil
+// if the document does not have an element with the key. It is NOT
+// recursive.
+func (d *LazyDocument) Lookup(key string) *Value {
+	elem := d.LookupElement(key)
+	if elem == nil {
+		return nil
+	}
+
+	return elem.value
+}
+
+// LookupElementErr is the same as LookupElement, except it returns an
+// ElementNotFound error when the element does not exist, or the error
+// from indexing an invalid document.
+func (d *LazyDocument) LookupElementErr(key string) (*Element, error) {
+	if err := d.index(); err != nil {
+		return nil, err
+	}
+
+	elem := d.LookupElement(key)
+	if elem == nil {
+		return nil, bsonerr.ElementNotFound
+	}
+
+	return elem, nil
+}
+
+// LookupErr is the same as Lookup, except it returns an
+// ElementNotFound error when the element does not exist, or the error
+// from indexing an invalid document.
+func (d *LazyDocument) LookupErr(key string) (*Value, error) {
+	elem, err := d.LookupElementErr(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return elem.value, nil
+}
+
+// RecursiveLookup searches the document, recursively, for the element
+// at the path of keys, where the intermediate elements must be
+// documents or arrays, as Reader.RecursiveLookup does. The documents
+// along the path are also indexed lazily, and remain indexed, so that
+// repeated lookups do not rescan them, and changes to the returned
+// element are part of the document when it is encoded.
+func (d *LazyDocument) RecursiveLookup(key ...string) (*Element, error) {
+	if len(key) < 1 {
+		return nil, bsonerr.EmptyKey
+	}
+	if err := d.index(); err != nil {
+		return nil, err
+	}
+
+	idx := d.find(key[0])
+	if idx < 0 {
+		return nil, bsonerr.ElementNotFound
+	}
+
+	if len(key) == 1 {
+		return d.element(idx), nil
+	}
+
+	ent := &d.entries[idx]
+	if ent.elem != nil {
+		return recursiveLookupValue(ent.elem.value, key[1:])
+	}
+
+	switch bsontype.Type(d.raw[ent.start]) {
+	case bsontype.EmbeddedDocument, bsontype.Array:
+	default:
+		return nil, bsonerr.InvalidDepthTraversal
+	}
+
+	if ent.child == nil {
+		ent.child = &LazyDocument{raw: d.raw[ent.offset:ent.end]}
+	}
+
+	return ent.child.RecursiveLookup(key[1:]...)
+}
+
+// recursiveLookupValue continues a recursive lookup in the value of a
+// materialized element, through its mutable document or array.
+func recursiveLookupValue(v *Value, key []string) (*Element, error) {
+	for {
+		var elem *Element
+
+		switch v.Type() {
+		case bsontype.EmbeddedDocument:
+			elem = v.MutableDocument().LookupElement(key[0])
+		case bsontype.Array:
+			idx, err := strconv.ParseUint(key[0], 10, 0)
+			if err != nil {
+				return nil, bsonerr.ElementNotFound
+			}
+			elem, _ = v.MutableArray().LookupElemdent(uint(idx))
+		default:
+			return nil, bsonerr.InvalidDepthTraversal
+		}
+
+		if elem == nil {
+			return nil, bsonerr.ElementNotFound
+		}
+		if len(key) == 1 {
+			return elem, nil
+		}
+
+		v, key = elem.value, key[1:]
+	}
+}
+
+// Set replaces the first element with the same key as elem, or appends
+// elem to the document if there is no such element. If a nil element
+// is passed as a parameter this method will panic.
+func (d *LazyDocument) Set(elem *Element) *LazyDocument {
+	if elem == nil {
+		panic(bsonerr.NilElement)
+	}
+
+	idx := d.find(elem.Key())
+	switch {
+	case d.err != nil:
+		return d
+	case idx < 0:
+		d.entries = append(d.entries, lazyEntry{elem: elem})
+	default:
+		d.entries[idx] = lazyEntry{elem: elem}
+	}
+	d.modified = true
+
+	return d
+}
+
+// Append adds each element to the end of the document, in order. If a
+// nil element is passed as a parameter this method will panic.
+func (d *LazyDocument) Append(elems ...*Element) *LazyDocument {
+	if d.index() != nil {
+		return d
+	}
+
+	for _, elem := range elems {
+		if elem == nil {
+			panic(bsonerr.NilElement)
+		}
+
+		d.entries = append(d.entries, lazyEntry{elem: elem})
+	}
+	d.modified = true
+
+	return d
+}
+
+// Delete removes the first element with the key from the document and
+// returns it. If the key does not exist, Delete returns nil.
+func (d *LazyDocument) Delete(key string) *Element {
+	idx := d.find(key)
+	if idx < 0 {
+		return nil
+	}
+
+	elem := d.element(idx)
+	d.entries = append(d.entries[:idx], d.entries[idx+1:]...)
+	d.modified = true
+
+	return elem
+}
+
+// Modified reports whether elements have been added to, replaced in,
+// or removed from the document. It does not detect changes made
+// through elements that lookups returned.
+func (d *LazyDocument) Modified() bool { return d.modified }
+
+// AppendBSON appends the encoded document to dst, copying consecutive
+// untouched elements from the original buffer in single operations.
+func (d *LazyDocument) AppendBSON(dst []byte) ([]byte, error) {
+	if d == nil {
+		return dst, bsonerr.NilDocument
+	}
+	if !d.indexed {
+		return append(dst, d.raw...), nil
+	}
+	if d.err != nil {
+		return dst, d.err
+	}
+
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+
+	var (
+		runStart uint32
+		runEnd   uint32
+		err      error
+	)
+
+	for idx := range d.entries {
+		ent := &d.entries[idx]
+		if d.untouched(idx) {
+			if ent.start != runEnd {
+				dst = append(dst, d.raw[runStart:runEnd]...)
+				runStart = ent.start
+			}
+			runEnd = ent.end
+			continue
+		}
+
+		dst = append(dst, d.raw[runStart:runEnd]...)
+		runStart, runEnd = 0, 0
+
+		if ent.child != nil {
+			dst = append(dst, d.raw[ent.start:ent.offset]...)
+			dst, err = ent.child.AppendBSON(dst)
+		} else {
+			dst, err = ent.elem.AppendBSON(dst)
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+
+	dst = append(dst, d.raw[runStart:runEnd]...)
+	dst = append(dst, 0x00)
+	putLength(dst, start)
+
+	return dst, nil
+}
+
+// MarshalBSON implements the Marshaler interface.
+func (d *LazyDocument) MarshalBSON() ([]byte, error) { return d.AppendBSON(nil) }
+
+// MarshalDocument implements the DocumentMarshaler interface, decoding
+// the entire document.
+func (d *LazyDocument) MarshalDocument() (*Document, error) {
+	out, err := d.AppendBSON(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadDocument(out)
+}
+
+// Validate validates the entire document, including the values that
+// have not been used, and returns its size.
+func (d *LazyDocument) Validate() (uint32, error) {
+	out, err := d.AppendBSON(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return Reader(out).Validate()
+}
+
+// String implements the fmt.Stringer interface.
+func (d *LazyDocument) String() string {
+	out, err := d.AppendBSON(nil)
+	if err != nil {
+		return "bson.LazyDocument{<invalid>}"
+	}
+
+	return "bson.LazyDocument" + strings.TrimPrefix(Reader(out).String(), "bson.Reader")
+}
@@ -0,0 +1,304 @@
+package birch
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/tychoish/birch/bsonerr"
+)
+
+func TestLazyDocument(t *testing.T) {
+	doc := DC.Elements(
+		EC.String("a", "first"),
+		EC.SubDocumentFromElements("b",
+			EC.Int32("c", 1),
+			EC.ArrayFromElements("d", VC.String("x"), VC.DocumentFromElements(EC.Int64("e", 2))),
+		),
+		EC.Boolean("f", true),
+		EC.Double("g", 4.5),
+	)
+	data, err := doc.MarshalBSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(t *testing.T) *LazyDocument {
+		t.Helper()
+
+		lazy, err := ReadLazyDocument(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lazy
+	}
+	check := func(t *testing.T, lazy *LazyDocument, expected *Document) {
+		t.Helper()
+
+		out, err := lazy.MarshalBSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := expected.MarshalBSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, want) {
+			t.Fatalf("got %s, expected %s", Reader(out), expected)
+		}
+	}
+	materialized := func(lazy *LazyDocument) int {
+		var count int
+		for _, ent := range lazy.entries {
+			if ent.elem != nil {
+				count++
+			}
+		}
+		return count
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		for _, test := range makeDocumentTestCases(0) {
+			t.Run(test.Name, func(t *testing.T) {
+				expected, err := test.Doc.MarshalBSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				lazy, err := ReadLazyDocument(append(expected, 0xff))
+				if err != nil {
+					t.Fatal(err)
+				}
+				out, err := lazy.MarshalBSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out, expected) {
+					t.Fatalf("got %X, expected %X", out, expected)
+				}
+
+				if lazy.Len() != test.Doc.Len() {
+					t.Fatalf("got %d elements, expected %d", lazy.Len(), test.Doc.Len())
+				}
+
+				// after materializing every element, the
+				// document is still encoded from its bytes.
+				for elem, err := range lazy.Iterator() {
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !elem.Equal(test.Doc.LookupElement(elem.Key())) {
+						t.Fatalf("element %q does not match", elem.Key())
+					}
+				}
+				out, err = lazy.MarshalBSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out, expected) {
+					t.Fatalf("got %X, expected %X", out, expected)
+				}
+
+				parsed, err := lazy.MarshalDocument()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !VC.Document(parsed).Equal(VC.Document(test.Doc)) {
+					t.Fatalf("got %s, expected %s", parsed, test.Doc)
+				}
+			})
+		}
+	})
+	t.Run("Lookup", func(t *testing.T) {
+		lazy := read(t)
+
+		if lazy.entries != nil {
+			t.Fatal("document should not be indexed before access")
+		}
+		if v := lazy.Lookup("f"); v == nil || !v.Boolean() {
+			t.Fatalf("unexpected value %v", v)
+		}
+		if materialized(lazy) != 1 {
+			t.Fatalf("materialized %d elements", materialized(lazy))
+		}
+
+		if lazy.Lookup("missing") != nil {
+			t.Fatal("found missing key")
+		}
+		if _, err := lazy.LookupErr("missing"); !errors.Is(err, bsonerr.ElementNotFound) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if elem, err := lazy.LookupElementErr("g"); err != nil || elem.Value().Double() != 4.5 {
+			t.Fatalf("unexpected element %v (%v)", elem, err)
+		}
+
+		keys := slices.Collect(lazy.Keys())
+		if !slices.Equal(keys, []string{"a", "b", "f", "g"}) {
+			t.Fatalf("unexpected keys %v", keys)
+		}
+		if materialized(lazy) != 2 {
+			t.Fatalf("materialized %d elements", materialized(lazy))
+		}
+	})
+	t.Run("RecursiveLookup", func(t *testing.T) {
+		lazy := read(t)
+
+		elem, err := lazy.RecursiveLookup("b", "d", "1", "e")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elem.Value().Int64() != 2 {
+			t.Fatalf("unexpected element %s", elem)
+		}
+		if materialized(lazy) != 0 {
+			t.Fatal("intermediate documents should not be materialized")
+		}
+
+		expected, err := Reader(data).RecursiveLookup("b", "d", "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elem, err = lazy.RecursiveLookup("b", "d", "0"); err != nil || !elem.Equal(expected) {
+			t.Fatalf("unexpected element %v (%v)", elem, err)
+		}
+
+		for _, test := range []struct {
+			keys []string
+			err  error
+		}{
+			{keys: nil, err: bsonerr.EmptyKey},
+			{keys: []string{"missing"}, err: bsonerr.ElementNotFound},
+			{keys: []string{"b", "missing"}, err: bsonerr.ElementNotFound},
+			{keys: []string{"a", "b"}, err: bsonerr.InvalidDepthTraversal},
+			{keys: []string{"b", "c", "d"}, err: bsonerr.InvalidDepthTraversal},
+		} {
+			if _, err := lazy.RecursiveLookup(test.keys...); !errors.Is(err, test.err) {
+				t.Fatalf("%v: unexpected error %v", test.keys, err)
+			}
+		}
+
+		// lookups through materialized elements use their
+		// mutable documents.
+		lazy = read(t)
+		lazy.Lookup("b").MutableDocument().Set(EC.Int32("c", 10))
+		if elem, err = lazy.RecursiveLookup("b", "c"); err != nil || elem.Value().Int32() != 10 {
+			t.Fatalf("unexpected element %v (%v)", elem, err)
+		}
+		if elem, err = lazy.RecursiveLookup("b", "d", "1", "e"); err != nil || elem.Value().Int64() != 2 {
+			t.Fatalf("unexpected element %v (%v)", elem, err)
+		}
+		if _, err = lazy.RecursiveLookup("b", "d", "x"); !errors.Is(err, bsonerr.ElementNotFound) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("Modify", func(t *testing.T) {
+		lazy := read(t)
+		lazy.Set(EC.Int32("f", 5)).Append(EC.String("h", "last"))
+		if lazy.Delete("a") == nil {
+			t.Fatal("expected deleted element")
+		}
+		if lazy.Delete("missing") != nil {
+			t.Fatal("deleted missing key")
+		}
+		if !lazy.Modified() {
+			t.Fatal("document should be modified")
+		}
+
+		expected := doc.Copy()
+		expected.Set(EC.Int32("f", 5)).Append(EC.String("h", "last"))
+		expected.Delete("a")
+		check(t, lazy, expected)
+
+		if lazy.Len() != 4 {
+			t.Fatalf("got %d elements", lazy.Len())
+		}
+	})
+	t.Run("ModifyNested", func(t *testing.T) {
+		lazy := read(t)
+
+		// changes through elements returned by lookups are
+		// encoded, including those nested in documents that
+		// the lazy document has not materialized.
+		lazy.Lookup("b").MutableDocument().Set(EC.Int32("c", 10))
+		check(t, lazy, DC.Elements(
+			EC.String("a", "first"),
+			EC.SubDocumentFromElements("b",
+				EC.Int32("c", 10),
+				EC.ArrayFromElements("d", VC.String("x"), VC.DocumentFromElements(EC.Int64("e", 2))),
+			),
+			EC.Boolean("f", true),
+			EC.Double("g", 4.5),
+		))
+
+		lazy = read(t)
+		elem, err := lazy.RecursiveLookup("b", "d", "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		elem.Value().MutableDocument().Append(EC.Null("n"))
+
+		expected := DC.Elements(
+			EC.String("a", "first"),
+			EC.SubDocumentFromElements("b",
+				EC.Int32("c", 1),
+				EC.ArrayFromElements("d", VC.String("x"), VC.DocumentFromElements(EC.Int64("e", 2), EC.Null("n"))),
+			),
+			EC.Boolean("f", true),
+			EC.Double("g", 4.5),
+		)
+		check(t, lazy, expected)
+
+		// materializing the parent keeps the nested changes.
+		if v := lazy.Lookup("b"); v.MutableDocument().Len() != 2 {
+			t.Fatalf("unexpected document %v", v)
+		}
+		check(t, lazy, expected)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		for _, b := range [][]byte{nil, {0x05, 0x00, 0x00}, {0x06, 0x00, 0x00, 0x00, 0x00}, {0x04, 0x00, 0x00, 0x00, 0x00}} {
+			if _, err := ReadLazyDocument(b); err == nil {
+				t.Fatalf("expected error for %X", b)
+			}
+		}
+
+		// a string element whose length runs past the end of the
+		// document.
+		invalid := []byte{0x0d, 0x00, 0x00, 0x00, 0x02, 'a', 0x00, 0x10, 0x00, 0x00, 0x00, 'b', 0x00}
+		lazy, err := ReadLazyDocument(invalid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lazy.Len() != 0 || lazy.Lookup("a") != nil {
+			t.Fatal("invalid documents should not have elements")
+		}
+		if _, err := lazy.LookupErr("a"); err == nil || errors.Is(err, bsonerr.ElementNotFound) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if _, err := lazy.MarshalBSON(); err == nil {
+			t.Fatal("expected error encoding invalid document")
+		}
+		if _, err := lazy.Validate(); err == nil {
+			t.Fatal("expected error validating invalid document")
+		}
+
+		// values are not validated until they are used.
+		nested := DC.Elements(EC.SubDocumentFromElements("a", EC.String("b", "c")))
+		out, err := nested.MarshalBSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the length of the nested string runs past the end of
+		// its document.
+		out[14] = 0x10
+		if lazy, err = ReadLazyDocument(out); err != nil {
+			t.Fatal(err)
+		}
+		if lazy.Len() != 1 {
+			t.Fatal("expected to index the top level element")
+		}
+		if _, err := lazy.Validate(); err == nil {
+			t.Fatal("expected error validating invalid value")
+		}
+	})
+}
@@ -0,0 +1,260 @@
+package birch
+
+import (
+	"strconv"
+
+	"github.com/tychoish/birch/bsontype"
+)
+
+// ArrayMergeStrategy determines how Merge combines an array in the
+// document with an array in the overlay.
+type ArrayMergeStrategy int
+
+const (
+	// ArrayReplace replaces the array with the overlay array.
+	ArrayReplace ArrayMergeStrategy = iota
+	// ArrayAppend appends the values of the overlay array to the
+	// array.
+	ArrayAppend
+	// ArrayUnion appends the values of the overlay array that are not
+	// already in the array. When MergeOptions.UnionKey is set,
+	// documents in the overlay array that have the same value for the
+	// key as a document in the array are merged into that document.
+	ArrayUnion
+)
+
+// MergeOptions control how Merge combines documents. The zero value
+// merges embedded documents recursively, and replaces all other
+// values, including arrays, with the values in the overlay.
+type MergeOptions struct {
+	Arrays ArrayMergeStrategy
+	// UnionKey is the key that identifies documents in arrays merged
+	// with ArrayUnion. When empty, values are only compared as a
+	// whole.
+	UnionKey string
+	// NullDeletes removes keys whose value in the overlay is null,
+	// rather than setting them to null, as in RFC 7396 (JSON Merge
+	// Patch).
+	NullDeletes bool
+	// OnConflict, when set, is called for each value that the overlay
+	// would replace with a different value, and returns the value to
+	// keep: the current value, the overlay value or another value.
+	// When it returns an error, Merge returns a *PathError that wraps
+	// it, and does not modify the document. Values that are merged
+	// (documents, and arrays with ArrayAppend or ArrayUnion), or that
+	// are deleted with NullDeletes, are not conflicts.
+	OnConflict func(path Path, current, overlay *Value) (*Value, error)
+}
+
+// Merge combines the overlay document into the document: keys that
+// are only in the overlay are added, in order, after the existing
+// keys, embedded documents in both are merged recursively, and other
+// values are combined as determined by the options. Unlike Extend,
+// Merge never produces duplicate keys. The document does not share
+// storage with the overlay after the merge.
+func (d *Document) Merge(overlay *Document, opts MergeOptions) error {
+	out, err := cloneDocument(d)
+	if err != nil {
+		return err
+	}
+
+	src, err := cloneDocument(overlay)
+	if err != nil {
+		return err
+	}
+
+	if err = opts.mergeDocuments(nil, out, src); err != nil {
+		return err
+	}
+
+	d.elems = out.elems
+	d.cacheValid = false
+
+	return nil
+}
+
+// MergePatch applies the patch to the document as an RFC 7396 JSON
+// Merge Patch: keys with null values are removed, embedded documents
+// are merged recursively, and all other values are replaced.
+func (d *Document) MergePatch(patch *Document) error {
+	return d.Merge(patch, MergeOptions{NullDeletes: true})
+}
+
+// MergeValue returns the result of merging the overlay value into the
+// current value, at the path, as Merge does for each key of the
+// overlay. The current value is nil when the key does not exist, and
+// the result is nil when the key should be removed. Neither value is
+// modified.
+func (opts MergeOptions) MergeValue(path Path, current, overlay *Value) (*Value, error) {
+	var err error
+
+	if current != nil {
+		if current, err = cloneValue(current); err != nil {
+			return nil, err
+		}
+	}
+	if overlay, err = cloneValue(overlay); err != nil {
+		return nil, err
+	}
+
+	return opts.mergeValue(path, current, overlay)
+}
+
+func (opts MergeOptions) mergeDocuments(path Path, d, overlay *Document) error {
+	for _, elem := range overlay.elems {
+		key := elem.Key()
+
+		var current *Value
+		if existing := d.LookupElement(key); existing != nil {
+			current = existing.value
+		}
+
+		out, err := opts.mergeValue(patchPath(path, key), current, elem.value)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case out == nil && current != nil:
+			d.Delete(key)
+		case out != nil && out != current:
+			d.Set(EC.Value(key, out))
+		}
+	}
+
+	return nil
+}
+
+// mergeValue merges the values, modifying the current value in place
+// when it is a document or array.
+func (opts MergeOptions) mergeValue(path Path, current, overlay *Value) (*Value, error) {
+	if opts.NullDeletes && overlay.Type() == bsontype.Null {
+		return nil, nil
+	}
+	if current == nil {
+		return opts.prune(overlay), nil
+	}
+
+	switch {
+	case current.Type() == bsontype.EmbeddedDocument && overlay.Type() == bsontype.EmbeddedDocument:
+		return current, opts.mergeDocuments(path, current.MutableDocument(), overlay.MutableDocument())
+	case current.Type() == bsontype.Array && overlay.Type() == bsontype.Array && opts.Arrays != ArrayReplace:
+		return current, opts.mergeArrays(path, current.MutableArray(), overlay.MutableArray())
+	case current.Equal(overlay):
+		return current, nil
+	case opts.OnConflict != nil:
+		out, err := opts.OnConflict(path, current, overlay)
+		if err != nil {
+			return nil, &PathError{Path: path, Depth: len(path), Type: current.Type(), Err: err}
+		}
+		return out, nil
+	default:
+		return opts.prune(overlay), nil
+	}
+}
+
+func (opts MergeOptions) mergeArrays(path Path, current, overlay *Array) error {
+	if opts.Arrays == ArrayAppend {
+		for _, elem := range overlay.doc.elems {
+			current.Append(opts.prune(elem.value))
+		}
+		return nil
+	}
+
+	for _, elem := range overlay.doc.elems {
+		idx := opts.unionIndex(current, elem.value)
+		if idx < 0 {
+			current.Append(opts.prune(elem.value))
+			continue
+		}
+
+		existing := current.doc.elems[idx].value
+		if existing.Type() != bsontype.EmbeddedDocument || elem.value.Type() != bsontype.EmbeddedDocument {
+			continue
+		}
+
+		if _, err := opts.mergeValue(patchPath(path, strconv.Itoa(idx)), existing, elem.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unionIndex returns the index of the value in the array that
+// matches the overlay value, or -1 if there is none. Documents match
+// on the value of UnionKey, when it is set, and all other values must
+// be equal.
+func (opts MergeOptions) unionIndex(arr *Array, v *Value) int {
+	var key *Value
+	if doc, ok := v.MutableDocumentOK(); ok && opts.UnionKey != "" {
+		if elem := doc.LookupElement(opts.UnionKey); elem != nil {
+			key = elem.value
+		}
+	}
+
+	for idx, elem := range arr.doc.elems {
+		if key == nil {
+			if Compare(elem.value, v) == 0 {
+				return idx
+			}
+			continue
+		}
+
+		doc, ok := elem.value.MutableDocumentOK()
+		if !ok {
+			continue
+		}
+		if other := doc.LookupElement(opts.UnionKey); other != nil && Compare(other.value, key) == 0 {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// prune removes keys with null values from documents in a value that
+// is added to the document, when NullDeletes is set, since they have
+// no existing value to remove.
+func (opts MergeOptions) prune(v *Value) *Value {
+	doc, ok := v.MutableDocumentOK()
+	if !opts.NullDeletes || !ok {
+		return v
+	}
+
+	elems := doc.elems[:0]
+	for _, elem := range doc.elems {
+		if elem.value.Type() == bsontype.Null {
+			continue
+		}
+		opts.prune(elem.value)
+		elems = append(elems, elem)
+	}
+	clear(doc.elems[len(elems):])
+	doc.elems = elems
+	doc.cacheValid = false
+
+	return v
+}
+
+// cloneDocument returns a copy of the document that does not share
+// storage with it.
+func cloneDocument(d *Document) (*Document, error) {
+	data, err := d.MarshalBSON()
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadDocument(data)
+}
+
+// cloneValue returns a copy of the value that does not share storage
+// with it.
+func cloneValue(v *Value) (*Value, error) {
+	doc, err := cloneDocument(DC.Elements(EC.Value("v", v)))
+	if err != nil {
+		return nil, err
+	}
+
+	return doc.elems[0].value, nil
+}
@@ -0,0 +1,235 @@
+package birch
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tychoish/birch/bsonerr"
+)
+
+func TestMerge(t *testing.T) {
+	defaults := func() *Document {
+		return DC.Elements(
+			EC.String("name", "service"),
+			EC.SubDocumentFromElements("server",
+				EC.String("host", "localhost"),
+				EC.Int32("port", 8080),
+				EC.SubDocumentFromElements("tls", EC.Boolean("enabled", false)),
+			),
+			EC.ArrayFromElements("tags", VC.String("a"), VC.String("b")),
+			EC.ArrayFromElements("users",
+				VC.DocumentFromElements(EC.String("name", "admin"), EC.String("role", "all")),
+				VC.DocumentFromElements(EC.String("name", "guest"), EC.String("role", "read")),
+			),
+		)
+	}
+	overlay := func() *Document {
+		return DC.Elements(
+			EC.SubDocumentFromElements("server",
+				EC.Int32("port", 9090),
+				EC.SubDocumentFromElements("tls", EC.Boolean("enabled", true), EC.String("cert", "x.pem")),
+			),
+			EC.ArrayFromElements("tags", VC.String("b"), VC.String("c")),
+			EC.ArrayFromElements("users",
+				VC.DocumentFromElements(EC.String("name", "guest"), EC.String("role", "none")),
+				VC.DocumentFromElements(EC.String("name", "ops"), EC.String("role", "write")),
+			),
+			EC.Null("name"),
+			EC.String("env", "prod"),
+		)
+	}
+	server := EC.SubDocumentFromElements("server",
+		EC.String("host", "localhost"),
+		EC.Int32("port", 9090),
+		EC.SubDocumentFromElements("tls", EC.Boolean("enabled", true), EC.String("cert", "x.pem")),
+	)
+
+	for _, test := range []struct {
+		name     string
+		opts     MergeOptions
+		expected *Document
+	}{
+		{
+			name: "Default",
+			expected: DC.Elements(
+				EC.Null("name"),
+				server,
+				EC.ArrayFromElements("tags", VC.String("b"), VC.String("c")),
+				EC.ArrayFromElements("users",
+					VC.DocumentFromElements(EC.String("name", "guest"), EC.String("role", "none")),
+					VC.DocumentFromElements(EC.String("name", "ops"), EC.String("role", "write")),
+				),
+				EC.String("env", "prod"),
+			),
+		},
+		{
+			name: "Append",
+			opts: MergeOptions{Arrays: ArrayAppend, NullDeletes: true},
+			expected: DC.Elements(
+				server,
+				EC.ArrayFromElements("tags", VC.String("a"), VC.String("b"), VC.String("b"), VC.String("c")),
+				EC.ArrayFromElements("users",
+					VC.DocumentFromElements(EC.String("name", "admin"), EC.String("role", "all")),
+					VC.DocumentFromElements(EC.String("name", "guest"), EC.String("role", "read")),
+					VC.DocumentFromElements(EC.String("name", "guest"), EC.String("role", "none")),
+					VC.DocumentFromElements(EC.String("name", "ops"), EC.String("role", "write")),
+				),
+				EC.String("env", "prod"),
+			),
+		},
+		{
+			name: "Union",
+			opts: MergeOptions{Arrays: ArrayUnion},
+			expected: DC.Elements(
+				EC.Null("name"),
+				server,
+				EC.ArrayFromElements("tags", VC.String("a"), VC.String("b"), VC.String("c")),
+				EC.ArrayFromElements("users",
+					VC.DocumentFromElements(EC.String("name", "admin"), EC.String("role", "all")),
+					VC.DocumentFromElements(EC.String("name", "guest"), EC.String("role", "read")),
+					VC.DocumentFromElements(EC.String("name", "guest"), EC.String("role", "none")),
+					VC.DocumentFromElements(EC.String("name", "ops"), EC.String("role", "write")),
+				),
+				EC.String("env", "prod"),
+			),
+		},
+		{
+			name: "UnionKey",
+			opts: MergeOptions{Arrays: ArrayUnion, UnionKey: "name", NullDeletes: true},
+			expected: DC.Elements(
+				server,
+				EC.ArrayFromElements("tags", VC.String("a"), VC.String("b"), VC.String("c")),
+				EC.ArrayFromElements("users",
+					VC.DocumentFromElements(EC.String("name", "admin"), EC.String("role", "all")),
+					VC.DocumentFromElements(EC.String("name", "guest"), EC.String("role", "none")),
+					VC.DocumentFromElements(EC.String("name", "ops"), EC.String("role", "write")),
+				),
+				EC.String("env", "prod"),
+			),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			doc := defaults()
+			if err := doc.Merge(overlay(), test.opts); err != nil {
+				t.Fatal(err)
+			}
+			if doc.String() != test.expected.String() {
+				t.Fatalf("got %s, expected %s", doc, test.expected)
+			}
+		})
+	}
+	t.Run("MergePatch", func(t *testing.T) {
+		// the example from RFC 7396, section 3.
+		doc := DC.Elements(
+			EC.String("title", "Goodbye!"),
+			EC.SubDocumentFromElements("author", EC.String("givenName", "John"), EC.String("familyName", "Doe")),
+			EC.ArrayFromElements("tags", VC.String("example"), VC.String("sample")),
+			EC.String("content", "This will be unchanged"),
+		)
+		patch := DC.Elements(
+			EC.String("title", "Hello!"),
+			EC.String("phoneNumber", "+01-123-456-7890"),
+			EC.SubDocumentFromElements("author", EC.Null("familyName")),
+			EC.ArrayFromElements("tags", VC.String("example")),
+		)
+		expected := DC.Elements(
+			EC.String("title", "Hello!"),
+			EC.SubDocumentFromElements("author", EC.String("givenName", "John")),
+			EC.ArrayFromElements("tags", VC.String("example")),
+			EC.String("content", "This will be unchanged"),
+			EC.String("phoneNumber", "+01-123-456-7890"),
+		)
+
+		if err := doc.MergePatch(patch); err != nil {
+			t.Fatal(err)
+		}
+		if doc.String() != expected.String() {
+			t.Fatalf("got %s, expected %s", doc, expected)
+		}
+	})
+	t.Run("PruneNulls", func(t *testing.T) {
+		doc := DC.Elements(EC.String("a", "x"))
+		patch := DC.Elements(
+			EC.SubDocumentFromElements("a", EC.Null("b"), EC.Int32("c", 1)),
+			EC.SubDocumentFromElements("d", EC.SubDocumentFromElements("e", EC.Null("f"))),
+			EC.Null("g"),
+		)
+		expected := DC.Elements(
+			EC.SubDocumentFromElements("a", EC.Int32("c", 1)),
+			EC.SubDocumentFromElements("d", EC.SubDocument("e", DC.New())),
+		)
+
+		if err := doc.MergePatch(patch); err != nil {
+			t.Fatal(err)
+		}
+		if doc.String() != expected.String() {
+			t.Fatalf("got %s, expected %s", doc, expected)
+		}
+	})
+	t.Run("Conflicts", func(t *testing.T) {
+		var conflicts []string
+		keep := MergeOptions{OnConflict: func(path Path, current, _ *Value) (*Value, error) {
+			conflicts = append(conflicts, path.String())
+			return current, nil
+		}}
+
+		doc := defaults()
+		if err := doc.Merge(overlay(), keep); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"server.port", "server.tls.enabled", "tags", "users", "name"}
+		if len(conflicts) != len(expected) {
+			t.Fatalf("got %v, expected %v", conflicts, expected)
+		}
+		for idx := range expected {
+			if conflicts[idx] != expected[idx] {
+				t.Fatalf("got %v, expected %v", conflicts, expected)
+			}
+		}
+		if doc.Lookup("server").MutableDocument().Lookup("port").Int32() != 8080 || doc.Lookup("name").StringValue() != "service" {
+			t.Fatalf("unexpected document %s", doc)
+		}
+		if doc.Lookup("env").StringValue() != "prod" {
+			t.Fatalf("unexpected document %s", doc)
+		}
+	})
+	t.Run("ConflictError", func(t *testing.T) {
+		fail := MergeOptions{OnConflict: func(Path, *Value, *Value) (*Value, error) { return nil, bsonerr.DuplicateKey }}
+
+		doc := defaults()
+		before := doc.String()
+		err := doc.Merge(overlay(), fail)
+
+		var pathErr *PathError
+		if !errors.As(err, &pathErr) || !errors.Is(err, bsonerr.DuplicateKey) || pathErr.Path.String() != "server.port" {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if doc.String() != before {
+			t.Fatalf("document modified: %s", doc)
+		}
+	})
+	t.Run("NoSharedStorage", func(t *testing.T) {
+		doc := DC.New()
+		src := overlay()
+		if err := doc.Merge(src, MergeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		doc.Lookup("server").MutableDocument().Lookup("tls").MutableDocument().Set(EC.Boolean("enabled", false))
+		if !src.Lookup("server").MutableDocument().Lookup("tls").MutableDocument().Lookup("enabled").Boolean() {
+			t.Fatalf("overlay modified: %s", src)
+		}
+	})
+	t.Run("MergeValue", func(t *testing.T) {
+		current := VC.DocumentFromElements(EC.Int32("a", 1))
+		out, err := MergeOptions{}.MergeValue(Path{"x"}, current, VC.DocumentFromElements(EC.Int32("b", 2)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.MutableDocument().Len() != 2 || current.MutableDocument().Len() != 1 {
+			t.Fatalf("unexpected values %v and %v", out, current)
+		}
+		if out, err = (MergeOptions{NullDeletes: true}).MergeValue(Path{"x"}, current, VC.Null()); err != nil || out != nil {
+			t.Fatalf("unexpected value %v (%v)", out, err)
+		}
+	})
+}
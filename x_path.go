@@ -0,0 +1,345 @@
+package birch
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+)
+
+// maxArrayPadding is the largest number of null values that the path
+// methods will add to an array to reach an index, which is the same
+// limit that MongoDB uses.
+const maxArrayPadding = 1500000
+
+// Path identifies a nested value in a document as a sequence of keys,
+// where keys into arrays are (non-negative) numeric indexes.
+type Path []string
+
+// ParsePath splits a dotted path (e.g. "a.b.3.c") into its keys.
+func ParsePath(path string) Path {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// String returns the dotted form of the path.
+func (p Path) String() string { return strings.Join(p, ".") }
+
+// PathError is returned by the path methods when a path cannot be
+// resolved. Depth is the number of keys in the path that were
+// resolved before the error, and Type is the type of the value at
+// that point in the path.
+type PathError struct {
+	Path  Path
+	Depth int
+	Type  bsontype.Type
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *PathError) Error() string {
+	if e.Depth == 0 {
+		return fmt.Sprintf("invalid path %q: %v", e.Path.String(), e.Err)
+	}
+	return fmt.Sprintf("invalid path %q at %q (%s): %v", e.Path.String(), e.Path[:e.Depth].String(), e.Type, e.Err)
+}
+
+// Unwrap returns the underlying cause of the error.
+func (e *PathError) Unwrap() error { return e.Err }
+
+// LookupPath returns the value at the path, or nil if there is no
+// value at the path. Paths that run through values that are neither
+// documents nor arrays return a *PathError.
+func (d *Document) LookupPath(path Path) (*Value, error) {
+	parent, err := d.resolvePath(path, false)
+	if err != nil || parent == nil {
+		return nil, err
+	}
+
+	return parent.get(path)
+}
+
+// SetPath sets the value at the path, replacing any existing value.
+// Missing intermediate documents are created, and setting an index
+// past the end of an array pads the array with null values, as in
+// MongoDB. Paths that run through values that are neither documents
+// nor arrays return a *PathError.
+func (d *Document) SetPath(path Path, value *Value) error {
+	return d.UpsertPath(path, func(*Value) (*Value, error) { return value, nil })
+}
+
+// UpsertPath calls the function with the current value at the path,
+// or nil if there is no value, and stores the value that it returns
+// in the same way as SetPath. If the function returns an error, the
+// document is not modified.
+func (d *Document) UpsertPath(path Path, fn func(*Value) (*Value, error)) error {
+	parent, err := d.resolvePath(path, false)
+	if err != nil {
+		return err
+	}
+
+	var current *Value
+	if parent != nil {
+		current, err = parent.get(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	value, err := fn(current)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return &PathError{Path: path, Depth: len(path), Err: bsonerr.NilElement}
+	}
+
+	if parent == nil {
+		if parent, err = d.resolvePath(path, true); err != nil {
+			return err
+		}
+	}
+
+	return parent.set(path, value)
+}
+
+// DeletePath removes the value at the path and returns the removed
+// element, or nil if there was no value at the path. As in MongoDB,
+// deleting an element of an array replaces it with null rather than
+// shifting the remaining elements.
+func (d *Document) DeletePath(path Path) (*Element, error) {
+	parent, err := d.resolvePath(path, false)
+	if err != nil || parent == nil {
+		return nil, err
+	}
+
+	return parent.delete(path)
+}
+
+// IncrementPath adds the numeric value delta to the value at the path,
+// and returns the result. When there is no value at the path, delta is
+// stored. Int32 values that overflow are promoted to Int64, and any
+// operation involving a Double produces a Double. Incrementing a
+// non-numeric value returns an error that wraps bsonerr.NonNumeric.
+func (d *Document) IncrementPath(path Path, delta *Value) (*Value, error) {
+	var out *Value
+	err := d.UpsertPath(path, func(current *Value) (*Value, error) {
+		if !isNumeric(delta) {
+			return nil, &PathError{Path: path, Depth: len(path), Type: delta.Type(), Err: bsonerr.NonNumeric}
+		}
+		if current == nil {
+			out = delta
+			return delta, nil
+		}
+		if !isNumeric(current) {
+			return nil, &PathError{Path: path, Depth: len(path), Type: current.Type(), Err: bsonerr.NonNumeric}
+		}
+
+		var err error
+		if out, err = addNumeric(current, delta); err != nil {
+			return nil, &PathError{Path: path, Depth: len(path), Type: current.Type(), Err: err}
+		}
+		return out, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// pathParent is the document or array that contains the last key of
+// a path.
+type pathParent struct {
+	doc *Document
+	arr *Array
+}
+
+// resolvePath walks all but the last key of the path. When create is
+// false, and a key is missing, both the parent and error are nil.
+func (d *Document) resolvePath(path Path, create bool) (*pathParent, error) {
+	return (&pathParent{doc: d}).resolve(path, create)
+}
+
+// resolve walks all but the last key of the path, starting from the
+// document or array p, in the same manner as resolvePath.
+func (p *pathParent) resolve(path Path, create bool) (*pathParent, error) {
+	if len(path) == 0 {
+		return nil, &PathError{Path: path, Err: bsonerr.EmptyKey}
+	}
+	for idx, key := range path {
+		if key == "" {
+			return nil, &PathError{Path: path, Depth: idx, Err: bsonerr.EmptyKey}
+		}
+	}
+
+	parent := &pathParent{doc: p.doc, arr: p.arr}
+
+	for depth, key := range path[:len(path)-1] {
+		var next *Value
+
+		if parent.doc != nil {
+			elem := parent.doc.findElemForKey(key)
+			if elem == nil {
+				if !create {
+					return nil, nil
+				}
+				child := DC.New()
+				parent.doc.Append(EC.SubDocument(key, child))
+				parent.doc = child
+				continue
+			}
+			next = elem.value
+		} else {
+			index, err := parent.index(path, depth)
+			if err != nil {
+				return nil, err
+			}
+			if index >= parent.arr.Len() {
+				if !create {
+					return nil, nil
+				}
+				child := DC.New()
+				parent.arr.pad(index)
+				parent.arr.Append(VC.Document(child))
+				parent.doc, parent.arr = child, nil
+				continue
+			}
+			next = parent.arr.doc.elems[index].value
+		}
+
+		switch next.Type() {
+		case bsontype.EmbeddedDocument:
+			parent.doc, parent.arr = next.MutableDocument(), nil
+		case bsontype.Array:
+			parent.doc, parent.arr = nil, next.MutableArray()
+		default:
+			return nil, &PathError{Path: path, Depth: depth + 1, Type: next.Type(), Err: bsonerr.InvalidDepthTraversal}
+		}
+	}
+
+	return parent, nil
+}
+
+// index parses the key at depth as an index into the parent array.
+func (p *pathParent) index(path Path, depth int) (int, error) {
+	index, err := strconv.ParseUint(path[depth], 10, 0)
+	if err != nil {
+		return 0, &PathError{Path: path, Depth: depth, Type: bsontype.Array, Err: bsonerr.InvalidArrayKey}
+	}
+
+	if index > uint64(p.arr.Len()+maxArrayPadding) || index > math.MaxInt32 {
+		return 0, &PathError{Path: path, Depth: depth, Type: bsontype.Array, Err: bsonerr.OutOfBounds}
+	}
+
+	return int(index), nil
+}
+
+func (p *pathParent) get(path Path) (*Value, error) {
+	key := path[len(path)-1]
+	if p.doc != nil {
+		if elem := p.doc.findElemForKey(key); elem != nil {
+			return elem.value, nil
+		}
+		return nil, nil
+	}
+
+	index, err := p.index(path, len(path)-1)
+	if err != nil {
+		return nil, err
+	}
+	if index >= p.arr.Len() {
+		return nil, nil
+	}
+
+	return p.arr.doc.elems[index].value, nil
+}
+
+func (p *pathParent) set(path Path, value *Value) error {
+	key := path[len(path)-1]
+	if p.doc != nil {
+		p.doc.Set(EC.Value(key, value))
+		return nil
+	}
+
+	index, err := p.index(path, len(path)-1)
+	if err != nil {
+		return err
+	}
+
+	if index < p.arr.Len() {
+		p.arr.Set(uint(index), value)
+		return nil
+	}
+
+	p.arr.pad(index)
+	p.arr.Append(value)
+
+	return nil
+}
+
+func (p *pathParent) delete(path Path) (*Element, error) {
+	key := path[len(path)-1]
+	if p.doc != nil {
+		return p.doc.Delete(key), nil
+	}
+
+	index, err := p.index(path, len(path)-1)
+	if err != nil {
+		return nil, err
+	}
+	if index >= p.arr.Len() {
+		return nil, nil
+	}
+
+	elem := EC.Value(key, p.arr.doc.elems[index].value)
+	p.arr.Set(uint(index), VC.Null())
+
+	return elem, nil
+}
+
+// pad appends null values to the array until it has size elements.
+func (a *Array) pad(size int) {
+	for a.Len() < size {
+		a.Append(VC.Null())
+	}
+}
+
+func isNumeric(v *Value) bool {
+	switch v.Type() {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double:
+		return true
+	default:
+		return false
+	}
+}
+
+// addNumeric adds two numeric values, using the widest type of the
+// two operands.
+func addNumeric(a, b *Value) (*Value, error) {
+	switch {
+	case a.Type() == bsontype.Double || b.Type() == bsontype.Double:
+		x, _ := valueAsFloat64(a)
+		y, _ := valueAsFloat64(b)
+		return VC.Double(x + y), nil
+	case a.Type() == bsontype.Int32 && b.Type() == bsontype.Int32:
+		sum := int64(a.Int32()) + int64(b.Int32())
+		if sum > math.MaxInt32 || sum < math.MinInt32 {
+			return VC.Int64(sum), nil
+		}
+		return VC.Int32(int32(sum)), nil
+	default:
+		x, _ := valueAsInt64(a)
+		y, _ := valueAsInt64(b)
+		sum := x + y
+		if (y > 0 && sum < x) || (y < 0 && sum > x) {
+			return nil, bsonerr.NumericOverflow
+		}
+		return VC.Int64(sum), nil
+	}
+}
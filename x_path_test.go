@@ -0,0 +1,280 @@
+package birch
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+)
+
+func requireJSON(t *testing.T, doc *Document, expected string) {
+	t.Helper()
+	out, err := doc.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != expected {
+		t.Errorf("expected %s, got %s", expected, out)
+	}
+}
+
+func makePathTestDocument() *Document {
+	return DC.Elements(
+		EC.Int32("a", 1),
+		EC.SubDocumentFromElements("b", EC.String("c", "d")),
+		EC.ArrayFromElements("arr",
+			VC.DocumentFromElements(EC.Int32("x", 1)),
+			VC.Int32(2),
+		),
+	)
+}
+
+func TestPath(t *testing.T) {
+	t.Run("ParsePath", func(t *testing.T) {
+		if p := ParsePath("a.b.3"); len(p) != 3 || p[2] != "3" || p.String() != "a.b.3" {
+			t.Errorf("unexpected path %v", p)
+		}
+		if p := ParsePath(""); len(p) != 0 {
+			t.Errorf("unexpected path %v", p)
+		}
+	})
+	t.Run("SetPath", func(t *testing.T) {
+		for _, tc := range []struct {
+			name     string
+			path     string
+			expected string
+		}{
+			{
+				name:     "TopLevel",
+				path:     "a",
+				expected: `{"a":true,"b":{"c":"d"},"arr":[{"x":1},2]}`,
+			},
+			{
+				name:     "NewTopLevel",
+				path:     "z",
+				expected: `{"a":1,"b":{"c":"d"},"arr":[{"x":1},2],"z":true}`,
+			},
+			{
+				name:     "Nested",
+				path:     "b.c",
+				expected: `{"a":1,"b":{"c":true},"arr":[{"x":1},2]}`,
+			},
+			{
+				name:     "IntermediateDocuments",
+				path:     "b.e.f",
+				expected: `{"a":1,"b":{"c":"d","e":{"f":true}},"arr":[{"x":1},2]}`,
+			},
+			{
+				name:     "ArrayIndex",
+				path:     "arr.1",
+				expected: `{"a":1,"b":{"c":"d"},"arr":[{"x":1},true]}`,
+			},
+			{
+				name:     "DocumentInArray",
+				path:     "arr.0.y",
+				expected: `{"a":1,"b":{"c":"d"},"arr":[{"x":1,"y":true},2]}`,
+			},
+			{
+				name:     "PadArray",
+				path:     "arr.4",
+				expected: `{"a":1,"b":{"c":"d"},"arr":[{"x":1},2,null,null,true]}`,
+			},
+			{
+				name:     "PadArrayWithDocument",
+				path:     "arr.3.y",
+				expected: `{"a":1,"b":{"c":"d"},"arr":[{"x":1},2,null,{"y":true}]}`,
+			},
+			{
+				name:     "NumericKeyInDocument",
+				path:     "b.0",
+				expected: `{"a":1,"b":{"c":"d","0":true},"arr":[{"x":1},2]}`,
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				doc := makePathTestDocument()
+				if err := doc.SetPath(ParsePath(tc.path), VC.Boolean(true)); err != nil {
+					t.Fatal(err)
+				}
+				requireJSON(t, doc, tc.expected)
+			})
+		}
+		t.Run("Serialized", func(t *testing.T) {
+			// documents read from bytes must reflect changes made
+			// to nested values.
+			data, err := makePathTestDocument().MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := ReadDocument(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := doc.SetPath(Path{"arr", "0", "x"}, VC.Int32(42)); err != nil {
+				t.Fatal(err)
+			}
+			data, err = doc.MarshalBSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ReadDocument(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			requireJSON(t, out, `{"a":1,"b":{"c":"d"},"arr":[{"x":42},2]}`)
+		})
+	})
+	t.Run("Errors", func(t *testing.T) {
+		for _, tc := range []struct {
+			name  string
+			path  Path
+			err   error
+			depth int
+			typ   bsontype.Type
+		}{
+			{name: "Empty", path: nil, err: bsonerr.EmptyKey},
+			{name: "EmptyKey", path: Path{"b", ""}, err: bsonerr.EmptyKey, depth: 1},
+			{name: "Scalar", path: Path{"a", "b"}, err: bsonerr.InvalidDepthTraversal, depth: 1, typ: bsontype.Int32},
+			{name: "ScalarInArray", path: Path{"arr", "1", "b"}, err: bsonerr.InvalidDepthTraversal, depth: 2, typ: bsontype.Int32},
+			{name: "ArrayKey", path: Path{"arr", "x"}, err: bsonerr.InvalidArrayKey, depth: 1, typ: bsontype.Array},
+			{name: "NegativeIndex", path: Path{"arr", "-1"}, err: bsonerr.InvalidArrayKey, depth: 1, typ: bsontype.Array},
+			{name: "PaddingLimit", path: Path{"arr", "2000000"}, err: bsonerr.OutOfBounds, depth: 1, typ: bsontype.Array},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				doc := makePathTestDocument()
+				err := doc.SetPath(tc.path, VC.Null())
+
+				var perr *PathError
+				if !errors.As(err, &perr) {
+					t.Fatalf("expected path error, got %v", err)
+				}
+				if !errors.Is(err, tc.err) || perr.Depth != tc.depth || perr.Type != tc.typ {
+					t.Errorf("unexpected error %v: %+v", err, perr)
+				}
+				requireJSON(t, doc, `{"a":1,"b":{"c":"d"},"arr":[{"x":1},2]}`)
+
+				if _, err := doc.DeletePath(tc.path); !errors.Is(err, tc.err) {
+					t.Errorf("delete returned %v", err)
+				}
+			})
+		}
+	})
+	t.Run("LookupPath", func(t *testing.T) {
+		doc := makePathTestDocument()
+
+		for path, expected := range map[string]string{"a": "1", "b.c": `"d"`, "arr.0.x": "1", "arr.1": "2"} {
+			val, err := doc.LookupPath(ParsePath(path))
+			if err != nil || val == nil {
+				t.Fatalf("looking up %s returned %v, %v", path, val, err)
+			}
+			if out, _ := val.MarshalJSON(); string(out) != expected {
+				t.Errorf("looking up %s returned %s", path, out)
+			}
+		}
+		for _, path := range []string{"missing", "missing.key", "b.missing", "arr.10", "arr.10.x"} {
+			if val, err := doc.LookupPath(ParsePath(path)); err != nil || val != nil {
+				t.Errorf("looking up %s returned %v, %v", path, val, err)
+			}
+		}
+
+		var perr *PathError
+		if _, err := doc.LookupPath(ParsePath("a.b")); !errors.As(err, &perr) || !errors.Is(err, bsonerr.InvalidDepthTraversal) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := doc.LookupPath(ParsePath("arr.x")); !errors.Is(err, bsonerr.InvalidArrayKey) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("DeletePath", func(t *testing.T) {
+		doc := makePathTestDocument()
+
+		elem, err := doc.DeletePath(ParsePath("b.c"))
+		if err != nil || elem == nil || elem.Value().StringValue() != "d" {
+			t.Fatalf("unexpected result %v, %v", elem, err)
+		}
+		elem, err = doc.DeletePath(ParsePath("arr.0"))
+		if err != nil || elem == nil || elem.Value().Type() != bsontype.EmbeddedDocument {
+			t.Fatalf("unexpected result %v, %v", elem, err)
+		}
+		requireJSON(t, doc, `{"a":1,"b":{},"arr":[null,2]}`)
+
+		for _, path := range []string{"missing", "missing.key", "b.missing", "arr.10"} {
+			elem, err = doc.DeletePath(ParsePath(path))
+			if err != nil || elem != nil {
+				t.Errorf("deleting %s returned %v, %v", path, elem, err)
+			}
+		}
+		requireJSON(t, doc, `{"a":1,"b":{},"arr":[null,2]}`)
+	})
+	t.Run("UpsertPath", func(t *testing.T) {
+		doc := makePathTestDocument()
+
+		err := doc.UpsertPath(ParsePath("x.y"), func(current *Value) (*Value, error) {
+			if current != nil {
+				t.Error("value should not exist")
+			}
+			return VC.String("new"), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = doc.UpsertPath(ParsePath("x.y"), func(current *Value) (*Value, error) {
+			return VC.String(current.StringValue() + "er"), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := errors.New("abort")
+		err = doc.UpsertPath(ParsePath("q.r.s"), func(*Value) (*Value, error) { return nil, expected })
+		if !errors.Is(err, expected) {
+			t.Errorf("unexpected error %v", err)
+		}
+		requireJSON(t, doc, `{"a":1,"b":{"c":"d"},"arr":[{"x":1},2],"x":{"y":"newer"}}`)
+	})
+	t.Run("IncrementPath", func(t *testing.T) {
+		for _, tc := range []struct {
+			name     string
+			start    *Value
+			delta    *Value
+			expected *Value
+			err      error
+		}{
+			{name: "Missing", delta: VC.Int32(2), expected: VC.Int32(2)},
+			{name: "Int32", start: VC.Int32(1), delta: VC.Int32(2), expected: VC.Int32(3)},
+			{name: "Int32Overflow", start: VC.Int32(2147483647), delta: VC.Int32(1), expected: VC.Int64(2147483648)},
+			{name: "Int64", start: VC.Int64(1), delta: VC.Int32(2), expected: VC.Int64(3)},
+			{name: "Double", start: VC.Int32(1), delta: VC.Double(0.5), expected: VC.Double(1.5)},
+			{name: "Int64Overflow", start: VC.Int64(9223372036854775807), delta: VC.Int64(1), err: bsonerr.NumericOverflow},
+			{name: "NonNumeric", start: VC.String("one"), delta: VC.Int32(1), err: bsonerr.NonNumeric},
+			{name: "NonNumericDelta", start: VC.Int32(1), delta: VC.String("one"), err: bsonerr.NonNumeric},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				doc := DC.New()
+				if tc.start != nil {
+					if err := doc.SetPath(Path{"a", "n"}, tc.start); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				out, err := doc.IncrementPath(Path{"a", "n"}, tc.delta)
+				if tc.err != nil {
+					if !errors.Is(err, tc.err) {
+						t.Fatalf("expected %v, got %v", tc.err, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !out.Equal(tc.expected) {
+					t.Errorf("expected %s, got %s", tc.expected.Interface(), out.Interface())
+				}
+				if stored := doc.Lookup("a").MutableDocument().Lookup("n"); stored.Type() != tc.expected.Type() {
+					t.Errorf("stored value has type %s", stored.Type())
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,340 @@
+package birch
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/tychoish/birch/bsontype"
+	"github.com/tychoish/fun/adt"
+)
+
+// Registry holds encoders and decoders for application types that
+// the reflection-based conversion does not handle (or does not handle
+// the way the application would like), for example net.IP, url.URL or
+// enumerations that should be stored as strings.
+//
+// Encoders and decoders are matched by the exact type of the value:
+// an encoder registered for url.URL is used for url.URL values and
+// for the values that *url.URL pointers point to, but not for other
+// types with url.URL as their underlying type. Registering a function
+// for a type that already has one replaces it.
+//
+// DefaultRegistry is used by EC.Interface, ECE.Interface,
+// DC.MapInterface, Value.Interface and Document.Unmarshal. Libraries
+// that need their own conversions without affecting the rest of the
+// program should create a registry with NewRegistry, or with
+// DefaultRegistry.Extend to keep the application's conversions, and
+// use the Registry's methods directly. The zero value is an empty
+// registry, and all methods are safe for concurrent use.
+type Registry struct {
+	parent     *Registry
+	encoders   adt.SyncMap[reflect.Type, func(reflect.Value) (*Value, error)]
+	decoders   adt.SyncMap[reflect.Type, func(*Value, reflect.Value) error]
+	interfaces adt.SyncMap[bsontype.Type, func(*Value) (any, bool)]
+
+	// hasEncoders is set when an encoder is registered, so that
+	// conversions skip looking up encoders for registries that
+	// have none.
+	hasEncoders atomic.Bool
+}
+
+// DefaultRegistry is the registry used by the package-level
+// constructors and conversions.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry { return &Registry{} }
+
+// Extend returns a new registry that uses the functions registered
+// with r, including functions registered after Extend returns, unless
+// the new registry has its own function for the type.
+func (r *Registry) Extend() *Registry { return &Registry{parent: r} }
+
+// RegisterEncoder registers a function that converts values of type T
+// to BSON values. T should be a concrete (non-interface) type. An
+// encoder that returns a nil value produces a null value.
+func RegisterEncoder[T any](r *Registry, fn func(T) (*Value, error)) {
+	r.encoders.Store(reflect.TypeFor[T](), func(rv reflect.Value) (*Value, error) {
+		return fn(rv.Interface().(T))
+	})
+	r.hasEncoders.Store(true)
+}
+
+// RegisterDecoder registers a function that converts BSON values to
+// values of type T, used by Unmarshal when populating fields, map
+// values and slice items of type T. Null and undefined values are
+// always decoded as the zero value without calling the function.
+// Errors are reported as *DecodeError values.
+func RegisterDecoder[T any](r *Registry, fn func(*Value) (T, error)) {
+	r.decoders.Store(reflect.TypeFor[T](), func(val *Value, rv reflect.Value) error {
+		out, err := fn(val)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(&out).Elem())
+		return nil
+	})
+}
+
+// RegisterInterface registers a function used by Interface (and
+// Unmarshal, for empty interface targets) to convert values of the
+// BSON type to Go values. When the function returns false, the value
+// is converted as it would be without the function, which makes it
+// possible to handle only some binary subtypes, for example.
+func (r *Registry) RegisterInterface(t bsontype.Type, fn func(*Value) (any, bool)) {
+	r.interfaces.Store(t, fn)
+}
+
+func (r *Registry) encoder(rt reflect.Type) (func(reflect.Value) (*Value, error), bool) {
+	for reg := r; reg != nil; reg = reg.parent {
+		if !reg.hasEncoders.Load() {
+			continue
+		}
+		if fn, ok := reg.encoders.Load(rt); ok {
+			return fn, true
+		}
+	}
+	return nil, false
+}
+
+// anyEncoders reports whether an encoder is registered with the
+// registry or with the registries it extends.
+func (r *Registry) anyEncoders() bool {
+	for reg := r; reg != nil; reg = reg.parent {
+		if reg.hasEncoders.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Registry) decoder(rt reflect.Type) (func(*Value, reflect.Value) error, bool) {
+	for reg := r; reg != nil; reg = reg.parent {
+		if fn, ok := reg.decoders.Load(rt); ok {
+			return fn, true
+		}
+	}
+	return nil, false
+}
+
+func (r *Registry) interfaceFunc(t bsontype.Type) (func(*Value) (any, bool), bool) {
+	for reg := r; reg != nil; reg = reg.parent {
+		if fn, ok := reg.interfaces.Load(t); ok {
+			return fn, true
+		}
+	}
+	return nil, false
+}
+
+// encodeRegistered converts the value with the encoder registered for
+// its type. The boolean is false when there is no such encoder.
+func (r *Registry) encodeRegistered(key string, value any) (*Element, bool, error) {
+	// the conversions of the built-in types do not use reflection,
+	// so avoid it when there are no encoders.
+	if value == nil || !r.anyEncoders() {
+		return nil, false, nil
+	}
+
+	rv := reflect.ValueOf(value)
+	enc, ok := r.encoder(rv.Type())
+	if !ok {
+		return nil, false, nil
+	}
+
+	elem, err := encodeRegistered(enc, key, rv)
+	return elem, true, err
+}
+
+func encodeRegistered(enc func(reflect.Value) (*Value, error), key string, rv reflect.Value) (*Element, error) {
+	val, err := enc(rv)
+	if err != nil {
+		return nil, &EncodeError{Path: key, Type: rv.Type(), Err: err}
+	}
+	if val == nil {
+		return EC.Null(key), nil
+	}
+
+	return EC.Value(key, val), nil
+}
+
+// element converts the value in the manner of EC.Interface, producing
+// a null element when the value cannot be converted.
+func (r *Registry) element(key string, value any) *Element {
+	elem, err := r.interfaceElement(key, value)
+	if err != nil || elem == nil {
+		elem = EC.Null(key)
+	}
+
+	return elem
+}
+
+// Element converts the value to an element, in the manner of
+// ECE.Interface, using the functions registered with the registry.
+func (r *Registry) Element(key string, value any) (*Element, error) {
+	if elem, ok, err := r.encodeRegistered(key, value); ok {
+		return elem, err
+	}
+
+	switch t := value.(type) {
+	case uint:
+		switch {
+		case t < math.MaxInt32:
+			return EC.Int32(key, int32(t)), nil
+		case uint64(t) > math.MaxInt64:
+			return nil, fmt.Errorf("BSON only has signed integer types and %d overflows an int64", t)
+		default:
+			return EC.Int64(key, int64(t)), nil
+		}
+	case uint64:
+		switch {
+		case t < math.MaxInt32:
+			return EC.Int32(key, int32(t)), nil
+		case t > math.MaxInt64:
+			return nil, fmt.Errorf("BSON only has signed integer types and %d overflows an int64", t)
+		default:
+			return EC.Int64(key, int64(t)), nil
+		}
+	case DocumentMarshaler:
+		return ECE.DocumentMarshaler(key, t)
+	case Marshaler:
+		return ECE.Marshaler(key, t)
+	default:
+		if t == nil {
+			return EC.Null(key), nil
+		}
+		elem, err := r.interfaceElement(key, t)
+		if err != nil {
+			return nil, err
+		}
+		if elem == nil || elem.Value().Type() == bsontype.Null {
+			return nil, fmt.Errorf("Cannot create element for type %T, try using bsoncodec.ConstructElementErr", value)
+		}
+		return elem, nil
+	}
+}
+
+// Value converts the value to a BSON value, in the manner of
+// VCE.Interface, using the functions registered with the registry.
+func (r *Registry) Value(value any) (*Value, error) {
+	elem, err := r.Element("", value)
+	if err != nil {
+		return nil, err
+	}
+
+	return elem.value, nil
+}
+
+// MapInterface converts the map to a document, in the manner of
+// DCE.MapInterface, using the functions registered with the registry.
+func (r *Registry) MapInterface(in map[string]any) (*Document, error) {
+	out := DC.Make(len(in))
+
+	for k, v := range in {
+		elem, err := r.Element(k, v)
+		if err != nil {
+			return nil, err
+		}
+
+		out.Append(elem)
+	}
+
+	return out, nil
+}
+
+func (r *Registry) mapDocument(in map[string]any) *Document {
+	out := DC.Make(len(in))
+	for k, v := range in {
+		out.Append(r.element(k, v))
+	}
+
+	return out
+}
+
+func (r *Registry) mapInterfaceDocument(in map[any]any) *Document {
+	out := DC.Make(len(in))
+	for k, v := range in {
+		out.Append(r.element(bestStringAttempt(k), v))
+	}
+
+	return out
+}
+
+func (r *Registry) sliceElement(key string, in []any) *Element {
+	vals := make([]*Value, len(in))
+
+	for idx := range in {
+		vals[idx] = r.element("", in[idx]).value
+	}
+
+	return EC.Array(key, NewArray(vals...))
+}
+
+// Interface converts the value to a Go value, in the manner of
+// Value.Interface, using the functions registered with the registry.
+// Documents and arrays are converted to map[string]any and []any
+// values, with their contents converted by the registry.
+func (r *Registry) Interface(v *Value) any {
+	if v == nil {
+		return nil
+	}
+
+	if fn, ok := r.interfaceFunc(v.Type()); ok {
+		if out, ok := fn(v); ok {
+			return out
+		}
+	}
+
+	switch v.Type() {
+	case bsontype.EmbeddedDocument:
+		doc := v.MutableDocument()
+		out := make(map[string]any, doc.Len())
+		for elem := range doc.Iterator() {
+			out[elem.Key()] = r.Interface(elem.value)
+		}
+		return out
+	case bsontype.Array:
+		arr := v.MutableArray()
+		out := make([]any, 0, arr.Len())
+		for val := range arr.Iterator() {
+			out = append(out, r.Interface(val))
+		}
+		return out
+	default:
+		return v.scalarInterface()
+	}
+}
+
+// Unmarshal populates the value from the document, in the manner of
+// Document.Unmarshal, using the functions registered with the
+// registry.
+func (r *Registry) Unmarshal(d *Document, into any) error {
+	switch out := into.(type) {
+	case DocumentUnmarshaler:
+		return out.UnmarshalDocument(d)
+	case Unmarshaler:
+		raw, err := d.MarshalBSON()
+		if err != nil {
+			return err
+		}
+		return out.UnmarshalBSON(raw)
+	case map[string]string:
+		for _, elem := range d.elems {
+			if val, ok := elem.value.StringValueOK(); ok {
+				out[elem.Key()] = val
+			}
+		}
+	case map[string]any:
+		for _, elem := range d.elems {
+			out[elem.Key()] = r.Interface(elem.value)
+		}
+	case map[any]any:
+		for _, elem := range d.elems {
+			out[elem.Key()] = r.Interface(elem.value)
+		}
+	default:
+		return r.unmarshalReflect(d, into)
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package birch
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/tychoish/birch/bsontype"
+)
+
+type registryColor int
+
+const (
+	registryRed registryColor = iota + 1
+	registryBlue
+)
+
+func (c registryColor) String() string {
+	switch c {
+	case registryRed:
+		return "red"
+	case registryBlue:
+		return "blue"
+	default:
+		return fmt.Sprint(int(c))
+	}
+}
+
+type registryUUID [16]byte
+
+func newTestRegistry() *Registry {
+	reg := NewRegistry()
+	RegisterEncoder(reg, func(ip net.IP) (*Value, error) { return VC.String(ip.String()), nil })
+	RegisterDecoder(reg, func(v *Value) (net.IP, error) {
+		ip := net.ParseIP(v.StringValue())
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", v.StringValue())
+		}
+		return ip, nil
+	})
+	RegisterEncoder(reg, func(u url.URL) (*Value, error) { return VC.String(u.String()), nil })
+	RegisterDecoder(reg, func(v *Value) (url.URL, error) {
+		u, err := url.Parse(v.StringValue())
+		if err != nil {
+			return url.URL{}, err
+		}
+		return *u, nil
+	})
+	RegisterEncoder(reg, func(c registryColor) (*Value, error) { return VC.String(c.String()), nil })
+	RegisterDecoder(reg, func(v *Value) (registryColor, error) {
+		switch v.StringValue() {
+		case "red":
+			return registryRed, nil
+		case "blue":
+			return registryBlue, nil
+		default:
+			return 0, errors.New("unknown color")
+		}
+	})
+	return reg
+}
+
+func TestRegistry(t *testing.T) {
+	type host struct {
+		Name    string
+		Address net.IP
+		Link    *url.URL
+		Colors  []registryColor
+	}
+
+	t.Run("Element", func(t *testing.T) {
+		reg := newTestRegistry()
+
+		for _, test := range []struct {
+			name     string
+			value    any
+			expected string
+		}{
+			{name: "IP", value: net.ParseIP("10.0.0.1"), expected: "10.0.0.1"},
+			{name: "URL", value: url.URL{Scheme: "https", Host: "example.com"}, expected: "https://example.com"},
+			{name: "URLPointer", value: &url.URL{Scheme: "https", Host: "example.net"}, expected: "https://example.net"},
+			{name: "Enum", value: registryBlue, expected: "blue"},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				elem, err := reg.Element("key", test.value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if elem.Key() != "key" || elem.Value().StringValue() != test.expected {
+					t.Fatalf("unexpected element %s", elem)
+				}
+			})
+		}
+	})
+	t.Run("Struct", func(t *testing.T) {
+		reg := newTestRegistry()
+		in := host{
+			Name:    "db",
+			Address: net.ParseIP("192.168.1.10"),
+			Link:    &url.URL{Scheme: "mongodb", Host: "db:27017"},
+			Colors:  []registryColor{registryRed, registryBlue},
+		}
+
+		val, err := reg.Value(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := val.MutableDocument()
+		if doc.Lookup("address").StringValue() != "192.168.1.10" || doc.Lookup("link").StringValue() != "mongodb://db:27017" {
+			t.Fatalf("unexpected document %s", doc)
+		}
+		if color, err := doc.Lookup("colors").MutableArray().Lookup(1); err != nil || color.StringValue() != "blue" {
+			t.Fatalf("unexpected document %s", doc)
+		}
+
+		var out host
+		if err := reg.Unmarshal(doc, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Name != in.Name || !out.Address.Equal(in.Address) || *out.Link != *in.Link || len(out.Colors) != 2 || out.Colors[1] != registryBlue {
+			t.Fatalf("unexpected value %+v", out)
+		}
+	})
+	t.Run("Map", func(t *testing.T) {
+		reg := newTestRegistry()
+
+		doc, err := reg.MapInterface(map[string]any{"color": registryRed, "nested": map[string]any{"ip": net.IPv4(1, 2, 3, 4)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Lookup("color").StringValue() != "red" || doc.Lookup("nested").MutableDocument().Lookup("ip").StringValue() != "1.2.3.4" {
+			t.Fatalf("unexpected document %s", doc)
+		}
+
+		out := map[string]registryColor{}
+		if err := reg.Unmarshal(DC.Elements(EC.String("a", "red"), EC.String("b", "blue")), &out); err != nil {
+			t.Fatal(err)
+		}
+		if out["a"] != registryRed || out["b"] != registryBlue {
+			t.Fatalf("unexpected value %v", out)
+		}
+	})
+	t.Run("DecodeError", func(t *testing.T) {
+		reg := newTestRegistry()
+
+		var out host
+		err := reg.Unmarshal(DC.Elements(EC.ArrayFromElements("colors", VC.String("red"), VC.String("green"))), &out)
+
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if decodeErr.Path != "colors.1" || decodeErr.Err == nil || decodeErr.Err.Error() != "unknown color" {
+			t.Fatalf("unexpected error %v", decodeErr)
+		}
+	})
+	t.Run("EncodeError", func(t *testing.T) {
+		reg := NewRegistry()
+		RegisterEncoder(reg, func(registryColor) (*Value, error) { return nil, errors.New("no colors") })
+
+		var encodeErr *EncodeError
+		if _, err := reg.Element("c", registryRed); !errors.As(err, &encodeErr) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if encodeErr.Path != "c" || encodeErr.Type != reflect.TypeFor[registryColor]() || encodeErr.Err.Error() != "no colors" {
+			t.Fatalf("unexpected error %v", encodeErr)
+		}
+		if _, err := reg.Element("s", []registryColor{registryRed}); !errors.As(err, &encodeErr) || encodeErr.Path != "s.0" {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if _, err := reg.MapInterface(map[string]any{"c": registryRed}); err == nil {
+			t.Fatal("expected error")
+		}
+		if elem := reg.element("c", registryRed); elem.Value().Type() != bsontype.Null {
+			t.Fatalf("unexpected element %s", elem)
+		}
+	})
+	t.Run("Scoped", func(t *testing.T) {
+		newTestRegistry()
+
+		if elem := EC.Interface("c", registryRed); elem.Value().Type() != bsontype.Int64 && elem.Value().Type() != bsontype.Int32 {
+			t.Fatalf("default registry used scoped encoder: %s", elem)
+		}
+		if _, ok := DefaultRegistry.encoder(reflect.TypeFor[registryColor]()); ok {
+			t.Fatal("default registry should not have the encoder")
+		}
+	})
+	t.Run("Extend", func(t *testing.T) {
+		parent := newTestRegistry()
+		child := parent.Extend()
+		RegisterEncoder(child, func(c registryColor) (*Value, error) { return VC.Int32(int32(c)), nil })
+
+		if elem, err := child.Element("c", registryBlue); err != nil || elem.Value().Int32() != 2 {
+			t.Fatalf("unexpected element %s (%v)", elem, err)
+		}
+		if elem, err := parent.Element("c", registryBlue); err != nil || elem.Value().StringValue() != "blue" {
+			t.Fatalf("unexpected element %s (%v)", elem, err)
+		}
+		if elem, err := child.Element("ip", net.IPv4(127, 0, 0, 1)); err != nil || elem.Value().StringValue() != "127.0.0.1" {
+			t.Fatalf("unexpected element %s (%v)", elem, err)
+		}
+
+		// functions registered with the parent later are visible
+		RegisterEncoder(parent, func(u registryUUID) (*Value, error) { return VC.String("uuid"), nil })
+		if elem, err := child.Element("id", registryUUID{}); err != nil || elem.Value().StringValue() != "uuid" {
+			t.Fatalf("unexpected element %s (%v)", elem, err)
+		}
+	})
+	t.Run("NoEncoders", func(t *testing.T) {
+		// registries without encoders convert values without
+		// looking for them.
+		parent := NewRegistry()
+		child := parent.Extend()
+		if child.anyEncoders() {
+			t.Fatal("empty registries should not have encoders")
+		}
+		if elem, err := child.Element("c", registryBlue); err != nil || elem.Value().Int32() != 2 {
+			t.Fatalf("unexpected element %s (%v)", elem, err)
+		}
+
+		RegisterEncoder(parent, func(c registryColor) (*Value, error) { return VC.String(c.String()), nil })
+		if !child.anyEncoders() {
+			t.Fatal("encoders registered with the parent should be found")
+		}
+		if elem, err := child.Element("c", registryBlue); err != nil || elem.Value().StringValue() != "blue" {
+			t.Fatalf("unexpected element %s (%v)", elem, err)
+		}
+	})
+	t.Run("Interface", func(t *testing.T) {
+		reg := NewRegistry()
+		reg.RegisterInterface(bsontype.Binary, func(v *Value) (any, bool) {
+			subtype, data := v.Binary()
+			if subtype != 0x04 || len(data) != 16 {
+				return nil, false
+			}
+			return registryUUID(data), true
+		})
+
+		id := registryUUID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+		doc := DC.Elements(
+			EC.BinaryWithSubtype("id", id[:], 0x04),
+			EC.Binary("data", []byte{1, 2}),
+			EC.ArrayFromElements("ids", VC.BinaryWithSubtype(id[:], 0x04)),
+		)
+
+		out, ok := reg.Interface(VC.Document(doc)).(map[string]any)
+		if !ok {
+			t.Fatal("expected map")
+		}
+		if out["id"] != id || out["ids"].([]any)[0] != id {
+			t.Fatalf("unexpected value %v", out)
+		}
+		if _, ok := out["data"].([]byte); !ok {
+			t.Fatalf("unexpected value %v", out)
+		}
+
+		var target struct {
+			ID any `bson:"id"`
+		}
+		if err := reg.Unmarshal(doc, &target); err != nil {
+			t.Fatal(err)
+		}
+		if target.ID != id {
+			t.Fatalf("unexpected value %v", target.ID)
+		}
+
+		if _, ok := VC.Document(doc).Interface().(map[string]any)["id"].(registryUUID); ok {
+			t.Fatal("default registry used scoped interface function")
+		}
+	})
+	t.Run("Default", func(t *testing.T) {
+		type defaultOnly struct{ value string }
+		RegisterEncoder(DefaultRegistry, func(d defaultOnly) (*Value, error) { return VC.String(d.value), nil })
+		RegisterDecoder(DefaultRegistry, func(v *Value) (defaultOnly, error) { return defaultOnly{value: v.StringValue()}, nil })
+
+		if elem := EC.Interface("d", defaultOnly{value: "hi"}); elem.Value().StringValue() != "hi" {
+			t.Fatalf("unexpected element %s", elem)
+		}
+		if elem, err := ECE.Interface("d", defaultOnly{value: "hi"}); err != nil || elem.Value().StringValue() != "hi" {
+			t.Fatalf("unexpected element %s (%v)", elem, err)
+		}
+		doc := DC.MapInterface(map[string]any{"d": defaultOnly{value: "there"}})
+		if doc.Lookup("d").StringValue() != "there" {
+			t.Fatalf("unexpected document %s", doc)
+		}
+
+		var out struct {
+			D defaultOnly
+		}
+		if err := doc.Unmarshal(&out); err != nil {
+			t.Fatal(err)
+		}
+		if out.D.value != "there" {
+			t.Fatalf("unexpected value %+v", out)
+		}
+	})
+}
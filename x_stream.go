@@ -0,0 +1,273 @@
+package birch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/tychoish/birch/bsonerr"
+)
+
+// DefaultMaxDocumentSize is the maximum document size that decoders and
+// encoders use when the options do not specify one. This is the
+// largest document that MongoDB stores.
+const DefaultMaxDocumentSize = 16 * 1024 * 1024
+
+// minDecoderBuffer is the smallest read that a decoder makes from its
+// underlying reader.
+const minDecoderBuffer = 32 * 1024
+
+// DecoderOptions control the behavior of a Decoder.
+type DecoderOptions struct {
+	// MaxDocumentSize is the size, in bytes, of the largest
+	// document that the decoder will read. When zero, the
+	// decoder uses DefaultMaxDocumentSize.
+	MaxDocumentSize int
+
+	// SkipCorrupt causes the decoder to discard documents that
+	// are invalid or too large, and resynchronize by scanning
+	// forward for the next valid document, rather than returning
+	// an error.
+	SkipCorrupt bool
+
+	// Limits are the limits that the decoder applies to each
+	// document, which it treats as corrupt when they exceed
+	// them. When Limits.MaxDocumentSize is zero, the decoder
+	// uses MaxDocumentSize.
+	Limits DecodeOptions
+}
+
+// Decoder reads a sequence of concatenated BSON documents, as in the
+// .bson files that mongodump produces, from an io.Reader.
+//
+// The Decoder reuses its buffer between documents: the Reader returned
+// by Decode is only valid until the next call to Decode, and callers
+// must copy documents that they retain.
+type Decoder struct {
+	r       io.Reader
+	opts    DecoderOptions
+	buf     []byte
+	start   int
+	end     int
+	eof     bool
+	err     error
+	skipped int64
+}
+
+// NewDecoder constructs a Decoder that reads documents from r.
+func NewDecoder(r io.Reader, opts DecoderOptions) *Decoder {
+	if opts.MaxDocumentSize <= 0 {
+		opts.MaxDocumentSize = DefaultMaxDocumentSize
+	}
+	if opts.Limits.MaxDocumentSize <= 0 {
+		opts.Limits.MaxDocumentSize = opts.MaxDocumentSize
+	}
+
+	return &Decoder{r: r, opts: opts}
+}
+
+// Skipped returns the number of bytes that the decoder has discarded
+// while resynchronizing after corrupt documents.
+func (d *Decoder) Skipped() int64 { return d.skipped }
+
+// Decode returns the next document in the stream, or io.EOF when the
+// stream ends between documents. When the stream ends within a
+// document, the error wraps io.ErrUnexpectedEOF. Once Decode returns
+// an error, all subsequent calls return the same error.
+func (d *Decoder) Decode() (Reader, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	for {
+		doc, err := d.next()
+		switch {
+		case err == nil:
+			return doc, nil
+		case d.opts.SkipCorrupt && errors.Is(err, errCorruptDocument):
+			// discard a byte and try to read a document
+			// from the following position.
+			d.start++
+			d.skipped++
+			continue
+		default:
+			d.err = err
+			return nil, err
+		}
+	}
+}
+
+// Iterator returns a sequence of the documents in the stream, ending
+// at the end of the stream, or after yielding the first error.
+func (d *Decoder) Iterator() iter.Seq2[Reader, error] {
+	return func(yield func(Reader, error) bool) {
+		for {
+			doc, err := d.Decode()
+			if err == io.EOF {
+				return
+			}
+			if !yield(doc, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// errCorruptDocument marks decoding errors after which the decoder
+// can resynchronize.
+var errCorruptDocument = errors.New("corrupt document")
+
+func (d *Decoder) next() (Reader, error) {
+	if err := d.fill(4); err != nil {
+		if err == io.EOF && d.start == d.end {
+			return nil, io.EOF
+		}
+		return nil, corruptDocument(err)
+	}
+
+	size := int(readi32(d.buf[d.start : d.start+4]))
+	switch {
+	case size < 5:
+		return nil, corruptDocument(fmt.Errorf("%w: %d", bsonerr.InvalidLength, size))
+	case size > d.opts.MaxDocumentSize:
+		return nil, corruptDocument(fmt.Errorf("%w: %d is larger than %d", bsonerr.DocumentTooLarge, size, d.opts.MaxDocumentSize))
+	}
+
+	if err := d.fill(size); err != nil {
+		return nil, corruptDocument(err)
+	}
+
+	doc := Reader(d.buf[d.start : d.start+size])
+	if _, err := d.opts.Limits.Validate(doc); err != nil {
+		return nil, corruptDocument(err)
+	}
+
+	d.start += size
+
+	return doc, nil
+}
+
+// corruptDocument annotates errors from reading a document, converting the end
+// of the stream into io.ErrUnexpectedEOF and marking the error as one
+// that the decoder can recover from by resynchronizing. Errors from the
+// underlying reader are returned as-is.
+func corruptDocument(err error) error {
+	var rerr readError
+	if errors.As(err, &rerr) {
+		return rerr.error
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return fmt.Errorf("%w: %w", errCorruptDocument, err)
+}
+
+// readError wraps errors from the underlying reader so that they are
+// not treated as corrupt documents.
+type readError struct{ error }
+
+// fill ensures that at least n bytes are buffered after the current
+// position, reading from the underlying reader as needed. It returns
+// io.EOF if the stream ends first.
+func (d *Decoder) fill(n int) error {
+	if d.end-d.start >= n {
+		return nil
+	}
+	if d.eof {
+		return io.EOF
+	}
+
+	if d.start > 0 {
+		d.end = copy(d.buf, d.buf[d.start:d.end])
+		d.start = 0
+	}
+
+	if n > len(d.buf) {
+		buf := make([]byte, max(n, 2*len(d.buf), minDecoderBuffer))
+		copy(buf, d.buf[:d.end])
+		d.buf = buf
+	}
+
+	for d.end < n {
+		count, err := d.r.Read(d.buf[d.end:])
+		d.end += count
+
+		switch {
+		case err == io.EOF:
+			d.eof = true
+			if d.end < n {
+				return io.EOF
+			}
+		case err != nil:
+			return readError{err}
+		}
+	}
+
+	return nil
+}
+
+// EncoderOptions control the behavior of an Encoder.
+type EncoderOptions struct {
+	// MaxDocumentSize is the size, in bytes, of the largest
+	// document that the encoder will write. When zero, the
+	// encoder uses DefaultMaxDocumentSize.
+	MaxDocumentSize int
+}
+
+// Encoder writes a sequence of concatenated BSON documents to an
+// io.Writer, in the format that Decoder reads.
+type Encoder struct {
+	w    io.Writer
+	opts EncoderOptions
+	buf  []byte
+}
+
+// NewEncoder constructs an Encoder that writes documents to w.
+func NewEncoder(w io.Writer, opts EncoderOptions) *Encoder {
+	if opts.MaxDocumentSize <= 0 {
+		opts.MaxDocumentSize = DefaultMaxDocumentSize
+	}
+
+	return &Encoder{w: w, opts: opts}
+}
+
+// Encode writes the document to the stream, reusing the encoder's
+// buffer between documents.
+func (e *Encoder) Encode(doc *Document) error {
+	buf, err := doc.AppendBSON(e.buf[:0])
+	if err != nil {
+		return err
+	}
+	e.buf = buf
+
+	if err := e.checkSize(len(buf)); err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(buf)
+	return err
+}
+
+// EncodeReader validates the document and writes it to the stream.
+func (e *Encoder) EncodeReader(r Reader) error {
+	size, err := r.Validate()
+	if err != nil {
+		return err
+	}
+	if err := e.checkSize(int(size)); err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(r[:size])
+	return err
+}
+
+func (e *Encoder) checkSize(size int) error {
+	if size > e.opts.MaxDocumentSize {
+		return fmt.Errorf("%w: %d is larger than %d", bsonerr.DocumentTooLarge, size, e.opts.MaxDocumentSize)
+	}
+	return nil
+}
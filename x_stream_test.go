@@ -0,0 +1,178 @@
+package birch
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/tychoish/birch/bsonerr"
+)
+
+func encodeStream(t *testing.T, docs ...*Document) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf, EncoderOptions{})
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeStream(t *testing.T, dec *Decoder) ([]*Document, error) {
+	t.Helper()
+
+	var out []*Document
+	for rdr, err := range dec.Iterator() {
+		if err != nil {
+			return out, err
+		}
+
+		// the decoder reuses its buffer, so copy the document.
+		doc, err := ReadDocument(append([]byte{}, rdr...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, doc)
+	}
+	return out, nil
+}
+
+func TestStream(t *testing.T) {
+	docs := []*Document{
+		DC.Elements(EC.Int32("a", 1)),
+		DC.Elements(EC.String("b", "two"), EC.SubDocumentFromElements("c", EC.Boolean("d", true))),
+		DC.New(),
+		DC.Elements(EC.Binary("e", bytes.Repeat([]byte("x"), 100*1024))),
+	}
+
+	checkDocs := func(t *testing.T, got []*Document, expected ...*Document) {
+		t.Helper()
+
+		if len(got) != len(expected) {
+			t.Fatalf("got %d documents, expected %d", len(got), len(expected))
+		}
+		for idx := range expected {
+			if !VC.Document(got[idx]).Equal(VC.Document(expected[idx])) {
+				t.Fatalf("document %d: got %s, expected %s", idx, got[idx], expected[idx])
+			}
+		}
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		data := encodeStream(t, docs...)
+
+		got, err := decodeStream(t, NewDecoder(bytes.NewReader(data), DecoderOptions{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDocs(t, got, docs...)
+	})
+	t.Run("SmallReads", func(t *testing.T) {
+		data := encodeStream(t, docs...)
+
+		got, err := decodeStream(t, NewDecoder(iotest.OneByteReader(bytes.NewReader(data)), DecoderOptions{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDocs(t, got, docs...)
+	})
+	t.Run("Empty", func(t *testing.T) {
+		dec := NewDecoder(bytes.NewReader(nil), DecoderOptions{})
+		if _, err := dec.Decode(); err != io.EOF {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+	})
+	t.Run("EncodeReader", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		enc := NewEncoder(buf, EncoderOptions{})
+
+		data, err := docs[1].MarshalBSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.EncodeReader(Reader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatal("encoded reader does not match")
+		}
+
+		if err := enc.EncodeReader(Reader(data[:len(data)-1])); err == nil {
+			t.Fatal("expected error for invalid document")
+		}
+	})
+	t.Run("MaxDocumentSize", func(t *testing.T) {
+		enc := NewEncoder(io.Discard, EncoderOptions{MaxDocumentSize: 1024})
+		if err := enc.Encode(docs[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Encode(docs[3]); !errors.Is(err, bsonerr.DocumentTooLarge) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		data := encodeStream(t, docs...)
+		got, err := decodeStream(t, NewDecoder(bytes.NewReader(data), DecoderOptions{MaxDocumentSize: 1024}))
+		if !errors.Is(err, bsonerr.DocumentTooLarge) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		checkDocs(t, got, docs[:3]...)
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		data := encodeStream(t, docs[0], docs[1])
+
+		dec := NewDecoder(bytes.NewReader(data[:len(data)-3]), DecoderOptions{})
+		got, err := decodeStream(t, dec)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		checkDocs(t, got, docs[0])
+
+		// errors are sticky
+		if _, again := dec.Decode(); !errors.Is(again, io.ErrUnexpectedEOF) {
+			t.Fatalf("unexpected error %v", again)
+		}
+	})
+	t.Run("Resynchronize", func(t *testing.T) {
+		first := encodeStream(t, docs[0])
+		rest := encodeStream(t, docs[1], docs[2])
+
+		corrupt := append([]byte{}, first...)
+		corrupt = append(corrupt, 0xde, 0xad, 0xbe, 0xef, 0x00)
+		corrupt = append(corrupt, rest[:len(rest)-2]...)
+		corrupt = append(corrupt, 0xff)
+		corrupt = append(corrupt, encodeStream(t, docs[0])...)
+		corrupt = append(corrupt, 0x01, 0x02)
+
+		got, err := decodeStream(t, NewDecoder(bytes.NewReader(corrupt), DecoderOptions{}))
+		if err == nil {
+			t.Fatal("expected error without resynchronization")
+		}
+		checkDocs(t, got, docs[0])
+
+		dec := NewDecoder(bytes.NewReader(corrupt), DecoderOptions{SkipCorrupt: true})
+		got, err = decodeStream(t, dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDocs(t, got, docs[0], docs[1], docs[0])
+		if dec.Skipped() == 0 {
+			t.Fatal("expected skipped bytes")
+		}
+	})
+	t.Run("ReaderError", func(t *testing.T) {
+		data := encodeStream(t, docs[0])
+		expected := errors.New("read failed")
+
+		dec := NewDecoder(io.MultiReader(bytes.NewReader(data), iotest.ErrReader(expected)), DecoderOptions{SkipCorrupt: true})
+		got, err := decodeStream(t, dec)
+		if !errors.Is(err, expected) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		checkDocs(t, got, docs[0])
+	})
+}
@@ -0,0 +1,232 @@
+package birch
+
+import (
+	"iter"
+	"strconv"
+
+	"github.com/tychoish/birch/bsontype"
+)
+
+// WalkOrder determines the order in which Walk visits values.
+type WalkOrder int
+
+const (
+	// DepthFirst visits each document or array, and then all of its
+	// descendants, before the values that follow it.
+	DepthFirst WalkOrder = iota
+	// BreadthFirst visits all values at one depth before the values
+	// at the next depth.
+	BreadthFirst
+)
+
+// WalkOptions control the traversal of Walk. The zero value walks all
+// values depth first.
+type WalkOptions struct {
+	Order WalkOrder
+	// Skip, when set, is called for each document and array after it
+	// is visited. When it returns true, the walk does not visit the
+	// values that the document or array contains.
+	Skip func(Path, *Value) bool
+}
+
+// Walk returns an iterator over every value in the document and in
+// its nested documents and arrays, depth first, with the path of each
+// value. Paths of array elements use the index as the key. Each path
+// is a distinct slice, which callers may retain.
+func (d *Document) Walk() iter.Seq2[Path, *Value] { return WalkOptions{}.Document(d) }
+
+// Walk returns an iterator over every value in the document, in the
+// same manner as Document.Walk, without constructing documents. The
+// walk stops at the first element that cannot be read; use Validate
+// to check the document first.
+func (r Reader) Walk() iter.Seq2[Path, *Value] { return WalkOptions{}.Reader(r) }
+
+// Document returns an iterator over every value in the document and
+// in its nested documents and arrays.
+func (opts WalkOptions) Document(d *Document) iter.Seq2[Path, *Value] {
+	return opts.walk(d.Iterator(), false)
+}
+
+// Reader returns an iterator over every value in the document and in
+// its nested documents and arrays.
+func (opts WalkOptions) Reader(r Reader) iter.Seq2[Path, *Value] {
+	return opts.walk(readerElements(r), true)
+}
+
+func (opts WalkOptions) walk(root iter.Seq[*Element], reader bool) iter.Seq2[Path, *Value] {
+	return func(yield func(Path, *Value) bool) {
+		if opts.Order == BreadthFirst {
+			opts.breadthFirst(root, reader, yield)
+			return
+		}
+		opts.depthFirst(nil, root, false, reader, yield)
+	}
+}
+
+func (opts WalkOptions) depthFirst(parent Path, elems iter.Seq[*Element], array, reader bool, yield func(Path, *Value) bool) bool {
+	idx := 0
+	for elem := range elems {
+		path := childPath(parent, elem, array, idx)
+		idx++
+
+		if !yield(path, elem.value) {
+			return false
+		}
+
+		if children, isArray, ok := opts.children(path, elem.value, reader); ok {
+			if !opts.depthFirst(path, children, isArray, reader, yield) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (opts WalkOptions) breadthFirst(root iter.Seq[*Element], reader bool, yield func(Path, *Value) bool) {
+	type level struct {
+		path  Path
+		elems iter.Seq[*Element]
+		array bool
+	}
+
+	queue := []level{{elems: root}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		idx := 0
+		for elem := range current.elems {
+			path := childPath(current.path, elem, current.array, idx)
+			idx++
+
+			if !yield(path, elem.value) {
+				return
+			}
+
+			if children, isArray, ok := opts.children(path, elem.value, reader); ok {
+				queue = append(queue, level{path: path, elems: children, array: isArray})
+			}
+		}
+	}
+}
+
+// children returns the elements of a document or array value, unless
+// the options skip it.
+func (opts WalkOptions) children(path Path, v *Value, reader bool) (iter.Seq[*Element], bool, bool) {
+	typ := v.Type()
+	if typ != bsontype.EmbeddedDocument && typ != bsontype.Array {
+		return nil, false, false
+	}
+	if opts.Skip != nil && opts.Skip(path, v) {
+		return nil, false, false
+	}
+
+	isArray := typ == bsontype.Array
+	switch {
+	case reader:
+		return readerElements(v.Reader()), isArray, true
+	case isArray:
+		return v.MutableArray().doc.Iterator(), true, true
+	default:
+		return v.MutableDocument().Iterator(), false, true
+	}
+}
+
+// childPath returns a new path for the element, which does not share
+// storage with the parent path or the paths of sibling elements.
+func childPath(parent Path, elem *Element, array bool, idx int) Path {
+	key := elem.Key()
+	if array {
+		key = strconv.Itoa(idx)
+	}
+
+	return append(parent[:len(parent):len(parent)], key)
+}
+
+func readerElements(r Reader) iter.Seq[*Element] {
+	return func(yield func(*Element) bool) {
+		for elem, err := range r.Iterator() {
+			if err != nil || !yield(elem) {
+				return
+			}
+		}
+	}
+}
+
+// Flatten returns a document with a dotted key (e.g. "a.b.0") for
+// every value in the document that is not a non-empty document or
+// array. Empty documents and arrays are preserved as values.
+func (d *Document) Flatten() *Document {
+	out := DC.New()
+	for path, val := range d.Walk() {
+		if isNonEmptyContainer(val) {
+			continue
+		}
+		out.Append(EC.Value(path.String(), val))
+	}
+
+	return out
+}
+
+func isNonEmptyContainer(v *Value) bool {
+	switch v.Type() {
+	case bsontype.EmbeddedDocument:
+		return v.MutableDocument().Len() > 0
+	case bsontype.Array:
+		return v.MutableArray().Len() > 0
+	default:
+		return false
+	}
+}
+
+// Unflatten reverses Flatten: it returns a document with the value of
+// every dotted key in the document stored at the corresponding path.
+// Documents whose keys are all array indexes, in order, starting at
+// zero, are converted to arrays. Keys that conflict (e.g. "a" and
+// "a.b", where "a" is not a document) produce a *PathError.
+func (d *Document) Unflatten() (*Document, error) {
+	out := DC.New()
+	for _, elem := range d.elems {
+		if err := out.SetPath(ParsePath(elem.Key()), elem.value); err != nil {
+			return nil, err
+		}
+	}
+
+	unflattenArrays(out)
+
+	return out, nil
+}
+
+// unflattenArrays replaces the nested documents that have array
+// indexes as keys with arrays, recursively.
+func unflattenArrays(d *Document) {
+	for idx, elem := range d.elems {
+		doc, ok := elem.value.MutableDocumentOK()
+		if !ok {
+			continue
+		}
+
+		unflattenArrays(doc)
+		if arr, ok := documentAsArray(doc); ok {
+			d.elems[idx] = EC.Array(elem.Key(), arr)
+			d.cacheValid = false
+		}
+	}
+}
+
+func documentAsArray(d *Document) (*Array, bool) {
+	if d.Len() == 0 {
+		return nil, false
+	}
+
+	arr := MakeArray(d.Len())
+	for idx, elem := range d.elems {
+		if elem.Key() != strconv.Itoa(idx) {
+			return nil, false
+		}
+		arr.Append(elem.value)
+	}
+
+	return arr, true
+}
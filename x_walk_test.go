@@ -0,0 +1,159 @@
+package birch
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/tychoish/birch/bsonerr"
+	"github.com/tychoish/birch/bsontype"
+)
+
+func TestWalk(t *testing.T) {
+	doc := DC.Elements(
+		EC.Int32("a", 1),
+		EC.SubDocumentFromElements("b",
+			EC.String("c", "x"),
+			EC.ArrayFromElements("d", VC.Int32(2), VC.DocumentFromElements(EC.Boolean("e", true))),
+		),
+		EC.Double("f", 1.5),
+	)
+	reader, err := doc.MarshalBSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := func(seq func(yield func(Path, *Value) bool)) []string {
+		var out []string
+		for path := range seq {
+			out = append(out, path.String())
+		}
+		return out
+	}
+
+	depthFirst := []string{"a", "b", "b.c", "b.d", "b.d.0", "b.d.1", "b.d.1.e", "f"}
+	breadthFirst := []string{"a", "b", "f", "b.c", "b.d", "b.d.0", "b.d.1", "b.d.1.e"}
+	skipped := []string{"a", "b", "b.c", "b.d", "f"}
+	skip := func(path Path, _ *Value) bool { return path.String() == "b.d" }
+
+	for _, test := range []struct {
+		name     string
+		opts     WalkOptions
+		expected []string
+	}{
+		{name: "DepthFirst", expected: depthFirst},
+		{name: "BreadthFirst", opts: WalkOptions{Order: BreadthFirst}, expected: breadthFirst},
+		{name: "Skip", opts: WalkOptions{Skip: skip}, expected: skipped},
+		{name: "SkipBreadthFirst", opts: WalkOptions{Order: BreadthFirst, Skip: skip}, expected: []string{"a", "b", "f", "b.c", "b.d"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if out := paths(test.opts.Document(doc)); !slices.Equal(out, test.expected) {
+				t.Errorf("document: got %v, expected %v", out, test.expected)
+			}
+			if out := paths(test.opts.Reader(reader)); !slices.Equal(out, test.expected) {
+				t.Errorf("reader: got %v, expected %v", out, test.expected)
+			}
+		})
+	}
+	t.Run("Methods", func(t *testing.T) {
+		if out := paths(doc.Walk()); !slices.Equal(out, depthFirst) {
+			t.Errorf("got %v", out)
+		}
+		if out := paths(Reader(reader).Walk()); !slices.Equal(out, depthFirst) {
+			t.Errorf("got %v", out)
+		}
+	})
+	t.Run("Values", func(t *testing.T) {
+		for path, val := range doc.Walk() {
+			expected, err := Get[*Value](doc, path...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !val.Equal(expected) {
+				t.Errorf("%s: got %v, expected %v", path, val, expected)
+			}
+		}
+	})
+	t.Run("RetainPaths", func(t *testing.T) {
+		var retained []Path
+		for path := range doc.Walk() {
+			retained = append(retained, path)
+		}
+		out := make([]string, 0, len(retained))
+		for _, path := range retained {
+			out = append(out, path.String())
+		}
+		if !slices.Equal(out, depthFirst) {
+			t.Fatalf("got %v", out)
+		}
+	})
+	t.Run("Stop", func(t *testing.T) {
+		count := 0
+		for path := range (WalkOptions{Order: BreadthFirst}).Reader(reader) {
+			count++
+			if path.String() == "b.c" {
+				break
+			}
+		}
+		if count != 4 {
+			t.Fatalf("visited %d values", count)
+		}
+	})
+}
+
+func TestFlatten(t *testing.T) {
+	doc := DC.Elements(
+		EC.Int32("a", 1),
+		EC.SubDocumentFromElements("b",
+			EC.String("c", "x"),
+			EC.ArrayFromElements("d", VC.Int32(2), VC.ArrayFromValues(VC.Int32(3), VC.Int32(4)), VC.DocumentFromElements(EC.Boolean("e", true))),
+			EC.SubDocument("empty", DC.New()),
+		),
+		EC.ArrayFromElements("g"),
+	)
+
+	flat := doc.Flatten()
+	keys := make([]string, 0, flat.Len())
+	for elem := range flat.Iterator() {
+		keys = append(keys, elem.Key())
+	}
+	expected := []string{"a", "b.c", "b.d.0", "b.d.1.0", "b.d.1.1", "b.d.2.e", "b.empty", "g"}
+	if !slices.Equal(keys, expected) {
+		t.Fatalf("got %v, expected %v", keys, expected)
+	}
+	if flat.Lookup("b.d.1.1").Int32() != 4 || flat.Lookup("g").Type() != bsontype.Array {
+		t.Fatalf("unexpected document %s", flat)
+	}
+
+	t.Run("Unflatten", func(t *testing.T) {
+		out, err := flat.Unflatten()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if CompareDocuments(out, doc) != 0 || out.String() != doc.String() {
+			t.Fatalf("got %s, expected %s", out, doc)
+		}
+	})
+	t.Run("IndexKeys", func(t *testing.T) {
+		out, err := DC.Elements(EC.Int32("a.1", 1), EC.Int32("a.0", 0), EC.Int32("b.0", 0), EC.Int32("b.1.x", 1)).Unflatten()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Lookup("a").Type() != bsontype.EmbeddedDocument {
+			t.Fatalf("unexpected document %s", out)
+		}
+		if out.Lookup("b").Type() != bsontype.Array {
+			t.Fatalf("unexpected document %s", out)
+		}
+	})
+	t.Run("Conflict", func(t *testing.T) {
+		_, err := DC.Elements(EC.Int32("a", 1), EC.Int32("a.b", 2)).Unflatten()
+		if !errors.Is(err, bsonerr.InvalidDepthTraversal) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		_, err = DC.Elements(EC.Int32("a..b", 1)).Unflatten()
+		if !errors.Is(err, bsonerr.EmptyKey) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}